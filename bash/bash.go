@@ -10,12 +10,16 @@
 package bash
 
 import (
+    "context"
+    "errors"
     "fmt"
     "strings"
     "bufio"
     "os"
+    "io/ioutil"
     "log"
     "foxyblox/system"
+    "foxyblox/fileutils"
     "foxyblox/types"
     "foxyblox/cron"
     "foxyblox/server"
@@ -112,22 +116,44 @@ func RunCmdLine() {
     
 }
 
+// warn about the locations that were degraded while getting the file
+func printReadReport(filename string, report *fileutils.ReadReport) {
+    for _, location := range report.Degraded {
+        fmt.Fprintf(os.Stderr, "Warning: location %s is degraded, %s was read from the other locations\n",
+                    location, filename)
+    }
+    for _, location := range report.Rebuilt {
+        fmt.Fprintf(os.Stderr, "Rebuilt the component of %s on %s\n", filename, location)
+    }
+}
+
+// contents of the input file, - = stdin
+func readInput(path string) ([]byte, error) {
+    if path == "-" {
+        return ioutil.ReadAll(os.Stdin)
+    }
+    return ioutil.ReadFile(path)
+}
+
 /*
-    Run with command line parameters, and then exit
+    Run with command line parameters, and then exit. Returns the error of the
+    command if it failed (what it was doing, along with why), so that the
+    process can exit with a non-zero status
 */
-func Run(args []string) {
-    // echo command
+func Run(args []string) error {
+    // echo command (to stderr, stdout can be the output of get)
     for i := 0; i < len(args); i++ {
-        fmt.Printf("%s ", args[i])
+        fmt.Fprintf(os.Stderr, "%s ", args[i])
     }
-    fmt.Printf("\n")
+    fmt.Fprintf(os.Stderr, "\n")
 
     // check if plausible command
     if len(args) < 2 {
         fmt.Printf("Usage: ./foxyblox [command] [optional arguments]\n")
-        fmt.Printf("Example commands: save, get, delete, checkDbParity, initLocal\n")
+        fmt.Printf("(get [filename] [username] [output path, - for stdout])\n")
+        fmt.Printf("Example commands: save, get, list, delete, checkDbParity, initLocal\n")
         fmt.Printf("createConfigFile\n")
-        return
+        return errors.New("no command given")
     }
 
     // get os (to know what the executable is called)
@@ -136,17 +162,48 @@ func Run(args []string) {
     // switch based on the command given
     switch args[1] {
         case "save":
+            // [amount of locations] [locations...], and/or --policy [policy]
+            // (without locations, the data disks in the configs)
             targetFilename := args[2]
             username := args[3]
-            locationsAmount, err := strconv.Atoi(args[4])
-            check(err)
+            policy := ""
+            var rest []string
+            for i := 4; i < len(args); i++ {
+                if args[i] == "--policy" && i + 1 < len(args) {
+                    policy = args[i + 1]
+                    i++
+                } else {
+                    rest = append(rest, args[i])
+                }
+            }
+
+            var locations []string
+            if len(rest) > 0 {
+                locationsAmount, err := strconv.Atoi(rest[0])
+                check(err)
+
+                locations = make([]string, locationsAmount)
+                for i := 0; i < locationsAmount; i++ {
+                    locations[i] = rest[1 + i]
+                }
+            }
 
-            locations := make([]string, locationsAmount)
-            for i := 0; i < locationsAmount; i++ {
-                locations[i] = args[5 + i]
+            // a directory is saved with everything in it, under its name
+            if info, err := os.Stat(targetFilename); err == nil && info.IsDir() {
+                saved, err := system.AddDirectory(targetFilename, username, locations, policy)
+                if err != nil {
+                    return fmt.Errorf("can't add directory %s (added %d files): %w",
+                                      targetFilename, saved, err)
+                }
+
+                fmt.Printf("Added %d files of %s\n", saved, targetFilename)
+                return nil
             }
 
-            system.AddFile(targetFilename, username, locations)
+            err := system.AddFileWithPolicy(targetFilename, username, locations, policy)
+            if err != nil {
+                return fmt.Errorf("can't add file %s: %w", targetFilename, err)
+            }
 
             fmt.Printf("Added file %s\n", targetFilename)
 
@@ -154,18 +211,412 @@ func Run(args []string) {
             targetFilename := args[2]
             username := args[3]
 
-            getLocation := system.GetFile(targetFilename, username)
+            /*
+                Without such a file, a folder with files in it is gotten into a
+                local tree, in the output folder (or here), anything else is
+                not found (- for stdout only works for a single file)
+            */
+            if _, err := system.StatFile(targetFilename, username); errors.Is(err, types.ErrNotFound) {
+                entries, listErr := system.ListDirectory(targetFilename, username)
+                if listErr != nil || len(entries) == 0 {
+                    return fmt.Errorf("can't get file %s: %w", targetFilename, err)
+                }
+
+                outputDir := "."
+                if len(args) > 4 {
+                    if args[4] == "-" {
+                        return fmt.Errorf("can't write folder %s to stdout, give an output folder",
+                                          targetFilename)
+                    }
+                    outputDir = args[4]
+                }
+
+                gotten, err := system.GetDirectory(targetFilename, username, outputDir)
+                if err != nil {
+                    return fmt.Errorf("can't get %s (got %d files): %w", targetFilename,
+                                      gotten, err)
+                }
+
+                fmt.Printf("Retreived %d files of %s into %s\n", gotten, targetFilename, outputDir)
+                return nil
+            }
+
+            /*
+                Optional output path, - = stdout. The file is written to
+                <output path>.tmp first, and only renamed into place once all
+                of it was gotten, so a failed get leaves nothing behind
+            */
+            if len(args) > 4 {
+                output := os.Stdout
+                tempName := args[4] + ".tmp"
+                if args[4] != "-" {
+                    file, err := os.Create(tempName)
+                    if err != nil {
+                        return fmt.Errorf("can't create %s: %w", tempName, err)
+                    }
+                    output = file
+                }
+
+                report, err := system.GetStreamWithReport(context.Background(), output,
+                                                          targetFilename, username)
+                if output != os.Stdout {
+                    closeErr := output.Close()
+                    if err == nil && closeErr == nil {
+                        err = os.Rename(tempName, args[4])
+                    } else if err == nil {
+                        err = closeErr
+                    }
+                    if err != nil {
+                        os.Remove(tempName)
+                    }
+                }
+                if err != nil {
+                    return fmt.Errorf("can't get file %s: %w", targetFilename, err)
+                }
+
+                printReadReport(targetFilename, report)
+                fmt.Fprintf(os.Stderr, "Retreived file %s\n", targetFilename)
+                return nil
+            }
+
+            getLocation, report, err := system.GetFileWithReport(targetFilename, username)
+            if err != nil {
+                return fmt.Errorf("can't get file %s: %w", targetFilename, err)
+            }
+            printReadReport(targetFilename, report)
 
             fmt.Printf("Retreived file at %s\n", getLocation)
 
+        case "list":
+            // [username] [directory], every file of the user without a directory
+            username := args[2]
+            directory := ""
+            if len(args) > 3 {
+                directory = args[3]
+            }
+
+            entries, err := system.ListDirectory(directory, username)
+            if err != nil {
+                return fmt.Errorf("can't list the files of %s: %w", username, err)
+            }
+
+            for _, entry := range entries {
+                if entry.Stat != nil {
+                    fmt.Printf("%s (%d bytes)\n", entry.Filename, entry.Stat.Size)
+                } else {
+                    fmt.Printf("%s\n", entry.Filename)
+                }
+            }
+
         case "delete":
             targetFilename := args[2]
             username := args[3]
 
-            entry := system.DeleteFile(targetFilename, username)
+            entry, err := system.DeleteFile(targetFilename, username)
+            if err != nil {
+                return fmt.Errorf("can't delete file %s: %w", targetFilename, err)
+            }
 
             fmt.Printf("Deleted file %s\n", entry.Filename)
 
+        case "rebuild":
+            oldLocation := args[2]
+            newLocation := args[3]
+
+            rebuiltCount, err := system.RebuildLocation(oldLocation, newLocation)
+            if err != nil {
+                return fmt.Errorf("can't rebuild %s onto %s (rebuilt %d files, run again to resume): %w",
+                                  oldLocation, newLocation, rebuiltCount, err)
+            }
+
+            fmt.Printf("Rebuilt %d files from %s onto %s\n", rebuiltCount, oldLocation, newLocation)
+
+        case "rebalance":
+            // a single file, or every file when none is given
+            if len(args) > 3 {
+                targetFilename := args[2]
+                username := args[3]
+
+                err := system.RestripeFile(targetFilename, username)
+                if err != nil {
+                    return fmt.Errorf("can't re-encode file %s: %w", targetFilename, err)
+                }
+
+                fmt.Printf("Re-encoded file %s\n", targetFilename)
+                return nil
+            }
+
+            restripedCount, err := system.Rebalance()
+            if err != nil {
+                return fmt.Errorf("can't rebalance (re-encoded %d files, run again to resume): %w",
+                                  restripedCount, err)
+            }
+
+            fmt.Printf("Re-encoded %d files\n", restripedCount)
+
+        case "scrub":
+            // optional limit (bytes per second) and duration (e.g. 6h)
+            var bytesPerSecond int64 = 0
+            var duration time.Duration = 0
+            if len(args) > 2 {
+                limit, err := strconv.ParseInt(args[2], 10, 64)
+                if err != nil {
+                    return fmt.Errorf("invalid limit %s: %w", args[2], err)
+                }
+                bytesPerSecond = limit
+            }
+            if len(args) > 3 {
+                parsed, err := time.ParseDuration(args[3])
+                if err != nil {
+                    return fmt.Errorf("invalid duration %s: %w", args[3], err)
+                }
+                duration = parsed
+            }
+
+            summary, err := cron.Scrub(bytesPerSecond, duration)
+            if err != nil {
+                err = fmt.Errorf("scrub stopped (run again to resume): %w", err)
+                if summary == nil {
+                    return err
+                }
+            }
+
+            fmt.Printf("%sReport in %s\n", summary.Report(), types.SCRUB_REPORT_FILE)
+            return err
+
+        case "gc":
+            // --dry-run: only report, --quarantine: move the orphans aside
+            dryRun := false
+            quarantine := false
+            for _, option := range args[2:] {
+                switch option {
+                    case "--dry-run":
+                        dryRun = true
+                    case "--quarantine":
+                        quarantine = true
+                    default:
+                        return fmt.Errorf("unknown option %s", option)
+                }
+            }
+
+            report, err := cron.CollectGarbage(dryRun, quarantine)
+            if err != nil {
+                err = fmt.Errorf("garbage collection stopped: %w", err)
+                if report == nil {
+                    return err
+                }
+            }
+
+            fmt.Printf("%sReport in %s\n", report.Report(), types.GC_REPORT_FILE)
+            return err
+
+        case "stat":
+            targetFilename := args[2]
+            username := args[3]
+
+            entry, err := system.StatFile(targetFilename, username)
+            if err != nil {
+                return fmt.Errorf("can't stat %s: %w", targetFilename, err)
+            }
+
+            fmt.Printf("%s, version %d, %s on %s\n", entry.Filename, entry.Version,
+                       entry.Layout.Policy(), strings.Join(entry.Disks, ", "))
+            if entry.Stat == nil {
+                fmt.Printf("saved before sizes, modes and times were kept\n")
+                return nil
+            }
+            fmt.Printf("size %d bytes, mode %v\n", entry.Stat.Size, os.FileMode(entry.Stat.Mode))
+            fmt.Printf("modified %s, created %s\n",
+                       time.Unix(0, entry.Stat.ModTime).Format(time.RFC3339),
+                       time.Unix(0, entry.Stat.Created).Format(time.RFC3339))
+
+        case "versions":
+            targetFilename := args[2]
+            username := args[3]
+
+            versions, err := system.ListVersions(targetFilename, username)
+            if err != nil {
+                return fmt.Errorf("can't list the versions of %s: %w", targetFilename, err)
+            }
+
+            for _, version := range versions {
+                fmt.Printf("version %d, saved %s, %s\n", version.Version,
+                           time.Unix(version.Saved, 0).Format(time.RFC3339),
+                           version.Layout.Policy())
+            }
+
+        case "getVersion":
+            targetFilename := args[2]
+            username := args[3]
+            version, err := strconv.Atoi(args[4])
+            if err != nil {
+                return fmt.Errorf("invalid version %s: %w", args[4], err)
+            }
+
+            getLocation, err := system.GetFileVersion(targetFilename, username, version)
+            if err != nil {
+                return fmt.Errorf("can't get version %d of %s: %w", version, targetFilename, err)
+            }
+
+            fmt.Printf("Retreived version %d at %s\n", version, getLocation)
+
+        case "restore":
+            targetFilename := args[2]
+            username := args[3]
+            version, err := strconv.Atoi(args[4])
+            if err != nil {
+                return fmt.Errorf("invalid version %s: %w", args[4], err)
+            }
+
+            err = system.RestoreVersion(targetFilename, username, version)
+            if err != nil {
+                return fmt.Errorf("can't restore version %d of %s: %w", version, targetFilename, err)
+            }
+
+            fmt.Printf("Restored version %d of %s\n", version, targetFilename)
+
+        case "retention":
+            // versions to keep and days to keep them for, 0 = no limit
+            username := args[2]
+            keepVersions, err := strconv.Atoi(args[3])
+            if err != nil {
+                return fmt.Errorf("invalid amount of versions %s: %w", args[3], err)
+            }
+            keepDays := 0
+            if len(args) > 4 {
+                keepDays, err = strconv.Atoi(args[4])
+                if err != nil {
+                    return fmt.Errorf("invalid amount of days %s: %w", args[4], err)
+                }
+            }
+
+            err = system.SetRetention(username, types.Retention{KeepVersions: keepVersions,
+                                                                KeepDays: keepDays})
+            if err != nil {
+                return fmt.Errorf("can't set the retention of %s: %w", username, err)
+            }
+
+            fmt.Printf("User %s keeps %d versions for %d days (0 = no limit)\n", username,
+                       keepVersions, keepDays)
+
+        case "snapshot":
+            username := args[2]
+            snapshot := args[3]
+
+            err := system.CreateSnapshot(username, snapshot)
+            if err != nil {
+                return fmt.Errorf("can't create snapshot %s of %s: %w", snapshot, username, err)
+            }
+
+            fmt.Printf("Created snapshot %s of %s\n", snapshot, username)
+
+        case "snapshots":
+            // the snapshots of the user, or the files in one of them
+            username := args[2]
+            if len(args) > 3 {
+                entries, err := system.ListSnapshotFiles(username, args[3])
+                if err != nil {
+                    return fmt.Errorf("can't list snapshot %s of %s: %w", args[3], username, err)
+                }
+
+                for _, entry := range entries {
+                    fmt.Printf("%s\n", entry.Filename)
+                }
+                return nil
+            }
+
+            snapshots, err := system.ListSnapshots(username)
+            if err != nil {
+                return fmt.Errorf("can't list the snapshots of %s: %w", username, err)
+            }
+
+            for _, snapshot := range snapshots {
+                fmt.Printf("%s\n", snapshot)
+            }
+
+        case "getSnapshot":
+            username := args[2]
+            snapshot := args[3]
+            targetFilename := args[4]
+
+            getLocation, err := system.GetSnapshotFile(username, snapshot, targetFilename)
+            if err != nil {
+                return fmt.Errorf("can't get file %s from snapshot %s: %w", targetFilename,
+                                  snapshot, err)
+            }
+
+            fmt.Printf("Retreived file at %s\n", getLocation)
+
+        case "restoreSnapshot":
+            // a single file, or every file in the snapshot when none is given
+            username := args[2]
+            snapshot := args[3]
+            if len(args) > 4 {
+                targetFilename := args[4]
+                err := system.RestoreSnapshotFile(username, snapshot, targetFilename)
+                if err != nil {
+                    return fmt.Errorf("can't restore file %s from snapshot %s: %w",
+                                      targetFilename, snapshot, err)
+                }
+
+                fmt.Printf("Restored file %s from snapshot %s\n", targetFilename, snapshot)
+                return nil
+            }
+
+            restoredCount, err := system.RestoreSnapshot(username, snapshot)
+            if err != nil {
+                return fmt.Errorf("can't restore snapshot %s (restored %d files): %w",
+                                  snapshot, restoredCount, err)
+            }
+
+            fmt.Printf("Restored %d files from snapshot %s\n", restoredCount, snapshot)
+
+        case "deleteSnapshot":
+            username := args[2]
+            snapshot := args[3]
+
+            err := system.DeleteSnapshot(username, snapshot)
+            if err != nil {
+                return fmt.Errorf("can't delete snapshot %s of %s: %w", snapshot, username, err)
+            }
+
+            fmt.Printf("Deleted snapshot %s of %s\n", snapshot, username)
+
+        case "append":
+            // the data to append is read from the input file (- = stdin)
+            targetFilename := args[2]
+            username := args[3]
+            data, err := readInput(args[4])
+            if err != nil {
+                return fmt.Errorf("can't read %s: %w", args[4], err)
+            }
+
+            err = system.AppendFile(targetFilename, username, data)
+            if err != nil {
+                return fmt.Errorf("can't append to %s: %w", targetFilename, err)
+            }
+
+            fmt.Printf("Appended %d bytes to %s\n", len(data), targetFilename)
+
+        case "writeAt":
+            targetFilename := args[2]
+            username := args[3]
+            offset, err := strconv.ParseInt(args[4], 10, 64)
+            if err != nil {
+                return fmt.Errorf("invalid offset %s: %w", args[4], err)
+            }
+            data, err := readInput(args[5])
+            if err != nil {
+                return fmt.Errorf("can't read %s: %w", args[5], err)
+            }
+
+            err = system.WriteAt(targetFilename, username, offset, data)
+            if err != nil {
+                return fmt.Errorf("can't write to %s: %w", targetFilename, err)
+            }
+
+            fmt.Printf("Wrote %d bytes to %s at %d\n", len(data), targetFilename, offset)
+
         case "checkDbParity":
             errorFound := cron.CheckDbParity(types.CONFIG_FILE)
 
@@ -177,7 +628,10 @@ func Run(args []string) {
             fmt.Printf("Created local structure\n")
 
         case "createConfigFile":
-            system.GetConfigs()
+            _, err := system.GetConfigs()
+            if err != nil {
+                return fmt.Errorf("can't create config file: %w", err)
+            }
 
             fmt.Printf("Created default config file, can change it now.\n")
 
@@ -198,9 +652,11 @@ func Run(args []string) {
             fmt.Printf("Finished running client\n")
 
         default:
-            fmt.Printf("Error: unsupported command\n")
+            return fmt.Errorf("unsupported command %s", args[1])
     }
 
+    return nil
+
 }
 
 
@@ -343,7 +799,8 @@ func runTest1() {
             check(err)
             testingFilename = databaseFiles[i]
 
-            system.AddFile(databaseFiles[i], username, diskLocations)
+            err = system.AddFile(databaseFiles[i], username, diskLocations)
+            check(err)
         }
 
         // just rename it
@@ -367,7 +824,8 @@ func runTest1() {
             // actually it's faster to just add when you already have
             // entry in the database, so this won't be an accurate reading
 
-            system.AddFile(testingFilename, username, diskLocations)
+            err := system.AddFile(testingFilename, username, diskLocations)
+            check(err)
 
             // just going to delete the file after, so that the runtimes
             // make sense, at least it'll just be a multiple of 2 basically
@@ -375,8 +833,9 @@ func runTest1() {
             // sizes (note that the file size doesn't matter for the
             // database itself)
 
-            r := system.DeleteFile(testingFilename, username)
-            if r == nil {
+            _, err = system.DeleteFile(testingFilename, username)
+            if err != nil {
+                fmt.Println(err)
                 return
             }
 
@@ -390,7 +849,7 @@ func runTest1() {
             // maybe can rename the file here, so that on the next round it's
             // a little different
             newName := randStringRunes(NAME_SIZE)
-            err := os.Rename(testingFilename, newName)
+            err = os.Rename(testingFilename, newName)
             check(err)
             testingFilename = newName
         }
@@ -442,7 +901,8 @@ func runTest2() {
         // create the file, with random data
         createRandomFile(testingFilename, fileSize)
 
-        system.AddFile(testingFilename, username, diskLocations)
+        err := system.AddFile(testingFilename, username, diskLocations)
+        check(err)
     }
     
     // run the tests
@@ -468,7 +928,8 @@ func runTest2() {
             // actually it's faster to just add when you already have
             // entry in the database, so this won't be an accurate reading
 
-            system.AddFile(testingFilename, username, diskLocations)
+            err := system.AddFile(testingFilename, username, diskLocations)
+            check(err)
 
             // just going to delete the file after, so that the runtimes
             // make sense, at least it'll just be a multiple of 2 basically
@@ -476,8 +937,9 @@ func runTest2() {
             // sizes (note that the file size doesn't matter for the
             // database itself)
 
-            r := system.DeleteFile(testingFilename, username)
-            if r == nil {
+            _, err = system.DeleteFile(testingFilename, username)
+            if err != nil {
+                fmt.Println(err)
                 return
             }
 
@@ -491,7 +953,7 @@ func runTest2() {
             // maybe can rename the file here, so that on the next round it's
             // a little different
             newName := randStringRunes(NAME_SIZE)
-            err := os.Rename(testingFilename, newName)
+            err = os.Rename(testingFilename, newName)
             check(err)
             testingFilename = newName
         }
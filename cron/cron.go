@@ -10,10 +10,12 @@
 package cron
 
 import (
+    "context"
     "fmt"
     "os"
     "log"
     "io/ioutil"
+    "time"
     "foxyblox/types"
     "foxyblox/system"
 )
@@ -113,7 +115,8 @@ func checkDbParityForUser(username string, elog *log.Logger, configs *types.Conf
 }
 
 func CheckDbParity(configFileName string) bool {
-    configs := system.GetConfigs()
+    configs, err := system.GetConfigs()
+    check(err)
 
     dbDisks := configs.Dbdisks
     elog := log.New(os.Stderr, "", log.Ldate | log.Ltime | log.Lshortfile) // 0 = no timestamps
@@ -135,4 +138,60 @@ func CheckDbParity(configFileName string) bool {
     }
 
     return foundError
-}
\ No newline at end of file
+}
+/*
+    Scrub all of the files of the users (see system.Scrub), for at most
+    duration (0 = until it is done), reading and writing at most
+    bytesPerSecond (0 = no limit). A scrub that didn't finish is resumed the
+    next time. The summary is written to types.SCRUB_REPORT_FILE, also when
+    the scrub ran out of time.
+*/
+func Scrub(bytesPerSecond int64, duration time.Duration) (*system.ScrubSummary, error) {
+    ctx := context.Background()
+    if duration > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, duration)
+        defer cancel()
+    }
+
+    summary, err := system.Scrub(ctx, types.SCRUB_STATE_FILE, bytesPerSecond)
+    if summary == nil {
+        return nil, err
+    }
+
+    report := summary.Report()
+    if err != nil {
+        report += fmt.Sprintf("stopped after %s/%s: %v\n", summary.LastUsername,
+                              summary.LastFilename, err)
+    }
+    writeErr := ioutil.WriteFile(types.SCRUB_REPORT_FILE, []byte(report), 0644)
+    if err == nil {
+        err = writeErr
+    }
+
+    return summary, err
+}
+
+/*
+    Remove the components that the database doesn't refer to anymore (see
+    system.CollectGarbage), or move them into the quarantine folders of their
+    locations. Nothing is changed in a dry run. The report is written to
+    types.GC_REPORT_FILE.
+*/
+func CollectGarbage(dryRun bool, quarantine bool) (*system.GarbageReport, error) {
+    report, err := system.CollectGarbage(dryRun, quarantine, types.GC_MIN_AGE)
+    if report == nil {
+        return nil, err
+    }
+
+    text := report.Report()
+    if err != nil {
+        text += fmt.Sprintf("stopped: %v\n", err)
+    }
+    writeErr := ioutil.WriteFile(types.GC_REPORT_FILE, []byte(text), 0644)
+    if err == nil {
+        err = writeErr
+    }
+
+    return report, err
+}
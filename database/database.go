@@ -25,15 +25,19 @@
 package database
 
 import (
+    "errors"
     "fmt"
     "os"
-    "log"
     // "math"
-    "crypto/md5"
     "os/exec"
     "bytes"
     "encoding/binary"
+    "io/ioutil"
+    "sort"
+    "strconv"
+    "strings"
     "foxyblox/database/transaction"
+    "foxyblox/hashes"
     "foxyblox/types"
     // "time"
 )
@@ -45,6 +49,9 @@ type Header struct {
     RootPointer int64
     FreeList int64
     TrueDbSize int64
+    Version uint8 // types.DB_FORMAT_LEGACY for databases created before this field existed
+    ParityDiskCount uint8 // parity disk slots in every entry (after the DiskCount data disk slots)
+    HashAlgorithm uint8 // hash of the header and the entries, always types.HASH_MD5 before DB_FORMAT_HASH
 }
 
 // type types.TreeEntry struct {
@@ -54,34 +61,166 @@ type Header struct {
 //     Disks []string
 // }
 
-// check error, exit if non-nil
-func check(err error) {
-    if err != nil {
-        log.Fatal("Exiting: ", err);
-    }
-}
-
 // return true if either file or directory exists with given path
 func pathExists(path string) (bool) {
     _, err := os.Stat(path)
     return !os.IsNotExist(err)
 }
 
+// size of an entry in the database with the given header
+func entrySize(header *Header) int16 {
+    size := header.FileNameSize + 2*(types.POINTER_SIZE) + int16(header.DiskCount + header.ParityDiskCount) * int16(header.DiskNameSize) + entryHashSize(header)
+    if header.Version != types.DB_FORMAT_LEGACY {
+        size += types.ENTRY_METADATA_SIZE
+    }
+
+    return size
+}
+
+// size of the hash at the end of every entry
+func entryHashSize(header *Header) int16 {
+    return int16(hashes.Size(int(header.HashAlgorithm)))
+}
+
+// hash of buf with the algorithm of the database (the algorithm is checked
+// when the header is read or created, so it is always known here)
+func entryHash(buf []byte, header *Header) []byte {
+    hash, _ := hashes.Sum(int(header.HashAlgorithm), buf)
+    return hash
+}
+
+// size of the header (without its hash) in each version of the format
+func rawHeaderSize(version uint8) int {
+    switch version {
+    case types.DB_FORMAT_LEGACY:
+        return int(types.RAW_HEADER_SIZE)
+    case types.DB_FORMAT_LAYOUT:
+        return int(types.RAW_HEADER_SIZE) + 2 // + version + parity disk count
+    }
+    return binary.Size(Header{})
+}
+
+// offset of the metadata (layout, etc.) in an entry, right after the disks
+func metadataOffset(header *Header) int {
+    return int(header.FileNameSize) + 2 * types.POINTER_SIZE + int(header.DiskCount + header.ParityDiskCount) * int(header.DiskNameSize)
+}
+
+/*
+    Serialize the header, followed by its hash, the way it is stored at the
+    start of every database file (headers of older versions keep their
+    original size, so the hash stays where those versions expect it)
+*/
+func headerToBuf(header *Header) []byte {
+    // can't fail, all of the fields of the header have a fixed size
+    binaryBuffer := new(bytes.Buffer)
+    binary.Write(binaryBuffer, binary.LittleEndian, header)
+
+    headerBuf := binaryBuffer.Bytes()[0:rawHeaderSize(header.Version)]
+
+    return append(headerBuf, entryHash(headerBuf, header)...)
+}
+
+/*
+    Serialize a tree entry according to the format of the header, returns an
+    error if the entry doesn't fit
+*/
+func entryToBuf(entry *types.TreeEntry, header *Header) ([]byte, error) {
+    SIZE_OF_ENTRY := entrySize(header)
+    if len(entry.Filename) > int(header.FileNameSize) {
+        return nil, fmt.Errorf("%w: filename %s is longer than %d bytes", types.ErrNameTooLong,
+                               entry.Filename, header.FileNameSize)
+    }
+    if len(entry.Disks) > int(header.DiskCount + header.ParityDiskCount) {
+        return nil, fmt.Errorf("%s is stored on %d disks, database only has room for %d",
+                               entry.Filename, len(entry.Disks), header.DiskCount + header.ParityDiskCount)
+    }
+    if len(entry.Policy) > types.MAX_POLICY_SIZE {
+        return nil, fmt.Errorf("%w: policy %s is longer than %d bytes", types.ErrInvalidLayout,
+                               entry.Policy, types.MAX_POLICY_SIZE)
+    }
+
+    buf := make([]byte, SIZE_OF_ENTRY)
+    copy(buf, entry.Filename)
+
+    binary.LittleEndian.PutUint64(buf[header.FileNameSize:], uint64(entry.Left))
+    binary.LittleEndian.PutUint64(buf[header.FileNameSize + types.POINTER_SIZE:], uint64(entry.Right))
+
+    // copy in the file locations
+    for i := 0; i < len(entry.Disks); i++ {
+        if len(entry.Disks[i]) > int(header.DiskNameSize) {
+            return nil, fmt.Errorf("%w: disk name %s is longer than %d bytes", types.ErrNameTooLong,
+                                   entry.Disks[i], header.DiskNameSize)
+        }
+        offset := int(header.FileNameSize) + 2 * types.POINTER_SIZE + i * int(header.DiskNameSize)
+        copy(buf[offset:], entry.Disks[i])
+    }
+
+    /*
+        Metadata (from DB_FORMAT_LAYOUT on):
+            [1 byte scheme] [1 byte data count] [1 byte parity count]
+            [1 byte striping] [8 bytes stripe size] [1 byte hash algorithm]
+            [4 bytes generation] [4 bytes version] [8 bytes time saved]
+            [1 byte policy length] [MAX_POLICY_SIZE bytes policy]
+            [1 byte stat known] [8 bytes size] [4 bytes mode]
+            [8 bytes time modified] [8 bytes time created]
+        (0 striping = whole strips, the way files were saved before striping,
+        0 hash algorithm = MD5, the way components were hashed before,
+        0 generation = components named after the file only, the generation
+        was a single byte before, the bytes after it were always 0, no policy
+        = the default layout, the stat is only stored from DB_FORMAT_STAT on,
+        older databases keep their format and don't store it)
+    */
+    if header.Version == types.DB_FORMAT_LEGACY {
+        // a mirror on two locations is the same as RAID 4 on them
+        mirror := entry.Layout.Scheme == types.MIRROR_SCHEME && entry.Layout.ParityCount == 1
+        if (entry.Layout.Scheme != types.XOR_SCHEME && !mirror) || entry.Layout.ParityCount != 1 ||
+           entry.Layout.Striping != types.STRIPING_NONE || entry.Policy != "" {
+            return nil, fmt.Errorf("database uses the legacy format, can only store RAID 4 files " +
+                                   "with the default layout")
+        }
+    } else {
+        metadata := buf[metadataOffset(header):]
+        metadata[0] = byte(entry.Layout.Scheme)
+        metadata[1] = byte(entry.Layout.DataCount)
+        metadata[2] = byte(entry.Layout.ParityCount)
+        metadata[3] = byte(entry.Layout.Striping)
+        binary.LittleEndian.PutUint64(metadata[4:12], uint64(entry.Layout.StripeSize))
+        metadata[12] = byte(entry.Layout.HashAlgorithm)
+        binary.LittleEndian.PutUint32(metadata[13:17], uint32(entry.Layout.Generation))
+        binary.LittleEndian.PutUint32(metadata[17:21], uint32(entry.Version))
+        binary.LittleEndian.PutUint64(metadata[21:29], uint64(entry.Saved))
+        metadata[29] = byte(len(entry.Policy))
+        copy(metadata[30:30 + types.MAX_POLICY_SIZE], entry.Policy)
+        if header.Version >= types.DB_FORMAT_STAT && entry.Stat != nil {
+            statBuf := metadata[30 + types.MAX_POLICY_SIZE:]
+            statBuf[0] = 1
+            binary.LittleEndian.PutUint64(statBuf[1:9], uint64(entry.Stat.Size))
+            binary.LittleEndian.PutUint32(statBuf[9:13], entry.Stat.Mode)
+            binary.LittleEndian.PutUint64(statBuf[13:21], uint64(entry.Stat.ModTime))
+            binary.LittleEndian.PutUint64(statBuf[21:29], uint64(entry.Stat.Created))
+        }
+    }
+
+    // write the hash into the end of the entry
+    hashSize := entryHashSize(header)
+    copy(buf[SIZE_OF_ENTRY - hashSize:], entryHash(buf[0:SIZE_OF_ENTRY - hashSize], header))
+
+    return buf, nil
+}
+
 // return a tree entry corresponding to the read buffer
 func bufferToEntry(buf []byte, header *Header, configs *types.Config) (*types.TreeEntry) {
     currentFilename := bytes.Trim(buf[0:header.FileNameSize], "\x00")
-    currentNode := types.TreeEntry{string(currentFilename), 0, 0, []string(nil), nil}
+    currentNode := types.TreeEntry{Filename: string(currentFilename)}
 
-    b := bytes.NewReader(buf[header.FileNameSize: header.FileNameSize + types.POINTER_SIZE])
-    err := binary.Read(b, binary.LittleEndian, &currentNode.Left); check(err)
-    b = bytes.NewReader(buf[header.FileNameSize + types.POINTER_SIZE: header.FileNameSize + 2 * types.POINTER_SIZE])
-    err = binary.Read(b, binary.LittleEndian, &currentNode.Right); check(err)
+    currentNode.Left = bufToPointer(buf[header.FileNameSize:])
+    currentNode.Right = bufToPointer(buf[header.FileNameSize + types.POINTER_SIZE:])
 
     // header disk count is inherited from configs file, and is more accurate to
     // this file specifically
-    currentNode.Disks = make([]string, header.DiskCount + 1) // + 1 for parity disk***
+    currentNode.Disks = make([]string, header.DiskCount + header.ParityDiskCount)
     i := 0
-    for i = 0; i < int(header.DiskCount) + 1; i++ { // + 1 for parity disk***
+    for i = 0; i < len(currentNode.Disks); i++ {
         upperBound := int(header.FileNameSize) + 2 * int(types.POINTER_SIZE) + (i + 1) * int(header.DiskNameSize)
         lowerBound := int(header.FileNameSize) + 2 * int(types.POINTER_SIZE) + i * int(header.DiskNameSize)
         currentNode.Disks[i] = string(bytes.Trim(buf[lowerBound:upperBound], "\x00"))
@@ -91,16 +230,40 @@ func bufferToEntry(buf []byte, header *Header, configs *types.Config) (*types.Tr
     }
 
     // trim the slice from empty entries (didn't use all of the distribution disk count)
-    if i != int(header.DiskCount) {
-        currentNode.Disks = currentNode.Disks[0:i]
+    currentNode.Disks = currentNode.Disks[0:i]
+
+    if header.Version == types.DB_FORMAT_LEGACY {
+        // only RAID 4 existed, with the parity disk at the end
+        currentNode.Layout = types.Layout{Scheme: types.XOR_SCHEME,
+                                          DataCount: len(currentNode.Disks) - 1, ParityCount: 1}
+    } else {
+        metadata := buf[metadataOffset(header):]
+        currentNode.Layout = types.Layout{Scheme: int(metadata[0]),
+                                          DataCount: int(metadata[1]), ParityCount: int(metadata[2]),
+                                          Striping: int(metadata[3]),
+                                          StripeSize: int64(binary.LittleEndian.Uint64(metadata[4:12])),
+                                          HashAlgorithm: int(metadata[12]),
+                                          Generation: int(binary.LittleEndian.Uint32(metadata[13:17]))}
+        currentNode.Version = int(binary.LittleEndian.Uint32(metadata[17:21]))
+        currentNode.Saved = int64(binary.LittleEndian.Uint64(metadata[21:29]))
+        policySize := int(metadata[29])
+        if policySize <= types.MAX_POLICY_SIZE {
+            currentNode.Policy = string(metadata[30:30 + policySize])
+        }
+        statBuf := metadata[30 + types.MAX_POLICY_SIZE:]
+        if header.Version >= types.DB_FORMAT_STAT && statBuf[0] == 1 {
+            currentNode.Stat = &types.FileStat{Size: int64(binary.LittleEndian.Uint64(statBuf[1:9])),
+                                               Mode: binary.LittleEndian.Uint32(statBuf[9:13]),
+                                               ModTime: int64(binary.LittleEndian.Uint64(statBuf[13:21])),
+                                               Created: int64(binary.LittleEndian.Uint64(statBuf[21:29]))}
+        }
     }
 
     // get the hash at the end, and verify it, return nil if something went wrong
-    originalHash := buf[len(buf) - types.MD5_SIZE:len(buf)]
-    h := md5.New()
-    h.Write(buf[0:len(buf) - types.MD5_SIZE])
-    computedHash := h.Sum(nil)
-    currentNode.Hash = make([]byte, types.MD5_SIZE)
+    hashSize := int(entryHashSize(header))
+    originalHash := buf[len(buf) - hashSize:len(buf)]
+    computedHash := entryHash(buf[0:len(buf) - hashSize], header)
+    currentNode.Hash = make([]byte, hashSize)
     for i := 0; i < len(originalHash); i++ {
         currentNode.Hash[i] = originalHash[i]
         if computedHash[i] != originalHash[i] {
@@ -114,7 +277,7 @@ func bufferToEntry(buf []byte, header *Header, configs *types.Config) (*types.Tr
 }
 
 // returns the newly modified entry, with updated hash
-func modifyEntry(oldEntry []byte, newData []byte, locationOfChange int) []byte {
+func modifyEntry(oldEntry []byte, newData []byte, locationOfChange int, header *Header) []byte {
     newEntry := make([]byte, len(oldEntry))
     for i := 0; i < len(oldEntry); i++ {
         newEntry[i] = oldEntry[i]
@@ -124,23 +287,21 @@ func modifyEntry(oldEntry []byte, newData []byte, locationOfChange int) []byte {
     }
 
     // compute the hash for this modified parent entry
-    h := md5.New()
-    h.Write(newEntry[0:len(oldEntry) - types.MD5_SIZE])
-    newHash := h.Sum(nil)
-    for i := 0; i < types.MD5_SIZE; i++ {
-        newEntry[len(newEntry) - types.MD5_SIZE + i] = newHash[i]
+    hashSize := int(entryHashSize(header))
+    newHash := entryHash(newEntry[0:len(oldEntry) - hashSize], header)
+    for i := 0; i < hashSize; i++ {
+        newEntry[len(newEntry) - hashSize + i] = newHash[i]
     }
 
     return newEntry
 }
 
-func verifyFreeListEntry(freeListEntryBuf []byte) []byte {
+func verifyFreeListEntry(freeListEntryBuf []byte, header *Header) []byte {
     // compute the hash for this modified parent entry
-    h := md5.New()
-    h.Write(freeListEntryBuf[0:len(freeListEntryBuf) - types.MD5_SIZE])
-    newHash := h.Sum(nil)
-    oldHash := freeListEntryBuf[len(freeListEntryBuf) - types.MD5_SIZE: len(freeListEntryBuf)]
-    for i := 0; i < types.MD5_SIZE; i++ {
+    hashSize := int(entryHashSize(header))
+    newHash := entryHash(freeListEntryBuf[0:len(freeListEntryBuf) - hashSize], header)
+    oldHash := freeListEntryBuf[len(freeListEntryBuf) - hashSize: len(freeListEntryBuf)]
+    for i := 0; i < hashSize; i++ {
         if newHash[i] != oldHash[i] {
             // fmt.Printf("Found an error in free list entry\n")
             return nil
@@ -150,33 +311,150 @@ func verifyFreeListEntry(freeListEntryBuf []byte) []byte {
     return freeListEntryBuf
 }
 
-// get the header in this dbFile
-func getHeader(dbFile *os.File) (Header, int) {
+// pointer stored (little endian) at the start of buf
+func bufToPointer(buf []byte) int64 {
+    return int64(binary.LittleEndian.Uint64(buf[0:types.POINTER_SIZE]))
+}
+
+// pointer as it is stored in the database
+func pointerToBuf(pointer int64) []byte {
+    buf := make([]byte, types.POINTER_SIZE)
+    binary.LittleEndian.PutUint64(buf, uint64(pointer))
+    return buf
+}
+
+// get the header in this dbFile, types.ErrCorrupt if it doesn't match its hash
+func getHeader(dbFile *os.File) (Header, error) {
     buf := make([]byte, types.HEADER_SIZE)
     _, err := dbFile.ReadAt(buf, 0)
-    check(err)
+    if err != nil {
+        return Header{}, fmt.Errorf("%w: can't read header of %s: %v", types.ErrCorrupt,
+                                    dbFile.Name(), err)
+    }
 
+    // can't fail, the buffer is larger than the header
     var header Header
     b := bytes.NewReader(buf)
-    err = binary.Read(b, binary.LittleEndian, &header)
-    check(err)
+    binary.Read(b, binary.LittleEndian, &header)
 
     // check the hash on the header here, recover if not correct
-    headerHash := md5.New()
-    sizeOfRawHeader := binary.Size(header)
-    headerHash.Write(buf[0:sizeOfRawHeader])
-    computedHeaderHash := headerHash.Sum(nil)
-
-    originalHash := buf[sizeOfRawHeader:sizeOfRawHeader + types.MD5_SIZE]
-    for i := 0; i < types.MD5_SIZE; i++ {
-        if originalHash[i] != computedHeaderHash[i] {
-            return header, -1
-            // log.Fatal("Error in header")
-            // fmt.Printf("Error in header\n")
+    if header.Version >= types.DB_FORMAT_HASH &&
+       headerHashMatches(buf, rawHeaderSize(header.Version), int(header.HashAlgorithm)) {
+        return header, nil
+    }
+
+    /*
+        Headers from before the hash algorithm was stored are one byte
+        shorter, and always hashed with MD5 (the byte read as the algorithm is
+        really the start of the hash)
+    */
+    if headerHashMatches(buf, rawHeaderSize(types.DB_FORMAT_LAYOUT), types.HASH_MD5) {
+        header.Version = types.DB_FORMAT_LAYOUT
+        header.HashAlgorithm = uint8(types.HASH_MD5)
+        return header, nil
+    }
+
+    /*
+        Databases created before the header had a version in it have a shorter
+        header, with the hash right after it (only RAID 4 existed then, so there
+        is always one parity disk)
+    */
+    if headerHashMatches(buf, rawHeaderSize(types.DB_FORMAT_LEGACY), types.HASH_MD5) {
+        header.Version = types.DB_FORMAT_LEGACY
+        header.ParityDiskCount = 1
+        header.HashAlgorithm = uint8(types.HASH_MD5)
+        return header, nil
+    }
+
+    return header, fmt.Errorf("%w: hash of the header of %s does not match", types.ErrCorrupt,
+                              dbFile.Name())
+}
+
+/*
+    True if the hash (with the given algorithm) after the first
+    sizeOfRawHeader bytes of buf is correct
+*/
+func headerHashMatches(buf []byte, sizeOfRawHeader int, algorithm int) bool {
+    computedHeaderHash, err := hashes.Sum(algorithm, buf[0:sizeOfRawHeader])
+    if err != nil || sizeOfRawHeader + len(computedHeaderHash) > len(buf) {
+        return false
+    }
+
+    originalHash := buf[sizeOfRawHeader:sizeOfRawHeader + len(computedHeaderHash)]
+    return bytes.Equal(originalHash, computedHeaderHash)
+}
+
+/*
+    Error if the filename can't be stored in the database (the first
+    character picks the database disk, so it can't be empty), if it would
+    be taken for a past version of a file (see VersionKey), or if it is not a
+    relative path that the components of the file can be saved under
+*/
+func CheckFilename(filename string) error {
+    if strings.Contains(filename, types.VERSION_SEPARATOR) {
+        return fmt.Errorf("%w: filename %q has the version separator in it", types.ErrInvalidName,
+                          filename)
+    }
+
+    err := checkKey(filename)
+    if err != nil {
+        return err
+    }
+
+    /*
+        Filenames are relative paths ("photos/2020/beach.jpg"), the components
+        of a file are saved under its path, so none of its folders can be
+        empty, "." or "..", or be named like the folders that the components
+        of each generation are saved in (".g<N>", see fileutils.storedFilename)
+    */
+    if strings.HasPrefix(filename, "/") {
+        return fmt.Errorf("%w: filename %q should be a relative path", types.ErrInvalidName,
+                          filename)
+    }
+    for _, segment := range strings.Split(filename, "/") {
+        if segment == "" || segment == "." || segment == ".." || isGenerationFolder(segment) {
+            return fmt.Errorf("%w: filename %q has %q in its path", types.ErrInvalidName,
+                              filename, segment)
         }
     }
 
-    return header, 0
+    return nil
+}
+
+// true if segment is named like the folders that the components of each generation are saved in
+func isGenerationFolder(segment string) bool {
+    if !strings.HasPrefix(segment, ".g") {
+        return false
+    }
+    _, err := strconv.Atoi(segment[2:])
+    return err == nil
+}
+
+// error if the key (a filename, or a VersionKey) can't be stored in the database
+/*
+    Error if the username can't be the name of a folder on the data disks and
+    of the database files of the user: it can't be empty, "." or "..", or
+    have a path separator in it
+*/
+func CheckUsername(username string) error {
+    if username == "" || username == "." || username == ".." ||
+       strings.ContainsAny(username, "/\\") {
+        return fmt.Errorf("%w: username %q can't be a folder name", types.ErrInvalidName,
+                          username)
+    }
+    return nil
+}
+
+func checkKey(filename string) error {
+    if len(filename) == 0 {
+        return fmt.Errorf("%w: filename is empty", types.ErrInvalidName)
+    }
+    if len(filename) > int(types.MAX_FILE_NAME_SIZE) {
+        return fmt.Errorf("%w: filename %s is longer than %d bytes", types.ErrNameTooLong,
+                          filename, types.MAX_FILE_NAME_SIZE)
+    }
+
+    return nil
 }
 
 // get the database that this file is stored in
@@ -229,7 +507,7 @@ func getParityFilename(username string, filename string, configs *types.Config)
     return dbFilename
 }
 
-func createIntermediateMkdir(path string) {
+func createIntermediateMkdir(path string) error {
     cmd := exec.Command("mkdir", "-p", path)
 
     var out bytes.Buffer
@@ -237,7 +515,11 @@ func createIntermediateMkdir(path string) {
     cmd.Stdout = &out
     cmd.Stderr = &stderr
     err := cmd.Run()
-    check(err)
+    if err != nil {
+        return fmt.Errorf("can't create %s: %v %s", path, err, stderr.String())
+    }
+
+    return nil
 }
 
 func InitializeDatabaseStructureLocal() bool {
@@ -267,7 +549,7 @@ func InitializeDatabaseStructureLocal() bool {
 // maybe get rid of storageType and just pass in the locations (since always
 // will be localhost or EBS anyway)
 // note: dbdisklocations here can be subfolders in the drives
-func InitializeDatabaseStructure(dbdiskLocations []string) (bool) {
+func InitializeDatabaseStructure(dbdiskLocations []string) (bool, error) {
     /*
         Create the following structure if it doesn't already exist:
 
@@ -286,12 +568,15 @@ func InitializeDatabaseStructure(dbdiskLocations []string) (bool) {
 
     for i := 0; i < len(dbdiskLocations); i++ {
         if !pathExists(dbdiskLocations[i]) {
-            createIntermediateMkdir(dbdiskLocations[i])
+            err := createIntermediateMkdir(dbdiskLocations[i])
+            if err != nil {
+                return madeChanges, err
+            }
             madeChanges = true
         }
     }
 
-    return madeChanges
+    return madeChanges, nil
 }
 
 /*
@@ -358,8 +643,25 @@ func DeleteDatabaseForUser(username string, configs *types.Config) {
 // Note: no transactions used here because this is database creation, not all
 // of the files even exist yet. This can be updated later to have a more robust
 // way of determining if there was an unexpected server crash in this function
-func CreateDatabaseForUser(username string, configs *types.Config) {
-    var SIZE_OF_ENTRY int16 = types.MAX_FILE_NAME_SIZE + 2*(types.POINTER_SIZE) + int16(configs.DataDiskCount + 1) * int16(types.MAX_DISK_NAME_SIZE) + types.MD5_SIZE
+func CreateDatabaseForUser(username string, configs *types.Config) error {
+    // used to be MAX_DISK_COUNT, now takes the value from configs, and then
+    // is stored in the header for future use
+    parityDiskCount := configs.ParityDiskCount
+    if parityDiskCount < 1 {
+        parityDiskCount = 1
+    }
+    h := Header{FileNameSize: types.MAX_FILE_NAME_SIZE, DiskCount: uint8(configs.DataDiskCount),
+                DiskNameSize: types.MAX_DISK_NAME_SIZE, RootPointer: types.HEADER_SIZE,
+                Version: types.DB_FORMAT_VERSION, ParityDiskCount: uint8(parityDiskCount),
+                HashAlgorithm: uint8(configs.HashAlgorithm)}
+    if hashes.Size(configs.HashAlgorithm) == 0 {
+        return fmt.Errorf("%w: unknown hash algorithm %d", types.ErrInvalidConfig,
+                          configs.HashAlgorithm)
+    }
+    SIZE_OF_ENTRY := entrySize(&h)
+    h.FreeList = types.HEADER_SIZE + int64(SIZE_OF_ENTRY)
+    h.TrueDbSize = types.HEADER_SIZE + int64(SIZE_OF_ENTRY)
+
     parityBuf := make([]byte, types.HEADER_SIZE + int64(SIZE_OF_ENTRY))
     for i := 0; i < len(configs.Dbdisks) - 1; i++ { //- NUM_PARITY_DISKS
         // dbCompLocation := fmt.Sprintf("%s/%s_%d", dbdisklocations[i], username, i)
@@ -368,7 +670,9 @@ func CreateDatabaseForUser(username string, configs *types.Config) {
         dbCompLocation := fmt.Sprintf("%s/%s_%d", configs.Dbdisks[i], username, i)
 
         dbFile, err := os.Create(dbCompLocation)
-        check(err)
+        if err != nil {
+            return err
+        }
 
         /*
             Each database component file should have the following format:
@@ -398,35 +702,23 @@ func CreateDatabaseForUser(username string, configs *types.Config) {
                     and then reassign root of this list as the next entry
                     in the list (could be end of the file then)
                 - 8 byte true size of header (not including 0 bytes at end)
+                - 1 byte version of the database format
+                - 1 byte amount of parity disks that a file can be stored
+                across (the disk slots in an entry = data + parity disks)
+                - 1 byte hash algorithm of the header and of the entries
+                (hash of the header is right after it, up to 32 bytes)
                 - (64 - previous entries) extra bytes to leave space for any
                 additional components might need to be added to the header
                 later
 
-                Altogether: 64 bytes (20 bytes of useful data, as of now)
+                Altogether: 64 bytes (31 bytes of useful data, as of now)
                 Edit: possibly forcing this to be same size as entry, so that
                 adding actions to a transaction is easier (all the same size)
                 ^ might not need this though, can decrease later if possible
         */
 
-        // used to be MAX_DISK_COUNT, now takes the value from configs, and then
-        // is stored in the header for future use
-        h := Header{types.MAX_FILE_NAME_SIZE, uint8(configs.DataDiskCount), types.MAX_DISK_NAME_SIZE, 
-                    types.HEADER_SIZE, types.HEADER_SIZE + int64(SIZE_OF_ENTRY),
-                    types.HEADER_SIZE + int64(SIZE_OF_ENTRY)}
-
-        buf := new(bytes.Buffer)
-        err = binary.Write(buf, binary.LittleEndian, &h)
-        check(err)
-
-        header := buf.Bytes()
-
-        // TODO: add hash on the header
-        headerHash := md5.New()
-        headerHash.Write(header)
-        computedHeaderHash := headerHash.Sum(nil)
-
-        // append it to the end of the raw header
-        header = append(header, computedHeaderHash...)
+        // raw header, with its hash appended to the end
+        header := headerToBuf(&h)
 
         // zero bytes
         zeroes := make([]byte, types.HEADER_SIZE - int64(len(header)))
@@ -434,26 +726,28 @@ func CreateDatabaseForUser(username string, configs *types.Config) {
 
         // write header to database file
         _, err = dbFile.WriteAt(header, 0)
-        check(err)
+        if err != nil {
+            dbFile.Close()
+            return err
+        }
 
         for j := 0; j < len(header); j++ {
             parityBuf[j] ^= header[j]
         }
 
-        // put in the the hash for the root node: hash of all zeroes of length entrysize - md5_size
-        hash := md5.New()
-        root := make([]byte, SIZE_OF_ENTRY - types.MD5_SIZE)
-        hash.Write(root)
-        rootHash := hash.Sum(nil)
-        _, err = dbFile.WriteAt(rootHash, types.HEADER_SIZE + int64(SIZE_OF_ENTRY) - types.MD5_SIZE)
-        check(err)
+        // put in the the hash for the root node: hash of all zeroes of length entrysize - hash size
+        hashSize := int64(entryHashSize(&h))
+        root := make([]byte, int64(SIZE_OF_ENTRY) - hashSize)
+        rootHash := entryHash(root, &h)
+        _, err = dbFile.WriteAt(rootHash, types.HEADER_SIZE + int64(SIZE_OF_ENTRY) - hashSize)
+        dbFile.Close()
+        if err != nil {
+            return err
+        }
 
         for j := 0; j < len(rootHash); j++ {
-            parityBuf[types.HEADER_SIZE + int64(SIZE_OF_ENTRY) - types.MD5_SIZE + int64(j)] ^= rootHash[j]
+            parityBuf[types.HEADER_SIZE + int64(SIZE_OF_ENTRY) - hashSize + int64(j)] ^= rootHash[j]
         }
-
-
-        dbFile.Close()
     }
 
     // initialize parity drive as the exclusive OR of the header
@@ -461,11 +755,14 @@ func CreateDatabaseForUser(username string, configs *types.Config) {
     // writing into a database file, check if this will increase its size,
     // and double the size of all the database files if this is true
     dbParityFileName := fmt.Sprintf("%s/%s_p", configs.Dbdisks[len(configs.Dbdisks) - 1], username)
-    dbParityFile, err := os.Create(dbParityFileName); check(err)
-
-    dbParityFile.WriteAt(parityBuf, 0)
+    dbParityFile, err := os.Create(dbParityFileName)
+    if err != nil {
+        return err
+    }
+    defer dbParityFile.Close()
 
-    dbParityFile.Close()
+    _, err = dbParityFile.WriteAt(parityBuf, 0)
+    return err
 }
 
 /*
@@ -476,47 +773,49 @@ func CreateDatabaseForUser(username string, configs *types.Config) {
     doesn't really do anything and when you recover, you just check if all of
     the disks are the same
 */
-func resizeAllDbDisks(username string, configs *types.Config) {
+func resizeAllDbDisks(username string, configs *types.Config) error {
     // add onto the parity file (just append 0s accordingly, b/c
     // exclusive OR of 0s is 0) - NOTE: resizing the parity disk first,
     // because then if resizing is interrupted, the future writes to
     // the regular disks won't cause EOF on the parity disk
     dbParityFilename := fmt.Sprintf("%s/%s_p", configs.Dbdisks[len(configs.Dbdisks) - 1], username)
-        
-    dbParityFile, err := os.OpenFile(dbParityFilename, os.O_RDWR, 0755)
-    check(err)
-
-    // double the size of the file (write zeroes into the file)
-    fileStat, err := dbParityFile.Stat(); check(err);
-    sizeOfDbFile := fileStat.Size(); // in bytes
-
-    buf := make([]byte, types.POINTER_SIZE)
-    _, err = dbParityFile.WriteAt(buf, sizeOfDbFile*2 - types.POINTER_SIZE)
-    check(err)
-
-    dbParityFile.Close()
+    err := doubleDbFile(dbParityFilename)
+    if err != nil {
+        return err
+    }
 
     // resize all of the other disks
     for i := 0; i < len(configs.Dbdisks) - 1; i++ {
         dbFilename := fmt.Sprintf("%s/%s_%d", configs.Dbdisks[i], username, i)
+        err = doubleDbFile(dbFilename)
+        if err != nil {
+            return err
+        }
+    }
 
-        dbFile, err := os.OpenFile(dbFilename, os.O_RDWR, 0755)
-        check(err)
-
-        // double the size of the file (write zeroes into the file)
-        fileStat, err := dbFile.Stat(); check(err);
-        sizeOfDbFile := fileStat.Size(); // in bytes
+    // fmt.Printf("Resized all of the disks\n")
+    return nil
+}
 
-        // can just write a small buffer to the location where we want
-        // and will resize for us
-        buf := make([]byte, types.POINTER_SIZE)
-        _, err = dbFile.WriteAt(buf, sizeOfDbFile*2 - types.POINTER_SIZE)
-        check(err)
+// double the size of the file (write zeroes into the file)
+func doubleDbFile(dbFilename string) error {
+    dbFile, err := os.OpenFile(dbFilename, os.O_RDWR, 0755)
+    if err != nil {
+        return err
+    }
+    defer dbFile.Close()
 
-        dbFile.Close()
+    fileStat, err := dbFile.Stat()
+    if err != nil {
+        return err
     }
+    sizeOfDbFile := fileStat.Size(); // in bytes
 
-    // fmt.Printf("Resized all of the disks\n")
+    // can just write a small buffer to the location where we want
+    // and will resize for us
+    buf := make([]byte, types.POINTER_SIZE)
+    _, err = dbFile.WriteAt(buf, sizeOfDbFile*2 - types.POINTER_SIZE)
+    return err
 }
 
 /*
@@ -532,17 +831,22 @@ func resizeAllDbDisks(username string, configs *types.Config) {
 
 */
 func recoverFromDbDiskFailure(dbFilename string, nodeLocation int64, username string, 
-                            configs *types.Config) {
+                            configs *types.Config) error {
     fmt.Printf("Detected an error in drive: %s, location: %d\n", dbFilename, nodeLocation)
 
-    dataDiskCount := len(configs.Dbdisks) - configs.ParityDiskCount
+    // the database always has a single parity disk (configs.ParityDiskCount
+    // is for user data)
+    dataDiskCount := len(configs.Dbdisks) - 1
 
     /*
         Delete the offending file, and recreate it with the correct data
     */
     os.Remove(dbFilename)
     fixedFile, err := os.OpenFile(dbFilename, os.O_RDWR | os.O_CREATE, 0755)
-    check(err)
+    if err != nil {
+        return err
+    }
+    defer fixedFile.Close()
 
     // read all of the other disks besides this one, and XOR with the parity
     // disk bit by bit and reconstruct the file
@@ -555,18 +859,28 @@ func recoverFromDbDiskFailure(dbFilename string, nodeLocation int64, username st
     parityDriveFileName := fmt.Sprintf("%s/%s_p", configs.Dbdisks[len(configs.Dbdisks) - 1], username) 
 
     parityDriveFile, err := os.Open(parityDriveFileName)
-    check(err)
+    if err != nil {
+        return fmt.Errorf("%w: can't rebuild %s: %v", types.ErrUnrecoverable, dbFilename, err)
+    }
+    defer parityDriveFile.Close()
     
     count := 0
     for i := 0; i < dataDiskCount; i++ {
         tmpName := fmt.Sprintf("%s/%s_%d", configs.Dbdisks[i], username, i)
         if tmpName != dbFilename {
-            otherDriveFiles[count], err = os.Open(tmpName); check(err)
+            otherDriveFiles[count], err = os.Open(tmpName)
+            if err != nil {
+                return fmt.Errorf("%w: can't rebuild %s: %v", types.ErrUnrecoverable, dbFilename, err)
+            }
+            defer otherDriveFiles[count].Close()
             count++
         }
     }
 
-    fileStat, err := parityDriveFile.Stat(); check(err);
+    fileStat, err := parityDriveFile.Stat()
+    if err != nil {
+        return err
+    }
     size := fileStat.Size(); // in bytes
     // fmt.Printf("\n\n\n\nSize: %d\n\n\n\n", size)
 
@@ -587,14 +901,18 @@ func recoverFromDbDiskFailure(dbFilename string, nodeLocation int64, username st
 
         // true parity strip
         _, err = parityDriveFile.ReadAt(trueParityStrip, currentLocation)
-        check(err)
+        if err != nil {
+            return fmt.Errorf("%w: can't rebuild %s: %v", types.ErrUnrecoverable, dbFilename, err)
+        }
 
         // compute the missing piece by XORing all of the other strips
         for i := 0; i < len(otherDriveFiles); i++ {
             file := otherDriveFiles[i]
 
             _, err = file.ReadAt(buf, currentLocation)
-            check(err)
+            if err != nil {
+                return fmt.Errorf("%w: can't rebuild %s: %v", types.ErrUnrecoverable, dbFilename, err)
+            }
 
             for j := 0; j < len(trueParityStrip); j++ {
                 trueParityStrip[j] ^= buf[j]
@@ -603,30 +921,156 @@ func recoverFromDbDiskFailure(dbFilename string, nodeLocation int64, username st
 
         // write missing piece into the fixed file
         _, err = fixedFile.WriteAt(trueParityStrip, currentLocation)
-        check(err)
+        if err != nil {
+            return err
+        }
 
         // update location
         currentLocation += int64(len(trueParityStrip))
     }
 
-    for i := 0; i < len(otherDriveFiles); i++ {
-        otherDriveFiles[i].Close()
+    return nil
+}
+
+/*
+    Database file of a user that is open for reading (the header is already
+    read). Whenever something read from it doesn't match its hash, the file is
+    rebuilt from the other database disks, and read again.
+*/
+type dbHandle struct {
+    file *os.File
+    filename string
+    username string
+    configs *types.Config
+    header Header
+}
+
+func openDb(dbFilename string, username string, configs *types.Config) (*dbHandle, error) {
+    d := &dbHandle{filename: dbFilename, username: username, configs: configs}
+    var err error
+    d.file, err = os.OpenFile(dbFilename, os.O_RDWR, 0755)
+    if err != nil {
+        return nil, err
+    }
+
+    d.header, err = getHeader(d.file)
+    for retries := 0; err != nil && retries != types.RETRY_COUNT; retries++ { // error in computed hash
+        err = d.recover(0)
+        if err != nil {
+            break
+        }
+
+        d.header, err = getHeader(d.file)
+    }
+    if err != nil {
+        d.close()
+        return nil, err
     }
-    parityDriveFile.Close()
-    fixedFile.Close()
+
+    return d, nil
+}
+
+// rebuild the file from the other disks, and reopen it
+func (d *dbHandle) recover(location int64) error {
+    // close the file first, since recover will delete it
+    d.close()
+
+    err := recoverFromDbDiskFailure(d.filename, location, d.username, d.configs)
+    if err != nil {
+        return err
+    }
+
+    d.file, err = os.OpenFile(d.filename, os.O_RDWR, 0755)
+    return err
+}
+
+func (d *dbHandle) close() {
+    if d.file != nil {
+        d.file.Close()
+        d.file = nil
+    }
+}
+
+/*
+    Read the entry at location (checked with valid), recovering the file when
+    it can't be read or is not valid, types.ErrCorrupt if it never is
+*/
+func (d *dbHandle) readVerified(location int64, valid func(buf []byte) bool) ([]byte, error) {
+    buf := make([]byte, entrySize(&d.header))
+    _, err := d.file.ReadAt(buf, location)
+    for retries := 0; (err != nil || !valid(buf)) && retries != types.RETRY_COUNT; retries++ {
+        err = d.recover(location)
+        if err != nil {
+            return nil, err
+        }
+
+        _, err = d.file.ReadAt(buf, location)
+    }
+    if err != nil || !valid(buf) {
+        return nil, fmt.Errorf("%w: entry at %d of %s can't be read or rebuilt", types.ErrCorrupt,
+                               location, d.filename)
+    }
+
+    return buf, nil
+}
+
+// read the tree entry at location, along with its raw bytes
+func (d *dbHandle) readEntry(location int64) (*types.TreeEntry, []byte, error) {
+    var entry *types.TreeEntry = nil
+    buf, err := d.readVerified(location, func(buf []byte) bool {
+        entry = bufferToEntry(buf, &d.header, d.configs)
+        return entry != nil
+    })
+    if err != nil {
+        return nil, nil, err
+    }
+
+    return entry, buf, nil
+}
+
+// read the entry in the free list at location
+func (d *dbHandle) readFreeListEntry(location int64) ([]byte, error) {
+    return d.readVerified(location, func(buf []byte) bool {
+        return verifyFreeListEntry(buf, &d.header) != nil
+    })
 }
 
 /*
     dbdisklocations = the disks that the file is spread out across
     padding file = second to last, parity file = last
 
-    TODO: make this use the config object
+    The file is recorded with the default layout in the configs, see
+    AddFileEntryToDatabase
 */
 func AddFileSpecsToDatabase(filename string, username string, diskLocations []string,
-                            configs *types.Config) {
+                            configs *types.Config) error {
+    entry := &types.TreeEntry{Filename: filename, Disks: diskLocations,
+                              Layout: types.DefaultLayout(len(diskLocations), configs)}
+    return AddFileEntryToDatabase(entry, username, configs)
+}
+
+/*
+    Add (or update) the entry for a file, including the layout it was saved
+    with, so that it can be rebuilt later (entry.Left and entry.Right are
+    ignored, those are managed by the tree)
+*/
+func AddFileEntryToDatabase(entry *types.TreeEntry, username string, configs *types.Config) error {
+    filename := entry.Filename
+    err := checkKey(filename)
+    if err != nil {
+        return err
+    }
+
     if !pathExists(configs.Dbdisks[0] + "/" + username + "_0") { // check if at least one disk exists
         // InitializeDatabaseStructure(LOCALHOST, nil)
-        CreateDatabaseForUser(username, configs)
+        err = CheckUsername(username) // a new user, the name comes from outside
+        if err != nil {
+            return err
+        }
+        err = CreateDatabaseForUser(username, configs)
+        if err != nil {
+            return err
+        }
     }
 
     /*
@@ -651,60 +1095,43 @@ func AddFileSpecsToDatabase(filename string, username string, diskLocations []st
     dbParityFilename := getParityFilename(username, filename, configs)
 
     /*
-        Begin transaction
+        Begin transaction (dropped if anything fails before it is committed)
     */
     t := transaction.New(dbFilenames, dbParityFilename, configs)
+    defer transaction.Abort(t)
 
     // read in the database file and get root of the tree
-    dbFile, err := os.OpenFile(dbFilename, os.O_RDWR, 0755)
-    check(err)
-    fileStat, err := dbFile.Stat(); check(err);
-    sizeOfDbFile := fileStat.Size(); // in bytes
-
-    header, errCode := getHeader(dbFile)
-    retries := 0
-    for errCode != 0 && retries != types.RETRY_COUNT { // error in computed hash
-        dbFile.Close()
-
-        recoverFromDbDiskFailure(dbFilename, 0, username, configs)
-
-        // reopen the database file
-        dbFile, err = os.OpenFile(dbFilename, os.O_RDWR, 0755)
-        check(err)
-
-        header, errCode = getHeader(dbFile)
-
-        retries++
+    db, err := openDb(dbFilename, username, configs)
+    if err != nil {
+        return err
     }
+    defer db.close()
+    header := db.header
     oldHeader := header
 
-    var SIZE_OF_ENTRY int16 = header.FileNameSize + 2*(types.POINTER_SIZE) + int16(header.DiskCount + 1) * int16(header.DiskNameSize) + types.MD5_SIZE
+    fileStat, err := db.file.Stat()
+    if err != nil {
+        return err
+    }
+    sizeOfDbFile := fileStat.Size(); // in bytes
+
+    SIZE_OF_ENTRY := entrySize(&header)
+    t.SizeOfEntry = SIZE_OF_ENTRY
 
     /*
         Tree entry: 
         [256 bytes for file name] [pointer to left child] 
         [pointer to right child] [list of disks, each 1H28 bytes]
+        [metadata, 128 bytes (not in legacy databases)] [hash]
     */
 
-    // entry we want to insert
-    targetNode := make([]byte, SIZE_OF_ENTRY)
-    for i := 0; i < len(filename); i++ {
-        targetNode[i] = filename[i]
-    }
-    // copy in the file locations
-    for i := 0; i < len(diskLocations); i++ {
-        diskName := diskLocations[i]
-        for j := 0; j < len(diskName); j++ {
-            offset := int(header.FileNameSize) + 2 * types.POINTER_SIZE + i * int(header.DiskNameSize)
-            targetNode[offset + j] = diskName[j]
-        }
-    }
-    // write the hash into the end of the entry
-    h := md5.New()
-    h.Write(targetNode[0:SIZE_OF_ENTRY - types.MD5_SIZE])        
-    targetNodeHash := h.Sum(nil)
-    for i := int64(0); i < types.MD5_SIZE; i++ {
-        targetNode[int64(SIZE_OF_ENTRY) - types.MD5_SIZE + i] = targetNodeHash[i]
+    // entry we want to insert (new entries are leaves)
+    newNode := types.TreeEntry{Filename: filename, Disks: entry.Disks, Layout: entry.Layout,
+                               Version: entry.Version, Saved: entry.Saved, Policy: entry.Policy,
+                               Stat: entry.Stat}
+    targetNode, err := entryToBuf(&newNode, &header)
+    if err != nil {
+        return err
     }
 
     /*
@@ -719,36 +1146,18 @@ func AddFileSpecsToDatabase(filename string, username string, diskLocations []st
 
     foundInsertionPoint := false
     left := false
-    entryBuf := make([]byte, SIZE_OF_ENTRY)
+    var entryBuf []byte
     for !foundInsertionPoint {
-        // read in the current node
-        _, err = dbFile.ReadAt(entryBuf, currentNodeLocation)
-        check(err)
-        currentNode := bufferToEntry(entryBuf, &header, configs)
-
         /*
-            Check if the currentNode had an error in reading (hash was
+            read in the current node (if it had an error in reading (hash was
             incorrect) -> fix this disk and re-write this entry to the location
-            where it was supposed to be
+            where it was supposed to be)
         */
-        retries := 0
-        for currentNode == nil && retries != types.RETRY_COUNT {
-            dbFile.Close()
-
-            recoverFromDbDiskFailure(dbFilename, currentNodeLocation, username, configs)
-
-            // reopen the database file
-            dbFile, err = os.OpenFile(dbFilename, os.O_RDWR, 0755)
-            check(err)
-
-            // get the currentNode again
-            _, err = dbFile.ReadAt(entryBuf, currentNodeLocation)
-            check(err)
-
-            currentNode = bufferToEntry(entryBuf, &header, configs)
-
-            retries++
+        currentNode, buf, err := db.readEntry(currentNodeLocation)
+        if err != nil {
+            return err
         }
+        entryBuf = buf
 
         // go left if < (if equals, doesn't make sense to keep going)
         if filename < currentNode.Filename {
@@ -762,24 +1171,26 @@ func AddFileSpecsToDatabase(filename string, username string, diskLocations []st
             }
         } else if filename == currentNode.Filename {
             // entry already exists, likely just updating it
-            // can handle this later
 
-            // TODO: handle the case when saving the file again, just update
-            // the current entry and that's it
+            // keep the links to the children of the current entry
+            newNode.Left = currentNode.Left
+            newNode.Right = currentNode.Right
+            targetNode, err = entryToBuf(&newNode, &header)
+            if err != nil {
+                return err
+            }
 
             // copy in the actual entry now
-            errCode = transaction.AddAction(t, entryBuf, targetNode, currentNodeLocation)
-            transaction.HandleActionError(errCode)
+            err = transaction.AddAction(t, entryBuf, targetNode, currentNodeLocation)
+            if err != nil {
+                return err
+            }
 
-            dbFile.Close()
-            transaction.Commit(t)
+            db.close()
 
             // fmt.Printf("Updated entry for %s\n", filename)
 
-            return
-
-            // foundInsertionPoint = true
-
+            return transaction.Commit(t)
         } else { // go right if >
             if currentNode.Right == 0 {
                 foundInsertionPoint = true
@@ -789,10 +1200,6 @@ func AddFileSpecsToDatabase(filename string, username string, diskLocations []st
                 currentNodeLocation = currentNode.Right
             }
         }
-
-        if !foundInsertionPoint {
-            entryBuf = make([]byte, SIZE_OF_ENTRY)
-        }
     }
 
     /*
@@ -807,29 +1214,33 @@ func AddFileSpecsToDatabase(filename string, username string, diskLocations []st
     // disk, if not then extend it after you replay the log
     for (header.TrueDbSize + int64(SIZE_OF_ENTRY)) > sizeOfDbFile {
         // TODO: not sure if need to add resizing to transaction
-        resizeAllDbDisks(username, configs)
+        err = resizeAllDbDisks(username, configs)
+        if err != nil {
+            return err
+        }
 
-        fileStat, err := dbFile.Stat(); check(err);
+        fileStat, err := db.file.Stat()
+        if err != nil {
+            return err
+        }
         sizeOfDbFile = fileStat.Size(); // in bytes
     }
 
     /*
         Make the parent node point to this new entry
     */
-    binaryBuffer := new(bytes.Buffer)
-    err = binary.Write(binaryBuffer, binary.LittleEndian, &header.FreeList)
-    check(err)
-
     offsetToPointer := int(header.FileNameSize)
     if !left { // determine which pointer to set it as based on loop
         offsetToPointer += types.POINTER_SIZE
     }
 
-    newParentLink := binaryBuffer.Bytes()
-    newEntry := modifyEntry(entryBuf, newParentLink, offsetToPointer)
+    newParentLink := pointerToBuf(header.FreeList)
+    newEntry := modifyEntry(entryBuf, newParentLink, offsetToPointer, &header)
 
-    errCode = transaction.AddAction(t, entryBuf, newEntry, currentNodeLocation)
-    transaction.HandleActionError(errCode)
+    err = transaction.AddAction(t, entryBuf, newEntry, currentNodeLocation)
+    if err != nil {
+        return err
+    }
 
     // update the true size of the database (we are going to enter a new entry)
     header.TrueDbSize += int64(SIZE_OF_ENTRY)
@@ -837,40 +1248,20 @@ func AddFileSpecsToDatabase(filename string, username string, diskLocations []st
     // update free list to point to next entry in it
     // pointer to next in free list = first 8 bytes in the
     // entry in free list, if all 0s, then end of free list
-    insertionPointBuf := make([]byte, SIZE_OF_ENTRY) //types.POINTER_SIZE
-    _, err = dbFile.ReadAt(insertionPointBuf, header.FreeList)
-    check(err)
-
-    // don't verify the pointer if it is to the end of the file (no entry
-    // there to check)
+    var insertionPointBuf []byte
     if header.FreeList != (header.TrueDbSize - int64(SIZE_OF_ENTRY)) {
-        freeListEntry := verifyFreeListEntry(insertionPointBuf)
-        retries := 0
-        for freeListEntry == nil && retries != types.RETRY_COUNT {
-            dbFile.Close()
-
-            recoverFromDbDiskFailure(dbFilename, header.FreeList, username, configs)
-
-            // reopen the database file
-            dbFile, err = os.OpenFile(dbFilename, os.O_RDWR, 0755)
-            check(err)
-
-            // get the currentNode again
-            insertionPointBuf := make([]byte, SIZE_OF_ENTRY)
-            _, err = dbFile.ReadAt(insertionPointBuf, header.FreeList)
-            check(err)
-
-            freeListEntry = verifyFreeListEntry(insertionPointBuf)
-
-            retries++
-        }
+        insertionPointBuf, err = db.readFreeListEntry(header.FreeList)
+    } else {
+        // don't verify the pointer if it is to the end of the file (no entry
+        // there to check)
+        insertionPointBuf = make([]byte, SIZE_OF_ENTRY)
+        _, err = db.file.ReadAt(insertionPointBuf, header.FreeList)
+    }
+    if err != nil {
+        return err
     }
 
-    // check(err)
-    var pointer int64 = 0
-    bufferReader := bytes.NewReader(insertionPointBuf[0:types.POINTER_SIZE])
-    err = binary.Read(bufferReader, binary.LittleEndian, &pointer)
-    check(err)
+    pointer := bufToPointer(insertionPointBuf)
 
     insertionPoint := header.FreeList
     if pointer == 0 {
@@ -881,71 +1272,45 @@ func AddFileSpecsToDatabase(filename string, username string, diskLocations []st
     }
 
     // copy in the actual entry now
-    errCode = transaction.AddAction(t, insertionPointBuf, targetNode, insertionPoint)
-    transaction.HandleActionError(errCode)
-
-    // push any updates to header
-    binaryBuffer = new(bytes.Buffer)
-    err = binary.Write(binaryBuffer, binary.LittleEndian, &header)
-    check(err)
-
-    // add the new hash of the header** TODO
-
-    newHeaderBuf := binaryBuffer.Bytes() // get new header
-
-    binaryBuffer = new(bytes.Buffer)
-    err = binary.Write(binaryBuffer, binary.LittleEndian, &oldHeader); check(err)
-    oldHeaderBuf := binaryBuffer.Bytes()
-    errCode = transaction.AddAction(t, oldHeaderBuf, newHeaderBuf, 0)
-    transaction.HandleActionError(errCode)
-
-    // update the hash of the header
-    oldHash := md5.New()
-    oldHash.Write(oldHeaderBuf)
-    computedOldHash := oldHash.Sum(nil)
-
-    newHash := md5.New()
-    newHash.Write(newHeaderBuf)
-    computedNewHash := newHash.Sum(nil)
+    err = transaction.AddAction(t, insertionPointBuf, targetNode, insertionPoint)
+    if err != nil {
+        return err
+    }
 
-    errCode = transaction.AddAction(t, computedOldHash, computedNewHash, int64(len(newHeaderBuf)))
-    transaction.HandleActionError(errCode)
+    // push any updates to header (along with the new hash of the header)
+    newHeaderBuf := headerToBuf(&header)
+    oldHeaderBuf := headerToBuf(&oldHeader)
+    err = transaction.AddAction(t, oldHeaderBuf, newHeaderBuf, 0)
+    if err != nil {
+        return err
+    }
 
-    dbFile.Close()
-    transaction.Commit(t)
+    db.close()
 
     // fmt.Printf("Successfully added filename: %s to the database\n", filename)
+    return transaction.Commit(t)
 }
 
 
 // here, storageType is in reference to where the database is stored
-func GetFileEntry(filename string, username string, configs *types.Config) (*types.TreeEntry) {
+// types.ErrNotFound if the user has no database, or the file is not in it
+func GetFileEntry(filename string, username string, configs *types.Config) (*types.TreeEntry, error) {
+    err := checkKey(filename)
+    if err != nil {
+        return nil, err
+    }
     if !pathExists(configs.Dbdisks[0] + "/" + username + "_0") {
-        return nil
+        return nil, fmt.Errorf("%w: user %s has no database", types.ErrNotFound, username)
     }
 
     dbFilename := getDbFilenameForFile(filename, username, configs)
 
     // read in the database file and get root of the tree
-    dbFile, err := os.OpenFile(dbFilename, os.O_RDWR, 0755)
-    check(err)
-
-    header, errCode := getHeader(dbFile)
-    retries := 0
-    for errCode != 0 && retries != types.RETRY_COUNT { // error in computed hash
-        dbFile.Close()
-
-        recoverFromDbDiskFailure(dbFilename, 0, username, configs)
-
-        // reopen the database file
-        dbFile, err = os.OpenFile(dbFilename, os.O_RDWR, 0755)
-        check(err)
-
-        header, errCode = getHeader(dbFile)
-
-        retries++
+    db, err := openDb(dbFilename, username, configs)
+    if err != nil {
+        return nil, err
     }
-    var SIZE_OF_ENTRY int16 = header.FileNameSize + 2*(types.POINTER_SIZE) + int16(header.DiskCount + 1) * int16(header.DiskNameSize) + types.MD5_SIZE
+    defer db.close()
 
     /*
         Traverse the tree until you find a spot that you can insert the
@@ -955,41 +1320,20 @@ func GetFileEntry(filename string, username string, configs *types.Config) (*typ
     */
 
     // Start at root
-    currentNodeLocation := header.RootPointer
+    currentNodeLocation := db.header.RootPointer
 
     foundFileOrLeaf := false
     foundFile := false
     var currentNode *types.TreeEntry = nil
     for !foundFileOrLeaf {
-        // read in the current node
-        buf := make([]byte, SIZE_OF_ENTRY)
-        _, err = dbFile.ReadAt(buf, currentNodeLocation)
-        check(err)
-
-        currentNode = bufferToEntry(buf, &header, configs)
         /*
-            Check if the currentNode had an error in reading (hash was
+            read in the current node (if it had an error in reading (hash was
             incorrect) -> fix this disk and re-write this entry to the location
-            where it was supposed to be
+            where it was supposed to be)
         */
-        retries := 0
-        for currentNode == nil && retries != types.RETRY_COUNT {
-            dbFile.Close() // close the file first, since recover will delete it**
-
-            recoverFromDbDiskFailure(dbFilename, currentNodeLocation, username, configs)
-
-            // reopen the database file
-            dbFile, err = os.OpenFile(dbFilename, os.O_RDWR, 0755)
-            check(err)
-
-            // get the currentNode again
-            buf := make([]byte, SIZE_OF_ENTRY)
-            _, err = dbFile.ReadAt(buf, currentNodeLocation)
-            check(err)
-
-            currentNode = bufferToEntry(buf, &header, configs)
-
-            retries++
+        currentNode, _, err = db.readEntry(currentNodeLocation)
+        if err != nil {
+            return nil, err
         }
 
         // go left if < (if equals, doesn't make sense to keep going)
@@ -1012,23 +1356,265 @@ func GetFileEntry(filename string, username string, configs *types.Config) (*typ
         }
     }
 
-    dbFile.Close()
+    if !foundFile {
+        return nil, fmt.Errorf("%w: %s of user %s", types.ErrNotFound, filename, username)
+    }
 
-    if foundFile {
-        // fmt.Printf("Successfully got the file\n")
-        return currentNode
-    } else {
-        return nil
+    // fmt.Printf("Successfully got the file\n")
+    return currentNode, nil
+}
+
+/*
+    All of the entries of the user, in order of their filenames (the files
+    are split across the database disks, every one of them is read), without
+    the past versions of the files
+*/
+func ListFileEntries(username string, configs *types.Config) ([]*types.TreeEntry, error) {
+    entries, err := ListFileEntriesWithVersions(username, configs)
+    if err != nil {
+        return nil, err
+    }
+
+    current := entries[:0]
+    for _, entry := range entries {
+        if _, _, isVersion := ParseVersionKey(entry.Filename); !isVersion {
+            current = append(current, entry)
+        }
     }
+    return current, nil
 }
 
 /*
-    Fix the tree first, and then add that spot into the free list, return
-    errorcode (0 = success, 1 = did not find file)
+    Same as ListFileEntries, along with the entries of the past versions of
+    the files (named after their keys, see VersionKey), each one right after
+    the current entry of its file
 */
-func DeleteFileEntry(filename string, username string, configs *types.Config) *types.TreeEntry {
+func ListFileEntriesWithVersions(username string, configs *types.Config) ([]*types.TreeEntry, error) {
     if !pathExists(configs.Dbdisks[0] + "/" + username + "_0") {
-        return nil
+        return nil, fmt.Errorf("%w: user %s has no database", types.ErrNotFound, username)
+    }
+
+    var entries []*types.TreeEntry
+    for i := 0; i < len(configs.Dbdisks) - 1; i++ {
+        dbFilename := fmt.Sprintf("%s/%s_%d", configs.Dbdisks[i], username, i)
+        db, err := openDb(dbFilename, username, configs)
+        if err != nil {
+            return nil, err
+        }
+
+        // the root is an empty entry, only its subtree is listed
+        root, _, err := db.readEntry(db.header.RootPointer)
+        if err == nil {
+            entries, err = db.appendSubtree(entries, root.Left)
+        }
+        if err == nil {
+            entries, err = db.appendSubtree(entries, root.Right)
+        }
+        db.close()
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    // every disk holds a range of the filenames, in the order of the disks
+    sort.Slice(entries, func(i int, j int) bool {
+        return entries[i].Filename < entries[j].Filename
+    })
+
+    return entries, nil
+}
+
+// append the entries of the subtree at location to entries, in order
+func (d *dbHandle) appendSubtree(entries []*types.TreeEntry,
+                                 location int64) ([]*types.TreeEntry, error) {
+    if location == 0 {
+        return entries, nil
+    }
+
+    entry, _, err := d.readEntry(location)
+    if err != nil {
+        return nil, err
+    }
+
+    entries, err = d.appendSubtree(entries, entry.Left)
+    if err != nil {
+        return nil, err
+    }
+    entries = append(entries, entry)
+    return d.appendSubtree(entries, entry.Right)
+}
+
+/*
+    Key that a past version of the file is kept under in the database, it
+    starts with the filename so that it is on the same database disk
+*/
+func VersionKey(filename string, version int) string {
+    return filename + types.VERSION_SEPARATOR + strconv.Itoa(version)
+}
+
+// filename and version of a key made by VersionKey, ok is false for any other key
+func ParseVersionKey(key string) (filename string, version int, ok bool) {
+    separator := strings.LastIndex(key, types.VERSION_SEPARATOR)
+    if separator < 0 {
+        return "", 0, false
+    }
+    version, err := strconv.Atoi(key[separator + 1:])
+    if err != nil {
+        return "", 0, false
+    }
+    return key[0:separator], version, true
+}
+
+/*
+    The entries of the past versions of the file (named after their keys, see
+    VersionKey), oldest first. The versions that are kept always come right
+    before the current one, older ones are only ever pruned from the start.
+*/
+func ListFileVersions(filename string, username string,
+                      configs *types.Config) ([]*types.TreeEntry, error) {
+    current, err := GetFileEntry(filename, username, configs)
+    if err != nil {
+        return nil, err
+    }
+
+    var versions []*types.TreeEntry
+    for version := current.Version - 1; version >= 0; version-- {
+        entry, err := GetFileEntry(VersionKey(filename, version), username, configs)
+        if errors.Is(err, types.ErrNotFound) || errors.Is(err, types.ErrNameTooLong) {
+            break
+        } else if err != nil {
+            return nil, err
+        }
+        versions = append(versions, entry)
+    }
+
+    // oldest first
+    for i, j := 0, len(versions) - 1; i < j; i, j = i + 1, j - 1 {
+        versions[i], versions[j] = versions[j], versions[i]
+    }
+    return versions, nil
+}
+
+/*
+    Users that have a database (named after the database files on the first
+    database disk), in order
+*/
+func ListUsers(configs *types.Config) ([]string, error) {
+    files, err := ioutil.ReadDir(configs.Dbdisks[0])
+    if err != nil {
+        return nil, err
+    }
+
+    var usernames []string
+    for _, file := range files {
+        if !file.IsDir() && strings.HasSuffix(file.Name(), "_0") {
+            usernames = append(usernames, strings.TrimSuffix(file.Name(), "_0"))
+        }
+    }
+    sort.Strings(usernames)
+
+    return usernames, nil
+}
+
+// database files of the user, the parity file last
+func dbFilesForUser(username string, configs *types.Config) []string {
+    var dbFiles []string
+    for i := 0; i < len(configs.Dbdisks) - 1; i++ {
+        dbFiles = append(dbFiles, fmt.Sprintf("%s/%s_%d", configs.Dbdisks[i], username, i))
+    }
+    return append(dbFiles, fmt.Sprintf("%s/%s_p", configs.Dbdisks[len(configs.Dbdisks) - 1],
+                                       username))
+}
+
+/*
+    Recreate the database of the user with room for the disk counts in the
+    configs, if it was created with less (entries can't hold more disks than
+    the header of the database says). All of the entries are kept. The old
+    database files stay next to the new ones (with a ".old" suffix) until
+    every entry is in the new database, an interrupted resize is undone the
+    next time this runs.
+*/
+func ResizeDatabaseForUser(username string, configs *types.Config) error {
+    dbFiles := dbFilesForUser(username, configs)
+
+    // put back the database of a resize that didn't finish
+    if pathExists(dbFiles[0] + ".old") {
+        err := restoreDbFiles(dbFiles)
+        if err != nil {
+            return err
+        }
+    }
+
+    db, err := openDb(dbFiles[0], username, configs)
+    if err != nil {
+        return err
+    }
+    header := db.header
+    db.close()
+
+    parityDiskCount := configs.ParityDiskCount
+    if parityDiskCount < 1 {
+        parityDiskCount = 1
+    }
+    if int(header.DiskCount) >= configs.DataDiskCount &&
+       int(header.ParityDiskCount) >= parityDiskCount {
+        return nil // already has room
+    }
+
+    entries, err := ListFileEntries(username, configs)
+    if err != nil {
+        return err
+    }
+
+    for _, dbFile := range dbFiles {
+        err = os.Rename(dbFile, dbFile + ".old")
+        if err != nil {
+            restoreDbFiles(dbFiles)
+            return err
+        }
+    }
+
+    err = CreateDatabaseForUser(username, configs)
+    for i := 0; err == nil && i < len(entries); i++ {
+        err = AddFileEntryToDatabase(entries[i], username, configs)
+    }
+    if err != nil {
+        restoreDbFiles(dbFiles)
+        return fmt.Errorf("can't resize the database of %s: %v", username, err)
+    }
+
+    for _, dbFile := range dbFiles {
+        os.Remove(dbFile + ".old")
+    }
+
+    return nil
+}
+
+// replace the database files with the ".old" ones that were kept by a resize
+func restoreDbFiles(dbFiles []string) error {
+    for _, dbFile := range dbFiles {
+        if !pathExists(dbFile + ".old") {
+            continue
+        }
+        err := os.Rename(dbFile + ".old", dbFile)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/*
+    Fix the tree first, and then add that spot into the free list, returns the
+    entry that was deleted (types.ErrNotFound if the file is not there)
+*/
+func DeleteFileEntry(filename string, username string, configs *types.Config) (*types.TreeEntry, error) {
+    err := checkKey(filename)
+    if err != nil {
+        return nil, err
+    }
+    if !pathExists(configs.Dbdisks[0] + "/" + username + "_0") {
+        return nil, fmt.Errorf("%w: user %s has no database", types.ErrNotFound, username)
     }
 
     dbFilenames := getDbFilenames(username, filename, configs)
@@ -1036,30 +1622,18 @@ func DeleteFileEntry(filename string, username string, configs *types.Config) *t
     dbParityFilename := getParityFilename(username, filename, configs)
 
     /*
-        Begin transaction
+        Begin transaction (dropped if anything fails before it is committed)
     */
     t := transaction.New(dbFilenames, dbParityFilename, configs)
+    defer transaction.Abort(t)
 
     // read in the database file and get root of the tree
-    dbFile, err := os.OpenFile(dbFilename, os.O_RDWR, 0755)
-    check(err)
-
-    header, errCode := getHeader(dbFile)
-    retries := 0
-    for errCode != 0 && retries != types.RETRY_COUNT { // error in computed hash
-        dbFile.Close()
-
-        recoverFromDbDiskFailure(dbFilename, 0, username, configs)
-
-        // reopen the database file
-        dbFile, err = os.OpenFile(dbFilename, os.O_RDWR, 0755)
-        check(err)
-
-        // get the header again
-        header, errCode = getHeader(dbFile)
-
-        retries++
+    db, err := openDb(dbFilename, username, configs)
+    if err != nil {
+        return nil, err
     }
+    defer db.close()
+    header := db.header
     oldHeader := header
 
     // Start at root
@@ -1067,40 +1641,23 @@ func DeleteFileEntry(filename string, username string, configs *types.Config) *t
     // currentNode := types.TreeEntry{"", 0, 0, nil}
     var currentNode *types.TreeEntry = nil
     var parentNodeLocation int64 = 0
-    var SIZE_OF_ENTRY int16 = header.FileNameSize + 2*(types.POINTER_SIZE) + int16(header.DiskCount + 1) * int16(header.DiskNameSize) + types.MD5_SIZE
+    SIZE_OF_ENTRY := entrySize(&header)
+    t.SizeOfEntry = SIZE_OF_ENTRY
 
     foundFileOrLeaf := false
     foundFile := false
     rightChild := false
-    currentNodeBuf := make([]byte, SIZE_OF_ENTRY)
+    var currentNodeBuf []byte = nil
     var parentNodeBuf []byte = nil
     for !foundFileOrLeaf {
-        // read in the current node
-        _, err = dbFile.ReadAt(currentNodeBuf, currentNodeLocation)
-        check(err)
-
-        currentNode = bufferToEntry(currentNodeBuf, &header, configs)
         /*
-            Check if the currentNode had an error in reading (hash was
+            read in the current node (if it had an error in reading (hash was
             incorrect) -> fix this disk and re-write this entry to the location
-            where it was supposed to be
+            where it was supposed to be)
         */
-        retries := 0
-        for currentNode == nil && retries != types.RETRY_COUNT {
-            dbFile.Close()
-
-            recoverFromDbDiskFailure(dbFilename, currentNodeLocation, username, configs)
-
-            // reopen the database file
-            dbFile, err = os.OpenFile(dbFilename, os.O_RDWR, 0755)
-            check(err)
-
-            // get the currentNode again
-            _, err = dbFile.ReadAt(currentNodeBuf, currentNodeLocation)
-            check(err)
-
-            currentNode = bufferToEntry(currentNodeBuf, &header, configs)
-            retries++
+        currentNode, currentNodeBuf, err = db.readEntry(currentNodeLocation)
+        if err != nil {
+            return nil, err
         }
 
         // go left if < (if equals, doesn't make sense to keep going)
@@ -1128,14 +1685,12 @@ func DeleteFileEntry(filename string, username string, configs *types.Config) *t
 
         if !foundFile {
             parentNodeBuf = currentNodeBuf
-            currentNodeBuf = make([]byte, SIZE_OF_ENTRY)
         }
     }
 
     if !foundFile {
         // fmt.Printf("Did not find the file %s\n", filename)
-        dbFile.Close()
-        return nil
+        return nil, fmt.Errorf("%w: %s of user %s", types.ErrNotFound, filename, username)
     }
     
     /*
@@ -1146,41 +1701,16 @@ func DeleteFileEntry(filename string, username string, configs *types.Config) *t
     */
 
     zeroBuf := make([]byte, SIZE_OF_ENTRY)
-    p := new(bytes.Buffer)
-    err = binary.Write(p, binary.LittleEndian, &header.FreeList)
-    check(err)
-    freeListPointer := p.Bytes()
-
-    newEntry := modifyEntry(zeroBuf, freeListPointer, 0)
-    oldEntryBuf := make([]byte, SIZE_OF_ENTRY)
-    _, err = dbFile.ReadAt(oldEntryBuf, currentNodeLocation)
-    check(err)
-
-    // do this just for the hash check
-    oldEntry := bufferToEntry(oldEntryBuf, &header, configs)
-    retries = 0
-    for oldEntry == nil && retries != types.RETRY_COUNT {
-        dbFile.Close()
-
-        recoverFromDbDiskFailure(dbFilename, currentNodeLocation, username, configs)
-
-        // reopen the database file
-        dbFile, err = os.OpenFile(dbFilename, os.O_RDWR, 0755)
-        check(err)
+    freeListPointer := pointerToBuf(header.FreeList)
 
-        // get the currentNode again
-        oldEntryBuf = make([]byte, SIZE_OF_ENTRY)
-        _, err = dbFile.ReadAt(oldEntryBuf, currentNodeLocation)
-        check(err)
+    newEntry := modifyEntry(zeroBuf, freeListPointer, 0, &header)
+    oldEntryBuf := currentNodeBuf
 
-        oldEntry = bufferToEntry(oldEntryBuf, &header, configs)
-
-        retries++
+    err = transaction.AddAction(t, oldEntryBuf, newEntry, currentNodeLocation)
+    if err != nil {
+        return nil, err
     }
 
-    errCode = transaction.AddAction(t, oldEntryBuf, newEntry, currentNodeLocation)
-    transaction.HandleActionError(errCode)
-
     // update free list to point here now, since freed up memory
     header.FreeList = currentNodeLocation
 
@@ -1202,10 +1732,12 @@ func DeleteFileEntry(filename string, username string, configs *types.Config) *t
         // remove from parent node's children
         buf := make([]byte, types.POINTER_SIZE)
 
-        newEntry := modifyEntry(parentNodeBuf, buf, offsetInParent)
+        newEntry := modifyEntry(parentNodeBuf, buf, offsetInParent, &header)
 
-        errCode = transaction.AddAction(t, parentNodeBuf, newEntry, parentNodeLocation)
-        transaction.HandleActionError(errCode)
+        err = transaction.AddAction(t, parentNodeBuf, newEntry, parentNodeLocation)
+        if err != nil {
+            return nil, err
+        }
 
     } else if currentNode.Left == 0 || currentNode.Right == 0 {
         childLocation := currentNode.Left
@@ -1213,15 +1745,13 @@ func DeleteFileEntry(filename string, username string, configs *types.Config) *t
             childLocation = currentNode.Right
         }
 
-        buf := new(bytes.Buffer)
-        err = binary.Write(buf, binary.LittleEndian, &childLocation)
-        check(err)
-
-        newPointer := buf.Bytes()
-        newEntry := modifyEntry(parentNodeBuf, newPointer, offsetInParent)
+        newPointer := pointerToBuf(childLocation)
+        newEntry := modifyEntry(parentNodeBuf, newPointer, offsetInParent, &header)
 
-        errCode = transaction.AddAction(t, parentNodeBuf, newEntry, parentNodeLocation)
-        transaction.HandleActionError(errCode)
+        err = transaction.AddAction(t, parentNodeBuf, newEntry, parentNodeLocation)
+        if err != nil {
+            return nil, err
+        }
         
     } else {
         // find leftmost node in right subtree
@@ -1229,34 +1759,13 @@ func DeleteFileEntry(filename string, username string, configs *types.Config) *t
         var candidateParentLocation int64 = currentNodeLocation
         var candidateNode *types.TreeEntry = nil // &types.TreeEntry{"", 0, 0, []string(nil)}
         var foundLeftMost bool = false
-        candidateBuf := make([]byte, SIZE_OF_ENTRY)
+        var candidateBuf []byte = nil
         candidateParentBuf := currentNodeBuf
         for !foundLeftMost {
             // read in the current node
-            candidateBuf = make([]byte, SIZE_OF_ENTRY)
-            _, err = dbFile.ReadAt(candidateBuf, candidateNodeLocation)
-            check(err)
-
-            candidateNode = bufferToEntry(candidateBuf, &header, configs)
-
-            retries := 0
-            for candidateNode == nil && retries != types.RETRY_COUNT {
-                dbFile.Close()
-
-                recoverFromDbDiskFailure(dbFilename, candidateNodeLocation, username, configs)
-
-                // reopen the database file
-                dbFile, err = os.OpenFile(dbFilename, os.O_RDWR, 0755)
-                check(err)
-                
-                // get the currentNode again
-                candidateBuf = make([]byte, SIZE_OF_ENTRY)
-                _, err = dbFile.ReadAt(candidateBuf, currentNodeLocation)
-                check(err)
-
-                candidateNode = bufferToEntry(candidateBuf, &header, configs)
-
-                retries++
+            candidateNode, candidateBuf, err = db.readEntry(candidateNodeLocation)
+            if err != nil {
+                return nil, err
             }
             
             // if doesn't have a left child, then it is the leftmost
@@ -1269,31 +1778,25 @@ func DeleteFileEntry(filename string, username string, configs *types.Config) *t
 
             if !foundLeftMost {
                 candidateParentBuf = candidateBuf
-                candidateBuf = make([]byte, SIZE_OF_ENTRY)
             }
         }
 
         /*
             overwrite original node that is being deleted with candidate node (link its parent to this new node)
         */
-        buf := new(bytes.Buffer)
-        err = binary.Write(buf, binary.LittleEndian, &candidateNodeLocation)
-        check(err)
-        newPointer := buf.Bytes()
-        newEntry := modifyEntry(parentNodeBuf, newPointer, offsetInParent)
+        newPointer := pointerToBuf(candidateNodeLocation)
+        newEntry := modifyEntry(parentNodeBuf, newPointer, offsetInParent, &header)
 
-        errCode = transaction.AddAction(t, parentNodeBuf, newEntry, parentNodeLocation)
-        transaction.HandleActionError(errCode)
+        err = transaction.AddAction(t, parentNodeBuf, newEntry, parentNodeLocation)
+        if err != nil {
+            return nil, err
+        }
 
         /*
             have the candidate node inherit the original node's links (left link now)
         */
-        buf = new(bytes.Buffer)
-        err = binary.Write(buf, binary.LittleEndian, &currentNode.Left)
-        check(err)
-
-        newPointer = buf.Bytes()
-        newEntry = modifyEntry(candidateBuf, newPointer, int(header.FileNameSize))
+        newPointer = pointerToBuf(currentNode.Left)
+        newEntry = modifyEntry(candidateBuf, newPointer, int(header.FileNameSize), &header)
 
         // errCode = transaction.AddAction(t, candidateBuf, newEntry, candidateNodeLocation)
         // transaction.HandleActionError(errCode)
@@ -1303,20 +1806,19 @@ func DeleteFileEntry(filename string, username string, configs *types.Config) *t
         // we don't need to do this, since it's link to its child will already be correct
         // we will mess it up if we do this (TODO: can make this cleaner later)
         if (candidateParentLocation != currentNodeLocation) {
-            buf = new(bytes.Buffer)
-            err = binary.Write(buf, binary.LittleEndian, &currentNode.Right)
-            check(err)
-            newPointer = buf.Bytes()
+            newPointer = pointerToBuf(currentNode.Right)
 
-            temp := modifyEntry(newEntry, newPointer, int(header.FileNameSize) + types.POINTER_SIZE)
+            temp := modifyEntry(newEntry, newPointer, int(header.FileNameSize) + types.POINTER_SIZE, &header)
             newEntry = temp
 
             // errCode = transaction.AddAction(t, candidateBuf, newEntry, candidateNodeLocation)
             // transaction.HandleActionError(errCode)
         }
 
-        errCode = transaction.AddAction(t, candidateBuf, newEntry, candidateNodeLocation)
-        transaction.HandleActionError(errCode)
+        err = transaction.AddAction(t, candidateBuf, newEntry, candidateNodeLocation)
+        if err != nil {
+            return nil, err
+        }
 
         /*
             Last check: did that node you used as a replacement have any children?
@@ -1333,31 +1835,31 @@ func DeleteFileEntry(filename string, username string, configs *types.Config) *t
 
         */
         if candidateNode.Right != 0 && (candidateParentLocation != currentNodeLocation) {
-            buf := new(bytes.Buffer)
-            err = binary.Write(buf, binary.LittleEndian, &candidateNode.Right)
-            check(err)
-
             // since it will now be the left child of the parent of candidate node
             // ^ not true always (candidate node could be immediate to the right of currentNode)
             // need to check if the parent node of candidate node is still currentNode
             offsetInCandPar := int(header.FileNameSize)
 
-            newPointer := buf.Bytes()
-            newEntry := modifyEntry(candidateParentBuf, newPointer, offsetInCandPar)
+            newPointer := pointerToBuf(candidateNode.Right)
+            newEntry := modifyEntry(candidateParentBuf, newPointer, offsetInCandPar, &header)
 
-            errCode = transaction.AddAction(t, candidateParentBuf, newEntry, candidateParentLocation)
-            transaction.HandleActionError(errCode)
+            err = transaction.AddAction(t, candidateParentBuf, newEntry, candidateParentLocation)
+            if err != nil {
+                return nil, err
+            }
 
         } else if candidateNode.Right == 0 && (candidateParentLocation != currentNodeLocation) { // else, just overwrite that link with 0
             newPointer := make([]byte, types.POINTER_SIZE)
             offsetInCandPar := int(header.FileNameSize)
-            newEntry := modifyEntry(candidateParentBuf, newPointer, offsetInCandPar)
+            newEntry := modifyEntry(candidateParentBuf, newPointer, offsetInCandPar, &header)
 
             // since it will now be the left child of the parent of candidate node
             // ^ not true always (candidate node could be immediate to the right of currentNode)
             // need to check if the parent node of candidate node is still currentNode
-            errCode = transaction.AddAction(t, candidateParentBuf, newEntry, candidateParentLocation)
-            transaction.HandleActionError(errCode)
+            err = transaction.AddAction(t, candidateParentBuf, newEntry, candidateParentLocation)
+            if err != nil {
+                return nil, err
+            }
 
         } // don't need to do anything in other case, because link from candidate to its child is already correct
     }
@@ -1366,32 +1868,14 @@ func DeleteFileEntry(filename string, username string, configs *types.Config) *t
     // up some space)
     header.TrueDbSize -= int64(SIZE_OF_ENTRY)
 
-    // rewrite the header
-    binaryBuffer := new(bytes.Buffer)
-    err = binary.Write(binaryBuffer, binary.LittleEndian, &header)
-    check(err)
+    // rewrite the header (along with its hash)
+    newHeaderBuf := headerToBuf(&header)
+    oldHeaderBuf := headerToBuf(&oldHeader)
 
-    newHeaderBuf := binaryBuffer.Bytes()
-
-    x := new(bytes.Buffer)
-    err = binary.Write(x, binary.LittleEndian, &oldHeader)
-    check(err)
-    oldHeaderBuf := x.Bytes()
-
-    errCode = transaction.AddAction(t, oldHeaderBuf, newHeaderBuf, 0)
-    transaction.HandleActionError(errCode)
-
-    // update the hash of the header
-    oldHash := md5.New()
-    oldHash.Write(oldHeaderBuf)
-    computedOldHash := oldHash.Sum(nil)
-
-    newHash := md5.New()
-    newHash.Write(newHeaderBuf)
-    computedNewHash := newHash.Sum(nil)
-
-    errCode = transaction.AddAction(t, computedOldHash, computedNewHash, int64(len(newHeaderBuf)))
-    transaction.HandleActionError(errCode)
+    err = transaction.AddAction(t, oldHeaderBuf, newHeaderBuf, 0)
+    if err != nil {
+        return nil, err
+    }
 
     // update the parity file to reflect the changes to both the header and
     // the entry
@@ -1410,39 +1894,38 @@ func DeleteFileEntry(filename string, username string, configs *types.Config) *t
     // check(err)
     // fmt.Printf("After after: %x\n", randomBuf[0])
 
-    dbFile.Close()
+    db.close()
 
-    transaction.Commit(t)
+    err = transaction.Commit(t)
+    if err != nil {
+        return nil, err
+    }
 
     // fmt.Printf("Successfully deleted node with filename %s\n", currentNode.Filename)
 
-    return currentNode // success
+    return currentNode, nil // success
 }
 
-func printTree(entry *types.TreeEntry, header *Header, dbFile *os.File, arr []string, level int, configs *types.Config) {
+func printTree(entry *types.TreeEntry, header *Header, dbFile *os.File, arr []string, level int, configs *types.Config) error {
     if entry != nil {
-        var SIZE_OF_ENTRY int16 = header.FileNameSize + 2*(types.POINTER_SIZE) + int16(header.DiskCount + 1) * int16(header.DiskNameSize) + types.MD5_SIZE
         // fmt.Printf("%s\n", entry.Filename)
         arr[level] += entry.Filename + " "
-        if entry.Left != 0 {
-            entryBuf := make([]byte, SIZE_OF_ENTRY)
-            _, err := dbFile.ReadAt(entryBuf, entry.Left)
-            check(err)
-            child := bufferToEntry(entryBuf, header, configs)
-        
-            printTree(child, header, dbFile, arr, level + 1, configs)
-        } else {
-            printTree(nil, nil, nil, arr, level + 1, configs)
-        }
-        if entry.Right != 0 {
-            entryBuf := make([]byte, SIZE_OF_ENTRY)
-            _, err := dbFile.ReadAt(entryBuf, entry.Right)
-            check(err)
-            child := bufferToEntry(entryBuf, header, configs)
+        for _, child := range []int64{entry.Left, entry.Right} {
+            if child == 0 {
+                printTree(nil, nil, nil, arr, level + 1, configs)
+                continue
+            }
 
-            printTree(child, header, dbFile, arr, level + 1, configs)
-        } else {
-            printTree(nil, nil, nil, arr, level + 1, configs)
+            entryBuf := make([]byte, entrySize(header))
+            _, err := dbFile.ReadAt(entryBuf, child)
+            if err != nil {
+                return err
+            }
+
+            err = printTree(bufferToEntry(entryBuf, header, configs), header, dbFile, arr, level + 1, configs)
+            if err != nil {
+                return err
+            }
         }
 
         // fmt.Printf("\n")
@@ -1452,67 +1935,43 @@ func printTree(entry *types.TreeEntry, header *Header, dbFile *os.File, arr []st
         // }
         arr[level] += "X "
     }
+
+    return nil
 }
 
 func PrettyPrintTree(username string, depth int, configs *types.Config) {
     for i := 0; i < len(configs.Dbdisks) - 1; i++ {
         fmt.Printf("Pretty printing tree for disk %d:\n\n", i)
-        // dbCompLocation := fmt.Sprintf("%s/%s_%d", dbdisklocations[i], username, i)
-        dbFileName := fmt.Sprintf("%s/%s_%d", configs.Dbdisks[i], username, i)
-        dbFile, err := os.Open(dbFileName)
-        check(err)
-
-        headerBuf := make([]byte, types.HEADER_SIZE)
-        _, err = dbFile.ReadAt(headerBuf, 0)
-        check(err)
-
-        header := Header{0, 0, 0, 0, 0, 0}
-        b := bytes.NewReader(headerBuf)
-        err = binary.Read(b, binary.LittleEndian, &header)
-        check(err)
-        var SIZE_OF_ENTRY int16 = header.FileNameSize + 2*(types.POINTER_SIZE) + int16(header.DiskCount + 1) * int16(header.DiskNameSize) + types.MD5_SIZE
-
-        entryBuf := make([]byte, SIZE_OF_ENTRY)
-        _, err = dbFile.ReadAt(entryBuf, header.RootPointer)
-        check(err)
-
-        entry := bufferToEntry(entryBuf, &header, configs)
-        
-        arr := make([]string, depth)
-        for i := 0; i < len(arr); i++ {
-            arr[i] = ""
+        arr, err := PrettyPrintTreeGetString(username, i, depth, configs)
+        if err != nil {
+            fmt.Printf("Can't print tree: %v\n", err)
         }
-
-        printTree(entry, &header, dbFile, arr, 0, configs)
         for i := 0; i < len(arr); i++ {
             fmt.Printf("%s\n", arr[i])
         }
 
-        dbFile.Close()
-
         fmt.Printf("\n\n")
     }
 }
 
-func PrettyPrintTreeGetString(username string, disk int, depth int, configs *types.Config) ([]string) {
+func PrettyPrintTreeGetString(username string, disk int, depth int, configs *types.Config) ([]string, error) {
     // dbCompLocation := fmt.Sprintf("%s/%s_%d", dbdisklocations[i], username, i)
     dbFileName := fmt.Sprintf("%s/%s_%d", configs.Dbdisks[disk], username, disk)
     dbFile, err := os.Open(dbFileName)
-    check(err)
-
-    headerBuf := make([]byte, types.HEADER_SIZE)
-    _, err = dbFile.ReadAt(headerBuf, 0)
-    check(err)
+    if err != nil {
+        return nil, err
+    }
+    defer dbFile.Close()
 
-    header := Header{0, 0, 0, 0, 0, 0}
-    b := bytes.NewReader(headerBuf)
-    err = binary.Read(b, binary.LittleEndian, &header)
-    check(err)
-    var SIZE_OF_ENTRY int16 = header.FileNameSize + 2*(types.POINTER_SIZE) + int16(header.DiskCount + 1) * int16(header.DiskNameSize) + types.MD5_SIZE
+    // only for printing, so doesn't matter if the header hash is off
+    header, _ := getHeader(dbFile)
+    SIZE_OF_ENTRY := entrySize(&header)
 
     entryBuf := make([]byte, SIZE_OF_ENTRY)
     _, err = dbFile.ReadAt(entryBuf, header.RootPointer)
-    check(err)
+    if err != nil {
+        return nil, err
+    }
 
     entry := bufferToEntry(entryBuf, &header, configs)
     
@@ -1521,9 +1980,6 @@ func PrettyPrintTreeGetString(username string, disk int, depth int, configs *typ
         arr[i] = ""
     }
 
-    printTree(entry, &header, dbFile, arr, 0, configs)
-
-    dbFile.Close()
-
-    return arr
-}
\ No newline at end of file
+    err = printTree(entry, &header, dbFile, arr, 0, configs)
+    return arr, err
+}
@@ -15,10 +15,15 @@ import (
     "os"
     "fmt"
     "bytes"
+    "errors"
+    "strings"
     "encoding/binary"
+    "crypto/md5"
+    "io/ioutil"
     // "os/exec"
     "time"
     "log"
+    "foxyblox/hashes"
     "foxyblox/types"
 )
 
@@ -34,6 +39,13 @@ var LARGE_FILE_SIZE int64 = int64(math.Pow(2, float64(18))) //int64(math.Pow(2,
 var configs *types.Config
 var diskLocations []string
 
+// the packages return their errors, tests still stop at the unexpected ones
+func check(err error) {
+    if err != nil {
+        log.Fatal("Exiting: ", err)
+    }
+}
+
 func TestMain(m *testing.M) {
     fmt.Println("Setting up for tests")
 
@@ -113,7 +125,7 @@ func TestDatabaseCreationAndRemoval(t *testing.T) {
 
     username := "atoron"
 
-    CreateDatabaseForUser(username, configs)
+    check(CreateDatabaseForUser(username, configs))
 
     for i := 0; i < TESTING_DISK_COUNT; i++ {
         dbCompLocation := fmt.Sprintf("./storage/dbdrive%d/%s_%d", i, username, i)
@@ -146,7 +158,7 @@ func TestDatabaseCreationAndRemoval(t *testing.T) {
         _, err = dbFile.ReadAt(buf, 0)
         check(err)
 
-        header := Header{0, 0, 0, 0, 0, 0}
+        header := Header{}
         b := bytes.NewReader(buf)
         err = binary.Read(b, binary.LittleEndian, &header)
         check(err)
@@ -199,7 +211,7 @@ func TestDatabaseCreationAndRemoval(t *testing.T) {
 func addFileHelper(t *testing.T, filename string, username string, 
                 shouldBeAddedAt int64, parentShouldBeAt int64, shouldBeLeft bool,
                 addedSoFar int, driveAddedTo int, dataDisks []string) {
-    AddFileSpecsToDatabase(filename, username, dataDisks, configs)
+    check(AddFileSpecsToDatabase(filename, username, dataDisks, configs))
 
     // check that the entry is in the correct spot, and that the header was
     // updated accordingly
@@ -213,7 +225,7 @@ func addFileHelper(t *testing.T, filename string, username string,
     check(err)
 
     entryFilename := bytes.Trim(buf[0:types.MAX_FILE_NAME_SIZE], "\x00")
-    entry := types.TreeEntry{string(entryFilename), 0, 0, []string(nil), nil}
+    entry := types.TreeEntry{Filename: string(entryFilename)}
 
     b := bytes.NewReader(buf[types.MAX_FILE_NAME_SIZE: types.MAX_FILE_NAME_SIZE + types.POINTER_SIZE])
     err = binary.Read(b, binary.LittleEndian, &entry.Left); check(err)
@@ -254,7 +266,7 @@ func addFileHelper(t *testing.T, filename string, username string,
     _, err = dbFile.ReadAt(buf, parentShouldBeAt)
     check(err)
 
-    entry = types.TreeEntry{string(buf[0:types.MAX_FILE_NAME_SIZE]), 0, 0, []string(nil), nil}
+    entry = types.TreeEntry{Filename: string(buf[0:types.MAX_FILE_NAME_SIZE])}
     b = bytes.NewReader(buf[types.MAX_FILE_NAME_SIZE: types.MAX_FILE_NAME_SIZE + types.POINTER_SIZE])
     err = binary.Read(b, binary.LittleEndian, &entry.Left); check(err)
     b = bytes.NewReader(buf[types.MAX_FILE_NAME_SIZE + types.POINTER_SIZE: types.MAX_FILE_NAME_SIZE + 2 * types.POINTER_SIZE])
@@ -279,7 +291,7 @@ func addFileHelper(t *testing.T, filename string, username string,
     _, err = dbFile.ReadAt(buf, 0)
     check(err)
 
-    header := Header{0, 0, 0, 0, 0, 0}
+    header := Header{}
     b = bytes.NewReader(buf)
     err = binary.Read(b, binary.LittleEndian, &header)
     check(err)
@@ -349,7 +361,7 @@ func TestAddingAFile(t *testing.T) {
     username := "atoron"
     filename := "testingFile.txt"
 
-    CreateDatabaseForUser(username, configs)
+    check(CreateDatabaseForUser(username, configs))
 
     addFileHelper(t, filename, username, types.HEADER_SIZE + int64(types.SIZE_OF_ENTRY), 
                   types.HEADER_SIZE, false, 0, 2, configs.Datadisks)
@@ -372,7 +384,7 @@ func TestAddingMultipleFiles(t *testing.T) {
     filename1_4 := "saatingFile.txt"
     filename1_5 := "sattingFile.txt"
 
-    CreateDatabaseForUser(username, configs)
+    check(CreateDatabaseForUser(username, configs))
     // t *testing.T, filename string, username string, 
     //             shouldBeAddedAt int64, parentShouldBeAt int64, shouldBeLeft bool,
     //             addedSoFar int, driveAddedTo int
@@ -435,7 +447,7 @@ func TestGettingFile(t *testing.T) {
     username := "atoron"
     filename := "testingFile.txt"
 
-    CreateDatabaseForUser(username, configs)
+    check(CreateDatabaseForUser(username, configs))
     // t *testing.T, filename string, username string, 
     //             shouldBeAddedAt int64, parentShouldBeAt int64, shouldBeLeft bool,
     //             addedSoFar int, driveAddedTo int
@@ -443,7 +455,7 @@ func TestGettingFile(t *testing.T) {
     addFileHelper(t, filename, username, types.HEADER_SIZE + int64(types.SIZE_OF_ENTRY), 
                   types.HEADER_SIZE, false, 0, 2, configs.Datadisks)
 
-    entry := GetFileEntry(filename, username, configs)
+    entry, _ := GetFileEntry(filename, username, configs)
     if entry == nil {
         t.Errorf("The entry returned is nil")
         removeDatabaseStructureAndCheck(t)
@@ -478,7 +490,7 @@ func deleteFileHelper(t *testing.T, filename string, username string,
     // note: in the context of the database, localhost just means that it will
     // be stored on the same machine but with the file structure, not really
     // separate drives (will be simulated with separate folders)
-    errCode := DeleteFileEntry(filename, username, configs)
+    errCode, _ := DeleteFileEntry(filename, username, configs)
 
     if shouldFindTheFile && errCode == nil {
         t.Errorf("Error code is incorrect, should have found the file")
@@ -509,7 +521,7 @@ func deleteFileHelper(t *testing.T, filename string, username string,
     check(err)
 
     entryFilename := bytes.Trim(buf[0:types.MAX_FILE_NAME_SIZE], "\x00")
-    entry := types.TreeEntry{string(entryFilename), 0, 0, []string(nil), nil}
+    entry := types.TreeEntry{Filename: string(entryFilename)}
 
     if entry.Filename == filename {
         t.Errorf("Parent has same filename as deleted node for some reason")
@@ -533,7 +545,7 @@ func deleteFileHelper(t *testing.T, filename string, username string,
     _, err = dbFile.ReadAt(buf, 0)
     check(err)
 
-    header := Header{0, 0, 0, 0, 0, 0}
+    header := Header{}
     b = bytes.NewReader(buf)
     err = binary.Read(b, binary.LittleEndian, &header)
     check(err)
@@ -612,7 +624,7 @@ func TestDeletingAFile(t *testing.T) {
     // filename1_4 := "saatingFile.txt"
     // filename1_5 := "sattingFile.txt"
 
-    CreateDatabaseForUser(username, configs)
+    check(CreateDatabaseForUser(username, configs))
     // t *testing.T, filename string, username string, 
     //             shouldBeAddedAt int64, parentShouldBeAt int64, shouldBeLeft bool,
     //             addedSoFar int, driveAddedTo int
@@ -650,7 +662,7 @@ func TestDeletingMultipleFiles(t *testing.T) {
     filename1_5 := "sattingFile.txt"
     filename1_6 := "sabtingFile.txt"
 
-    CreateDatabaseForUser(username, configs)
+    check(CreateDatabaseForUser(username, configs))
     // t *testing.T, filename string, username string, 
     //             shouldBeAddedAt int64, parentShouldBeAt int64, shouldBeLeft bool,
     //             addedSoFar int, driveAddedTo int
@@ -875,7 +887,7 @@ func TestOverallAddingGettingDeleting(t *testing.T) {
         filenames[i] = fmt.Sprintf("%d", i)
     }
 
-    CreateDatabaseForUser(username, configs)
+    check(CreateDatabaseForUser(username, configs))
 
     inDatabase := make([]bool, amountOfFiles)
     for i := 0; i < len(inDatabase); i++ {
@@ -890,13 +902,13 @@ func TestOverallAddingGettingDeleting(t *testing.T) {
     for added != (amountOfFiles / 2) {
         num := rand.Intn(amountOfFiles - 1) + 1
         if !inDatabase[num] {
-            AddFileSpecsToDatabase(filenames[num], username, configs.Datadisks, configs)
+            check(AddFileSpecsToDatabase(filenames[num], username, configs.Datadisks, configs))
             inDatabase[num] = true
             added++
         }
     }
 
-    currentTree = PrettyPrintTreeGetString(username, 0, amountOfFiles, configs)
+    currentTree, _ = PrettyPrintTreeGetString(username, 0, amountOfFiles, configs)
     middleTree := currentTree
     previousAddition := 0
     previousDeletion := 0
@@ -910,23 +922,23 @@ func TestOverallAddingGettingDeleting(t *testing.T) {
         for inDatabase[num] {
             num = rand.Intn(amountOfFiles - 1) + 1
         }
-        AddFileSpecsToDatabase(filenames[num], username, configs.Datadisks, configs)
+        check(AddFileSpecsToDatabase(filenames[num], username, configs.Datadisks, configs))
         inDatabase[num] = true
         previousAddition = num
         // previousTree = currentTree
-        // currentTree = PrettyPrintTreeGetString(LOCALHOST, username)
-        middleTree = PrettyPrintTreeGetString(username, 0, amountOfFiles, configs)
-        currentTree = PrettyPrintTreeGetString(username, 0, amountOfFiles, configs)
+        // currentTree, _ = PrettyPrintTreeGetString(LOCALHOST, username)
+        middleTree, _ = PrettyPrintTreeGetString(username, 0, amountOfFiles, configs)
+        currentTree, _ = PrettyPrintTreeGetString(username, 0, amountOfFiles, configs)
 
         // get one
         num = rand.Intn(amountOfFiles - 1) + 1
         for !inDatabase[num] {
             num = rand.Intn(amountOfFiles - 1) + 1
         }
-        entry := GetFileEntry(filenames[num], username, configs)
+        entry, _ := GetFileEntry(filenames[num], username, configs)
         // previousTree = currentTree
-        // currentTree = PrettyPrintTreeGetString(LOCALHOST, username)
-        currentTree = PrettyPrintTreeGetString(username, 0, amountOfFiles, configs)
+        // currentTree, _ = PrettyPrintTreeGetString(LOCALHOST, username)
+        currentTree, _ = PrettyPrintTreeGetString(username, 0, amountOfFiles, configs)
         if entry == nil {
             t.Errorf("Did not get entry %d at all", num)
             fmt.Printf("Added %d, deleted %d\n", previousAddition, previousDeletion)
@@ -961,11 +973,11 @@ func TestOverallAddingGettingDeleting(t *testing.T) {
         for !inDatabase[num] {
             num = rand.Intn(amountOfFiles - 1) + 1
         }
-        errCode := DeleteFileEntry(filenames[num], username, configs)
+        errCode, _ := DeleteFileEntry(filenames[num], username, configs)
         previousDeletion = num
         // previousTree = currentTree
-        // currentTree = PrettyPrintTreeGetString(LOCALHOST, username)
-        currentTree = PrettyPrintTreeGetString(username, 0, amountOfFiles, configs)
+        // currentTree, _ = PrettyPrintTreeGetString(LOCALHOST, username)
+        currentTree, _ = PrettyPrintTreeGetString(username, 0, amountOfFiles, configs)
         if errCode == nil {
             t.Errorf("There was an error in deletion")
             fmt.Printf("Added %d, deleted %d\n", previousAddition, previousDeletion)
@@ -993,7 +1005,7 @@ func TestOverallAddingGettingDeleting(t *testing.T) {
             break
         }
         inDatabase[num] = false
-        currentTree = PrettyPrintTreeGetString(username, 0, amountOfFiles, configs)
+        currentTree, _ = PrettyPrintTreeGetString(username, 0, amountOfFiles, configs)
 
         r++
     }
@@ -1008,7 +1020,7 @@ func TestMultipleUsers(t *testing.T) {
     username2 := "atoron2" // should check in database if username already exists
     filename := "testingFile.txt"
 
-    CreateDatabaseForUser(username, configs)
+    check(CreateDatabaseForUser(username, configs))
     // t *testing.T, filename string, username string, 
     //             shouldBeAddedAt int64, parentShouldBeAt int64, shouldBeLeft bool,
     //             addedSoFar int, driveAddedTo int
@@ -1016,7 +1028,7 @@ func TestMultipleUsers(t *testing.T) {
     addFileHelper(t, filename, username, types.HEADER_SIZE + int64(types.SIZE_OF_ENTRY), 
                   types.HEADER_SIZE, false, 0, 2, configs.Datadisks)
 
-    entry := GetFileEntry(filename, username, configs)
+    entry, _ := GetFileEntry(filename, username, configs)
     if entry == nil {
         t.Errorf("The entry returned is nil")
         removeDatabaseStructureAndCheck(t)
@@ -1041,7 +1053,7 @@ func TestMultipleUsers(t *testing.T) {
         t.Errorf("The pointers for entry are not right")
     }
 
-    CreateDatabaseForUser(username2, configs)
+    check(CreateDatabaseForUser(username2, configs))
     // t *testing.T, filename string, username string, 
     //             shouldBeAddedAt int64, parentShouldBeAt int64, shouldBeLeft bool,
     //             addedSoFar int, driveAddedTo int
@@ -1049,7 +1061,7 @@ func TestMultipleUsers(t *testing.T) {
     addFileHelper(t, filename, username2, types.HEADER_SIZE + int64(types.SIZE_OF_ENTRY), 
                   types.HEADER_SIZE, false, 0, 2, configs.Datadisks)
 
-    entry = GetFileEntry(filename, username2, configs)
+    entry, _ = GetFileEntry(filename, username2, configs)
     if entry == nil {
         t.Errorf("The entry returned is nil")
         removeDatabaseStructureAndCheck(t)
@@ -1083,7 +1095,7 @@ func TestAddEntryWithLessThanFourLocations(t *testing.T) {
     username := "atoron"
     filename := "testingFile.txt"
 
-    CreateDatabaseForUser(username, configs)
+    check(CreateDatabaseForUser(username, configs))
 
     addFileHelper(t, filename, username, types.HEADER_SIZE + int64(types.SIZE_OF_ENTRY), 
                   types.HEADER_SIZE, false, 0, 2, configs.Datadisks[0:2])
@@ -1091,6 +1103,549 @@ func TestAddEntryWithLessThanFourLocations(t *testing.T) {
     removeDatabaseStructureAndCheck(t)
 }
 
+func TestFileLayoutIsRecorded(t *testing.T) {
+    InitializeDatabaseStructure(configs.Dbdisks)
+
+    username := "atoron"
+    filename1 := "testingFile.txt"
+    filename2 := "testingFile2.txt"
+
+    check(CreateDatabaseForUser(username, configs))
+
+    // default layout comes from the configs (RAID 4 over all of the locations)
+    check(AddFileSpecsToDatabase(filename1, username, configs.Datadisks, configs))
+
+    rsLayout := types.Layout{Scheme: types.RS_SCHEME, DataCount: 2, ParityCount: 2}
+    entry := &types.TreeEntry{Filename: filename2, Disks: configs.Datadisks, Layout: rsLayout}
+    check(AddFileEntryToDatabase(entry, username, configs))
+
+    found, _ := GetFileEntry(filename1, username, configs)
+    xorLayout := types.Layout{Scheme: types.XOR_SCHEME, DataCount: TESTING_DISK_COUNT, ParityCount: 1}
+    if found == nil || found.Layout != xorLayout {
+        t.Errorf("Default layout was not recorded for %s", filename1)
+    }
+
+    found, _ = GetFileEntry(filename2, username, configs)
+    if found == nil || found.Layout != rsLayout {
+        t.Errorf("Reed-Solomon layout was not recorded for %s", filename2)
+    }
+
+    // saving the file again with another layout updates the entry in place,
+    // without losing the link to the other file
+    entry.Filename = filename1
+    check(AddFileEntryToDatabase(entry, username, configs))
+
+    found, _ = GetFileEntry(filename1, username, configs)
+    if found == nil || found.Layout != rsLayout {
+        t.Errorf("Layout was not updated for %s", filename1)
+    }
+    if entry, _ := GetFileEntry(filename2, username, configs); entry == nil {
+        t.Errorf("Lost %s when updating %s", filename2, filename1)
+    }
+
+    // stripe size is recorded with the rest of the layout
+    stripedLayout := types.Layout{Scheme: types.XOR_SCHEME, DataCount: TESTING_DISK_COUNT,
+                                  ParityCount: 1, Striping: types.STRIPING_ROTATING,
+                                  StripeSize: 64 * 1024}
+    entry = &types.TreeEntry{Filename: filename2, Disks: configs.Datadisks, Layout: stripedLayout}
+    check(AddFileEntryToDatabase(entry, username, configs))
+
+    found, _ = GetFileEntry(filename2, username, configs)
+    if found == nil || found.Layout != stripedLayout {
+        t.Errorf("Striped layout was not recorded for %s", filename2)
+    }
+
+    removeDatabaseStructureAndCheck(t)
+}
+
+/*
+    Write the database files for the user the way they were written by an
+    older version of the format (DB_FORMAT_LEGACY = no version in the header
+    and no metadata in the entries, DB_FORMAT_LAYOUT = no hash algorithm in
+    the header), with everything hashed with MD5
+*/
+func createOldDatabaseForUser(username string, version uint8) int16 {
+    var legacySizeOfEntry int16 = types.MAX_FILE_NAME_SIZE + 2*(types.POINTER_SIZE) + int16(configs.DataDiskCount + 1) * int16(types.MAX_DISK_NAME_SIZE) + types.MD5_SIZE
+    if version != types.DB_FORMAT_LEGACY {
+        legacySizeOfEntry += types.ENTRY_METADATA_SIZE
+    }
+    h := Header{FileNameSize: types.MAX_FILE_NAME_SIZE, DiskCount: uint8(configs.DataDiskCount),
+                DiskNameSize: types.MAX_DISK_NAME_SIZE, RootPointer: types.HEADER_SIZE,
+                FreeList: types.HEADER_SIZE + int64(legacySizeOfEntry),
+                TrueDbSize: types.HEADER_SIZE + int64(legacySizeOfEntry),
+                Version: version, ParityDiskCount: 1}
+
+    // header of the old size, followed by its MD5
+    headerBuf := new(bytes.Buffer)
+    err := binary.Write(headerBuf, binary.LittleEndian, &h)
+    check(err)
+    rawHeader := headerBuf.Bytes()[0:types.RAW_HEADER_SIZE]
+    if version != types.DB_FORMAT_LEGACY {
+        rawHeader = headerBuf.Bytes()[0:types.RAW_HEADER_SIZE + 2]
+    }
+    headerHash := md5.Sum(rawHeader)
+
+    dbBuf := make([]byte, types.HEADER_SIZE + int64(legacySizeOfEntry))
+    copy(dbBuf, rawHeader)
+    copy(dbBuf[len(rawHeader):], headerHash[:])
+    rootHash := md5.Sum(make([]byte, legacySizeOfEntry - types.MD5_SIZE))
+    copy(dbBuf[len(dbBuf) - types.MD5_SIZE:], rootHash[:])
+
+    parityBuf := make([]byte, len(dbBuf))
+    for i := 0; i < len(configs.Dbdisks) - 1; i++ {
+        dbFilename := fmt.Sprintf("%s/%s_%d", configs.Dbdisks[i], username, i)
+        err = ioutil.WriteFile(dbFilename, dbBuf, 0755)
+        check(err)
+
+        for j := 0; j < len(dbBuf); j++ {
+            parityBuf[j] ^= dbBuf[j]
+        }
+    }
+
+    dbParityFilename := fmt.Sprintf("%s/%s_p", configs.Dbdisks[len(configs.Dbdisks) - 1], username)
+    err = ioutil.WriteFile(dbParityFilename, parityBuf, 0755)
+    check(err)
+
+    return legacySizeOfEntry
+}
+
+func TestReadingLegacyDatabase(t *testing.T) {
+    InitializeDatabaseStructure(configs.Dbdisks)
+
+    username := "atoron"
+    filename := "testingFile.txt"
+
+    legacySizeOfEntry := createOldDatabaseForUser(username, types.DB_FORMAT_LEGACY)
+
+    check(AddFileSpecsToDatabase(filename, username, configs.Datadisks, configs))
+
+    entry, _ := GetFileEntry(filename, username, configs)
+    if entry == nil {
+        t.Fatalf("Did not find %s in legacy database", filename)
+    }
+    xorLayout := types.Layout{Scheme: types.XOR_SCHEME, DataCount: TESTING_DISK_COUNT, ParityCount: 1}
+    if entry.Layout != xorLayout {
+        t.Errorf("Legacy entries should be RAID 4, got %+v", entry.Layout)
+    }
+    if len(entry.Disks) != len(configs.Datadisks) {
+        t.Errorf("Disks were not read back correctly from legacy database")
+    }
+
+    // legacy databases keep their format (and entry size)
+    dbFilename := getDbFilenameForFile(filename, username, configs)
+    dbFile, err := os.Open(dbFilename)
+    check(err)
+    header, err := getHeader(dbFile)
+    dbFile.Close()
+    if err != nil || header.Version != types.DB_FORMAT_LEGACY {
+        t.Errorf("Legacy header was not recognized")
+    }
+    if header.TrueDbSize != types.HEADER_SIZE + 2*int64(legacySizeOfEntry) {
+        t.Errorf("Legacy entry size was not kept, true size = %d", header.TrueDbSize)
+    }
+
+    removeDatabaseStructureAndCheck(t)
+}
+
+func TestDatabaseHashAlgorithms(t *testing.T) {
+    username := "atoron"
+    filenames := []string{"a.txt", "m.txt", "z.txt", "b.txt"}
+
+    for _, algorithm := range []int{types.HASH_SHA256, types.HASH_BLAKE3} {
+        InitializeDatabaseStructure(configs.Dbdisks)
+
+        hashConfigs := *configs
+        hashConfigs.HashAlgorithm = algorithm
+        check(CreateDatabaseForUser(username, &hashConfigs))
+
+        for _, filename := range filenames {
+            check(AddFileSpecsToDatabase(filename, username, configs.Datadisks, &hashConfigs))
+        }
+        DeleteFileEntry(filenames[1], username, &hashConfigs)
+
+        for i, filename := range filenames {
+            entry, _ := GetFileEntry(filename, username, &hashConfigs)
+            if i == 1 && entry != nil {
+                t.Errorf("Found deleted %s with hash algorithm %d", filename, algorithm)
+            } else if i != 1 && entry == nil {
+                t.Errorf("Did not find %s with hash algorithm %d", filename, algorithm)
+            } else if entry != nil && len(entry.Hash) != hashes.Size(algorithm) {
+                t.Errorf("Hash of %s is %d bytes with algorithm %d", filename, len(entry.Hash), algorithm)
+            }
+        }
+
+        dbFile, err := os.Open(getDbFilenameForFile(filenames[0], username, &hashConfigs))
+        check(err)
+        header, err := getHeader(dbFile)
+        dbFile.Close()
+        if err != nil || header.Version != types.DB_FORMAT_VERSION ||
+           int(header.HashAlgorithm) != algorithm {
+            t.Errorf("Header does not have hash algorithm %d, got %+v", algorithm, header)
+        }
+
+        removeDatabaseStructureAndCheck(t)
+    }
+
+    // databases written before the hash algorithm was stored are still MD5
+    InitializeDatabaseStructure(configs.Dbdisks)
+
+    sizeOfEntry := createOldDatabaseForUser(username, types.DB_FORMAT_LAYOUT)
+
+    hashConfigs := *configs
+    hashConfigs.HashAlgorithm = types.HASH_SHA256
+    check(AddFileSpecsToDatabase(filenames[0], username, configs.Datadisks, &hashConfigs))
+    if entry, _ := GetFileEntry(filenames[0], username, &hashConfigs); entry == nil {
+        t.Errorf("Did not find %s in database without a hash algorithm", filenames[0])
+    }
+
+    dbFile, err := os.Open(getDbFilenameForFile(filenames[0], username, &hashConfigs))
+    check(err)
+    header, err := getHeader(dbFile)
+    dbFile.Close()
+    if err != nil || header.Version != types.DB_FORMAT_LAYOUT ||
+       header.HashAlgorithm != uint8(types.HASH_MD5) {
+        t.Errorf("Header without a hash algorithm was not recognized, got %+v", header)
+    }
+    if header.TrueDbSize != types.HEADER_SIZE + 2*int64(sizeOfEntry) {
+        t.Errorf("Entry size was not kept, true size = %d", header.TrueDbSize)
+    }
+
+    removeDatabaseStructureAndCheck(t)
+}
+
+func TestDatabaseErrors(t *testing.T) {
+    InitializeDatabaseStructure(configs.Dbdisks)
+
+    username := "atoron"
+    filename := "testingFile.txt"
+
+    // no database for the user yet
+    _, err := GetFileEntry(filename, username, configs)
+    if !errors.Is(err, types.ErrNotFound) {
+        t.Errorf("Getting from a user without a database gave %v", err)
+    }
+
+    check(CreateDatabaseForUser(username, configs))
+    check(AddFileSpecsToDatabase(filename, username, configs.Datadisks, configs))
+
+    entry, err := GetFileEntry("otherFile.txt", username, configs)
+    if entry != nil || !errors.Is(err, types.ErrNotFound) {
+        t.Errorf("Getting a missing file gave %v, %v", entry, err)
+    }
+    entry, err = DeleteFileEntry("otherFile.txt", username, configs)
+    if entry != nil || !errors.Is(err, types.ErrNotFound) {
+        t.Errorf("Deleting a missing file gave %v, %v", entry, err)
+    }
+
+    longName := strings.Repeat("a", int(types.MAX_FILE_NAME_SIZE) + 1)
+    err = AddFileSpecsToDatabase(longName, username, configs.Datadisks, configs)
+    if !errors.Is(err, types.ErrNameTooLong) {
+        t.Errorf("Adding a name that is too long gave %v", err)
+    }
+    err = AddFileSpecsToDatabase("", username, configs.Datadisks, configs)
+    if !errors.Is(err, types.ErrInvalidName) {
+        t.Errorf("Adding an empty name gave %v", err)
+    }
+
+    // the failed adds did not touch what was there
+    entry, err = GetFileEntry(filename, username, configs)
+    if err != nil || entry.Filename != filename {
+        t.Errorf("Lost %s after failed adds: %v", filename, err)
+    }
+
+    removeDatabaseStructureAndCheck(t)
+}
+
+func TestListingEntries(t *testing.T) {
+    InitializeDatabaseStructure(configs.Dbdisks)
+
+    usernames := []string{"atoron", "atoron2"}
+    // spread across all of the database disks
+    filenames := []string{"Apple.txt", "zebra.txt", "middle.txt", "a.txt", "Zeta.txt", "b.txt"}
+    for _, username := range usernames {
+        check(CreateDatabaseForUser(username, configs))
+    }
+    for _, filename := range filenames {
+        check(AddFileSpecsToDatabase(filename, usernames[0], configs.Datadisks, configs))
+    }
+    _, err := DeleteFileEntry("middle.txt", usernames[0], configs)
+    check(err)
+
+    entries, err := ListFileEntries(usernames[0], configs)
+    check(err)
+    shouldBe := []string{"Apple.txt", "Zeta.txt", "a.txt", "b.txt", "zebra.txt"}
+    if len(entries) != len(shouldBe) {
+        t.Fatalf("Listed %d entries, should be %d", len(entries), len(shouldBe))
+    }
+    for i := 0; i < len(shouldBe); i++ {
+        if entries[i].Filename != shouldBe[i] || entries[i].Disks[0] != configs.Datadisks[0] {
+            t.Errorf("Entry %d is %s, should be %s", i, entries[i].Filename, shouldBe[i])
+        }
+    }
+
+    entries, err = ListFileEntries(usernames[1], configs)
+    if err != nil || len(entries) != 0 {
+        t.Errorf("User without files listed %d entries: %v", len(entries), err)
+    }
+    if _, err = ListFileEntries("nobody", configs); !errors.Is(err, types.ErrNotFound) {
+        t.Errorf("Listing a user without a database gave %v", err)
+    }
+
+    users, err := ListUsers(configs)
+    check(err)
+    if len(users) != 2 || users[0] != usernames[0] || users[1] != usernames[1] {
+        t.Errorf("Listed users %v", users)
+    }
+
+    removeDatabaseStructureAndCheck(t)
+}
+
+func TestKeepingVersions(t *testing.T) {
+    InitializeDatabaseStructure(configs.Dbdisks)
+
+    username := "atoron"
+    filename := "testingFile.txt"
+    check(CreateDatabaseForUser(username, configs))
+
+    // version, time saved and generations past a byte are recorded
+    layout := types.DefaultLayout(len(configs.Datadisks), configs)
+    layout.Generation = 300
+    entry := &types.TreeEntry{Filename: filename, Disks: configs.Datadisks, Layout: layout,
+                              Version: 3, Saved: 1700000000}
+    check(AddFileEntryToDatabase(entry, username, configs))
+    for version := 1; version < 3; version++ {
+        past := &types.TreeEntry{Filename: VersionKey(filename, version), Disks: configs.Datadisks,
+                                 Layout: layout, Version: version}
+        past.Layout.Generation = version
+        check(AddFileEntryToDatabase(past, username, configs))
+    }
+    check(AddFileSpecsToDatabase("testingFile.txt2", username, configs.Datadisks, configs))
+
+    found, err := GetFileEntry(filename, username, configs)
+    check(err)
+    if found.Version != 3 || found.Saved != 1700000000 || found.Layout != layout {
+        t.Errorf("Entry was recorded as version %d, saved %d, layout %v", found.Version,
+                 found.Saved, found.Layout)
+    }
+
+    versions, err := ListFileVersions(filename, username, configs)
+    check(err)
+    if len(versions) != 2 {
+        t.Fatalf("Listed %d past versions, should be 2", len(versions))
+    }
+    for i, version := range versions {
+        name, number, ok := ParseVersionKey(version.Filename)
+        if !ok || name != filename || number != i + 1 || version.Version != i + 1 ||
+           version.Layout.Generation != i + 1 {
+            t.Errorf("Past version %d is %q, version %d", i, version.Filename, version.Version)
+        }
+    }
+
+    // the past versions are only listed along with the current entries when asked for
+    entries, err := ListFileEntries(username, configs)
+    check(err)
+    if len(entries) != 2 || entries[0].Filename != filename {
+        t.Errorf("Listed %d entries with the past versions left out", len(entries))
+    }
+    entries, err = ListFileEntriesWithVersions(username, configs)
+    check(err)
+    if len(entries) != 4 || entries[0].Filename != filename ||
+       entries[3].Filename != "testingFile.txt2" {
+        t.Errorf("Listed %d entries with the past versions", len(entries))
+    }
+
+    // filenames can't be taken for version keys
+    err = AddFileSpecsToDatabase(VersionKey(filename, 4), username, configs.Datadisks, configs)
+    if err != nil {
+        t.Errorf("Adding a version key gave %v", err)
+    }
+    if err = CheckFilename(VersionKey(filename, 4)); !errors.Is(err, types.ErrInvalidName) {
+        t.Errorf("Checking a filename with the version separator gave %v", err)
+    }
+    if _, _, ok := ParseVersionKey(filename); ok {
+        t.Errorf("Filename %s was taken for a version key", filename)
+    }
+
+    removeDatabaseStructureAndCheck(t)
+}
+
+func TestCheckingPaths(t *testing.T) {
+    for _, filename := range []string{"report.txt", "a/report.txt", "a/b/c/report.txt",
+                                      ".hidden/report.txt", "a/.g/report.txt", "a/.gallery/x"} {
+        if err := CheckFilename(filename); err != nil {
+            t.Errorf("Path %s gave %v", filename, err)
+        }
+    }
+
+    for _, filename := range []string{"/a/report.txt", "a//report.txt", "a/report.txt/",
+                                      "./report.txt", "a/../report.txt", ".g3/report.txt",
+                                      "a/.g12/report.txt"} {
+        if err := CheckFilename(filename); !errors.Is(err, types.ErrInvalidName) {
+            t.Errorf("Path %s gave %v", filename, err)
+        }
+    }
+}
+
+func TestCheckingUsernames(t *testing.T) {
+    for _, username := range []string{"atoron", "a.toron", "..atoron"} {
+        if err := CheckUsername(username); err != nil {
+            t.Errorf("Username %s gave %v", username, err)
+        }
+    }
+
+    for _, username := range []string{"", ".", "..", "../x", "a/b", "a\\b"} {
+        if err := CheckUsername(username); !errors.Is(err, types.ErrInvalidName) {
+            t.Errorf("Username %q gave %v", username, err)
+        }
+    }
+
+    // no database is created for them
+    InitializeDatabaseStructure(configs.Dbdisks)
+    err := AddFileSpecsToDatabase("report.txt", "../x", configs.Datadisks, configs)
+    if !errors.Is(err, types.ErrInvalidName) {
+        t.Errorf("Adding a file of user ../x gave %v", err)
+    }
+    removeDatabaseStructureAndCheck(t)
+}
+
+func TestStoringPolicies(t *testing.T) {
+    InitializeDatabaseStructure(configs.Dbdisks)
+
+    username := "atoron"
+    check(CreateDatabaseForUser(username, configs))
+
+    // the policy and its layout are recorded, files without one have the default
+    layout, err := types.ParsePolicy("mirror:3", configs)
+    check(err)
+    entry := &types.TreeEntry{Filename: "testingFile.txt", Disks: configs.Datadisks[0:3],
+                              Layout: layout, Policy: layout.Policy()}
+    check(AddFileEntryToDatabase(entry, username, configs))
+    check(AddFileSpecsToDatabase("testingFile.txt2", username, configs.Datadisks, configs))
+
+    found, err := GetFileEntry("testingFile.txt", username, configs)
+    check(err)
+    if found.Policy != "mirror:3" || found.Layout != layout || len(found.Disks) != 3 {
+        t.Errorf("Entry was recorded with policy %q, layout %v", found.Policy, found.Layout)
+    }
+    found, err = GetFileEntry("testingFile.txt2", username, configs)
+    check(err)
+    if found.Policy != "" {
+        t.Errorf("Entry without a policy was recorded with %q", found.Policy)
+    }
+
+    for _, policy := range []string{"raid:3+1", "mirror:1", "rs:0+2", "xor:3", "rs:a+b"} {
+        if _, err = types.ParsePolicy(policy, configs); !errors.Is(err, types.ErrInvalidLayout) {
+            t.Errorf("Policy %s gave %v", policy, err)
+        }
+    }
+    entry.Policy = strings.Repeat("x", types.MAX_POLICY_SIZE + 1)
+    if err = AddFileEntryToDatabase(entry, username, configs); err == nil {
+        t.Errorf("Policy longer than %d bytes was stored", types.MAX_POLICY_SIZE)
+    }
+
+    removeDatabaseStructureAndCheck(t)
+}
+
+func TestStoringStats(t *testing.T) {
+    InitializeDatabaseStructure(configs.Dbdisks)
+
+    username := "atoron"
+    check(CreateDatabaseForUser(username, configs))
+
+    stat := &types.FileStat{Size: 12345, Mode: 0640, ModTime: 1500000000123456789,
+                            Created: 1400000000987654321}
+    entry := &types.TreeEntry{Filename: "testingFile.txt", Disks: configs.Datadisks,
+                              Layout: types.DefaultLayout(len(configs.Datadisks), configs),
+                              Stat: stat}
+    check(AddFileEntryToDatabase(entry, username, configs))
+    check(AddFileSpecsToDatabase("testingFile.txt2", username, configs.Datadisks, configs))
+
+    found, err := GetFileEntry("testingFile.txt", username, configs)
+    check(err)
+    if found.Stat == nil || *found.Stat != *stat {
+        t.Errorf("Entry was recorded with stat %+v, should be %+v", found.Stat, stat)
+    }
+    found, err = GetFileEntry("testingFile.txt2", username, configs)
+    check(err)
+    if found.Stat != nil {
+        t.Errorf("Entry without a stat was recorded with %+v", found.Stat)
+    }
+
+    removeDatabaseStructureAndCheck(t)
+
+    // databases of an older format keep it, and don't keep the stat
+    InitializeDatabaseStructure(configs.Dbdisks)
+    createOldDatabaseForUser(username, types.DB_FORMAT_LAYOUT)
+    check(AddFileEntryToDatabase(entry, username, configs))
+
+    found, err = GetFileEntry("testingFile.txt", username, configs)
+    check(err)
+    if found.Stat != nil {
+        t.Errorf("Database without stats recorded %+v", found.Stat)
+    }
+
+    removeDatabaseStructureAndCheck(t)
+}
+
+func TestSnapshots(t *testing.T) {
+    InitializeDatabaseStructure(configs.Dbdisks)
+
+    username := "atoron"
+    filename := "testingFile.txt"
+    check(CreateDatabaseForUser(username, configs))
+    check(AddFileSpecsToDatabase(filename, username, configs.Datadisks, configs))
+
+    if err := CreateSnapshot("nobody", "q1", configs); !errors.Is(err, types.ErrNotFound) {
+        t.Errorf("Snapshot of a user without a database gave %v", err)
+    }
+    if err := CreateSnapshot(username, "a/b", configs); !errors.Is(err, types.ErrInvalidName) {
+        t.Errorf("Snapshot with a / in its name gave %v", err)
+    }
+    check(CreateSnapshot(username, "q1", configs))
+    if err := CreateSnapshot(username, "q1", configs); !errors.Is(err, types.ErrExists) {
+        t.Errorf("Snapshot with a name that is taken gave %v", err)
+    }
+
+    // the snapshot doesn't change with the database of the user
+    _, err := DeleteFileEntry(filename, username, configs)
+    check(err)
+    snapshotDatabase := SnapshotDatabase(username, "q1")
+    entry, err := GetFileEntry(filename, snapshotDatabase, configs)
+    if err != nil || entry.Filename != filename {
+        t.Errorf("File in the snapshot was %v: %v", entry, err)
+    }
+    check(CreateSnapshot(username, "empty", configs))
+
+    snapshots, err := ListSnapshots(username, configs)
+    check(err)
+    if len(snapshots) != 2 || snapshots[0] != "empty" || snapshots[1] != "q1" {
+        t.Errorf("Listed snapshots %v", snapshots)
+    }
+    users, err := ListUsers(configs)
+    check(err)
+    if len(users) != 1 || users[0] != username {
+        t.Errorf("Snapshots were listed as users: %v", users)
+    }
+    owner, snapshot, ok := ParseSnapshotDatabase(snapshotDatabase)
+    if !ok || owner != username || snapshot != "q1" {
+        t.Errorf("Parsed %s as %s, %s", snapshotDatabase, owner, snapshot)
+    }
+    if _, _, ok = ParseSnapshotDatabase(username); ok {
+        t.Errorf("Username was taken for a snapshot")
+    }
+
+    check(DeleteSnapshot(username, "q1", configs))
+    if err = DeleteSnapshot(username, "q1", configs); !errors.Is(err, types.ErrNotFound) {
+        t.Errorf("Deleting a snapshot twice gave %v", err)
+    }
+    snapshots, err = ListSnapshots(username, configs)
+    if err != nil || len(snapshots) != 1 {
+        t.Errorf("Listed snapshots %v after deleting one: %v", snapshots, err)
+    }
+
+    removeDatabaseStructureAndCheck(t)
+}
+
 // TODO, have to figure out a way to stop the function halfway through
 // can manually extract one of the WAL files that happens in the tests above
 // and run ReplayLog to see if it makes the database do the same thing
@@ -1101,7 +1656,7 @@ func TestRecoveringFromSystemCrash(t *testing.T) {
     username := "atoron"
     filename := "testingFile.txt"
 
-    CreateDatabaseForUser(username, configs)
+    check(CreateDatabaseForUser(username, configs))
 
     addFileHelper(t, filename, username, types.HEADER_SIZE + int64(types.SIZE_OF_ENTRY), 
                   types.HEADER_SIZE, false, 0, 2, configs.Datadisks)
@@ -1129,7 +1684,7 @@ func TestRecoveringFromSystemCrash(t *testing.T) {
 
 
     // try getting an entry now and see if it works out fine
-    entry := GetFileEntry(filename, username, configs)
+    entry, _ := GetFileEntry(filename, username, configs)
     if entry == nil {
         t.Errorf("The entry returned is nil")
         removeDatabaseStructureAndCheck(t)
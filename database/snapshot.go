@@ -0,0 +1,170 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: snapshot.go
+* Date created: 10/16/26
+*
+* Description: snapshots of the database of a user. A snapshot is a copy of
+* the database files of the user (<username>_N) at one point in time, kept
+* in the snapshot folder of every database disk. Its entries refer to the
+* same components as the entries they were copied from, nothing is copied
+* on the data disks. Every function of this package works on a snapshot by
+* passing SnapshotDatabase(username, snapshot) in place of the username.
+*******************************************************************************/
+
+package database
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "path"
+    "io/ioutil"
+    "sort"
+    "strings"
+    "foxyblox/types"
+)
+
+/*
+    Name that the database of the snapshot goes by, in place of a username
+    (the database files are named after it, relative to the database disks)
+*/
+func SnapshotDatabase(username string, snapshot string) string {
+    return path.Join(types.SNAPSHOT_FOLDER, username,
+                     username + types.SNAPSHOT_SEPARATOR + snapshot)
+}
+
+// user and snapshot of a name made by SnapshotDatabase, ok is false for a username
+func ParseSnapshotDatabase(name string) (username string, snapshot string, ok bool) {
+    if !strings.HasPrefix(name, types.SNAPSHOT_FOLDER + "/") {
+        return "", "", false
+    }
+
+    parts := strings.SplitN(strings.TrimPrefix(name, types.SNAPSHOT_FOLDER + "/"), "/", 2)
+    if len(parts) != 2 || !strings.HasPrefix(parts[1], parts[0] + types.SNAPSHOT_SEPARATOR) {
+        return "", "", false
+    }
+    return parts[0], strings.TrimPrefix(parts[1], parts[0] + types.SNAPSHOT_SEPARATOR), true
+}
+
+// error if the snapshot can't be named that
+func checkSnapshotName(snapshot string) error {
+    if snapshot == "" || strings.Contains(snapshot, "/") {
+        return fmt.Errorf("%w: snapshot name %q can't be empty or have a / in it",
+                          types.ErrInvalidName, snapshot)
+    }
+    return nil
+}
+
+/*
+    Copy the database of the user into a new snapshot, types.ErrExists if the
+    user has a snapshot with that name already. The copies are written under
+    temporary names first, and the first database file is put in place last,
+    the snapshot only exists once it is.
+*/
+func CreateSnapshot(username string, snapshot string, configs *types.Config) error {
+    err := checkSnapshotName(snapshot)
+    if err != nil {
+        return err
+    }
+    if !pathExists(configs.Dbdisks[0] + "/" + username + "_0") {
+        return fmt.Errorf("%w: user %s has no database", types.ErrNotFound, username)
+    }
+    snapshotDatabase := SnapshotDatabase(username, snapshot)
+    if pathExists(configs.Dbdisks[0] + "/" + snapshotDatabase + "_0") {
+        return fmt.Errorf("%w: user %s has a snapshot %s", types.ErrExists, username, snapshot)
+    }
+
+    dbFiles := dbFilesForUser(username, configs)
+    snapshotFiles := dbFilesForUser(snapshotDatabase, configs)
+    for i := 0; i < len(dbFiles); i++ {
+        err = os.MkdirAll(path.Dir(snapshotFiles[i]), types.REGULAR_FILE_MODE)
+        if err == nil {
+            err = copyDbFile(dbFiles[i], snapshotFiles[i] + ".tmp")
+        }
+        if err != nil {
+            for _, snapshotFile := range snapshotFiles {
+                os.Remove(snapshotFile + ".tmp")
+            }
+            return err
+        }
+    }
+
+    for i := len(snapshotFiles) - 1; i >= 0; i-- {
+        err = os.Rename(snapshotFiles[i] + ".tmp", snapshotFiles[i])
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// copy the database file to the new path, flushed to its disk
+func copyDbFile(from string, to string) error {
+    source, err := os.Open(from)
+    if err != nil {
+        return err
+    }
+    defer source.Close()
+
+    copied, err := os.Create(to)
+    if err != nil {
+        return err
+    }
+    _, err = io.Copy(copied, source)
+    if err == nil {
+        err = copied.Sync()
+    }
+    closeErr := copied.Close()
+    if err != nil {
+        return err
+    }
+    return closeErr
+}
+
+// names of the snapshots of the user, in order
+func ListSnapshots(username string, configs *types.Config) ([]string, error) {
+    files, err := ioutil.ReadDir(path.Join(configs.Dbdisks[0], types.SNAPSHOT_FOLDER, username))
+    if os.IsNotExist(err) {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+
+    var snapshots []string
+    prefix := username + types.SNAPSHOT_SEPARATOR
+    for _, file := range files {
+        if !file.IsDir() && strings.HasPrefix(file.Name(), prefix) &&
+           strings.HasSuffix(file.Name(), "_0") {
+            snapshots = append(snapshots, strings.TrimSuffix(strings.TrimPrefix(file.Name(),
+                                                                                prefix), "_0"))
+        }
+    }
+    sort.Strings(snapshots)
+
+    return snapshots, nil
+}
+
+/*
+    Remove the database of the snapshot (the first database file first, the
+    snapshot is gone once it is), types.ErrNotFound if there is no such
+    snapshot
+*/
+func DeleteSnapshot(username string, snapshot string, configs *types.Config) error {
+    err := checkSnapshotName(snapshot)
+    if err != nil {
+        return err
+    }
+    snapshotDatabase := SnapshotDatabase(username, snapshot)
+    if !pathExists(configs.Dbdisks[0] + "/" + snapshotDatabase + "_0") {
+        return fmt.Errorf("%w: user %s has no snapshot %s", types.ErrNotFound, username, snapshot)
+    }
+
+    for _, snapshotFile := range dbFilesForUser(snapshotDatabase, configs) {
+        err = os.Remove(snapshotFile)
+        if err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+    return nil
+}
@@ -20,10 +20,10 @@ package transaction
 import (
     "fmt"
     "os"
-    "log"
     "bytes"
     "encoding/binary"
     "path"
+    "foxyblox/hashes"
     "foxyblox/types"
     // "time"
 )
@@ -41,6 +41,7 @@ type Transaction struct {
     ActionAmount int
     WAL *os.File
     Configs *types.Config
+    SizeOfEntry int16 // size of an entry in the database, 0 = compute from configs
 }
 
 type LogEntry struct {
@@ -59,32 +60,31 @@ type WALHeader struct {
     DbFilenames []string // first one should be the disk this corresponds to, and last = parity disk
 }
 
-// check error, exit if non-nil
-func check(err error) {
-    if err != nil {
-        log.Fatal("Exiting: ", err);
-    }
-}
-
 // also needs the parity disk somehow, so can change it in commit
 func New(dbFilenames []string, dbParityFilename string, configs *types.Config) *Transaction {
     // estimate that about 5 actions will happen per transaction, can expand
     // the array when it is full
     actions := make([]*Action, types.INIT_ACTION_SIZE)
-    t := Transaction{dbFilenames, dbParityFilename, actions, 0, nil, configs}
+    t := Transaction{dbFilenames, dbParityFilename, actions, 0, nil, configs, 0}
     return &t
 }
 
-func getWALHeader(logFile *os.File) WALHeader {
+func getWALHeader(logFile *os.File) (WALHeader, error) {
     var SIZE_OF_WAL_HEADER int16 = types.RAW_WAL_HEADER //+  types.MAX_FILE_NAME_SIZE * int16(len(configs.Dbdisks))
     
     buf := make([]byte, SIZE_OF_WAL_HEADER)
     _, err := logFile.ReadAt(buf, 0)
-    check(err)
+    if err != nil {
+        return WALHeader{}, fmt.Errorf("%w: can't read header of log %s: %v", types.ErrCorrupt,
+                                       logFile.Name(), err)
+    }
     diskAmount := buf[2]
     dbdiskBuf := make([]byte, types.MAX_FILE_NAME_SIZE * int16(diskAmount))
     _, err = logFile.ReadAt(dbdiskBuf, int64(SIZE_OF_WAL_HEADER))
-    check(err)
+    if err != nil {
+        return WALHeader{}, fmt.Errorf("%w: can't read database paths of log %s: %v",
+                                       types.ErrCorrupt, logFile.Name(), err)
+    }
 
     var filenames []string = make([]string, diskAmount)
     for i := 0; i < int(diskAmount); i++ {
@@ -93,16 +93,13 @@ func getWALHeader(logFile *os.File) WALHeader {
         filenames[i] = string(bytes.Trim(dbdiskBuf[lowerBound: upperBound], "\x00"))
     }
 
-    var sizeOfEntry int16
-    b := bytes.NewReader(buf[3:5])
-    err = binary.Read(b, binary.LittleEndian, &sizeOfEntry)
-    check(err)
+    sizeOfEntry := int16(binary.LittleEndian.Uint16(buf[3:5]))
 
     header := WALHeader{buf[0], buf[1], buf[2], sizeOfEntry, filenames}
-    return header
+    return header, nil
 }
 
-func headerToBuf(header WALHeader, configs *types.Config) []byte {
+func headerToBuf(header WALHeader, configs *types.Config) ([]byte, error) {
     var SIZE_OF_WAL_HEADER int16 = types.RAW_WAL_HEADER +  types.MAX_FILE_NAME_SIZE * int16(len(configs.Dbdisks))
     buf := make([]byte, SIZE_OF_WAL_HEADER)
     buf[0] = header.Status
@@ -110,25 +107,21 @@ func headerToBuf(header WALHeader, configs *types.Config) []byte {
     buf[2] = header.DbDiskCount
 
     // now the size of the entry
-    bb := new(bytes.Buffer)
-    err := binary.Write(bb, binary.LittleEndian, &header.SizeOfEntry)
-    check(err)
-
-    sizeOfEntryBuf := bb.Bytes()
-    buf[3] = sizeOfEntryBuf[0]
-    buf[4] = sizeOfEntryBuf[1]
+    binary.LittleEndian.PutUint16(buf[3:5], uint16(header.SizeOfEntry))
 
     for i := 0; i < len(header.DbFilenames); i++ {
         lowerBound := types.RAW_WAL_HEADER +  i * types.MAX_PATH_TO_DB
         if len(header.DbFilenames[i]) > types.MAX_PATH_TO_DB {
-            log.Fatal("Length of path to database is too long in headerToBuf")
+            return nil, fmt.Errorf("%w: path to database %s is longer than %d bytes",
+                                   types.ErrNameTooLong, header.DbFilenames[i],
+                                   types.MAX_PATH_TO_DB)
         }
         for j := 0; j < len(header.DbFilenames[i]); j++ {
             buf[lowerBound + j] = header.DbFilenames[i][j]
         }
     }
 
-    return buf
+    return buf, nil
 }
 
 func bufToEntry(buf []byte) LogEntry {
@@ -141,21 +134,10 @@ func bufToEntry(buf []byte) LogEntry {
 }
 
 func bufToPointer(buf []byte) int64 {
-    var pointer int64
-    b := bytes.NewReader(buf)
-    err := binary.Read(b, binary.LittleEndian, &pointer)
-    check(err)
-
-    return pointer
+    return int64(binary.LittleEndian.Uint64(buf))
 }
 
-func HandleActionError(errCode int) {
-    if errCode != 0 {
-        log.Fatal("Exiting: there was an error in adding action")
-    }
-}
-
-// error code: 1 = error, 0 = success, likely error if new data is different length than old
+// error if new data is different length than old, or the log can't be written
 // maybe should be locking the WAL file here
 // assuming that all of the actions are going to be modifying entries, so just
 // going to be adding SIZE_OF_ENTRY data + location of where it goes
@@ -164,9 +146,10 @@ func HandleActionError(errCode int) {
 // size than entry
 // maybe actually can just do variable size changes, and since reading in sequentially
 // in the log file, it's fine anyway (will be more intuitive instead of extending things unecessarily)
-func AddAction(t *Transaction, oldData []byte, newData []byte, location int64) int {
+func AddAction(t *Transaction, oldData []byte, newData []byte, location int64) error {
     if len(newData) != len(oldData) { //|| len(newData) != SIZE_OF_ENTRY
-        return 1
+        return fmt.Errorf("new data of action is %d bytes, old data is %d bytes",
+                          len(newData), len(oldData))
     }
 
     // add it to the in-memory transaction (since the overall amount of memory)
@@ -187,7 +170,9 @@ func AddAction(t *Transaction, oldData []byte, newData []byte, location int64) i
         // DB is stored on from the filename like <atoron_1_WAL> is on drive 1)
         logName := fmt.Sprintf("%s_WAL", path.Base(t.DbFilenames[0]))
         log, err := os.OpenFile(logName, os.O_CREATE | os.O_RDWR, 0755)
-        check(err)
+        if err != nil {
+            return err
+        }
         t.WAL = log
         /* 
             create short header for WAL file:
@@ -196,71 +181,104 @@ func AddAction(t *Transaction, oldData []byte, newData []byte, location int64) i
                 2 bytes = size of an entry in this file
                 16 - (previous) extra bytes of 0s just in case need to add something later
         */
-        var SIZE_OF_ENTRY int16 = types.MAX_FILE_NAME_SIZE + 2*(types.POINTER_SIZE) + int16(t.Configs.DataDiskCount + 1) * int16(types.MAX_DISK_NAME_SIZE) + types.MD5_SIZE
+        SIZE_OF_ENTRY := t.SizeOfEntry
+        if SIZE_OF_ENTRY == 0 { // database didn't say, assume it was created with these configs
+            SIZE_OF_ENTRY = types.MAX_FILE_NAME_SIZE + 2*(types.POINTER_SIZE) + int16(t.Configs.DataDiskCount + t.Configs.ParityDiskCount) * int16(types.MAX_DISK_NAME_SIZE) + types.ENTRY_METADATA_SIZE + int16(hashes.Size(t.Configs.HashAlgorithm))
+        }
         header := WALHeader{0, 0, byte(len(t.Configs.Dbdisks)), SIZE_OF_ENTRY, append(t.DbFilenames, t.DbParityFilename)}
-        headerBuf := headerToBuf(header, t.Configs)
+        headerBuf, err := headerToBuf(header, t.Configs)
+        if err != nil {
+            return err
+        }
     
         var SIZE_OF_WAL_HEADER int16 = types.RAW_WAL_HEADER +  types.MAX_FILE_NAME_SIZE * int16(len(t.Configs.Dbdisks))
 
         // append remaining zeroes
         headerBuf = append(headerBuf, make([]byte, SIZE_OF_WAL_HEADER - int16(len(headerBuf)))...)
         _, err = log.WriteAt(headerBuf, 0)
-        check(err)
+        if err != nil {
+            return err
+        }
     }
 
-    // position of write
-    bb := new(bytes.Buffer)
-    err := binary.Write(bb, binary.LittleEndian, &location)
-    check(err)
-
-    entry := bb.Bytes()
-
-    // size of data
-    sizeOfData := int64(len(newData))
-    bb = new(bytes.Buffer)
-    err = binary.Write(bb, binary.LittleEndian, &sizeOfData)
-    check(err)
-    sizeOfDataBuf := bb.Bytes()
-
-    entry = append(entry, sizeOfDataBuf...)
-
-    // data
+    // position of write, size of data, then the data
+    entry := make([]byte, 2*types.POINTER_SIZE)
+    binary.LittleEndian.PutUint64(entry[0:types.POINTER_SIZE], uint64(location))
+    binary.LittleEndian.PutUint64(entry[types.POINTER_SIZE:2*types.POINTER_SIZE], uint64(len(newData)))
     entry = append(entry, newData...)
 
     // compute insertion point in log
-    header := getWALHeader(t.WAL)
+    header, err := getWALHeader(t.WAL)
+    if err != nil {
+        return err
+    }
 
     // append to the end of the file (exactly where we stopped last time)
-    fileStat, err := t.WAL.Stat(); check(err)
+    fileStat, err := t.WAL.Stat()
+    if err != nil {
+        return err
+    }
     sizeOfLog := fileStat.Size()
     _, err = t.WAL.WriteAt(entry, sizeOfLog)
-    check(err)
+    if err != nil {
+        return err
+    }
 
     t.ActionAmount += 1
     header.EntryCount += 1
 
     // update the header
-    newHeader := headerToBuf(header, t.Configs)
+    newHeader, err := headerToBuf(header, t.Configs)
+    if err != nil {
+        return err
+    }
     _, err = t.WAL.WriteAt(newHeader, 0)
-    check(err)
+    return err
+}
 
-    return 0
+/*
+    Drop the transaction without performing any of its actions (the log was
+    never marked as committed, so it is just removed)
+*/
+func Abort(t *Transaction) {
+    if t.WAL == nil {
+        return
+    }
+    t.WAL.Close()
+    t.WAL = nil
+    os.Remove(fmt.Sprintf("%s_WAL", path.Base(t.DbFilenames[0])))
 }
 
 // should probably lock the database file now, if concurrency is added into the
 // database
 // prevent commit or don't do anything when no actions added
-func Commit(t *Transaction) {
+// error if the commit was not flushed (nothing was changed, the log is
+// removed), or if the actions could not all be performed (the log is kept, and
+// replayed by ReplayLog)
+func Commit(t *Transaction) error {
+    if t.WAL == nil { // no actions
+        return nil
+    }
+
     // mark the header in COMMIT state
-    previousHeader := getWALHeader(t.WAL)
+    previousHeader, err := getWALHeader(t.WAL)
+    if err != nil {
+        Abort(t)
+        return err
+    }
     previousHeader.Status = types.COMMIT
-    commitHeader := headerToBuf(previousHeader, t.Configs)
-    _, err := t.WAL.WriteAt(commitHeader, 0)
-    check(err)
-
-    // flush the COMMIT
-    err = t.WAL.Sync()
-    check(err)
+    commitHeader, err := headerToBuf(previousHeader, t.Configs)
+    if err == nil {
+        _, err = t.WAL.WriteAt(commitHeader, 0)
+    }
+    if err == nil {
+        // flush the COMMIT
+        err = t.WAL.Sync()
+    }
+    if err != nil {
+        Abort(t)
+        return err
+    }
     // actually start performing the actions (can perform the writes to the
     // parity disk here, as well, because if a system crash happens, won't
     // be able to tell one case from another, so will just re-perform all of the
@@ -270,66 +288,112 @@ func Commit(t *Transaction) {
     // can lock the database here
     // TODO: can possibly perform all of these actions in parallel (in separate
     // threads)
+    err = performActions(t)
+    t.WAL.Close()
+    t.WAL = nil
+    if err != nil {
+        // the log stays behind, so the actions are performed again on replay
+        return fmt.Errorf("transaction on %s was committed, but not performed: %v",
+                          t.DbFilenames[0], err)
+    }
+
+    // delete the log file when certain that changes flushed into db
+    logName := fmt.Sprintf("%s_WAL", path.Base(t.DbFilenames[0]))
+    os.Remove(logName)
+
+    return nil
+}
+
+func performActions(t *Transaction) error {
     dbFile, err := os.OpenFile(t.DbFilenames[0], os.O_RDWR, 0755)
-    check(err)
+    if err != nil {
+        return err
+    }
+    defer dbFile.Close()
     dbParityFile, err := os.OpenFile(t.DbParityFilename, os.O_RDWR, 0755)
-    check(err)
+    if err != nil {
+        return err
+    }
+    defer dbParityFile.Close()
+
     for i := 0; i < t.ActionAmount; i++ {
         action := t.Actions[i]
     
         // write to the dbFile
         _, err = dbFile.WriteAt(action.NewData, action.Location)
-        check(err)
+        if err != nil {
+            return err
+        }
 
         // also update the parityFile
         buf := make([]byte, len(action.NewData))
         _, err = dbParityFile.ReadAt(buf, action.Location)
-        check(err)
+        if err != nil {
+            return err
+        }
 
         for j := 0; j < len(buf); j++ {
             buf[j] ^= action.OldData[j] ^ action.NewData[j] // old data ^ new data
         }
 
         _, err = dbParityFile.WriteAt(buf, action.Location)
-        check(err)
+        if err != nil {
+            return err
+        }
     }
 
     // flush the changes to the database (including parity disk)
     err = dbFile.Sync()
-    check(err)
-    err = dbParityFile.Sync()
-    check(err)
-
-    // delete the log file when certain that changes flushed into db
-    t.WAL.Close()
-    logName := fmt.Sprintf("%s_WAL", path.Base(t.DbFilenames[0]))
-    os.Remove(logName)
-
-    // clean up
-    dbFile.Close()
-    dbParityFile.Close()
+    if err != nil {
+        return err
+    }
+    return dbParityFile.Sync()
 }
 
 // replay all of the actions on the log (write all of the data into the
 // original disk, and compute parity as XOR of all three drives from
-// scratch)
-func ReplayLog(logName string) {
+// scratch), error if the log can't be replayed (it is kept to try again)
+func ReplayLog(logName string) error {
     log, err := os.Open(logName)
-    check(err) // maybe should just assume not well-formed and delete in this case
+    if err != nil {
+        return err
+    }
 
     // check if the header is well-formed, otherwise the log was not
     // committed yet
-    header := getWALHeader(log)
-    if header.Status != types.COMMIT {
+    header, err := getWALHeader(log)
+    if err != nil || header.Status != types.COMMIT {
         log.Close()
         os.Remove(logName)
-        return
+        return nil
+    }
+
+    err = replayEntries(log, header)
+    log.Close()
+    if err != nil {
+        return fmt.Errorf("can't replay log %s: %v", logName, err)
     }
 
+    // invalidate the log first (write 0 to the commit status bit)
+    // ^ don't think that needs to be done, b/c deleting a file is relatively atomic
+
+    // delete the log file when certain that changes flushed into db
+    os.Remove(logName)
+
+    return nil
+}
+
+func replayEntries(log *os.File, header WALHeader) error {
     dbFile, err := os.OpenFile(header.DbFilenames[0], os.O_RDWR, 0755)
-    check(err)
+    if err != nil {
+        return err
+    }
+    defer dbFile.Close()
     dbParityFile, err := os.OpenFile(header.DbFilenames[len(header.DbFilenames) - 1], os.O_RDWR, 0755)
-    check(err)
+    if err != nil {
+        return err
+    }
+    defer dbParityFile.Close()
 
     var SIZE_OF_WAL_HEADER int16 = types.RAW_WAL_HEADER +  types.MAX_FILE_NAME_SIZE * int16(len(header.DbFilenames))
     var SIZE_OF_ENTRY int = int(header.SizeOfEntry)
@@ -338,7 +402,9 @@ func ReplayLog(logName string) {
         // read in the location and size of the next component
         buf := make([]byte, 2*types.POINTER_SIZE)
         _, err = log.ReadAt(buf, currentPosition)
-        check(err)
+        if err != nil {
+            return err
+        }
         location := bufToPointer(buf[0:types.POINTER_SIZE])
         size := bufToPointer(buf[types.POINTER_SIZE:2*types.POINTER_SIZE])
         currentPosition += 2*types.POINTER_SIZE
@@ -346,32 +412,26 @@ func ReplayLog(logName string) {
         // read in the actual data
         buf = make([]byte, size)
         _, err = log.ReadAt(buf, currentPosition)
-        check(err)
+        if err != nil {
+            return err
+        }
 
         entry := LogEntry{location, size, buf}
         currentPosition += size
         
         // write to database file
         _, err = dbFile.WriteAt(entry.NewData, entry.Location)
-        check(err)
+        if err != nil {
+            return err
+        }
 
         // recompute parity disk at this location
         parityBuf := entry.NewData
         for j := 1; j < len(header.DbFilenames); j++ {
             // filename = path in this case
-            otherDb, err := os.Open(header.DbFilenames[j])
-            check(err)
-
-            otherDbBuf := make([]byte, SIZE_OF_ENTRY)
-            fileStat, err := otherDb.Stat(); check(err)
-            sizeOfDb := fileStat.Size()
-            if entry.Location + int64(SIZE_OF_ENTRY) < sizeOfDb {
-                // if read was out of bounds of the file, then must have been in the
-                // middle of resizing the databases, so should just assume it to be 0
-
-                // this case is fine though
-                _, err = otherDb.ReadAt(otherDbBuf, entry.Location)
-                check(err)
+            otherDbBuf, err := readOtherDb(header.DbFilenames[j], entry.Location, SIZE_OF_ENTRY)
+            if err != nil {
+                return err
             }
 
             for k := 0; k < SIZE_OF_ENTRY; k++ {
@@ -381,30 +441,43 @@ func ReplayLog(logName string) {
 
         // write it to the parity disk
         _, err = dbParityFile.WriteAt(parityBuf, entry.Location)
-        check(err)
+        if err != nil {
+            return err
+        }
     }
 
     // flush the re-done changes to the database (including parity disk)
     err = dbFile.Sync()
-    check(err)
-    err = dbParityFile.Sync()
-    check(err)
-
-    // invalidate the log first (write 0 to the commit status bit)
-    // ^ don't think that needs to be done, b/c deleting a file is relatively atomic
-
-    // delete the log file when certain that changes flushed into db
-    log.Close()
-    os.Remove(logName)
+    if err != nil {
+        return err
+    }
+    return dbParityFile.Sync()
+}
 
-    // clean up
-    dbFile.Close()
-    dbParityFile.Close()
-    for i := 1; i < len(header.DbFilenames); i++ {
-        // filename = path in this case
-        otherDb, err := os.Open(header.DbFilenames[i])
-        check(err)
+// size bytes at location of the database at path, 0s past the end of it
+func readOtherDb(path string, location int64, size int) ([]byte, error) {
+    otherDb, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer otherDb.Close()
 
-        otherDb.Close()
+    otherDbBuf := make([]byte, size)
+    fileStat, err := otherDb.Stat()
+    if err != nil {
+        return nil, err
+    }
+    sizeOfDb := fileStat.Size()
+    if location + int64(size) < sizeOfDb {
+        // if read was out of bounds of the file, then must have been in the
+        // middle of resizing the databases, so should just assume it to be 0
+
+        // this case is fine though
+        _, err = otherDb.ReadAt(otherDbBuf, location)
+        if err != nil {
+            return nil, err
+        }
     }
-}
\ No newline at end of file
+
+    return otherDbBuf, nil
+}
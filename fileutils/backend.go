@@ -0,0 +1,283 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: backend.go
+* Date created: 10/16/26
+*
+* Description: defines the storage backends that components of a file are
+* saved to. Every disk location is parsed by its URI scheme (file://, s3://,
+* sftp://, etc.) into a backend, plain paths are treated as local directories.
+*******************************************************************************/
+
+package fileutils
+
+import (
+    "fmt"
+    "os"
+    "io"
+    "io/ioutil"
+    "net/url"
+    "path/filepath"
+    "strings"
+    "sync"
+    "foxyblox/types"
+)
+
+/*
+    A single component (strip or parity strip) of a saved file, as handed out
+    by a backend. *os.File satisfies this, other backends can stage the
+    component however they want as long as random access reads and writes
+    are possible.
+*/
+type Component interface {
+    io.ReaderAt
+    io.WriterAt
+    io.Closer
+    Stat() (os.FileInfo, error)
+    // flush what was written to the component to its disk
+    Sync() error
+    Name() string
+}
+
+/*
+    A place that components can be stored in. Names given to a backend are
+    always relative to the root of the location that the backend was opened
+    for, and use "/" as the separator (i.e. "<username>/<filename>_<ID>").
+*/
+type Backend interface {
+    // open an existing component for reading
+    OpenComponent(name string) (Component, error)
+    // create (or truncate) a component for writing, creating any parent
+    // folders that are necessary
+    CreateComponent(name string) (Component, error)
+    // open an existing component for reading and writing in place (to
+    // repair damaged blocks of it)
+    UpdateComponent(name string) (Component, error)
+    RemoveComponent(name string) error
+    // move a component to a new name, replacing what is there at once
+    // (creating any parent folders that are necessary)
+    RenameComponent(oldName string, newName string) error
+    StatComponent(name string) (os.FileInfo, error)
+    // list the contents of a folder in the backend
+    List(dir string) ([]os.FileInfo, error)
+}
+
+/*
+    Creates a backend for a parsed location, registered per URI scheme
+*/
+type BackendFactory func(location *url.URL) (Backend, error)
+
+var backendFactories = map[string]BackendFactory{
+    "file": newLocalBackendFromURL,
+}
+var backendFactoriesLock sync.Mutex
+
+/*
+    Make a backend available for all locations with the given scheme, such
+    as "s3" or "sftp". Registering a scheme again replaces the old factory.
+*/
+func RegisterBackend(scheme string, factory BackendFactory) {
+    backendFactoriesLock.Lock()
+    defer backendFactoriesLock.Unlock()
+
+    backendFactories[strings.ToLower(scheme)] = factory
+}
+
+/*
+    Parse a disk location and return the backend responsible for it. Plain
+    paths (no "<scheme>://" prefix) keep working as local directories, so that
+    existing configs and database entries stay valid.
+*/
+func OpenBackend(location string) (Backend, error) {
+    if !strings.Contains(location, "://") {
+        return &localBackend{root: location}, nil
+    }
+
+    parsed, err := url.Parse(location)
+    if err != nil {
+        return nil, fmt.Errorf("could not parse disk location %s: %v", location, err)
+    }
+
+    backendFactoriesLock.Lock()
+    factory, ok := backendFactories[strings.ToLower(parsed.Scheme)]
+    backendFactoriesLock.Unlock()
+    if !ok {
+        return nil, fmt.Errorf("no storage backend registered for scheme %q (location %s)",
+                               parsed.Scheme, location)
+    }
+
+    return factory(parsed)
+}
+
+/*
+    The location written the same way however it was spelled, so that
+    locations can be compared: local folders (plain paths and file:// URLs)
+    are absolute, clean paths ("storage/drive0", "./storage/drive0/" and
+    "file://storage/drive0" are the same folder), other locations are kept as
+    they are
+*/
+func canonicalLocation(location string) string {
+    root := location
+    if strings.Contains(location, "://") {
+        parsed, err := url.Parse(location)
+        if err != nil || strings.ToLower(parsed.Scheme) != "file" {
+            return location
+        }
+        root = parsed.Host + parsed.Path
+    }
+
+    absRoot, err := filepath.Abs(root)
+    if err != nil {
+        return filepath.Clean(root)
+    }
+    return absRoot
+}
+
+// open the backends for all of the locations, in the same order
+func openBackends(diskLocations []string) ([]Backend, error) {
+    backends := make([]Backend, len(diskLocations))
+    for i := 0; i < len(diskLocations); i++ {
+        backend, err := OpenBackend(diskLocations[i])
+        if err != nil {
+            return nil, err
+        }
+        backends[i] = backend
+    }
+
+    return backends, nil
+}
+
+/*
+    Name that the components of the file are saved under. A file that was
+    saved again or re-encoded (generation > 0) gets components with new
+    names, in a folder of the generation, so that the old components can stay
+    (as a past version, or until the new ones are in place).
+*/
+func storedFilename(filename string, layout types.Layout) string {
+    if layout.Generation == 0 {
+        return filename
+    }
+    return fmt.Sprintf(".g%d/%s", layout.Generation, filename)
+}
+
+// name of the data component with the given ID, relative to a backend
+func componentName(username string, filename string, ID int) string {
+    return fmt.Sprintf("%s/%s_%d", username, filename, ID)
+}
+
+/*
+    name of the parity component with the given index, relative to a backend
+    (first one keeps the original "_p" name, so RAID 4 files stay readable)
+*/
+func parityComponentName(username string, filename string, index int) string {
+    if index == 0 {
+        return fmt.Sprintf("%s/%s_p", username, filename)
+    }
+    return fmt.Sprintf("%s/%s_p%d", username, filename, index)
+}
+
+/*
+    name of the component with the given ID in a file split into dataCount
+    data components (IDs >= dataCount are the parity components)
+*/
+func componentNameForID(username string, filename string, ID int, dataCount int) string {
+    if ID < dataCount {
+        return componentName(username, filename, ID)
+    }
+    return parityComponentName(username, filename, ID - dataCount)
+}
+
+/*
+    name of the component saved to the given location, striped files keep one
+    component per location, with the parity units spread across all of them
+*/
+func locationComponentName(username string, filename string, location int,
+                           layout types.Layout) string {
+    if layout.Striping == types.STRIPING_ROTATING {
+        return componentName(username, filename, location)
+    }
+    return componentNameForID(username, filename, location, layout.DataCount)
+}
+
+/*
+    Name of the location of a backend in errors, backends can name themselves
+    by implementing fmt.Stringer (the local backend is named by its directory)
+*/
+func backendName(backend Backend, location int) string {
+    if limited, ok := backend.(*limitedBackend); ok { // see scrub.go
+        backend = limited.Backend
+    }
+    if named, ok := backend.(fmt.Stringer); ok {
+        return named.String()
+    }
+    return fmt.Sprintf("location %d", location)
+}
+
+/*
+    Local backend - a directory on a disk that is mounted on this server
+    (localhost folders, EBS volumes, etc.)
+*/
+type localBackend struct {
+    root string
+}
+
+// file:///abs/path and file://relative/path both map to local directories
+func newLocalBackendFromURL(location *url.URL) (Backend, error) {
+    root := location.Host + location.Path
+    if root == "" {
+        return nil, fmt.Errorf("empty path in disk location %s", location.String())
+    }
+
+    return &localBackend{root: root}, nil
+}
+
+func (b *localBackend) String() string {
+    return b.root
+}
+
+func (b *localBackend) path(name string) string {
+    return filepath.Join(b.root, filepath.FromSlash(name))
+}
+
+func (b *localBackend) OpenComponent(name string) (Component, error) {
+    return os.Open(b.path(name))
+}
+
+func (b *localBackend) CreateComponent(name string) (Component, error) {
+    path := b.path(name)
+    if !pathExists(filepath.Dir(path)) {
+        err := os.MkdirAll(filepath.Dir(path), 0755)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return openFile(path)
+}
+
+func (b *localBackend) UpdateComponent(name string) (Component, error) {
+    return os.OpenFile(b.path(name), os.O_RDWR, 0)
+}
+
+func (b *localBackend) RemoveComponent(name string) error {
+    return os.Remove(b.path(name))
+}
+
+func (b *localBackend) RenameComponent(oldName string, newName string) error {
+    path := b.path(newName)
+    if !pathExists(filepath.Dir(path)) {
+        err := os.MkdirAll(filepath.Dir(path), 0755)
+        if err != nil {
+            return err
+        }
+    }
+
+    return os.Rename(b.path(oldName), path)
+}
+
+func (b *localBackend) StatComponent(name string) (os.FileInfo, error) {
+    return os.Stat(b.path(name))
+}
+
+func (b *localBackend) List(dir string) ([]os.FileInfo, error) {
+    return ioutil.ReadDir(b.path(dir))
+}
@@ -0,0 +1,486 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: component.go
+* Date created: 10/16/26
+*
+* Description: format of the components on disk. A component is its data,
+* followed by a trailer with the hash of every block of the data (so that
+* corruption can be pinned down to a block, and only that block rebuilt):
+*
+*   [data] [block hashes] [data size, 8 bytes] [block size, 8 bytes]
+*   [hash of all of the above trailer] [hash algorithm, 1 byte]
+*   [format version, 1 byte] [COMPONENT_MAGIC]
+*
+* All of the hashes are made with the algorithm in the trailer (see package
+* hashes). Version 1 trailers don't have the algorithm byte, and always use
+* MD5. Components written before the trailer existed are [data] [MD5 of
+* data]. Both can still be read (damaged ones are rebuilt in the current
+* format).
+*******************************************************************************/
+
+package fileutils
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash"
+    "strings"
+    "foxyblox/hashes"
+    "foxyblox/types"
+)
+
+const COMPONENT_MAGIC = "FXBC"
+const COMPONENT_FORMAT_MD5 uint8 = 1 // no hash algorithm in the trailer, always MD5
+const COMPONENT_FORMAT_VERSION uint8 = 2
+
+/*
+    Size of everything in the trailer after the block hashes: data size +
+    block size + hash of the trailer + (algorithm) + version + magic
+*/
+func componentFooterSize(version uint8, algorithm int) int {
+    size := 8 + 8 + hashes.Size(algorithm) + 1 + len(COMPONENT_MAGIC)
+    if version != COMPONENT_FORMAT_MD5 {
+        size++
+    }
+    return size
+}
+
+// new hash for a component, the algorithm has already been checked (by
+// checkLayout, or when the trailer was read), so it is always known here
+func newHash(algorithm int) hash.Hash {
+    h, _ := hashes.New(algorithm)
+    return h
+}
+
+/*
+    What was found to be wrong with a component when it was checked, nil
+    means that the component is intact
+*/
+type componentDamage struct {
+    whole bool // missing, unreadable, or can't tell which blocks are bad
+    blocks []int64 // indices of the blocks that don't match their hashes
+}
+
+// true if the block with the given index has to be rebuilt
+func (d *componentDamage) hasBlock(block int64) bool {
+    if d == nil {
+        return false
+    }
+    if d.whole {
+        return true
+    }
+    for _, other := range d.blocks {
+        if other == block {
+            return true
+        }
+    }
+    return false
+}
+
+var wholeComponentDamage = &componentDamage{whole: true}
+
+// contents of the trailer of a component
+type componentInfo struct {
+    dataSize int64
+    blockSize int64 // 0 for components in the old format
+    blockHashes [][]byte
+    legacyHash []byte // hash of the whole data, for components in the old format
+    algorithm int // hash algorithm of all of the hashes
+}
+
+/*
+    Hashes the data of a component as it is written (in order), one hash per
+    block of blockSize bytes
+*/
+type componentHasher struct {
+    blockSize int64
+    algorithm int
+    current hash.Hash
+    inBlock int64
+    dataSize int64
+    blockHashes [][]byte
+}
+
+func newComponentHasher(blockSize int64, algorithm int) *componentHasher {
+    return &componentHasher{blockSize: blockSize, algorithm: algorithm,
+                            current: newHash(algorithm)}
+}
+
+func (h *componentHasher) Write(p []byte) (int, error) {
+    written := len(p)
+    for len(p) > 0 {
+        n := h.blockSize - h.inBlock
+        if n > int64(len(p)) {
+            n = int64(len(p))
+        }
+
+        h.current.Write(p[0:n])
+        h.inBlock += n
+        h.dataSize += n
+        p = p[n:]
+
+        if h.inBlock == h.blockSize {
+            h.blockHashes = append(h.blockHashes, h.current.Sum(nil))
+            h.current = newHash(h.algorithm)
+            h.inBlock = 0
+        }
+    }
+
+    return written, nil
+}
+
+// hashes of all of the blocks, including the last one (may not be full)
+func (h *componentHasher) finish() [][]byte {
+    if h.inBlock > 0 {
+        h.blockHashes = append(h.blockHashes, h.current.Sum(nil))
+        h.current = newHash(h.algorithm)
+        h.inBlock = 0
+    }
+    return h.blockHashes
+}
+
+// trailer to write right after the data of the component
+func (h *componentHasher) trailer() []byte {
+    blockHashes := h.finish()
+
+    footerSize := componentFooterSize(COMPONENT_FORMAT_VERSION, h.algorithm)
+    trailer := make([]byte, 0, len(blockHashes) * hashes.Size(h.algorithm) + footerSize)
+    for _, blockHash := range blockHashes {
+        trailer = append(trailer, blockHash...)
+    }
+
+    sizes := make([]byte, 16)
+    binary.LittleEndian.PutUint64(sizes[0:8], uint64(h.dataSize))
+    binary.LittleEndian.PutUint64(sizes[8:16], uint64(h.blockSize))
+    trailer = append(trailer, sizes...)
+
+    trailerHash := newHash(h.algorithm)
+    trailerHash.Write(trailer)
+    trailer = trailerHash.Sum(trailer)
+    trailer = append(trailer, byte(h.algorithm), COMPONENT_FORMAT_VERSION)
+    trailer = append(trailer, COMPONENT_MAGIC...)
+
+    return trailer
+}
+
+/*
+    Read the trailer of the component, an error means that the trailer is
+    damaged (so nothing in the component can be trusted)
+*/
+func readComponentInfo(file Component) (*componentInfo, error) {
+    fileStat, err := file.Stat()
+    if err != nil {
+        return nil, err
+    }
+    size := fileStat.Size()
+
+    magic := make([]byte, len(COMPONENT_MAGIC))
+    if size >= int64(len(magic)) {
+        _, err = file.ReadAt(magic, size - int64(len(magic)))
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    if string(magic) != COMPONENT_MAGIC {
+        // old format, just the hash of the data at the end
+        if size < types.MD5_SIZE {
+            return nil, fmt.Errorf("%w: component is too short to have a hash", types.ErrCorrupt)
+        }
+        legacyHash := make([]byte, types.MD5_SIZE)
+        _, err = file.ReadAt(legacyHash, size - types.MD5_SIZE)
+        if err != nil {
+            return nil, err
+        }
+        return &componentInfo{dataSize: size - types.MD5_SIZE, legacyHash: legacyHash,
+                              algorithm: types.HASH_MD5}, nil
+    }
+
+    // version, and the hash algorithm right before it (from version 2 on)
+    versionBuf := make([]byte, 2)
+    if size < int64(len(versionBuf) + len(COMPONENT_MAGIC)) {
+        return nil, fmt.Errorf("%w: component is too short to have a trailer", types.ErrCorrupt)
+    }
+    _, err = file.ReadAt(versionBuf, size - int64(len(versionBuf) + len(COMPONENT_MAGIC)))
+    if err != nil {
+        return nil, err
+    }
+
+    version := versionBuf[1]
+    algorithm := types.HASH_MD5
+    if version == COMPONENT_FORMAT_VERSION {
+        algorithm = int(versionBuf[0])
+    } else if version != COMPONENT_FORMAT_MD5 {
+        return nil, fmt.Errorf("%w: unsupported component format version %d", types.ErrCorrupt,
+                               version)
+    }
+    hashSize := int64(hashes.Size(algorithm))
+    if hashSize == 0 {
+        return nil, fmt.Errorf("%w: unknown hash algorithm %d in component trailer",
+                               types.ErrCorrupt, algorithm)
+    }
+
+    footerSize := int64(componentFooterSize(version, algorithm))
+    if size < footerSize {
+        return nil, fmt.Errorf("%w: component is too short to have a trailer", types.ErrCorrupt)
+    }
+    footer := make([]byte, footerSize)
+    _, err = file.ReadAt(footer, size - footerSize)
+    if err != nil {
+        return nil, err
+    }
+
+    dataSize := int64(binary.LittleEndian.Uint64(footer[0:8]))
+    blockSize := int64(binary.LittleEndian.Uint64(footer[8:16]))
+    if dataSize < 0 || blockSize < 1 {
+        return nil, fmt.Errorf("%w: sizes in the component trailer are invalid", types.ErrCorrupt)
+    }
+    blockCount := (dataSize + blockSize - 1) / blockSize
+    tableStart := size - footerSize - blockCount * hashSize
+    if tableStart != dataSize {
+        return nil, fmt.Errorf("%w: sizes in the component trailer are invalid", types.ErrCorrupt)
+    }
+
+    // everything before the hash of the trailer
+    trailer := make([]byte, blockCount * hashSize + 16)
+    _, err = file.ReadAt(trailer, tableStart)
+    if err != nil {
+        return nil, err
+    }
+    trailerHash := newHash(algorithm)
+    trailerHash.Write(trailer)
+    if !bytes.Equal(trailerHash.Sum(nil), footer[16:16 + hashSize]) {
+        return nil, fmt.Errorf("%w: component trailer does not match its hash", types.ErrCorrupt)
+    }
+
+    info := &componentInfo{dataSize: dataSize, blockSize: blockSize,
+                           blockHashes: make([][]byte, blockCount), algorithm: algorithm}
+    for i := int64(0); i < blockCount; i++ {
+        info.blockHashes[i] = trailer[i * hashSize:(i + 1) * hashSize]
+    }
+
+    return info, nil
+}
+
+/*
+    Checks the data of a component against its trailer, as the data is read
+    (in order)
+*/
+type componentVerifier struct {
+    info *componentInfo
+    hasher *componentHasher // new format
+    legacyHasher hash.Hash // old format
+}
+
+func newComponentVerifier(info *componentInfo) *componentVerifier {
+    if info.blockSize == 0 {
+        return &componentVerifier{info: info, legacyHasher: newHash(info.algorithm)}
+    }
+    return &componentVerifier{info: info, hasher: newComponentHasher(info.blockSize, info.algorithm)}
+}
+
+func (v *componentVerifier) Write(p []byte) (int, error) {
+    if v.legacyHasher != nil {
+        return v.legacyHasher.Write(p)
+    }
+    return v.hasher.Write(p)
+}
+
+// damage found once all of the data has been written, nil if there is none
+func (v *componentVerifier) damage() *componentDamage {
+    if v.legacyHasher != nil {
+        if !bytes.Equal(v.legacyHasher.Sum(nil), v.info.legacyHash) {
+            return wholeComponentDamage
+        }
+        return nil
+    }
+
+    blockHashes := v.hasher.finish()
+    if len(blockHashes) != len(v.info.blockHashes) {
+        return wholeComponentDamage
+    }
+
+    var damage *componentDamage
+    for i := 0; i < len(blockHashes); i++ {
+        if !bytes.Equal(blockHashes[i], v.info.blockHashes[i]) {
+            if damage == nil {
+                damage = &componentDamage{}
+            }
+            damage.blocks = append(damage.blocks, int64(i))
+        }
+    }
+
+    return damage
+}
+
+// verify the region of the component against the hashes of the blocks it is in
+func (info *componentInfo) verifyRegion(file Component, offset int64, buf []byte) error {
+    damage, err := info.checkRegion(file, offset, buf)
+    if err == nil && damage != nil {
+        return fmt.Errorf("%w: block %d of %s does not match its hash", types.ErrCorrupt,
+                          damage.blocks[0], file.Name())
+    }
+    return err
+}
+
+/*
+    Read the region of the component into buf, checking the blocks it is in
+    against their hashes. Returns the blocks that don't match (nil if they
+    all do, buf is only filled then), an error if the region can't be read.
+*/
+func (info *componentInfo) checkRegion(file Component, offset int64,
+                                       buf []byte) (*componentDamage, error) {
+    if info.blockSize == 0 { // old format, only the whole component can be checked
+        _, err := file.ReadAt(buf, offset)
+        return nil, err
+    }
+    if offset + int64(len(buf)) > info.dataSize {
+        return nil, errors.New("region is past the end of the component")
+    }
+    if len(buf) == 0 {
+        return nil, nil
+    }
+
+    firstBlock := offset / info.blockSize
+    lastBlock := (offset + int64(len(buf)) - 1) / info.blockSize
+    start := firstBlock * info.blockSize
+    end := (lastBlock + 1) * info.blockSize
+    if end > info.dataSize {
+        end = info.dataSize
+    }
+
+    blocks := make([]byte, end - start)
+    _, err := file.ReadAt(blocks, start)
+    if err != nil {
+        return nil, err
+    }
+
+    var damage *componentDamage
+    for block := firstBlock; block <= lastBlock; block++ {
+        blockEnd := (block + 1) * info.blockSize
+        if blockEnd > end {
+            blockEnd = end
+        }
+        blockHash := newHash(info.algorithm)
+        blockHash.Write(blocks[block * info.blockSize - start:blockEnd - start])
+        if !bytes.Equal(blockHash.Sum(nil), info.blockHashes[block]) {
+            if damage == nil {
+                damage = &componentDamage{}
+            }
+            damage.blocks = append(damage.blocks, block)
+        }
+    }
+    if damage != nil {
+        return damage, nil
+    }
+
+    copy(buf, blocks[offset - start:])
+    return nil, nil
+}
+
+/*
+    Read through the whole component and check it against its trailer,
+    returns nil if it is intact
+*/
+func checkComponent(backend Backend, name string) *componentDamage {
+    file, err := backend.OpenComponent(name)
+    if err != nil {
+        return wholeComponentDamage
+    }
+    defer file.Close()
+
+    info, err := readComponentInfo(file)
+    if err != nil {
+        return wholeComponentDamage
+    }
+
+    verifier := newComponentVerifier(info)
+    buf := make([]byte, types.MAX_BUFFER_SIZE)
+    for position := int64(0); position < info.dataSize; {
+        if info.dataSize - position < int64(len(buf)) {
+            buf = buf[0:info.dataSize - position]
+        }
+
+        _, err = file.ReadAt(buf, position)
+        if err != nil {
+            return wholeComponentDamage
+        }
+        verifier.Write(buf)
+
+        position += int64(len(buf))
+    }
+
+    return verifier.damage()
+}
+
+// size of the data in the component (without the trailer)
+func componentDataSize(file Component) (int64, error) {
+    info, err := readComponentInfo(file)
+    if err != nil {
+        return 0, err
+    }
+    return info.dataSize, nil
+}
+
+/*
+    Error if some block is damaged on more components than the layout can
+    rebuild (checked before anything is rewritten), naming the locations
+    that are damaged
+*/
+func checkRecoverable(damage []*componentDamage, filename string, layout types.Layout,
+                      backends []Backend) error {
+    componentCount := layout.DataCount + layout.ParityCount
+
+    var whole []int
+    var blocks []int64
+    for location, d := range damage {
+        if d != nil && d.whole {
+            whole = append(whole, location)
+        } else if d != nil {
+            blocks = append(blocks, d.blocks...)
+        }
+    }
+
+    worst := whole
+    for _, block := range blocks {
+        var damaged []int
+        for location, d := range damage {
+            if d.hasBlock(block) {
+                damaged = append(damaged, location)
+            }
+        }
+        if len(damaged) > len(worst) {
+            worst = damaged
+        }
+    }
+
+    if len(worst) > layout.ParityCount {
+        names := make([]string, len(worst))
+        for i, location := range worst {
+            names[i] = backendName(backends[location], location)
+        }
+        return fmt.Errorf("%w: %d of %d components damaged (%s), %s can only be recovered from %d",
+                          types.ErrUnrecoverable, len(worst), componentCount,
+                          strings.Join(names, ", "), filename, layout.ParityCount)
+    }
+    return nil
+}
+
+/*
+    A location is unavailable when its root can't be listed (a drive that is
+    not mounted, a bucket that is gone), components are not rebuilt there
+*/
+func locationAvailable(backend Backend) bool {
+    _, err := backend.List("")
+    return err == nil
+}
+
+// size of the blocks that are hashed separately in the components of a file
+func componentBlockSize(layout types.Layout) int64 {
+    if layout.Striping == types.STRIPING_ROTATING {
+        return layout.StripeSize // one block per stripe
+    }
+    return types.COMPONENT_BLOCK_SIZE
+}
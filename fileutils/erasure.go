@@ -0,0 +1,319 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: erasure.go
+* Date created: 10/16/26
+*
+* Description: Galois field (GF(2^8)) arithmetic and the coding matrices used
+* to compute parity components. Every layout is a systematic code: the data
+* components are stored as is, and parity component j is the sum (XOR) of
+* coefficient[j][i] * (data component i) over all data components i.
+*******************************************************************************/
+
+package fileutils
+
+import (
+    "errors"
+    "fmt"
+    "foxyblox/hashes"
+    "foxyblox/types"
+)
+
+/*
+    GF(2^8) with the primitive polynomial x^8 + x^4 + x^3 + x^2 + 1 (0x11d),
+    addition is XOR, multiplication goes through the log/exp tables
+*/
+const GALOIS_POLYNOMIAL = 0x11d
+
+var galExp [510]byte
+var galLog [256]int
+
+func init() {
+    x := 1
+    for i := 0; i < 255; i++ {
+        galExp[i] = byte(x)
+        galExp[i + 255] = byte(x) // avoids having to take log sums mod 255
+        galLog[x] = i
+        x <<= 1
+        if x & 0x100 != 0 {
+            x ^= GALOIS_POLYNOMIAL
+        }
+    }
+}
+
+func galMul(a byte, b byte) byte {
+    if a == 0 || b == 0 {
+        return 0
+    }
+    return galExp[galLog[a] + galLog[b]]
+}
+
+func galInverse(a byte) byte {
+    if a == 0 {
+        panic("galInverse: 0 has no inverse")
+    }
+    return galExp[255 - galLog[a]]
+}
+
+// dst ^= c * src, for the overlapping length of the slices
+func galMulSliceXor(c byte, src []byte, dst []byte) {
+    if c == 0 {
+        return
+    }
+    if c == 1 { // plain parity, no need to go through the tables
+        for i := 0; i < len(src) && i < len(dst); i++ {
+            dst[i] ^= src[i]
+        }
+        return
+    }
+
+    logC := galLog[c]
+    for i := 0; i < len(src) && i < len(dst); i++ {
+        if src[i] != 0 {
+            dst[i] ^= galExp[logC + galLog[src[i]]]
+        }
+    }
+}
+
+/*
+    Returns the coefficients of the parity components for the layout, one row
+    per parity component, one column per data component:
+        XOR_SCHEME - single row of 1s (RAID 4)
+        PQ_SCHEME - row of 1s (P, same as RAID 4) and row of g^i (Q), where
+        g = 2 is the generator of the field (RAID 6), so any two missing
+        components can be rebuilt as long as there are at most 255 data
+        components
+        RS_SCHEME - Cauchy matrix 1 / (x_j + y_i), x_j = k + j, y_i = i, any
+        square submatrix of it is invertible, so any k of the k + m
+        components are enough to rebuild the rest
+        MIRROR_SCHEME - a single data component, and a 1 in every row, so
+        every parity component is a copy of it
+*/
+func parityCoefficients(layout types.Layout) [][]byte {
+    coefficients := make([][]byte, layout.ParityCount)
+    for j := 0; j < layout.ParityCount; j++ {
+        coefficients[j] = make([]byte, layout.DataCount)
+        for i := 0; i < layout.DataCount; i++ {
+            switch layout.Scheme {
+                case types.RS_SCHEME:
+                    coefficients[j][i] = galInverse(byte(layout.DataCount + j) ^ byte(i))
+                case types.PQ_SCHEME:
+                    if j == 0 {
+                        coefficients[j][i] = 1
+                    } else {
+                        coefficients[j][i] = galExp[i]
+                    }
+                default:
+                    coefficients[j][i] = 1
+            }
+        }
+    }
+
+    return coefficients
+}
+
+/*
+    Make sure that the layout can actually be used to distribute a file over
+    locationCount locations
+*/
+func checkLayout(layout types.Layout, locationCount int) error {
+    if layout.DataCount < 1 || layout.ParityCount < 1 {
+        return fmt.Errorf("%w: layout needs at least one data and one parity component, got %d+%d",
+                          types.ErrInvalidLayout, layout.DataCount, layout.ParityCount)
+    }
+    if layout.DataCount + layout.ParityCount != locationCount {
+        return fmt.Errorf("%w: layout %d+%d does not match the %d locations given",
+                          types.ErrInvalidLayout, layout.DataCount, layout.ParityCount, locationCount)
+    }
+
+    switch layout.Scheme {
+        case types.XOR_SCHEME:
+            if layout.ParityCount != 1 {
+                return fmt.Errorf("%w: XOR parity supports exactly one parity component, got %d",
+                                  types.ErrInvalidLayout, layout.ParityCount)
+            }
+        case types.PQ_SCHEME:
+            if layout.ParityCount != 2 {
+                return fmt.Errorf("%w: P+Q parity needs exactly two parity components, got %d",
+                                  types.ErrInvalidLayout, layout.ParityCount)
+            }
+            if layout.DataCount > 255 {
+                return fmt.Errorf("%w: P+Q parity supports at most 255 data components",
+                                  types.ErrInvalidLayout)
+            }
+        case types.MIRROR_SCHEME:
+            if layout.DataCount != 1 || layout.Striping != types.STRIPING_NONE {
+                return fmt.Errorf("%w: a mirror has a single data component in a whole strip",
+                                  types.ErrInvalidLayout)
+            }
+        case types.RS_SCHEME:
+            if layout.DataCount + layout.ParityCount > 256 {
+                return fmt.Errorf("%w: Reed-Solomon supports at most 256 components per file",
+                                  types.ErrInvalidLayout)
+            }
+        default:
+            return fmt.Errorf("%w: unknown redundancy scheme %d",
+                              types.ErrInvalidLayout, layout.Scheme)
+    }
+
+    switch layout.Striping {
+        case types.STRIPING_NONE:
+        case types.STRIPING_ROTATING:
+            if layout.StripeSize < 1 {
+                return fmt.Errorf("%w: stripe size has to be positive, got %d",
+                                  types.ErrInvalidLayout, layout.StripeSize)
+            }
+        default:
+            return fmt.Errorf("%w: unknown striping %d", types.ErrInvalidLayout, layout.Striping)
+    }
+
+    if hashes.Size(layout.HashAlgorithm) == 0 {
+        return fmt.Errorf("%w: unknown hash algorithm %d",
+                          types.ErrInvalidLayout, layout.HashAlgorithm)
+    }
+
+    return nil
+}
+
+/*
+    Given which components are still intact (available, sorted, exactly
+    DataCount of them, IDs >= DataCount are parity components), returns the
+    matrix that turns the available components back into the data components:
+        data[i] = sum over j of decode[i][j] * available[j]
+*/
+func decodeMatrix(layout types.Layout, available []int) ([][]byte, error) {
+    k := layout.DataCount
+    coefficients := parityCoefficients(layout)
+
+    // rows of the encoding matrix that correspond to the available components
+    matrix := make([][]byte, k)
+    for r := 0; r < k; r++ {
+        matrix[r] = make([]byte, k)
+        if available[r] < k {
+            matrix[r][available[r]] = 1
+        } else {
+            copy(matrix[r], coefficients[available[r] - k])
+        }
+    }
+
+    return invertMatrix(matrix)
+}
+
+// Gauss-Jordan elimination over GF(2^8)
+func invertMatrix(matrix [][]byte) ([][]byte, error) {
+    n := len(matrix)
+    work := make([][]byte, n)
+    for r := 0; r < n; r++ {
+        work[r] = make([]byte, 2 * n)
+        copy(work[r], matrix[r])
+        work[r][n + r] = 1
+    }
+
+    for col := 0; col < n; col++ {
+        // find a pivot
+        pivot := -1
+        for r := col; r < n; r++ {
+            if work[r][col] != 0 {
+                pivot = r
+                break
+            }
+        }
+        if pivot == -1 {
+            return nil, errors.New("matrix is singular")
+        }
+        work[col], work[pivot] = work[pivot], work[col]
+
+        // scale pivot row to 1
+        scale := galInverse(work[col][col])
+        for c := 0; c < 2 * n; c++ {
+            work[col][c] = galMul(work[col][c], scale)
+        }
+
+        // eliminate this column from the other rows
+        for r := 0; r < n; r++ {
+            if r != col && work[r][col] != 0 {
+                galMulSliceXor(work[r][col], work[col], work[r])
+            }
+        }
+    }
+
+    inverse := make([][]byte, n)
+    for r := 0; r < n; r++ {
+        inverse[r] = work[r][n:]
+    }
+
+    return inverse, nil
+}
+
+/*
+    Rebuild the units (equally sized pieces of the components, indexed by
+    component ID) listed in missing. units[ID] is nil for every unit that was
+    not read, any DataCount of the non-nil ones are used. Decoding matrices
+    are cached in decoders, keyed by which components were used.
+*/
+func reconstructUnits(layout types.Layout, units [][]byte, missing []int,
+                      decoders map[string][][]byte) error {
+    k := layout.DataCount
+
+    available := make([]int, 0, k)
+    for ID := 0; ID < len(units) && len(available) < k; ID++ {
+        if units[ID] != nil {
+            available = append(available, ID)
+        }
+    }
+    if len(available) < k {
+        return fmt.Errorf("only %d of the %d components needed are intact", len(available), k)
+    }
+
+    key := fmt.Sprint(available)
+    decode, ok := decoders[key]
+    if !ok {
+        var err error
+        decode, err = decodeMatrix(layout, available)
+        if err != nil {
+            return err
+        }
+        decoders[key] = decode
+    }
+
+    // all of the data is needed to recompute a parity unit
+    needAllData := false
+    for _, ID := range missing {
+        if ID >= k {
+            needAllData = true
+        }
+    }
+
+    unitSize := len(units[available[0]])
+    for i := 0; i < k; i++ {
+        if units[i] == nil && (needAllData || containsID(missing, i)) {
+            units[i] = make([]byte, unitSize)
+            for r := 0; r < k; r++ {
+                galMulSliceXor(decode[i][r], units[available[r]], units[i])
+            }
+        }
+    }
+
+    if needAllData {
+        coefficients := parityCoefficients(layout)
+        for _, ID := range missing {
+            if ID >= k {
+                units[ID] = make([]byte, unitSize)
+                for i := 0; i < k; i++ {
+                    galMulSliceXor(coefficients[ID - k][i], units[i], units[ID])
+                }
+            }
+        }
+    }
+
+    return nil
+}
+
+func containsID(IDs []int, ID int) bool {
+    for _, other := range IDs {
+        if other == ID {
+            return true
+        }
+    }
+    return false
+}
+
@@ -9,18 +9,17 @@
 package fileutils
 
 import (
+    "context"
     "fmt"
+    "io"
     "os"
-    "log"
+    "path"
     "path/filepath"
     "math"
     "sync"
-    "errors"
     // "crypto/sha256"
-    "crypto/md5"
     // "os/exec"
     // "bytes"
-    "strings"
     "foxyblox/types"
     // "time"
 )
@@ -30,6 +29,13 @@ type readResponse struct {
     err error
 }
 
+// payload sent from a writer to the parity writer, tagged with the writer's ID
+// since every parity component weighs the data components differently
+type parityPayload struct {
+    ID int
+    data []byte
+}
+
 type readOp struct {
     start int64
     numBytes int64
@@ -38,37 +44,56 @@ type readOp struct {
 }
 
 /*
-    Global Variables
-    Condition variables, locks, and checks
+    State shared by the writers and the parity writer of one save, every
+    save has its own (so that any number of them can run at the same time).
+    A writer sends a payload to the parity writer only when it has an
+    allowance, the parity writer gives the allowances back once it has the
+    payloads of all of the writers, so the writers move in lockstep.
 */
-var payloadCount int
-var parityWriterReady bool
-var m sync.Mutex
-var c *sync.Cond
-var allowances []bool
-var allowanceLocks []sync.Mutex
-var allowanceConditions []*sync.Cond
-
-func initialize(configs *types.Config, diskLocations []string) {
-    dataDiskCount := len(diskLocations) - configs.ParityDiskCount
-
-    payloadCount = 0
-    m = sync.Mutex{};
-    c = sync.NewCond(&m);
-    parityWriterReady = false
-    allowances = make([]bool, dataDiskCount)
-    allowanceLocks = make([]sync.Mutex, dataDiskCount)
-    allowanceConditions = make([]*sync.Cond, dataDiskCount)
-    for i := 0; i < len(allowanceConditions); i++ {
-        allowances[i] = true
-        allowanceConditions[i] = sync.NewCond(&allowanceLocks[i]);
+type saveSession struct {
+    allowances []bool
+    allowanceLocks []sync.Mutex
+    allowanceConditions []*sync.Cond
+}
+
+func newSaveSession(dataDiskCount int) *saveSession {
+    session := &saveSession{
+        allowances: make([]bool, dataDiskCount),
+        allowanceLocks: make([]sync.Mutex, dataDiskCount),
+        allowanceConditions: make([]*sync.Cond, dataDiskCount)}
+    for i := 0; i < len(session.allowanceConditions); i++ {
+        session.allowances[i] = true
+        session.allowanceConditions[i] = sync.NewCond(&session.allowanceLocks[i]);
     }
+
+    return session
 }
 
+// wait until writer ID is allowed to send a payload, and take the allowance
+func (s *saveSession) takeAllowance(ID int) {
+    personalLock := s.allowanceConditions[ID]
+    personalLock.L.Lock()
+    for !s.allowances[ID] { // while you don't have an allowance to send
+        personalLock.Wait()
+    }
 
-func check(err error) {
-    if err != nil {
-        log.Fatal("Exiting: ", err);
+    // reduce your own allowance, you're about to send
+    s.allowances[ID] = false
+
+    personalLock.L.Unlock()
+}
+
+// let all of the writers send their next payload
+func (s *saveSession) giveAllowances() {
+    for i := 0; i < len(s.allowances); i++ {
+        allowanceLock := s.allowanceConditions[i]
+        allowanceLock.L.Lock()
+
+        s.allowances[i] = true
+
+        allowanceLock.L.Unlock()
+
+        allowanceLock.Signal() // let this writer continue
     }
 }
 
@@ -89,6 +114,87 @@ func pathExists(path string) (bool) {
     return !os.IsNotExist(err)
 }
 
+/*
+    Length of the padding (0x80 followed by 0s, at most dataDiskCount bytes)
+    at the end of buf, which is the end of the last data component
+*/
+func paddingLength(buf []byte, dataDiskCount int) int {
+    for i := len(buf) - 1; i >= 0 && i >= len(buf) - dataDiskCount; i-- {
+        if buf[i] == 0x80 {
+            return len(buf) - i
+        }
+    }
+
+    return 0
+}
+
+// first error that is not nil, nil if there isn't one
+func firstError(errs []error) error {
+    for _, err := range errs {
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+/*
+    Create the temporary component of the file on every location of the
+    layout (they only take the place of the components once all of them are
+    written, see stageComponents), if one of them can't be created, the ones
+    that were are removed again
+*/
+func createComponents(backends []Backend, filename string, username string,
+                      layout types.Layout) ([]Component, error) {
+    components := make([]Component, layout.DataCount + layout.ParityCount)
+    for location := 0; location < len(components); location++ {
+        var err error
+        components[location], err = backends[location].CreateComponent(
+            locationComponentName(username, filename, location, layout) + TEMP_COMPONENT_SUFFIX)
+        if err != nil {
+            for other := 0; other < location; other++ {
+                components[other].Close()
+            }
+            removeComponentsWithSuffix(backends, filename, username, layout, TEMP_COMPONENT_SUFFIX)
+            return nil, err
+        }
+    }
+
+    return components, nil
+}
+
+/*
+    flush the component to its disk and close it, returns the first error of
+    the writes (writeErr), the flush and the close
+*/
+func finishComponent(file Component, writeErr error) error {
+    if writeErr == nil {
+        writeErr = file.Sync()
+    }
+    closeErr := file.Close()
+    if writeErr == nil {
+        writeErr = closeErr
+    }
+    return writeErr
+}
+
+// remove the components of the file on all of the locations (if they are there)
+func removeComponents(backends []Backend, filename string, username string, layout types.Layout) {
+    removeComponentsWithSuffix(backends, filename, username, layout, "")
+}
+
+// same as removeComponents, for the components with the suffix after their names
+func removeComponentsWithSuffix(backends []Backend, filename string, username string,
+                                layout types.Layout, suffix string) {
+    for i := 0; i < len(backends) && i < layout.DataCount + layout.ParityCount; i++ {
+        sliceFilename := locationComponentName(username, filename, i, layout) + suffix
+        // remove it, if it exists (which it should)
+        if _, err := backends[i].StatComponent(sliceFilename); !(os.IsNotExist(err)) { // file exists
+            backends[i].RemoveComponent(sliceFilename)
+        }
+    }
+}
 
 /*
     Arguments:
@@ -150,54 +256,197 @@ func pathExists(path string) (bool) {
         the file structure of the user, and also allow passing in locations to
         save in
 
-        Here, storageType is not necessary - should do a parse on each one of the
-        disk locations and save that component separately (use the regular
-        writers and readers for localhost/EBS, but need slightly special 
-        handling for the file otherwise [first create the file locally, and then
-        have to send it to the other systems if not local])
+        Each one of the disk locations is parsed into a Backend (see
+        backend.go), and every component is written through the backend of
+        its location, so the writers don't care whether it is local or not
+
+        The file is split according to the default layout in the configs
+        (ParityDiskCount parity components, computed with configs.Scheme),
+        see SaveFileWithLayout
 
-        TODO: create folder under user's username if doesn't exist!!, in all of
-        the disks that exist locally, just so that the local writers don't have
-        any issues
+        Nothing is left on the locations if the file can't be saved (the
+        error says why)
 
         // storageType int,
 */
-func SaveFile(path string, username string, diskLocations []string, configs *types.Config) {
-    // dataDisks := configs.Datadisks
-
-    // if user does not have a defined structure, create folders for him in all
-    // of the drives (maybe can do this in some sort of add user function)
-    // or maybe just need to do this for the ones in diskLocations
-    for i := 0; i < len(diskLocations); i++ { // maybe just do for diskLocations TODO
-        // this won't work for all of the drives, since not all will have the
-        // perfect local structure TODO
-        // fmt.Printf("datadisk: %s\n", dataDisks[i])
-        directory := fmt.Sprintf("%s/%s", diskLocations[i], username)
-        if !pathExists(directory) {
-            os.Mkdir(directory, 0755)
-        }
+func SaveFile(path string, username string, diskLocations []string, configs *types.Config) error {
+    return SaveFileWithLayout(path, username, diskLocations,
+                              types.DefaultLayout(len(diskLocations), configs), configs)
+}
+
+/*
+    Same as SaveFile, but the file is read from r instead of from a path, as it
+    comes in (an upload, a pipe, generated data), without making a temporary
+    copy of it first. size < 0 means that the size is not known, r is read
+    until EOF. Whole strips need the size of the file up front and are read out
+    of order, so streams are always saved in stripes (DEFAULT_STRIPE_SIZE,
+    unless the configs set a stripe size), except for mirrors. Returns the
+    layout the file was saved with, for its database entry.
+*/
+func SaveStream(ctx context.Context, r io.Reader, size int64, filename string,
+                username string, diskLocations []string,
+                configs *types.Config) (types.Layout, error) {
+    staged, err := SaveStreamStaged(ctx, r, size, filename, username, diskLocations, 0, configs)
+    if err != nil {
+        return streamLayout(len(diskLocations), configs), err
+    }
+
+    staged.Commit()
+    return staged.Layout, nil
+}
+
+/*
+    Same as SaveStream, the components are saved under the given generation
+    (see types.Layout), and the components it replaces are kept until the
+    save is committed
+*/
+func SaveStreamStaged(ctx context.Context, r io.Reader, size int64, filename string,
+                      username string, diskLocations []string, generation int,
+                      configs *types.Config) (*StagedSave, error) {
+    layout := types.DefaultLayout(len(diskLocations), configs)
+    layout.Generation = generation
+    return SaveStreamStagedWithLayout(ctx, r, size, filename, username, diskLocations, layout,
+                                      configs)
+}
+
+/*
+    Same as SaveStreamStaged, for a stream saved with the given layout (e.g.
+    the layout of a redundancy policy, see types.ParsePolicy), in stripes if
+    the layout is in whole strips (see streamLayout), the layout the stream
+    was saved with is in the StagedSave
+*/
+func SaveStreamStagedWithLayout(ctx context.Context, r io.Reader, size int64, filename string,
+                                username string, diskLocations []string, layout types.Layout,
+                                configs *types.Config) (*StagedSave, error) {
+    layout = stripedLayout(layout)
+
+    err := checkLayout(layout, len(diskLocations))
+    if err != nil {
+        return nil, err
+    }
+
+    backends, err := openBackends(diskLocations)
+    if err != nil {
+        return nil, err
+    }
+
+    filename = storedFilename(filename, layout)
+    if layout.Scheme == types.MIRROR_SCHEME {
+        err = saveMirrored(ctx, r, size, filename, username, backends, layout)
+    } else {
+        err = saveStriped(ctx, r, size, filename, username, backends, layout)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    return stageComponents(backends, filename, username, layout)
+}
+
+/*
+    layout of streams saved across locationCount locations, always in stripes
+    (mirrors are written sequentially anyway, they stay whole)
+*/
+func streamLayout(locationCount int, configs *types.Config) types.Layout {
+    return stripedLayout(types.DefaultLayout(locationCount, configs))
+}
+
+// the layout in stripes, if it is in whole strips (and not a mirror)
+func stripedLayout(layout types.Layout) types.Layout {
+    if layout.Striping == types.STRIPING_NONE && layout.Scheme != types.MIRROR_SCHEME {
+        layout.Striping = types.STRIPING_ROTATING
+        layout.StripeSize = types.DEFAULT_STRIPE_SIZE
+    }
+    return layout
+}
+
+/*
+    Same as SaveFile, but splits the file into layout.DataCount data components
+    (saved to the first locations) and layout.ParityCount parity components
+    (saved to the remaining locations). With RS_SCHEME, the file can be
+    rebuilt from any layout.DataCount of the components.
+*/
+func SaveFileWithLayout(path string, username string, diskLocations []string,
+                        layout types.Layout, configs *types.Config) error {
+    staged, err := SaveFileStaged(path, username, diskLocations, layout, configs)
+    if err != nil {
+        return err
+    }
+
+    staged.Commit()
+    return nil
+}
+
+/*
+    Same as SaveFileWithLayout, but the components that the save replaces (a
+    previous copy of the file) are kept until the save is committed, so that
+    the save can still be rolled back, i.e. when the database entry of the
+    file can't be updated
+*/
+func SaveFileStaged(path string, username string, diskLocations []string,
+                    layout types.Layout, configs *types.Config) (*StagedSave, error) {
+    return SaveFileStagedAs(path, filepath.Base(path), username, diskLocations, layout, configs)
+}
+
+/*
+    Same as SaveFileStaged, the file at path is saved under filename (a
+    relative path, e.g. "photos/beach.jpg", its components are saved in the
+    same folders on every location) instead of under the name of the file
+*/
+func SaveFileStagedAs(path string, filename string, username string, diskLocations []string,
+                      layout types.Layout, configs *types.Config) (*StagedSave, error) {
+    err := checkLayout(layout, len(diskLocations))
+    if err != nil {
+        return nil, err
     }
 
     /*
-        Modify diskLocations slightly to point it to saving somewhere locally
-        first, and then the components can be sent where they are actually
-        destined (if the location is not already local)
+        Every location is parsed into the backend that is responsible for it
+        (plain paths = local folders), the backends create the folder of the
+        user when the first component is created in them
     */
-
-    localDiskLocations := make([]string, len(diskLocations))
-    for i := 0; i < len(diskLocations); i++ {
-        // check if not local, TODO: just assigning it to be equal for now
-        localDiskLocations[i] = diskLocations[i]
+    backends, err := openBackends(diskLocations)
+    if err != nil {
+        return nil, err
     }
 
-    filename := filepath.Base(path);
-    originalFile, err := os.Open(path); check(err);
+    filename = storedFilename(filename, layout);
+    originalFile, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer originalFile.Close()
 
-    fileStat, err := originalFile.Stat(); check(err);
+    fileStat, err := originalFile.Stat()
+    if err != nil {
+        return nil, err
+    }
     size := fileStat.Size(); // in bytes
 
-    // NOTE: this could equivalently be just configs.DataDiskCount
-    dataDiskCount := len(diskLocations) - configs.ParityDiskCount
+    err = saveFile(originalFile, size, filename, username, backends, layout)
+    if err != nil {
+        return nil, err
+    }
+
+    return stageComponents(backends, filename, username, layout)
+}
+
+/*
+    Save the contents of an open file under the given (stored) name, split
+    according to the layout, into temporary components (see stageComponents)
+*/
+func saveFile(originalFile *os.File, size int64, filename string, username string,
+              backends []Backend, layout types.Layout) error {
+    if layout.Striping == types.STRIPING_ROTATING {
+        return saveStriped(context.Background(), originalFile, size, filename, username,
+                           backends, layout)
+    }
+    if layout.Scheme == types.MIRROR_SCHEME {
+        return saveMirrored(context.Background(), originalFile, size, filename, username,
+                            backends, layout)
+    }
+
+    dataDiskCount := layout.DataCount
 
     /*
         Calculate length of the strips the file will be divided into
@@ -230,145 +479,147 @@ func SaveFile(path string, username string, diskLocations []string, configs *typ
         Initiate the writers and readers
     */
 
+    // "./storage/drive" + i + "/" + username + "/" + filename + "_" + i,
+    // (the parity components are after the data components)
+    components, err := createComponents(backends, filename, username, layout)
+    if err != nil {
+        return err
+    }
+
     readRequests := make(chan *readOp, dataDiskCount)
-    parityChannel := make(chan []byte, dataDiskCount)
-    completionChannel := make(chan int, dataDiskCount + configs.ParityDiskCount)
+    parityChannel := make(chan *parityPayload, dataDiskCount)
+    completionChannel := make(chan error, dataDiskCount + layout.ParityCount)
 
-    // initializes all of the global condition variables and mutexes
-    initialize(configs, diskLocations)
+    // the condition variables and locks of this save
+    session := newSaveSession(dataDiskCount)
 
     // initiate a reader
     go reader(originalFile, readRequests)
 
-    // initiate a parity writer
-    // TODO: this isn't entirely general, assumes only one parity disk regardless
-    parityDiskFile := fmt.Sprintf("%s/%s/%s_p", localDiskLocations[len(diskLocations) - 1],
-                                  username, filename)
-    go parityWriter(parityDiskFile, parityChannel,
-                    completionChannel, dataDiskCount)
+    // initiate a parity writer, responsible for all of the parity components
+    go parityWriter(session, components[dataDiskCount:], parityCoefficients(layout),
+                    parityChannel, completionChannel, dataDiskCount, layout.HashAlgorithm)
 
     // initiate the writers
     for i := int64(0); i < int64(dataDiskCount); i++ {
-        // "./storage/drive" + i + "/" + filename + "_" + i,
-        storageFile := fmt.Sprintf("%s/%s/%s_%d", localDiskLocations[i],
-                                   username, filename, i)
+        storageFile := components[i]
         // if this is the writer responsible for the last strip of the file,
         // must add padding
         if (i == int64(dataDiskCount) - 1) {
 
-            go writer(i * stripLength, (i + 1) * stripLength - padding,
+            go writer(session, i * stripLength, (i + 1) * stripLength - padding,
                   storageFile, readRequests, parityChannel, 
-                  completionChannel, padding, int(i))
+                  completionChannel, padding, int(i), layout.HashAlgorithm)
         } else {
             // calculate start and end of this writer
-            go writer(i * stripLength, (i + 1) * stripLength,
+            go writer(session, i * stripLength, (i + 1) * stripLength,
                   storageFile, readRequests, parityChannel, 
-                  completionChannel, 0, int(i)) // no padding necessary in earlier strips
+                  completionChannel, 0, int(i), layout.HashAlgorithm) // no padding necessary in earlier strips
         }
     }
 
     // wait for all of the writers to be done
+    writerErrors := make([]error, dataDiskCount + 1)
     for i := 0; i < dataDiskCount; i++ {
-        <- completionChannel // may want to get error codes here
+        writerErrors[i] = <- completionChannel
     }
 
     close(parityChannel) // stop the parity writer
 
     // wait until the parity writer finishes
-    <- completionChannel
+    writerErrors[dataDiskCount] = <- completionChannel
 
     close(completionChannel) // don't need it anymore
     close(readRequests) // stop the reader channel
 
-    originalFile.Close()
-
-    /* TODO
-        Now, determine if any of the saved components need to be distributed
-        to other systems, by parsing through the names
+    // file.Close(); <-- currently saveLocalhost does this for you
 
-    */
+    err = firstError(writerErrors)
+    if err != nil {
+        removeComponentsWithSuffix(backends, filename, username, layout, TEMP_COMPONENT_SUFFIX)
+        return fmt.Errorf("can't save %s: %v", filename, err)
+    }
 
-    // file.Close(); <-- currently saveLocalhost does this for you
+    return nil
 }
 
 // alternate design: can hold multiple parityStrips in memory and release them
 // once done with them (attach a tag to the buffer sent in parityChannel to
 // know to which parityStrip this goes to)
-func parityWriter(location string, parityChannel chan []byte, completionChannel chan int, 
-                  writerCount int) {
-    parityFile, err := openFile(location); check(err)
-
-    // unsigned parity strip
-    parityStrip := make([]byte, types.MAX_BUFFER_SIZE)
+// parity component j = sum of coefficients[j][ID] * payload of writer ID over
+// all of the writers (all 1s = plain XOR, as in RAID 4)
+// after an error, payloads are still taken (so the writers never block), but
+// nothing else is written, and the error is sent back at the end
+func parityWriter(session *saveSession, parityFiles []Component, coefficients [][]byte,
+                  parityChannel chan *parityPayload, completionChannel chan error,
+                  writerCount int, hashAlgorithm int) {
+    var writeErr error
+
+    // unsigned parity strips
+    parityStrips := make([][]byte, len(parityFiles))
     var currentLocation int64 = 0
     localPayloadCount := 0
 
     /*
-        Save hash of parity file as well
+        Save hashes of the blocks of the parity files as well
     */
-    currentHash := md5.New()
+    currentHashes := make([]*componentHasher, len(parityFiles))
+    for j := 0; j < len(parityFiles); j++ {
+        currentHashes[j] = newComponentHasher(types.COMPONENT_BLOCK_SIZE, hashAlgorithm)
+    }
 
     for payload := range parityChannel { // also know job is done when buffers < max size
         localPayloadCount++
         if localPayloadCount == 1 {
-            // may need to shrink the parity strip
-            if  len(payload) < types.MAX_BUFFER_SIZE || len(payload) < len(parityStrip) {
-                parityStrip = make([]byte, len(payload))
-            } else {
-                // reset parityStrip
-                parityStrip = make([]byte, types.MAX_BUFFER_SIZE)
+            // reset the parity strips, may need to shrink them
+            for j := 0; j < len(parityStrips); j++ {
+                parityStrips[j] = make([]byte, len(payload.data))
             }
         }
 
-        // XOR with current parityStrip
+        // add onto the current parityStrips
         // assert that parity strip length is same as payload length here
-        if (len(payload) != len(parityStrip)) {
-            err := errors.New("Error: length of payload and partyStrip don't match")
-            check(err)
+        if (len(payload.data) != len(parityStrips[0])) && writeErr == nil {
+            writeErr = fmt.Errorf("length of payload (%d) and parity strip (%d) don't match",
+                                  len(payload.data), len(parityStrips[0]))
             //fmt.Printf("Payload = %d, parityStrip = %d\n", len(payload), len(parityStrip))
         }
-        for i := 0; i < len(payload); i++ {
-            parityStrip[i] ^= payload[i]
+        for j := 0; j < len(parityStrips) && writeErr == nil; j++ {
+            galMulSliceXor(coefficients[j][payload.ID], payload.data, parityStrips[j])
         }
 
         if localPayloadCount == writerCount { // got all necessary parity bits
             // can let the writers continue, perform this before initiating IO
             // to not block writers longer than necessary
             localPayloadCount = 0
-            for i := 0; i < len(allowances); i++ {
-                allowanceLock := allowanceConditions[i]
-                allowanceLock.L.Lock()
+            session.giveAllowances()
 
-                allowances[i] = true
+            // can write the parity buffers to the parity drives now (at currentLocation)
+            for j := 0; j < len(parityFiles) && writeErr == nil; j++ {
+                // err will be not nil if all bytes written
+                _, writeErr = parityFiles[j].WriteAt(parityStrips[j], currentLocation)
 
-                allowanceLock.L.Unlock()
-
-                allowanceLock.Signal() // let this writer continue
+                // update hash
+                currentHashes[j].Write(parityStrips[j])
             }
 
-            // can write the parity buffer to the parity drive now (at currentLocation)
-            _, err := parityFile.WriteAt(parityStrip, currentLocation)
-            check(err) // err will be not nil if all bytes written, may need to custom handle
-
-            currentLocation += int64(len(parityStrip))
-
-            // update hash
-            currentHash.Write(parityStrip)
+            currentLocation += int64(len(parityStrips[0]))
         }
     }
 
     /*
-        Append the hash to the end of the parity file, can later put the length
-        of the hash if this is necessary (appended to the end at a constant known
-        to me)
+        Append the trailer (block hashes) to the end of the parity files
     */
-    finalHash := currentHash.Sum(nil)
-    _, err = parityFile.WriteAt(finalHash, currentLocation)
-    check(err)
+    for j := 0; j < len(parityFiles); j++ {
+        if writeErr == nil {
+            finalHash := currentHashes[j].trailer()
+            _, writeErr = parityFiles[j].WriteAt(finalHash, currentLocation)
+        }
 
-    parityFile.Close()
+        writeErr = finishComponent(parityFiles[j], writeErr)
+    }
 
-    completionChannel <- 0 // success
+    completionChannel <- writeErr // nil = success
     // fmt.Println("Parity writer exiting");
 }
 
@@ -391,16 +642,15 @@ func reader(originalFile *os.File, readRequests <-chan *readOp) {
     // fmt.Println("Reader exiting");
 }
 
-func writer(start int64, end int64, location string, readRequests chan<- *readOp,
-            parityChannel chan []byte,
-            completionChannel chan int, padding int64, ID int) {
+func writer(session *saveSession, start int64, end int64, file Component,
+            readRequests chan<- *readOp, parityChannel chan *parityPayload,
+            completionChannel chan error, padding int64, ID int, hashAlgorithm int) {
     /*
         Issue read requests from original file until you have written your 
         entire strip to disk
     */
     // end should not be included [start, end)
     // fmt.Printf("Writer initialized from %d to %d\n", start, end)
-    file, err := openFile(location); check(err) // file to write into
     var currentLocation int64 = start;
     var locationInOutputFile int64 = 0;
 
@@ -419,95 +669,103 @@ func writer(start int64, end int64, location string, readRequests chan<- *readOp
 
         h.Sum(nil) // final checksum
 
+        Every block of the component is hashed separately (see component.go),
+        so corruption can later be pinned down to a block, with the algorithm
+        of the layout
     */
-    currentHash := md5.New()
-
-    for currentLocation < end { // should be <= for debugging? !=
-        // construct a read request
-        num := int64(math.Min(float64(types.MAX_BUFFER_SIZE), float64(end - currentLocation)))
-        read := &readOp {
-            start: currentLocation,
-            numBytes: num,
-            response: make(chan *readResponse)}
-
-        readRequests <- read
-        response := <- read.response // get the response from the reader, blocking
-        check(response.err);
-        var payloadLength int64 = int64(len(response.payload))
-        if (payloadLength < num) {
-            currentLocation += payloadLength;
-        } else {
-            currentLocation += payloadLength;
-        }
+    currentHash := newComponentHasher(types.COMPONENT_BLOCK_SIZE, hashAlgorithm)
 
+    /*
+        The parity writer waits for a payload from every writer before letting
+        any of them go on, so after an error the payloads (of the size they
+        would have had) are still sent, but nothing else is written
+    */
+    var writeErr error
 
-        // PAUSE HERE - before sending more payloads to the parity channel,
-        // ensure that all of the other writers have also finished their tasks
-        personalLock := allowanceConditions[ID]
-        personalLock.L.Lock()
-        for !allowances[ID] { // while you don't have an allowance to send
-            personalLock.Wait()
+    /*
+        The padding is the end of the strip, the payloads are cut out of
+        [start, end + padding) the same way as in the other strips, so that
+        the payloads of all of the writers line up even when the padding
+        does not fit in the last one
+    */
+    stripEnd := end + padding
+    for currentLocation < stripEnd {
+        // construct a read request, for the part of the payload that isn't padding
+        num := int64(math.Min(float64(types.MAX_BUFFER_SIZE), float64(stripEnd - currentLocation)))
+        payload := make([]byte, num)
+        if currentLocation < end {
+            read := &readOp {
+                start: currentLocation,
+                numBytes: int64(math.Min(float64(num), float64(end - currentLocation))),
+                response: make(chan *readResponse)}
+
+            readRequests <- read
+            response := <- read.response // get the response from the reader, blocking
+            if response.err != nil && writeErr == nil {
+                writeErr = response.err
+            }
+            copy(payload, response.payload)
         }
 
-        // compute the true payload: it is possible that padding should be added
-        // to this payload, so if padding is non-zero, add that many bytes
-        // but only if this is the last iteration (i.e. currentLocation == end)
-        if padding != 0 && currentLocation == end {
-            paddingSlice := make([]byte, int(padding))
-            paddingSlice[0] = 0x80         
-            response.payload = append(response.payload, paddingSlice...)
+        // the padding starts with 0x80, followed by 0s
+        if padding != 0 && currentLocation <= end && end < currentLocation + num {
+            payload[end - currentLocation] = 0x80
         }
+        currentLocation += num
 
-        // send once you know you can
-        parityChannel <- response.payload
+        // PAUSE HERE - before sending more payloads to the parity channel,
+        // ensure that all of the other writers have also finished their tasks
+        session.takeAllowance(ID)
 
-        // reduce your own allowance, you've already sent
-        allowances[ID] = false
+        // send once you know you can
+        parityChannel <- &parityPayload{ID: ID, data: payload}
 
-        personalLock.L.Unlock()
+        if writeErr != nil {
+            continue
+        }
 
         // write the payload to the end file
-        _, err := file.WriteAt(response.payload, locationInOutputFile)
-        locationInOutputFile += int64(len(response.payload))
-        // note: will error if numWritten < length of payload!!, may need to
-        // do custom error handle here
-        check(err)
+        // note: will error if numWritten < length of payload
+        _, writeErr = file.WriteAt(payload, locationInOutputFile)
+        locationInOutputFile += int64(len(payload))
 
         // update the hash
-        currentHash.Write(response.payload)
+        currentHash.Write(payload)
     }
     
     /*
-        Compute final hash of the file, and append it to the end of the file
+        Compute the trailer (hashes of the blocks), and append it to the end of the file
     */
     // startTime := time.Now()
-    finalHash := currentHash.Sum(nil)
+    finalHash := currentHash.trailer()
     // elapsed := time.Since(startTime)
     // fmt.Printf("Hash took %s", elapsed)
 
     // fmt.Printf("Final hash: %x, length = %d\n", finalHash, len(finalHash))
 
-    _, err = file.WriteAt(finalHash, locationInOutputFile)
-    check(err)
+    if writeErr == nil {
+        _, writeErr = file.WriteAt(finalHash, locationInOutputFile)
+    }
 
-    file.Close()
+    writeErr = finishComponent(file, writeErr)
 
     // return and let people know you are done
-    completionChannel <- 0 // success
+    completionChannel <- writeErr // nil = success
     // fmt.Println("Writer exiting");
 }
 
 /*
-    It has been determined that the drive with ID driveID is corrupted, when
-    reading a portion of the file, located in offendingFile. Fix the drive by
-    running fsck on it or some variant of this (to stop using the bad sectors
-    that corrupted this file), and then rewrite this portion of the file again,
-    by getting the correct version of it by using the other drives to recover.
+    It has been determined that the components in damage (indexed by ID, nil
+    for the intact ones, IDs >= layout.DataCount are the parity components)
+    are corrupted, when reading the file. Fix the drives by running fsck on
+    them or some variant of this (to stop using the bad sectors that
+    corrupted this file), and then rewrite the damaged blocks of these
+    components (or the whole components, if they are missing), by getting the
+    correct version of them from layout.DataCount of the components that are
+    intact in the same place.
 */
-func recoverFromDriveFailure(driveID int, offendingFile *os.File, 
-                            offendingFileLocation string, outputFile *os.File, 
-                            isParityDisk bool, hadPadding bool, diskLocations []string,
-                            username string, configs * types.Config) {
+func recoverFromDriveFailure(damage []*componentDamage, rawFileName string, outputFile *os.File,
+                             backends []Backend, layout types.Layout, username string) error {
     /*
         Fix the drive, if appropriate
         TODO: this is also not entirely geeneral yet, need to do this for
@@ -527,212 +785,174 @@ func recoverFromDriveFailure(driveID int, offendingFile *os.File,
     //     fmt.Printf("Fsck stdout: %q\n", out.String())
     // }
 
-    dataDiskCount := len(diskLocations) - configs.ParityDiskCount
+    dataDiskCount := layout.DataCount
+    componentCount := layout.DataCount + layout.ParityCount
+    blockSize := types.COMPONENT_BLOCK_SIZE
+
+    err := checkRecoverable(damage, rawFileName, layout, backends)
+    if err != nil {
+        return err
+    }
 
     /*
-        Delete the offending file, and recreate it with the correct data
+        Intact components are only read, components with damaged blocks have
+        those blocks rewritten in place
     */
-    oName := offendingFile.Name()
-    offendingFile.Close()
-    os.Remove(offendingFileLocation)
-    // fmt.Printf("Offending file location %s\n", offendingFileLocation)
-    fixedFile, err := openFile(offendingFileLocation); check(err)
-
-    rawFileName := oName
-    lastIndex := strings.LastIndex(rawFileName, "_")
-    rawFileName = rawFileName[:lastIndex] // cut off the _driveID part
-    x := strings.Split(rawFileName, "/")
-    rawFileName = x[len(x) - 1] // get the last part of the path, if name = path
-
-    if !isParityDisk {
-        // read all of the other disks besides this one, and XOR with the parity
-        // disk bit by bit and reconstruct the file
-        // NOTE: this can be done much more efficiently by issuing more IO requests
-        // and using a similar approach as the original saving of the file, but
-        // when recovering the file, performance isn't as big of an issue because
-        // of the rarity of the occasion (temporary implementation)
-
-        otherDriveFiles := make([]*os.File, dataDiskCount - 1)
-
-        parityDriveFileName := fmt.Sprintf("%s/%s/%s_p", diskLocations[len(diskLocations) - 1],
-                                  username, rawFileName)
-
-        parityDriveFile, err := os.Open(parityDriveFileName)
-        check(err)
-        
-        count := 0
-        for i := 0; i < dataDiskCount; i++ {
-            if i != driveID {
-                tmpName := fmt.Sprintf("%s/%s/%s_%d", diskLocations[i],
-                                        username, rawFileName, i)
-                otherDriveFiles[count], err = os.Open(tmpName); check(err)
-
-                count++
+    files := make([]Component, componentCount)
+    var rawSize int64 = -1
+    for ID := 0; ID < componentCount; ID++ {
+        if damage[ID] != nil && damage[ID].whole {
+            continue
+        }
+
+        name := componentNameForID(username, rawFileName, ID, dataDiskCount)
+        if damage[ID] == nil {
+            files[ID], err = backends[ID].OpenComponent(name)
+        } else {
+            files[ID], err = backends[ID].UpdateComponent(name)
+        }
+        if err != nil {
+            return err
+        }
+        defer files[ID].Close()
+
+        if rawSize == -1 {
+            rawSize, err = componentDataSize(files[ID])
+            if err != nil {
+                return err
             }
         }
+    }
 
-        fileStat, err := parityDriveFile.Stat(); check(err);
-        rawSize := fileStat.Size(); // in bytes
-        rawSize -= types.MD5_SIZE
-        size := rawSize // subtract size for hash at end
+    /*
+        Delete the offending files, and recreate them with the correct data
+        (unless the location itself is gone, the data is still served from
+        the other components then)
+    */
+    fixedHashes := make([]*componentHasher, componentCount)
+    for ID := 0; ID < componentCount; ID++ {
+        if damage[ID] == nil || !damage[ID].whole || !locationAvailable(backends[ID]) {
+            continue
+        }
 
-        trueParityStrip := make([]byte, types.MAX_BUFFER_SIZE)
-        buf := make([]byte, types.MAX_BUFFER_SIZE)
+        offendingFileLocation := componentNameForID(username, rawFileName, ID, dataDiskCount)
+        backends[ID].RemoveComponent(offendingFileLocation)
+        // fmt.Printf("Offending file location %s\n", offendingFileLocation)
+        files[ID], err = backends[ID].CreateComponent(offendingFileLocation)
+        if err != nil {
+            return err
+        }
+        defer files[ID].Close()
+        fixedHashes[ID] = newComponentHasher(blockSize, layout.HashAlgorithm)
+    }
 
-        var currentLocation int64 = 0
-        lastBuffer := false
-        currentHash := md5.New()
+    decoders := make(map[string][][]byte)
 
-        for currentLocation != size {
-            // check if need to resize the buffers
-            if (size - currentLocation) < int64(types.MAX_BUFFER_SIZE) {
-                lastBuffer = true
-                newSize := size - currentLocation
+    // NOTE: this can be done much more efficiently by issuing more IO requests
+    // and using a similar approach as the original saving of the file, but
+    // when recovering the file, performance isn't as big of an issue because
+    // of the rarity of the occasion (temporary implementation)
+    for block := int64(0); block * blockSize < rawSize; block++ {
+        currentLocation := block * blockSize
+        bufSize := int64(math.Min(float64(blockSize), float64(rawSize - currentLocation)))
 
-                trueParityStrip = make([]byte, newSize)
-                buf = make([]byte, newSize)
-            } else {
-                trueParityStrip = make([]byte, types.MAX_BUFFER_SIZE)
+        var missing []int
+        for ID := 0; ID < componentCount; ID++ {
+            if damage[ID].hasBlock(block) {
+                missing = append(missing, ID)
             }
+        }
+        if len(missing) == 0 {
+            continue
+        }
 
-            // true parity strip
-            _, err = parityDriveFile.ReadAt(trueParityStrip, currentLocation)
-            check(err)
+        // any dataDiskCount intact blocks are enough, prefer the data components
+        units := make([][]byte, componentCount)
+        read := 0
+        for ID := 0; ID < componentCount && read < dataDiskCount; ID++ {
+            if damage[ID].hasBlock(block) {
+                continue
+            }
+            units[ID] = make([]byte, bufSize)
+            _, err = files[ID].ReadAt(units[ID], currentLocation)
+            if err != nil {
+                return err
+            }
+            read++
+        }
 
-            // compute the missing piece by XORing all of the other strips
-            for i := 0; i < len(otherDriveFiles); i++ {
-                file := otherDriveFiles[i]
+        // compute the missing pieces from the intact ones
+        err = reconstructUnits(layout, units, missing, decoders)
+        if err != nil {
+            return err
+        }
 
-                _, err = file.ReadAt(buf, currentLocation)
-                check(err)
+        for _, ID := range missing {
+            buf := units[ID]
 
-                for j := 0; j < len(trueParityStrip); j++ {
-                    trueParityStrip[j] ^= buf[j]
+            // write missing piece into the fixed file
+            if files[ID] != nil {
+                _, err = files[ID].WriteAt(buf, currentLocation)
+                if err != nil {
+                    return err
                 }
             }
 
-            // write missing piece into the fixed file
-            _, err = fixedFile.WriteAt(trueParityStrip, currentLocation)
-            check(err) // NOTE: THIS ERROR CHECK WASN'T HERE BEFORE
-
             // update fixed hash
-            currentHash.Write(trueParityStrip)
+            if fixedHashes[ID] != nil {
+                fixedHashes[ID].Write(buf)
+            }
 
             // also write into the outputfile we were supposed to return
-            // make sure not to write the padding in here, though
-            if hadPadding && lastBuffer {
-                truePaddingSize := 0
-                for i := len(trueParityStrip) - 1; i >= len(trueParityStrip) - dataDiskCount; i-- {
-                    if trueParityStrip[i] == 0x80 {
-                        truePaddingSize = len(trueParityStrip) - i
-                        break
-                    }
+            // (the padding is cut off once all of the blocks are there)
+            if ID < dataDiskCount && outputFile != nil {
+                offsetInOutput := rawSize * int64(ID) + currentLocation
+                _, err = outputFile.WriteAt(buf, offsetInOutput)
+                if err != nil {
+                    return err
                 }
-
-                // fmt.Printf("True padding size in fix = %d\n", truePaddingSize)
-                // fmt.Printf("length before trim: %d\n", len(trueParityStrip))
-
-                // resize the size of the true raw data
-                trueParityStrip = append([]byte(nil), trueParityStrip[:len(trueParityStrip) - truePaddingSize]...)
-
-                // fmt.Printf("length after trim: %d\n", len(trueParityStrip))
-
-                // update "size" of the file
-                size -= int64(truePaddingSize)
             }
-
-            outputFile.WriteAt(trueParityStrip, rawSize * int64(driveID) + currentLocation)
-
-            // update location
-            currentLocation += int64(len(trueParityStrip))
         }
+    }
 
-        fixedHash := currentHash.Sum(nil)
-        // fmt.Printf("Fixed hash ID %d: %x, length = %d\n", driveID, fixedHash, len(fixedHash))
-        _, err = fixedFile.WriteAt(fixedHash, currentLocation)
-        check(err)
-
-        for i := 0; i < len(otherDriveFiles); i++ {
-            otherDriveFiles[i].Close()
+    for ID := 0; ID < componentCount; ID++ {
+        if fixedHashes[ID] != nil {
+            _, err = files[ID].WriteAt(fixedHashes[ID].trailer(), rawSize)
+            if err != nil {
+                return err
+            }
         }
-        parityDriveFile.Close()
-
-        /*
-            File is fixed! Maybe should be fixing other files at the same time
-            as fixing this one, or could just be realizing that later when you try
-            to read one of those broken files (not immediately clear which
-            one is better because we are running fsck to fix anyway, and will
-            realize that the fix caused some of the file data to change)
-        */
-    } else {
-        /*
-            Read all of the other drive files, XOR them together, and write them
-            to the parity drive
-        */
-        otherDriveFiles := make([]*os.File, dataDiskCount)
+    }
 
-        for i := 0; i < dataDiskCount; i++ {
-            tmpName := fmt.Sprintf("%s/%s/%s_%d", diskLocations[i],
-                                        username, rawFileName, i)
-            otherDriveFiles[i], err = os.Open(tmpName); check(err)
+    /*
+        The padding can start in the block before the last one, so the size of
+        the output is only known once the last data component is whole again
+        (the damaged blocks may have looked like they had less padding)
+    */
+    if outputFile != nil && damage[dataDiskCount - 1] != nil {
+        outputSize := rawSize * int64(dataDiskCount)
+        tail := make([]byte, int64(math.Min(float64(dataDiskCount), float64(rawSize))))
+        if files[dataDiskCount - 1] != nil {
+            _, err = files[dataDiskCount - 1].ReadAt(tail, rawSize - int64(len(tail)))
+        } else { // not rebuilt, but all of it was written to the output
+            _, err = outputFile.ReadAt(tail, outputSize - int64(len(tail)))
         }
-
-        fileStat, err := otherDriveFiles[0].Stat(); check(err);
-        size := fileStat.Size(); // in bytes
-        size -= types.MD5_SIZE // chop off the hash
-
-        filesParityStrip := make([]byte, types.MAX_BUFFER_SIZE)
-        buf := make([]byte, types.MAX_BUFFER_SIZE)
-
-        var currentLocation int64 = 0
-        currentHash := md5.New()
-        for currentLocation != size {
-            // check if need to resize the buffers
-            if (size - currentLocation) < int64(types.MAX_BUFFER_SIZE) {
-                newSize := size - currentLocation
-
-                filesParityStrip = make([]byte, newSize)
-                buf = make([]byte, newSize)
-            } else {
-                filesParityStrip = make([]byte, types.MAX_BUFFER_SIZE)
-            }
-
-            // compute the missing piece by XORing all of the other strips
-            for i := 0; i < len(otherDriveFiles); i++ {
-                file := otherDriveFiles[i]
-
-                _, err = file.ReadAt(buf, currentLocation)
-                check(err)
-
-                for j := 0; j < len(filesParityStrip); j++ {
-                    filesParityStrip[j] ^= buf[j]
-                }
-            }
-
-            // write missing piece into the fixed file
-            fixedFile.WriteAt(filesParityStrip, currentLocation)
-
-            // update fixed hash
-            currentHash.Write(filesParityStrip)
-
-            // update location
-            currentLocation += int64(len(filesParityStrip))
+        if err != nil {
+            return err
         }
 
-        fixedHash := currentHash.Sum(nil)
-        // fmt.Printf("Fixed hash ID %d: %x, length = %d\n", driveID, fixedHash, len(fixedHash))
-        _, err = fixedFile.WriteAt(fixedHash, currentLocation)
-        check(err)
-        for i := 0; i < len(otherDriveFiles); i++ {
-            otherDriveFiles[i].Close()
+        err = outputFile.Truncate(outputSize - int64(paddingLength(tail, dataDiskCount)))
+        if err != nil {
+            return err
         }
-
-        // File is fixed!
     }
 
-    fixedFile.Close()
-
+    /*
+        Files are fixed! (running fsck to fix the drives anyway, so any other
+        files that were broken will be realized the next time they are read)
+    */
     // TODO: print some useful success message here
+    return nil
 }
 
 /*
@@ -741,31 +961,45 @@ func recoverFromDriveFailure(driveID int, offendingFile *os.File,
     given range specified (since the component is from a range of the original
     file - offset = ID * size of component)
     sourcePath = where the file was originally saved - maybe might need this later
+
+    Sends ID + 1 on the completion channel if the component is corrupted,
+    missing or unreadable (the master recovers all of the broken components
+    together, what is wrong with this one is left in damage[ID]), 0 otherwise
+    (if the output file can't be written, the error is left in outputErrors[ID])
 */
 func basicReaderWriter(filename string, outputFile *os.File, 
                        ID int, hasPadding bool, completionChannel chan int,
-                       canRecoverChannel chan int, diskLocations []string,
-                       username string, configs *types.Config) {
-    dataDiskCount := len(diskLocations) - configs.ParityDiskCount
-
+                       damage []*componentDamage, outputErrors []error, backends []Backend,
+                       username string, dataDiskCount int) {
     // read from respective slice, and write it to the output file
-    file, err := os.Open(filename); check(err)
-    fileStat, err := file.Stat(); check(err);
-    rawSize := fileStat.Size(); // in bytes
-    size := rawSize
-
-    // subtract the size of the hash at the end to get the true size
-    size -= int64(types.MD5_SIZE)
+    // (a missing or unreadable component is treated just like a corrupted one)
+    file, err := backends[ID].OpenComponent(componentName(username, filename, ID))
+    if err != nil {
+        damage[ID] = wholeComponentDamage
+        completionChannel <- ID + 1
+        return
+    }
+    info, err := readComponentInfo(file)
+    if err != nil {
+        file.Close()
+        damage[ID] = wholeComponentDamage
+        completionChannel <- ID + 1
+        return
+    }
+    // size of the data, without the trailer
+    size := info.dataSize
 
     offsetInOutput := int64(ID) * size
     var position int64 = 0
 
-    currentHash := md5.New()
+    verifier := newComponentVerifier(info)
     lastBuffer := false
     buf := make([]byte, types.MAX_BUFFER_SIZE)
     for position != size {
 
-        if (size - position) <= int64(types.MAX_BUFFER_SIZE) { // will enter conditional at last bit of file
+        // the padding (at most dataDiskCount bytes) can't be cut in two, so
+        // the last buffer may be slightly bigger than the others
+        if (size - position) <= int64(types.MAX_BUFFER_SIZE + dataDiskCount) { // will enter conditional at last bit of file
             buf = make([]byte, size - position)
 
             // Should calculate padding on this buffer
@@ -776,22 +1010,21 @@ func basicReaderWriter(filename string, outputFile *os.File,
         // maybe could be creating a specific reader goroutine to perform these
         // reads so that this thread could keep running
         _, err = file.ReadAt(buf, position)
-        check(err)
+        if err != nil {
+            file.Close()
+            damage[ID] = wholeComponentDamage
+            completionChannel <- ID + 1
+            return
+        }
 
         /*
             Calculate the padding on this, but update hash before fixing buffer,
             since the hash includes the padding in it
         */
-        currentHash.Write(buf)
+        verifier.Write(buf)
         // calculate padding (if it exists) in this slice
         if hasPadding && lastBuffer {
-            truePaddingSize := 0
-            for i := len(buf) - 1; i >= len(buf) - dataDiskCount; i-- {
-                if buf[i] == 0x80 {
-                    truePaddingSize = len(buf) - i
-                    break
-                }
-            }
+            truePaddingSize := paddingLength(buf, dataDiskCount)
 
             // fmt.Printf("True padding size = %d\n", truePaddingSize)
 
@@ -805,118 +1038,84 @@ func basicReaderWriter(filename string, outputFile *os.File,
 
         // write into the outputfile at the specific offset that this writer
         // is responsible for
-        _, err = outputFile.WriteAt(buf, offsetInOutput); check(err)
+        _, err = outputFile.WriteAt(buf, offsetInOutput)
+        if err != nil {
+            file.Close()
+            outputErrors[ID] = err
+            completionChannel <- 0 // the component itself is fine
+            return
+        }
 
         // update positions
         length := int64(len(buf))
         position += length
         offsetInOutput += length
-
-        // update hash
-        // currentHash.Write(buf)
     }
 
     /*
-        Check if the computed hash on this component is correct, otherwise need
-        to handle appropriately (mark this disk as a bad disk and/or just rewrite
-        this component again, and then calculate the true value of this component
-        by using the parity drive to recover)
+        Check if the computed hashes of the blocks of this component are
+        correct, otherwise the master rebuilds the blocks that aren't (by
+        using the parity drives to recover)
     */
+    file.Close()
 
-    finalHash := currentHash.Sum(nil)
-    // fmt.Printf("Final hash ID %d: %x, length = %d\n", ID, finalHash, len(finalHash))
-    originalHash := make([]byte, types.MD5_SIZE)
-    _, err = file.ReadAt(originalHash, rawSize - types.MD5_SIZE)
-    check(err)
-    // fmt.Printf("Original hash ID %d: %x, length = %d\n", ID, originalHash, len(originalHash))
-
-    var hashesMatch bool = true
-    if len(originalHash) != types.MD5_SIZE {
-        // fmt.Printf("Original hash not correct length\n")
-        hashesMatch = false
-    }
-    for i := 0; i < types.MD5_SIZE; i++ {
-        if (finalHash[i] != originalHash[i]) {
-            hashesMatch = false
-        }
-    }
-
-    if !hashesMatch {
-        completionChannel <- ID + 1 // to make sure ID is not 0, so that reads as error
-        <- canRecoverChannel // wait until master says that this drive can recover
+    damage[ID] = verifier.damage()
+    if damage[ID] != nil {
         // fmt.Printf("This drive is messed up, ID = %d\n", ID)
-        recoverFromDriveFailure(ID, file, filename, outputFile, 
-                                false, hasPadding, diskLocations, username,
-                                configs)
-
-        // fmt.Printf("Successfully fixed drive ID = %d\n", ID)
+        completionChannel <- ID + 1 // to make sure ID is not 0, so that reads as error
+        return
     }
 
-    file.Close()
-
     completionChannel <- 0 // success
     // fmt.Println("RW exiting")
 }
 
-func basicParityChecker(filename string, parityCompletionChannel chan int, 
-                        canRecoverChannel chan int, diskLocations []string,
-                        username string, configs *types.Config) {
-    parityFile, err := os.Open(filename); check(err)
+/*
+    Check the hashes of the parity component with the given ID (>= dataDiskCount),
+    reports back the same way as basicReaderWriter
+*/
+func basicParityChecker(filename string, ID int, completionChannel chan int,
+                        damage []*componentDamage, backends []Backend,
+                        username string, dataDiskCount int) {
+    damage[ID] = checkComponent(backends[ID], componentNameForID(username, filename, ID, dataDiskCount))
+    if damage[ID] != nil {
+        completionChannel <- ID + 1
+        return
+    }
 
-    fileStat, err := parityFile.Stat()
-    rawSize := fileStat.Size()
-    size := rawSize
-    size -= types.MD5_SIZE
+    completionChannel <- 0 // success
+    // fmt.Println("Parity checker exiting.")
+}
 
-    buf := make([]byte, types.MAX_BUFFER_SIZE)
-    currentHash := md5.New()
+/*
+    What was wrong with the locations of a file when it was read
+*/
+type ReadReport struct {
+    // locations whose component was missing or could not be read (or that
+    // could not be reached at all), the file was served from the others
+    Degraded []string
+    // locations whose component (or some blocks of it) was rebuilt, the
+    // degraded locations that can't be reached are not rebuilt
+    Rebuilt []string
+}
 
-    var currentLocation int64 = 0
-    for currentLocation != size {
-        if (size - currentLocation) < int64(types.MAX_BUFFER_SIZE) {
-            buf = make([]byte, size - currentLocation)
+// report for the damage found on the locations, once the damage is repaired
+func newReadReport(damage []*componentDamage, backends []Backend,
+                   diskLocations []string) *ReadReport {
+    report := &ReadReport{}
+    for location := 0; location < len(damage); location++ {
+        if damage[location] == nil {
+            continue
         }
-
-        _, err = parityFile.ReadAt(buf, currentLocation)
-        check(err)
-
-        currentHash.Write(buf)
-
-        currentLocation += int64(len(buf))
-    }
-
-    finalHash := currentHash.Sum(nil)
-    // fmt.Printf("Final hash parity: %x, length = %d\n", finalHash, len(finalHash))
-    originalHash := make([]byte, types.MD5_SIZE)
-    _, err = parityFile.ReadAt(originalHash, rawSize - types.MD5_SIZE)
-    check(err)
-    // fmt.Printf("Original hash parity: %x, length = %d\n", originalHash, len(originalHash))
-
-    var hashesMatch bool = true
-    if len(originalHash) != types.MD5_SIZE {
-        // fmt.Printf("Original hash not correct length\n")
-        hashesMatch = false
-    }
-    for i := 0; i < types.MD5_SIZE; i++ {
-        if (finalHash[i] != originalHash[i]) {
-            hashesMatch = false
+        if damage[location].whole {
+            report.Degraded = append(report.Degraded, diskLocations[location])
+        }
+        if locationAvailable(backends[location]) {
+            report.Rebuilt = append(report.Rebuilt, diskLocations[location])
         }
     }
 
-    if !hashesMatch {
-        parityCompletionChannel <- 1
-        <- canRecoverChannel // wait until master says that this drive can recover
-        fmt.Printf("This drive is messed up, ID = parity\n")
-        recoverFromDriveFailure(0, parityFile, filename, nil, 
-                                true, false, diskLocations, username, configs)
-
-        fmt.Printf("Successfully fixed drive ID = parity\n")
-    }
-
-    parityFile.Close()
-
-    parityCompletionChannel <- 0 // success
-    // fmt.Println("Parity checker exiting.")
+    return report
 }
 
 /*
@@ -936,142 +1135,176 @@ func basicParityChecker(filename string, parityCompletionChannel chan int,
     diskLocations = where this file can be found
     configs = configs for the system (where the database is, RAID level, etc.)
 
-    returns the path to the downloaded file
+    returns the path to the downloaded file (see downloadedName, nothing is
+    left behind if the
+    file can't be read or rebuilt, types.ErrUnrecoverable if too many of its
+    components are broken)
+
+    The file is assumed to have been saved with the default layout in the
+    configs, see GetFileWithLayout
+*/
+func GetFile(filename string, username string, diskLocations []string,
+             configs *types.Config) (string, error) {
+    return GetFileWithLayout(filename, username, diskLocations,
+                             types.DefaultLayout(len(diskLocations), configs), configs)
+}
 
+/*
+    Where a file is gotten to in the working directory: downloaded-<name>, in
+    the same folders as its path ("a/report.txt" is gotten to
+    "a/downloaded-report.txt"), so files with the same name in different
+    folders don't overwrite each other
 */
-func GetFile(filename string, username string, diskLocations []string, configs *types.Config) string {
-    dataDiskCount := len(diskLocations) - configs.ParityDiskCount
+func downloadedName(filename string) string {
+    return filepath.FromSlash(path.Join(path.Dir(filename), "downloaded-" + path.Base(filename)))
+}
 
-    localDiskLocations := diskLocations
-    for i := 0; i < len(diskLocations); i++ {
-        // check if not already local here
-        localDiskLocations[i] = diskLocations[i]
+/*
+    Same as GetFile, for a file that was saved with the given layout (as
+    recorded in the database entry of the file). Up to layout.ParityCount
+    corrupted components are rebuilt from the intact ones.
+*/
+func GetFileWithLayout(filename string, username string, diskLocations []string,
+                       layout types.Layout, configs *types.Config) (string, error) {
+    downloadedFilename, _, err := GetFileWithReport(filename, username, diskLocations,
+                                                    layout, configs)
+    return downloadedFilename, err
+}
+
+/*
+    Same as GetFileWithLayout, and also reports the locations that were
+    degraded (missing locations and components are treated as failed disks,
+    the file is served from the surviving components and the parity)
+*/
+func GetFileWithReport(filename string, username string, diskLocations []string,
+                       layout types.Layout, configs *types.Config) (string, *ReadReport, error) {
+    err := checkLayout(layout, len(diskLocations))
+    if err != nil {
+        return "", nil, err
     }
 
     /*
-        TODO: check if any of the disk locations are not localhost or EBS, if
-        they are stored somewhere else other than where the server can directly
-        access, then fetch them first and place them in the locations the
-        basic reader/writers expect (parse the disk locations here)
+        Parse the disk locations into the backends that are responsible for
+        them, the readers only go through the backends (so they don't have to
+        care whether a component is local or not)
     */
-    for i := 0; i < len(diskLocations); i++ {
-        // pass into this function a local locations where to temporarily save
-        // the file, should possibly be doing load balancing instead of doing
-        // the disk that the server is on - might burn it out faster**
-        fetchDiskFileIfNotLocal(diskLocations[i], localDiskLocations[i], filename, username, configs);
+    backends, err := openBackends(diskLocations)
+    if err != nil {
+        return "", nil, err
     }
 
     // can delete this after sent in real model
-    downloadedFilename := fmt.Sprintf("downloaded-%s", filename)
+    downloadedFilename := downloadedName(filename)
+    err = os.MkdirAll(filepath.Dir(downloadedFilename), 0755)
+    if err != nil {
+        return "", nil, err
+    }
+
+    // a copy that was gotten before may be read-only (the permission bits of
+    // the original file are restored onto it), so it is replaced
+    os.Remove(downloadedFilename)
 
     // fmt.Printf("Creating file: %s\n", downloadedFilename)
-    outputFile, err := os.Create(downloadedFilename); check(err)
+    outputFile, err := os.Create(downloadedFilename)
+    if err != nil {
+        return "", nil, err
+    }
 
-    completionChannel := make(chan int, dataDiskCount)
-    canRecoverChannel := make(chan int, dataDiskCount)
-    parityCompletionChannel := make(chan int, configs.ParityDiskCount)
+    var damage []*componentDamage
+    name := storedFilename(filename, layout)
+    if layout.Scheme == types.MIRROR_SCHEME {
+        damage, err = getMirrored(name, outputFile, backends, layout, username)
+    } else if layout.Striping == types.STRIPING_ROTATING {
+        damage, err = getStriped(name, outputFile, backends, layout, username)
+    } else {
+        damage, err = getStrips(name, outputFile, backends, layout, username)
+    }
+    outputFile.Close()
 
-    for i := 0; i < dataDiskCount; i++ {
-        sliceFilename := fmt.Sprintf("%s/%s/%s_%d", localDiskLocations[i],
-                                  username, filename, i)
-        hasPadding := (i == int(dataDiskCount) - 1) // second to last disk has the padding
-        go basicReaderWriter(sliceFilename, outputFile, i, hasPadding, 
-                            completionChannel, canRecoverChannel,
-                            localDiskLocations, username, configs)
+    if err != nil {
+        os.Remove(downloadedFilename)
+        return "", nil, err
     }
 
-    // also create a basic reader to check the correctness of the redundant
-    // bits stored on the parity disk
-    parityFilename := fmt.Sprintf("%s/%s/%s_p", localDiskLocations[len(localDiskLocations) - 1],
-                                  username, filename)
-    // fmt.Printf("parity: %s\n", parityFilename)
-    go basicParityChecker(parityFilename, parityCompletionChannel, 
-                        canRecoverChannel, localDiskLocations, username, configs)
+    return downloadedFilename, newReadReport(damage, backends, diskLocations), nil
+}
 
-    // wait for all of the writers to be done
-    numberOfErrors := 0
-    // brokenDrive := -1
-    for i := 0; i < dataDiskCount; i++ {
-        errorCode := <- completionChannel // may want to get error codes here
-        if errorCode != 0 { // some drive had an issue
-            numberOfErrors++
-            // brokenDrive = errorCode
-        }
+/*
+    Same as GetFileWithLayout, for files saved in whole strips (one reader per
+    data component, and a checker per parity component), returns the damage
+    that was found on the components (nil for the intact ones)
+*/
+func getStrips(filename string, outputFile *os.File, backends []Backend,
+               layout types.Layout, username string) ([]*componentDamage, error) {
+    dataDiskCount := layout.DataCount
+    componentCount := layout.DataCount + layout.ParityCount
 
-        // got all of the other drives
-        if i == dataDiskCount - numberOfErrors {
-            // can let the drive(s) with errors know that they can use the
-            // other drives' files
-            // Note: for now, assuming only one drive will go down at a time
+    completionChannel := make(chan int, componentCount)
+    damage := make([]*componentDamage, componentCount)
+    outputErrors := make([]error, componentCount)
 
-            canRecoverChannel <- 0
-            // should wait for recovery to finish, will return a 0 after it
-            // returns
-            errorCode = <- completionChannel
-        }
+    for i := 0; i < dataDiskCount; i++ {
+        hasPadding := (i == int(dataDiskCount) - 1) // last data disk has the padding
+        go basicReaderWriter(filename, outputFile, i, hasPadding, completionChannel,
+                             damage, outputErrors, backends, username, dataDiskCount)
     }
 
-    // fmt.Printf("All of the writers finished\n")
-
-    // ensure parity checker finishes
-    errorCode := <- parityCompletionChannel
-    if errorCode != 0 {
-        canRecoverChannel <- 0
-        errorCode = <- parityCompletionChannel
+    // also create basic readers to check the correctness of the redundant
+    // bits stored on the parity disks
+    for i := dataDiskCount; i < componentCount; i++ {
+        go basicParityChecker(filename, i, completionChannel, damage, backends,
+                              username, dataDiskCount)
     }
 
-    // fmt.Printf("Parity writer finished\n")
-
-    // remove after sent
-    // os.Remove(filename)
-    outputFile.Close()
+    // wait for all of the readers to be done, and collect the broken drives
+    var brokenDrives []int
+    for i := 0; i < componentCount; i++ {
+        errorCode := <- completionChannel
+        if errorCode != 0 { // some drive had an issue
+            brokenDrives = append(brokenDrives, errorCode - 1)
+        }
+    }
 
+    // fmt.Printf("All of the readers finished\n")
     close(completionChannel)
-    close(parityCompletionChannel)
-    close(canRecoverChannel)
 
-    // fmt.Printf("Closed channels\n")
+    err := firstError(outputErrors)
+    if err != nil {
+        return nil, err
+    }
+
+    /*
+        Recover all of the broken drives at once, so that the recovery only
+        ever reads from components that are known to be intact
+    */
+    if len(brokenDrives) > 0 {
+        err = recoverFromDriveFailure(damage, filename, outputFile, backends,
+                                      layout, username)
+    }
 
-    return downloadedFilename
+    return damage, err
 }
 
 /*
-    TODO: check for each file if it can be deleted locally, otherwise issue
-    a separate command/function to delete the component on the different
-    system
+    Remove all of the components of a file, through the backends of the
+    locations it was saved to
 */
 func RemoveFile(filename string, username string, diskLocations []string,
-                configs *types.Config) {
-    dataDiskCount := len(diskLocations) - configs.ParityDiskCount
+                configs *types.Config) error {
+    return RemoveFileWithLayout(filename, username, diskLocations,
+                                types.DefaultLayout(len(diskLocations), configs), configs)
+}
 
-    for i := 0; i < dataDiskCount; i++ {
-        sliceFilename := fmt.Sprintf("%s/%s/%s_%d", diskLocations[i],
-                                  username, filename, i)
-        // remove it, if it exists (which it should)
-        // TODO: this assumes that the file is stored locally, need to update
-        // this later
-        if _, err := os.Stat(sliceFilename); !(os.IsNotExist(err)) { // file exists
-            os.Remove(sliceFilename)
-        }
+// same as RemoveFile, for a file that was saved with the given layout
+func RemoveFileWithLayout(filename string, username string, diskLocations []string,
+                          layout types.Layout, configs *types.Config) error {
+    backends, err := openBackends(diskLocations)
+    if err != nil {
+        return err
     }
 
-    parityFilename := fmt.Sprintf("%s/%s/%s_p", diskLocations[len(diskLocations) - 1],
-                                  username, filename)
-    // remove it, if it exists (which it should)
-    if _, err := os.Stat(parityFilename); !(os.IsNotExist(err)) { // file exists
-        os.Remove(parityFilename)
-    }
+    removeComponents(backends, storedFilename(filename, layout), username, layout)
 
     // fmt.Printf("Removed file %s\n", filename)
+    return nil
 }
-
-
-func fetchDiskFileIfNotLocal(diskLocation string, fetchLocation string, 
-                            filename string, username string, configs *types.Config) {
-    /*
-        TODO: implement, fetch the disk file if the disk location is not
-        accessible locally, put it in the place that writers and readers would
-        expect the file if it was local. Return if the disk location is 
-        accessible from the server.
-    */
-}
\ No newline at end of file
@@ -10,13 +10,23 @@ package fileutils
 
 import (
     "testing"
+    "crypto/md5"
+    "context"
+    "io"
     "math/rand"
     "math"
     "os"
     "fmt"
     "bytes"
+    "errors"
+    "strings"
     "os/exec"
     "time"
+    "sync"
+    "log"
+    "net/url"
+    "path/filepath"
+    "io/ioutil"
     "foxyblox/types"
 )
 
@@ -30,6 +40,13 @@ var LARGE_FILE_SIZE int64 = int64(math.Pow(2, float64(18))) //int64(math.Pow(2,
 var configs *types.Config
 var diskLocations []string
 
+// the packages return their errors, tests still stop at the unexpected ones
+func check(err error) {
+    if err != nil {
+        log.Fatal("Exiting: ", err)
+    }
+}
+
 func TestMain(m *testing.M) {
     fmt.Println("Setting up for tests")
 
@@ -124,7 +141,7 @@ func testSavingCorrectnessHelper(t *testing.T, size int, testingFilename string,
     // create sample file with random binary data
     testingFile, err := os.Create(testingFilename) // overwrite existing file if there
     if err != nil {
-        t.Errorf("Could not create %d\n", testingFilename)
+        t.Errorf("Could not create %s\n", testingFilename)
     }
 
     fileData := make([]byte, size)
@@ -137,7 +154,7 @@ func testSavingCorrectnessHelper(t *testing.T, size int, testingFilename string,
     startTime := time.Now()
 
     // call saveFile
-    SaveFile(testingFilename, username, diskLocations, configs)
+    check(SaveFile(testingFilename, username, diskLocations, configs))
 
     elapsed := time.Since(startTime)
     fmt.Printf("Saving file of size %d took %s\n", size, elapsed)
@@ -148,15 +165,15 @@ func testSavingCorrectnessHelper(t *testing.T, size int, testingFilename string,
         filename := fmt.Sprintf("%s/%s/%s_%d", diskLocations[i], username, testingFilename, i)
         file, err := os.Open(filename)
         if err != nil {
-            t.Errorf("Could not open %d\n", filename)
+            t.Errorf("Could not open %s\n", filename)
         }
         fileStat, err := file.Stat()
         if err != nil {
-            t.Errorf("Could not check stat of %d\n", filename)
+            t.Errorf("Could not check stat of %s\n", filename)
         }
 
         size := fileStat.Size()
-        size -= types.MD5_SIZE // strip off the hash at the end
+        size = dataSizeOf(file) // strip off the trailer (block hashes) at the end
 
         fileBuffer := make([]byte, size)
         file.ReadAt(fileBuffer, 0)
@@ -170,15 +187,15 @@ func testSavingCorrectnessHelper(t *testing.T, size int, testingFilename string,
     filename := fmt.Sprintf("%s/%s/%s_p", diskLocations[len(diskLocations) - 1], username, testingFilename)
     file, err := os.Open(filename)
     if err != nil {
-        t.Errorf("Could not open %d\n", filename)
+        t.Errorf("Could not open %s\n", filename)
     }
     fileStat, err := file.Stat()
     if err != nil {
-        t.Errorf("Could not check stat of %d\n", filename)
+        t.Errorf("Could not check stat of %s\n", filename)
     }
 
     fileSize := fileStat.Size()
-    fileSize -= types.MD5_SIZE // strip off the hash at the end
+    fileSize = dataSizeOf(file) // strip off the trailer (block hashes) at the end
 
     fileBuffer := make([]byte, fileSize)
     file.ReadAt(fileBuffer, 0)
@@ -194,7 +211,7 @@ func testSavingCorrectnessHelper(t *testing.T, size int, testingFilename string,
     // testingFilename = fmt.Sprintf("./%s", testingFilename)
     // os.Remove(testingFilename)
     // remove the file
-    RemoveFile(testingFilename, username, diskLocations, configs)
+    check(RemoveFile(testingFilename, username, diskLocations, configs))
 }
 
 func TestSavingCorrectnessVerySmallFile(t *testing.T) {
@@ -232,7 +249,7 @@ func TestGettingFile(t *testing.T) {
 
     testingFile, err := os.Create(testingFilename) // overwrite existing file if there
     if err != nil {
-        t.Errorf("Could not create %d\n", testingFilename)
+        t.Errorf("Could not create %s\n", testingFilename)
     }
 
     for i := int64(0); i < (LARGE_FILE_SIZE / int64(REGULAR_FILE_SIZE)); i++ {
@@ -241,14 +258,16 @@ func TestGettingFile(t *testing.T) {
 
         _, err = testingFile.WriteAt(smallData, i * int64(REGULAR_FILE_SIZE))
         if err != nil {
-            t.Errorf("Could not write to %d\n", testingFilename)
+            t.Errorf("Could not write to %s\n", testingFilename)
         }
     }
 
     // call saveFile
-    SaveFile(testingFilename, username, diskLocations, configs)
+    check(SaveFile(testingFilename, username, diskLocations, configs))
 
-    GetFile(testingFilename, username, diskLocations, configs)
+    if _, err := GetFile(testingFilename, username, diskLocations, configs); err != nil {
+        t.Fatalf("Could not get %s: %v", testingFilename, err)
+    }
 
     cmd := exec.Command("diff", testingFilename, "downloaded-" + testingFilename)
 
@@ -277,14 +296,14 @@ func TestGettingFile(t *testing.T) {
     // testingFilename = fmt.Sprintf("./downloaded-%s", testingFilename)
     // os.Remove(testingFilename)
     // remove the file
-    RemoveFile(testingFilename, username, diskLocations, configs)
+    check(RemoveFile(testingFilename, username, diskLocations, configs))
 }
 
 func testSimulatedDiskCorruptionHelper(t *testing.T, size int, testingFilename string, fileToCorrupt string) {
     // create sample file with random binary data
     testingFile, err := os.Create(testingFilename) // overwrite existing file if there
     if err != nil {
-        t.Errorf("Could not create %d\n", testingFilename)
+        t.Errorf("Could not create %s\n", testingFilename)
     }
 
     username := "atoron"
@@ -297,7 +316,7 @@ func testSimulatedDiskCorruptionHelper(t *testing.T, size int, testingFilename s
     testingFile.Close()
 
     // call saveFile
-    SaveFile(testingFilename, username, diskLocations, configs)
+    check(SaveFile(testingFilename, username, diskLocations, configs))
 
     // insert some faulty bits into the file
     file, err := os.OpenFile(fileToCorrupt, os.O_RDWR, 0755)
@@ -325,7 +344,9 @@ func testSimulatedDiskCorruptionHelper(t *testing.T, size int, testingFilename s
 
     file.Close()
 
-    GetFile(testingFilename, username, diskLocations, configs)
+    if _, err := GetFile(testingFilename, username, diskLocations, configs); err != nil {
+        t.Fatalf("Could not get %s: %v", testingFilename, err)
+    }
 
     // diff should still be fine, because recovered
 
@@ -355,7 +376,7 @@ func testSimulatedDiskCorruptionHelper(t *testing.T, size int, testingFilename s
     // testingFilename = fmt.Sprintf("./downloaded-%s", testingFilename)
     // os.Remove(testingFilename)
     // remove the file
-    RemoveFile(testingFilename, username, diskLocations, configs)
+    check(RemoveFile(testingFilename, username, diskLocations, configs))
 }
 
 func TestSimulatedDataDiskCorruption(t *testing.T) {
@@ -389,7 +410,7 @@ func TestSimulatedParityDiskCorruption(t *testing.T) {
     testingFilename := "testingFileLarge.txt"
     testingFile, err := os.Create(testingFilename) // overwrite existing file if there
     if err != nil {
-        t.Errorf("Could not create %d\n", testingFilename)
+        t.Errorf("Could not create %s\n", testingFilename)
     }
 
     username := "atoron"
@@ -402,7 +423,7 @@ func TestSimulatedParityDiskCorruption(t *testing.T) {
     testingFile.Close()
 
     // call saveFile
-    SaveFile(testingFilename, username, diskLocations, configs)
+    check(SaveFile(testingFilename, username, diskLocations, configs))
 
     // insert some faulty bits into the file
     parityFilename := fmt.Sprintf("./storage/drive%d/%s/%s_p", len(diskLocations) - 1, username, testingFilename)
@@ -422,7 +443,9 @@ func TestSimulatedParityDiskCorruption(t *testing.T) {
 
     file.Close()
 
-    GetFile(testingFilename, username, diskLocations, configs)
+    if _, err := GetFile(testingFilename, username, diskLocations, configs); err != nil {
+        t.Fatalf("Could not get %s: %v", testingFilename, err)
+    }
 
     // check that the parity disk is now correct
     // check if the XOR of the components is correct
@@ -431,16 +454,16 @@ func TestSimulatedParityDiskCorruption(t *testing.T) {
         filename := fmt.Sprintf("%s/%s/%s_%d", diskLocations[i], username, testingFilename, i)
         file, err := os.Open(filename)
         if err != nil {
-            t.Errorf("Could not open %d\n", filename)
+            t.Errorf("Could not open %s\n", filename)
         }
         fileStat, err := file.Stat()
         if err != nil {
-            t.Errorf("Could not check stat of %d\n", filename)
+            t.Errorf("Could not check stat of %s\n", filename)
         }
 
         size := fileStat.Size()
         fmt.Printf("Size : %d\n", size)
-        size -= types.MD5_SIZE // strip off the hash at the end
+        size = dataSizeOf(file) // strip off the trailer (block hashes) at the end
         fileBuffer := make([]byte, size)
         file.ReadAt(fileBuffer, 0)
         for j := 0; j < int(size); j++ {
@@ -452,15 +475,15 @@ func TestSimulatedParityDiskCorruption(t *testing.T) {
 
     file, err = os.Open(parityFilename)
     if err != nil {
-        t.Errorf("Could not open %d\n", parityFilename)
+        t.Errorf("Could not open %s\n", parityFilename)
     }
     fileStat, err := file.Stat()
     if err != nil {
-        t.Errorf("Could not check stat of %d\n", parityFilename)
+        t.Errorf("Could not check stat of %s\n", parityFilename)
     }
 
     size := fileStat.Size()
-    size -= types.MD5_SIZE // strip off the hash at the end
+    size = dataSizeOf(file) // strip off the trailer (block hashes) at the end
     fmt.Printf("Going to check size %d bytes\n", size)
 
     fileBuffer := make([]byte, size)
@@ -479,7 +502,7 @@ func TestSimulatedParityDiskCorruption(t *testing.T) {
     // testingFilename = fmt.Sprintf("./%s", testingFilename)
     // os.Remove(testingFilename)
     // remove the file
-    RemoveFile(testingFilename, username, diskLocations, configs)
+    check(RemoveFile(testingFilename, username, diskLocations, configs))
 }
 
 func TestRemoveFile(t *testing.T) {
@@ -487,7 +510,7 @@ func TestRemoveFile(t *testing.T) {
     testingFilename := "testingFile.txt"
     testingFile, err := os.Create(testingFilename) // overwrite existing file if there
     if err != nil {
-        t.Errorf("Could not create %d\n", testingFilename)
+        t.Errorf("Could not create %s\n", testingFilename)
     }
 
     username := "atoron"
@@ -501,7 +524,7 @@ func TestRemoveFile(t *testing.T) {
     testingFile.Close()
 
     // call saveFile
-    SaveFile(testingFilename, username, diskLocations, configs)
+    check(SaveFile(testingFilename, username, diskLocations, configs))
 
     // check that the files are there in the first place
     for i := 0; i < TESTING_DISK_COUNT; i++ {
@@ -516,7 +539,7 @@ func TestRemoveFile(t *testing.T) {
     }
 
     // remove the file
-    RemoveFile(testingFilename, username, diskLocations, configs)
+    check(RemoveFile(testingFilename, username, diskLocations, configs))
 
     // files should no longer be there
     for i := 0; i < 3; i++ {
@@ -536,10 +559,10 @@ func TestAddFileToLessThanFourLocations(t *testing.T) {
     testingFilename := "testingFile.txt"
     testingFile, err := os.Create(testingFilename) // overwrite existing file if there
     if err != nil {
-        t.Errorf("Could not create %d\n", testingFilename)
+        t.Errorf("Could not create %s\n", testingFilename)
     }
 
-    fmt.Println("Starting TEST: Add file to less than four locations\n")
+    fmt.Println("Starting TEST: Add file to less than four locations")
 
     username := "atoron"
 
@@ -553,7 +576,7 @@ func TestAddFileToLessThanFourLocations(t *testing.T) {
 
     for i := 2; i < TESTING_DISK_COUNT + 1; i++ {
         // call saveFile
-        SaveFile(testingFilename, username, diskLocations[0:i], configs)
+        check(SaveFile(testingFilename, username, diskLocations[0:i], configs))
 
         // check that the files are there in the first place
         smallerLocations := diskLocations[0:i]
@@ -569,7 +592,9 @@ func TestAddFileToLessThanFourLocations(t *testing.T) {
         }
 
         // check that getting the file will yield the correct result
-        GetFile(testingFilename, username, smallerLocations, configs)
+        if _, err := GetFile(testingFilename, username, smallerLocations, configs); err != nil {
+            t.Fatalf("Could not get %s: %v", testingFilename, err)
+        }
         cmd := exec.Command("diff", testingFilename, "downloaded-" + testingFilename)
 
         var out bytes.Buffer
@@ -589,7 +614,7 @@ func TestAddFileToLessThanFourLocations(t *testing.T) {
         }
 
         // remove the file
-        RemoveFile(testingFilename, username, smallerLocations, configs)
+        check(RemoveFile(testingFilename, username, smallerLocations, configs))
 
         // files should no longer be there
         for j := 0; j < len(smallerLocations) - 1; j++ {
@@ -616,12 +641,1506 @@ func TestMultipleUsers(t *testing.T) {
     testSavingCorrectnessHelper(t, SMALL_FILE_SIZE, testingFilename, username2)
 
     // remove the file
-    RemoveFile(testingFilename, username, diskLocations, configs)
+    check(RemoveFile(testingFilename, username, diskLocations, configs))
 
     // remove the file
-    RemoveFile(testingFilename, username2, diskLocations, configs)
+    check(RemoveFile(testingFilename, username2, diskLocations, configs))
+
+}
+
+
+func TestOpenBackend(t *testing.T) {
+    backend, err := OpenBackend("./storage/drive0")
+    if err != nil {
+        t.Errorf("Plain path did not open as a local backend: %s", err)
+    } else if local, ok := backend.(*localBackend); !ok || local.root != "./storage/drive0" {
+        t.Errorf("Plain path did not map to the local backend")
+    }
+
+    backend, err = OpenBackend("file:///tmp/storage/drive0")
+    if err != nil {
+        t.Errorf("file:// location did not open: %s", err)
+    } else if local, ok := backend.(*localBackend); !ok || local.root != "/tmp/storage/drive0" {
+        t.Errorf("file:// location did not map to the local backend")
+    }
+
+    _, err = OpenBackend("nosuchscheme://bucket/drive0")
+    if err == nil {
+        t.Errorf("Location with an unregistered scheme should not open")
+    }
+}
+
+func TestSavingToURILocations(t *testing.T) {
+    testingFilename := "testingFileURI.txt"
+    username := "atoron"
+
+    // all of the other schemes are registered by plugging in a backend, just
+    // pretend that this one is remote and point it at the local folders
+    RegisterBackend("testfs", func(location *url.URL) (Backend, error) {
+        return &localBackend{root: location.Host + location.Path}, nil
+    })
+
+    uriLocations := make([]string, len(diskLocations))
+    for i := 0; i < len(diskLocations); i++ {
+        absolutePath, err := filepath.Abs(diskLocations[i])
+        check(err)
+        if i % 2 == 0 {
+            uriLocations[i] = "file://" + absolutePath
+        } else {
+            uriLocations[i] = "testfs://" + absolutePath
+        }
+    }
+
+    createRandomFile(testingFilename, int64(SMALL_FILE_SIZE))
+
+    check(SaveFile(testingFilename, username, uriLocations, configs))
+
+    // components should end up in the same place as with plain paths
+    for i := 0; i < TESTING_DISK_COUNT; i++ {
+        stripFile := fmt.Sprintf("%s/%s/%s_%d", diskLocations[i], username, testingFilename, i)
+        if !pathExists(stripFile) {
+            t.Errorf("Component %s was not saved through its backend", stripFile)
+        }
+    }
+
+    if _, err := GetFile(testingFilename, username, uriLocations, configs); err != nil {
+        t.Fatalf("Could not get %s: %v", testingFilename, err)
+    }
+
+    cmd := exec.Command("diff", testingFilename, "downloaded-" + testingFilename)
+
+    var out bytes.Buffer
+    var stderr bytes.Buffer
+    cmd.Stdout = &out
+    cmd.Stderr = &stderr
+    err := cmd.Run()
+    if err != nil {
+        fmt.Printf("Diff stderr: %q\n", stderr.String())
+        t.Errorf("Diff stderr not empty")
+    }
+
+    if out.String() != "" {
+        t.Errorf("Diff output was not empty")
+    }
+
+    check(RemoveFile(testingFilename, username, uriLocations, configs))
+
+    parityfile := fmt.Sprintf("%s/%s/%s_p", diskLocations[len(diskLocations) - 1], username, testingFilename)
+    if pathExists(parityfile) {
+        t.Errorf("One of the components still exists (parity)")
+    }
+}
+
+func TestReedSolomonRecovery(t *testing.T) {
+    testingFilename := "testingFileRS.txt"
+    username := "atoron"
+
+    // 6 data + 3 parity components, should survive losing any 3 of them
+    layout := types.Layout{Scheme: types.RS_SCHEME, DataCount: 6, ParityCount: 3}
+    rsLocations := make([]string, layout.DataCount + layout.ParityCount)
+    for i := 0; i < len(rsLocations); i++ {
+        rsLocations[i] = fmt.Sprintf("./storage/rsdrive%d", i)
+    }
+
+    createRandomFile(testingFilename, LARGE_FILE_SIZE + 7)
+
+    check(SaveFileWithLayout(testingFilename, username, rsLocations, layout, configs))
+
+    // corrupt two data components (including the one with the padding) and
+    // one of the parity components
+    corrupted := []string{
+        fmt.Sprintf("%s/%s/%s_1", rsLocations[1], username, testingFilename),
+        fmt.Sprintf("%s/%s/%s_5", rsLocations[5], username, testingFilename),
+        fmt.Sprintf("%s/%s/%s_p1", rsLocations[7], username, testingFilename),
+    }
+    originals := make([][]byte, len(corrupted))
+    for i := 0; i < len(corrupted); i++ {
+        data, err := ioutil.ReadFile(corrupted[i])
+        check(err)
+        originals[i] = data
+
+        file, err := os.OpenFile(corrupted[i], os.O_RDWR, 0755)
+        check(err)
+        buf := make([]byte, 50)
+        rand.Read(buf)
+        _, err = file.WriteAt(buf, 5)
+        check(err)
+        file.Close()
+    }
+
+    if _, err := GetFileWithLayout(testingFilename, username, rsLocations, layout, configs); err != nil {
+        t.Fatalf("Could not get %s: %v", testingFilename, err)
+    }
+
+    original, err := ioutil.ReadFile(testingFilename)
+    check(err)
+    downloaded, err := ioutil.ReadFile("downloaded-" + testingFilename)
+    check(err)
+    if !bytes.Equal(original, downloaded) {
+        t.Errorf("File was not recovered from the intact components")
+    }
+
+    // the corrupted components should have been rewritten
+    for i := 0; i < len(corrupted); i++ {
+        data, err := ioutil.ReadFile(corrupted[i])
+        check(err)
+        if !bytes.Equal(data, originals[i]) {
+            t.Errorf("Component %s was not fixed", corrupted[i])
+        }
+    }
+
+    check(RemoveFileWithLayout(testingFilename, username, rsLocations, layout, configs))
+    for i := 0; i < len(corrupted); i++ {
+        if pathExists(corrupted[i]) {
+            t.Errorf("Component %s still exists", corrupted[i])
+        }
+    }
+}
+
+func TestReedSolomonAnyDataCountDecodes(t *testing.T) {
+    layout := types.Layout{Scheme: types.RS_SCHEME, DataCount: 6, ParityCount: 3}
+    total := layout.DataCount + layout.ParityCount
+
+    // every way of picking 6 of the 9 components should be decodable
+    for mask := 0; mask < (1 << uint(total)); mask++ {
+        var available []int
+        for ID := 0; ID < total; ID++ {
+            if mask & (1 << uint(ID)) != 0 {
+                available = append(available, ID)
+            }
+        }
+        if len(available) != layout.DataCount {
+            continue
+        }
+
+        if _, err := decodeMatrix(layout, available); err != nil {
+            t.Errorf("Could not decode from components %v: %v", available, err)
+        }
+    }
+
+    if checkLayout(types.Layout{Scheme: types.XOR_SCHEME, DataCount: 3, ParityCount: 2}, 5) == nil {
+        t.Errorf("XOR layout with more than one parity component should not be allowed")
+    }
+    if checkLayout(layout, 4) == nil {
+        t.Errorf("Layout should not be allowed on the wrong amount of locations")
+    }
+}
+
+func TestDualParityRecovery(t *testing.T) {
+    testingFilename := "testingFilePQ.txt"
+    username := "atoron"
+
+    // RAID 6: 3 data components + P + Q, survives losing any two components
+    layout := types.Layout{Scheme: types.PQ_SCHEME, DataCount: 3, ParityCount: 2}
+    pqLocations := make([]string, layout.DataCount + layout.ParityCount)
+    for i := 0; i < len(pqLocations); i++ {
+        pqLocations[i] = fmt.Sprintf("./storage/pqdrive%d", i)
+    }
+
+    createRandomFile(testingFilename, LARGE_FILE_SIZE)
+
+    // every pair of components: one goes missing, the other one is corrupted
+    for first := 0; first < len(pqLocations); first++ {
+        for second := first + 1; second < len(pqLocations); second++ {
+            check(SaveFileWithLayout(testingFilename, username, pqLocations, layout, configs))
+
+            missing := fmt.Sprintf("%s/%s", pqLocations[first],
+                                   componentNameForID(username, testingFilename, first, layout.DataCount))
+            corrupted := fmt.Sprintf("%s/%s", pqLocations[second],
+                                     componentNameForID(username, testingFilename, second, layout.DataCount))
+            err := os.Remove(missing)
+            check(err)
+
+            file, err := os.OpenFile(corrupted, os.O_RDWR, 0755)
+            check(err)
+            buf := make([]byte, 50)
+            rand.Read(buf)
+            _, err = file.WriteAt(buf, 5)
+            check(err)
+            file.Close()
+
+            if _, err := GetFileWithLayout(testingFilename, username, pqLocations, layout, configs); err != nil {
+                t.Fatalf("Could not get %s: %v", testingFilename, err)
+            }
+
+            original, err := ioutil.ReadFile(testingFilename)
+            check(err)
+            downloaded, err := ioutil.ReadFile("downloaded-" + testingFilename)
+            check(err)
+            if !bytes.Equal(original, downloaded) {
+                t.Errorf("File was not recovered with components %d and %d broken", first, second)
+            }
+            if !pathExists(missing) {
+                t.Errorf("Missing component %s was not rebuilt", missing)
+            }
+        }
+    }
+
+    check(RemoveFileWithLayout(testingFilename, username, pqLocations, layout, configs))
+}
+
+func TestStripedRecovery(t *testing.T) {
+    testingFilename := "testingFileStriped.txt"
+    username := "atoron"
+
+    var stripeSize int64 = 1024
+    layouts := []types.Layout{
+        types.Layout{Scheme: types.XOR_SCHEME, DataCount: 3, ParityCount: 1,
+                     Striping: types.STRIPING_ROTATING, StripeSize: stripeSize},
+        types.Layout{Scheme: types.PQ_SCHEME, DataCount: 3, ParityCount: 2,
+                     Striping: types.STRIPING_ROTATING, StripeSize: stripeSize},
+    }
+    // exact multiple of a stripe, partial last stripe, smaller than one unit
+    sizes := []int64{3 * stripeSize * 20, 3 * stripeSize * 20 + 517, 100}
+
+    for _, layout := range layouts {
+        stripedLocations := make([]string, layout.DataCount + layout.ParityCount)
+        for i := 0; i < len(stripedLocations); i++ {
+            stripedLocations[i] = fmt.Sprintf("./storage/stripedrive%d", i)
+        }
+
+        for _, size := range sizes {
+            createRandomFile(testingFilename, size)
+            original, err := ioutil.ReadFile(testingFilename)
+            check(err)
+
+            // intact, then as many broken locations as the layout can survive
+            for broken := 0; broken <= layout.ParityCount; broken++ {
+                check(SaveFileWithLayout(testingFilename, username, stripedLocations, layout, configs))
+
+                if broken >= 1 { // corrupt one unit in the middle of a component
+                    corrupted := fmt.Sprintf("%s/%s", stripedLocations[1],
+                                             componentName(username, testingFilename, 1))
+                    file, err := os.OpenFile(corrupted, os.O_RDWR, 0755)
+                    check(err)
+                    buf := make([]byte, 50)
+                    rand.Read(buf)
+                    _, err = file.WriteAt(buf, 10)
+                    check(err)
+                    file.Close()
+                }
+                if broken >= 2 {
+                    err = os.Remove(fmt.Sprintf("%s/%s", stripedLocations[3],
+                                                componentName(username, testingFilename, 3)))
+                    check(err)
+                }
+
+                if _, err := GetFileWithLayout(testingFilename, username, stripedLocations, layout, configs); err != nil {
+                    t.Fatalf("Could not get %s: %v", testingFilename, err)
+                }
+
+                downloaded, err := ioutil.ReadFile("downloaded-" + testingFilename)
+                check(err)
+                if !bytes.Equal(original, downloaded) {
+                    t.Errorf("Striped file of size %d (scheme %d) was not recovered with %d broken locations",
+                             size, layout.Scheme, broken)
+                }
+
+                // the broken components were rebuilt, so the file reads back without recovery
+                if _, err := GetFileWithLayout(testingFilename, username, stripedLocations, layout, configs); err != nil {
+                    t.Fatalf("Could not get %s: %v", testingFilename, err)
+                }
+                downloaded, err = ioutil.ReadFile("downloaded-" + testingFilename)
+                check(err)
+                if !bytes.Equal(original, downloaded) {
+                    t.Errorf("Striped components of size %d (scheme %d) were not rebuilt", size, layout.Scheme)
+                }
+            }
+        }
+
+        check(RemoveFileWithLayout(testingFilename, username, stripedLocations, layout, configs))
+    }
+}
+
+func TestSaveStream(t *testing.T) {
+    testingFilename := "testingFileStream.txt"
+    username := "atoron"
+
+    data := make([]byte, LARGE_FILE_SIZE + 123)
+    rand.Read(data)
+
+    // size known up front
+    layout, err := SaveStream(context.Background(), bytes.NewReader(data), int64(len(data)),
+                              testingFilename, username, diskLocations, configs)
+    if err != nil {
+        t.Fatalf("Could not save stream: %v", err)
+    }
+    if layout.Striping != types.STRIPING_ROTATING {
+        t.Errorf("Stream was not saved in stripes")
+    }
+
+    if _, err := GetFileWithLayout(testingFilename, username, diskLocations, layout, configs); err != nil {
+        t.Fatalf("Could not get %s: %v", testingFilename, err)
+    }
+    downloaded, err := ioutil.ReadFile("downloaded-" + testingFilename)
+    check(err)
+    if !bytes.Equal(data, downloaded) {
+        t.Errorf("Stream with known size was not saved correctly")
+    }
+
+    // size not known, read from a pipe until it is closed
+    pipeReader, pipeWriter := io.Pipe()
+    go func() {
+        for i := 0; i < len(data); i += 1000 {
+            end := i + 1000
+            if end > len(data) {
+                end = len(data)
+            }
+            pipeWriter.Write(data[i:end])
+        }
+        pipeWriter.Close()
+    }()
+    layout, err = SaveStream(context.Background(), pipeReader, -1, testingFilename,
+                             username, diskLocations, configs)
+    if err != nil {
+        t.Fatalf("Could not save stream of unknown size: %v", err)
+    }
+
+    if _, err := GetFileWithLayout(testingFilename, username, diskLocations, layout, configs); err != nil {
+        t.Fatalf("Could not get %s: %v", testingFilename, err)
+    }
+    downloaded, err = ioutil.ReadFile("downloaded-" + testingFilename)
+    check(err)
+    if !bytes.Equal(data, downloaded) {
+        t.Errorf("Stream with unknown size was not saved correctly")
+    }
+    check(RemoveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+
+    // stream ends early, or the save is cancelled, nothing is left behind
+    shortName := "testingFileShortStream.txt"
+    _, err = SaveStream(context.Background(), bytes.NewReader(data[0:100]), int64(len(data)),
+                        shortName, username, diskLocations, configs)
+    if err == nil {
+        t.Errorf("Saving a stream shorter than its size did not fail")
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    _, err = SaveStream(ctx, bytes.NewReader(data), int64(len(data)), shortName,
+                        username, diskLocations, configs)
+    if err == nil {
+        t.Errorf("Saving a stream with a cancelled context did not fail")
+    }
+
+    for i := 0; i < len(diskLocations); i++ {
+        if pathExists(fmt.Sprintf("%s/%s", diskLocations[i], componentName(username, shortName, i))) {
+            t.Errorf("Failed save left a component on %s", diskLocations[i])
+        }
+    }
+}
+
+func TestGetStream(t *testing.T) {
+    testingFilename := "testingFileGetStream.txt"
+    username := "atoron"
+
+    layouts := []types.Layout{
+        types.DefaultLayout(len(diskLocations), configs),
+        types.Layout{Scheme: types.XOR_SCHEME, DataCount: TESTING_DISK_COUNT, ParityCount: 1,
+                     Striping: types.STRIPING_ROTATING, StripeSize: 512},
+    }
+    sizes := []int64{100, int64(REGULAR_FILE_SIZE), LARGE_FILE_SIZE + 5}
+
+    for _, layout := range layouts {
+        for _, size := range sizes {
+            createRandomFile(testingFilename, size)
+            original, err := ioutil.ReadFile(testingFilename)
+            check(err)
+
+            check(SaveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+
+            // corrupt one of the components, it is rebuilt before streaming
+            corrupted := fmt.Sprintf("%s/%s", diskLocations[0],
+                                     locationComponentName(username, testingFilename, 0, layout))
+            file, err := os.OpenFile(corrupted, os.O_RDWR, 0755)
+            check(err)
+            _, err = file.WriteAt([]byte{0xff, 0x00, 0xff}, 0)
+            check(err)
+            file.Close()
+
+            var output bytes.Buffer
+            err = GetStream(context.Background(), &output, testingFilename, username,
+                            diskLocations, layout, configs)
+            if err != nil {
+                t.Errorf("Could not stream file of size %d: %v", size, err)
+            }
+            if !bytes.Equal(original, output.Bytes()) {
+                t.Errorf("Streamed file of size %d (striping %d) did not match", size, layout.Striping)
+            }
+
+            reader := OpenStream(context.Background(), testingFilename, username,
+                                 diskLocations, layout, configs)
+            streamed, err := ioutil.ReadAll(reader)
+            reader.Close()
+            if err != nil || !bytes.Equal(original, streamed) {
+                t.Errorf("File of size %d read through OpenStream did not match", size)
+            }
+        }
+
+        // too many broken components, nothing is written
+        for location := 0; location < 2; location++ {
+            os.Remove(fmt.Sprintf("%s/%s", diskLocations[location],
+                                  locationComponentName(username, testingFilename, location, layout)))
+        }
+        var output bytes.Buffer
+        err := GetStream(context.Background(), &output, testingFilename, username,
+                         diskLocations, layout, configs)
+        if err == nil || output.Len() != 0 {
+            t.Errorf("Streaming an unrecoverable file did not fail cleanly")
+        }
+
+        check(RemoveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+    }
+}
+
+func TestGetFileRange(t *testing.T) {
+    testingFilename := "testingFileRange.txt"
+    username := "atoron"
+
+    layouts := []types.Layout{
+        types.DefaultLayout(len(diskLocations), configs),
+        types.Layout{Scheme: types.XOR_SCHEME, DataCount: TESTING_DISK_COUNT, ParityCount: 1,
+                     Striping: types.STRIPING_ROTATING, StripeSize: 1000},
+    }
+
+    createRandomFile(testingFilename, LARGE_FILE_SIZE + 7)
+    original, err := ioutil.ReadFile(testingFilename)
+    check(err)
+    size := int64(len(original))
+
+    ranges := [][2]int64{{0, 1}, {0, size}, {size / 3 - 10, 20}, {12345, 4000},
+                         {size - 5, 5}, {size - 5, 100}, {size, 10}, {size + 100, 10},
+                         {0, math.MaxInt64}, {size - 5, math.MaxInt64}}
+
+    for _, layout := range layouts {
+        check(SaveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+
+        for broken := 0; broken < 3; broken++ {
+            if broken == 1 { // the middle of the file is on the missing component
+                os.Remove(fmt.Sprintf("%s/%s", diskLocations[1],
+                                      locationComponentName(username, testingFilename, 1, layout)))
+            } else if broken == 2 { // the start of the file is on a damaged block
+                check(SaveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+
+                file, err := os.OpenFile(fmt.Sprintf("%s/%s", diskLocations[0],
+                                         locationComponentName(username, testingFilename, 0, layout)),
+                                         os.O_RDWR, 0755)
+                check(err)
+                _, err = file.WriteAt([]byte{0xde, 0xad}, 0)
+                check(err)
+                file.Close()
+            }
+
+            for _, r := range ranges {
+                expected := []byte{}
+                if r[0] < size {
+                    end := size
+                    if r[1] < size - r[0] {
+                        end = r[0] + r[1]
+                    }
+                    expected = original[r[0]:end]
+                }
+
+                buf, err := GetFileRange(testingFilename, username, diskLocations, layout,
+                                         configs, r[0], r[1])
+                if err != nil {
+                    t.Errorf("Could not read range %d+%d: %v", r[0], r[1], err)
+                } else if !bytes.Equal(expected, buf) {
+                    t.Errorf("Range %d+%d (striping %d, case %d) did not match",
+                             r[0], r[1], layout.Striping, broken)
+                }
+            }
+        }
+
+        _, err = GetFileRange(testingFilename, username, diskLocations, layout, configs, -1, 10)
+        if err == nil {
+            t.Errorf("Negative offset was accepted")
+        }
+
+        check(RemoveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+    }
+}
+
+func TestBlockLevelRepair(t *testing.T) {
+    testingFilename := "testingFileBlocks.txt"
+    username := "atoron"
+
+    createRandomFile(testingFilename, LARGE_FILE_SIZE)
+    original, err := ioutil.ReadFile(testingFilename)
+    check(err)
+
+    check(SaveFile(testingFilename, username, diskLocations, configs))
+
+    components := make([]string, len(diskLocations))
+    intact := make([][]byte, len(diskLocations))
+    for i := 0; i < len(diskLocations); i++ {
+        components[i] = fmt.Sprintf("%s/%s", diskLocations[i],
+                                    componentNameForID(username, testingFilename, i, TESTING_DISK_COUNT))
+        intact[i], err = ioutil.ReadFile(components[i])
+        check(err)
+    }
+
+    // different blocks of two components, only one parity component but
+    // every block is still only damaged once
+    corrupt := func(path string, offset int64) {
+        file, err := os.OpenFile(path, os.O_RDWR, 0755)
+        check(err)
+        _, err = file.WriteAt([]byte{0xde, 0xad, 0xbe, 0xef}, offset)
+        check(err)
+        file.Close()
+    }
+    corrupt(components[0], 10)
+    corrupt(components[2], types.COMPONENT_BLOCK_SIZE + 10)
+
+    var output bytes.Buffer
+    err = GetStream(context.Background(), &output, testingFilename, username,
+                    diskLocations, types.DefaultLayout(len(diskLocations), configs), configs)
+    if err != nil || !bytes.Equal(original, output.Bytes()) {
+        t.Errorf("File was not recovered from damaged blocks in two components: %v", err)
+    }
+
+    for i := 0; i < len(components); i++ {
+        repaired, err := ioutil.ReadFile(components[i])
+        check(err)
+        if !bytes.Equal(intact[i], repaired) {
+            t.Errorf("Component %d was not repaired to its original contents", i)
+        }
+    }
+
+    // the same block damaged on two components can't be rebuilt
+    corrupt(components[0], 10)
+    corrupt(components[1], 20)
+    err = GetStream(context.Background(), &output, testingFilename, username,
+                    diskLocations, types.DefaultLayout(len(diskLocations), configs), configs)
+    if err == nil {
+        t.Errorf("Same block damaged on two components was not reported")
+    }
+
+    check(RemoveFile(testingFilename, username, diskLocations, configs))
+}
+
+func TestStreamRepairsOnDemand(t *testing.T) {
+    testingFilename := "testingFileStreamRepair.txt"
+    username := "atoron"
+
+    createRandomFile(testingFilename, LARGE_FILE_SIZE)
+    original, err := ioutil.ReadFile(testingFilename)
+    check(err)
+
+    layout := types.DefaultLayout(len(diskLocations), configs)
+    check(SaveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+
+    component := func(location int) string {
+        return fmt.Sprintf("%s/%s", diskLocations[location],
+                           locationComponentName(username, testingFilename, location, layout))
+    }
+    intactData, err := ioutil.ReadFile(component(1))
+    check(err)
+
+    // the second block of a data component, and the first one of the parity
+    // (which the stream doesn't need to read)
+    parity := layout.DataCount
+    for block, location := range []int{parity, 1} {
+        file, err := os.OpenFile(component(location), os.O_RDWR, 0755)
+        check(err)
+        _, err = file.WriteAt([]byte{0xde, 0xad}, int64(block) * types.COMPONENT_BLOCK_SIZE + 3)
+        check(err)
+        file.Close()
+    }
+    damagedParity, err := ioutil.ReadFile(component(parity))
+    check(err)
+
+    var output bytes.Buffer
+    report, err := GetStreamWithReport(context.Background(), &output, testingFilename, username,
+                                       diskLocations, layout, configs)
+    if err != nil || !bytes.Equal(original, output.Bytes()) {
+        t.Errorf("File with a damaged block was not streamed correctly: %v", err)
+    } else if len(report.Degraded) != 0 || len(report.Rebuilt) != 1 ||
+              report.Rebuilt[0] != diskLocations[1] {
+        t.Errorf("Damaged block was reported as %+v when streaming", report)
+    }
+
+    repaired, err := ioutil.ReadFile(component(1))
+    check(err)
+    if !bytes.Equal(intactData, repaired) {
+        t.Errorf("Damaged block of a data component was not repaired")
+    }
+    parityAfter, err := ioutil.ReadFile(component(parity))
+    check(err)
+    if !bytes.Equal(damagedParity, parityAfter) {
+        t.Errorf("Parity that the stream didn't need was rewritten")
+    }
 
+    check(RemoveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+    os.Remove(testingFilename)
 }
 
+func TestLegacyComponents(t *testing.T) {
+    testingFilename := "testingFileLegacy.txt"
+    username := "atoron"
+
+    createRandomFile(testingFilename, LARGE_FILE_SIZE)
+    original, err := ioutil.ReadFile(testingFilename)
+    check(err)
+
+    check(SaveFile(testingFilename, username, diskLocations, configs))
+
+    // rewrite every component the way they were written before the block
+    // hashes, [data] [MD5 of data]
+    components := make([]string, len(diskLocations))
+    for i := 0; i < len(diskLocations); i++ {
+        components[i] = fmt.Sprintf("%s/%s", diskLocations[i],
+                                    componentNameForID(username, testingFilename, i, TESTING_DISK_COUNT))
+        file, err := os.Open(components[i])
+        check(err)
+        data := make([]byte, dataSizeOf(file))
+        _, err = file.ReadAt(data, 0)
+        check(err)
+        file.Close()
+
+        legacyHash := md5.Sum(data)
+        err = ioutil.WriteFile(components[i], append(data, legacyHash[:]...), 0755)
+        check(err)
+    }
+
+    layout := types.DefaultLayout(len(diskLocations), configs)
+    part, err := GetFileRange(testingFilename, username, diskLocations, layout, configs, 1000, 5000)
+    if err != nil || !bytes.Equal(original[1000:6000], part) {
+        t.Errorf("Range of a file with old components did not match")
+    }
+
+    // a damaged old component is rebuilt in the new format
+    file, err := os.OpenFile(components[1], os.O_RDWR, 0755)
+    check(err)
+    _, err = file.WriteAt([]byte{0xde, 0xad}, 100)
+    check(err)
+    file.Close()
+
+    if _, err := GetFile(testingFilename, username, diskLocations, configs); err != nil {
+        t.Fatalf("Could not get %s: %v", testingFilename, err)
+    }
+    downloaded, err := ioutil.ReadFile("downloaded-" + testingFilename)
+    check(err)
+    if !bytes.Equal(original, downloaded) {
+        t.Errorf("File with old components was not read back correctly")
+    }
+
+    file, err = os.Open(components[1])
+    check(err)
+    info, err := readComponentInfo(file)
+    file.Close()
+    if err != nil || info.blockSize != types.COMPONENT_BLOCK_SIZE {
+        t.Errorf("Damaged old component was not rebuilt with block hashes")
+    }
+
+    check(RemoveFile(testingFilename, username, diskLocations, configs))
+}
+
+func TestHashAlgorithms(t *testing.T) {
+    testingFilename := "testingFileHashes.txt"
+    username := "atoron"
+
+    createRandomFile(testingFilename, LARGE_FILE_SIZE)
+    original, err := ioutil.ReadFile(testingFilename)
+    check(err)
+
+    for _, algorithm := range []int{types.HASH_SHA256, types.HASH_BLAKE3} {
+        for _, stripeSize := range []int64{0, 4096} {
+            hashConfigs := *configs
+            hashConfigs.HashAlgorithm = algorithm
+            hashConfigs.StripeSize = stripeSize
+            layout := types.DefaultLayout(len(diskLocations), &hashConfigs)
+
+            check(SaveFile(testingFilename, username, diskLocations, &hashConfigs))
+
+            component := fmt.Sprintf("%s/%s", diskLocations[1],
+                                     locationComponentName(username, testingFilename, 1, layout))
+            file, err := os.OpenFile(component, os.O_RDWR, 0755)
+            check(err)
+            info, err := readComponentInfo(file)
+            if err != nil || info.algorithm != algorithm {
+                t.Errorf("Component was not hashed with algorithm %d", algorithm)
+            }
+            _, err = file.WriteAt([]byte{0xde, 0xad}, 100)
+            check(err)
+            file.Close()
+
+            if _, err := GetFile(testingFilename, username, diskLocations, &hashConfigs); err != nil {
+                t.Fatalf("Could not get %s: %v", testingFilename, err)
+            }
+            downloaded, err := ioutil.ReadFile("downloaded-" + testingFilename)
+            check(err)
+            if !bytes.Equal(original, downloaded) {
+                t.Errorf("File hashed with algorithm %d (stripe size %d) did not match",
+                         algorithm, stripeSize)
+            }
+
+            check(RemoveFile(testingFilename, username, diskLocations, &hashConfigs))
+        }
+    }
+
+    // components from before the algorithm was in the trailer are MD5
+    check(SaveFile(testingFilename, username, diskLocations, configs))
+    components := make([]string, len(diskLocations))
+    for i := 0; i < len(diskLocations); i++ {
+        components[i] = fmt.Sprintf("%s/%s", diskLocations[i],
+                                    componentNameForID(username, testingFilename, i, TESTING_DISK_COUNT))
+        contents, err := ioutil.ReadFile(components[i])
+        check(err)
+
+        // [algorithm] [version] [magic] -> [version 1] [magic]
+        end := len(contents) - len(COMPONENT_MAGIC)
+        contents = append(contents[0:end - 2], COMPONENT_FORMAT_MD5)
+        contents = append(contents, COMPONENT_MAGIC...)
+        err = ioutil.WriteFile(components[i], contents, 0755)
+        check(err)
+    }
+
+    layout := types.DefaultLayout(len(diskLocations), configs)
+    part, err := GetFileRange(testingFilename, username, diskLocations, layout, configs, 1000, 5000)
+    if err != nil || !bytes.Equal(original[1000:6000], part) {
+        t.Errorf("Range of a file with version 1 components did not match")
+    }
+
+    file, err := os.OpenFile(components[0], os.O_RDWR, 0755)
+    check(err)
+    _, err = file.WriteAt([]byte{0xde, 0xad}, 100)
+    check(err)
+    file.Close()
+
+    if _, err := GetFile(testingFilename, username, diskLocations, configs); err != nil {
+        t.Fatalf("Could not get %s: %v", testingFilename, err)
+    }
+    downloaded, err := ioutil.ReadFile("downloaded-" + testingFilename)
+    check(err)
+    if !bytes.Equal(original, downloaded) {
+        t.Errorf("File with version 1 components was not read back correctly")
+    }
+
+    check(RemoveFile(testingFilename, username, diskLocations, configs))
+}
+
+// padding that doesn't fit in the last buffer of the strip is read (and rebuilt) whole
+func TestPaddingAcrossBuffers(t *testing.T) {
+    testingFilename := "testingFilePadding.txt"
+    username := "atoron"
+    layout := types.DefaultLayout(len(diskLocations), configs)
+    lastData := fmt.Sprintf("%s/%s", diskLocations[layout.DataCount - 1],
+                            locationComponentName(username, testingFilename, layout.DataCount - 1, layout))
+
+    // strips of 4 whole buffers + 1 byte, the padding starts in the 4th buffer
+    for _, size := range []int64{int64(types.MAX_BUFFER_SIZE) * 12, int64(types.MAX_BUFFER_SIZE) * 12 + 1} {
+        createRandomFile(testingFilename, size)
+        original, err := ioutil.ReadFile(testingFilename)
+        check(err)
+
+        for broken := 0; broken < 3; broken++ {
+            check(SaveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+
+            if broken == 1 { // the component with the padding is missing
+                check(os.Remove(lastData))
+            } else if broken == 2 { // the block with the end of the padding is damaged
+                file, err := os.OpenFile(lastData, os.O_RDWR, 0755)
+                check(err)
+                _, err = file.WriteAt([]byte{0x80}, dataSizeOf(file) - 1)
+                check(err)
+                file.Close()
+            }
+
+            downloadedTo, err := GetFileWithLayout(testingFilename, username, diskLocations,
+                                                   layout, configs)
+            check(err)
+            downloaded, err := ioutil.ReadFile(downloadedTo)
+            check(err)
+            if !bytes.Equal(original, downloaded) {
+                t.Errorf("File of size %d with %d broken did not match, got %d bytes",
+                         size, broken, len(downloaded))
+            }
+        }
+
+        check(RemoveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+    }
+}
+
+/*
+    Every save keeps its own state, so saves (and gets) of different files
+    can run at the same time, run with -race to check that nothing is shared
+*/
+func TestConcurrentSaves(t *testing.T) {
+    const SAVE_COUNT = 32
+    username := "atoron"
+
+    layouts := []types.Layout{
+        types.DefaultLayout(len(diskLocations), configs),
+        types.Layout{Scheme: types.RS_SCHEME, DataCount: TESTING_DISK_COUNT - 1, ParityCount: 2},
+        types.Layout{Scheme: types.XOR_SCHEME, DataCount: TESTING_DISK_COUNT, ParityCount: 1,
+                     Striping: types.STRIPING_ROTATING, StripeSize: 4096},
+    }
+
+    filenames := make([]string, SAVE_COUNT)
+    originals := make([][]byte, SAVE_COUNT)
+    for i := 0; i < SAVE_COUNT; i++ {
+        filenames[i] = fmt.Sprintf("testingFileConcurrent%d.txt", i)
+        createRandomFile(filenames[i], 3 * LARGE_FILE_SIZE + int64(i))
+        original, err := ioutil.ReadFile(filenames[i])
+        check(err)
+        originals[i] = original
+    }
+
+    var wg sync.WaitGroup
+    for i := 0; i < SAVE_COUNT; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            layout := layouts[i % len(layouts)]
+
+            err := SaveFileWithLayout(filenames[i], username, diskLocations, layout, configs)
+            if err != nil {
+                t.Errorf("Could not save %s: %v", filenames[i], err)
+                return
+            }
+
+            downloadedTo, err := GetFileWithLayout(filenames[i], username, diskLocations,
+                                                   layout, configs)
+            if err != nil {
+                t.Errorf("Could not get %s: %v", filenames[i], err)
+                return
+            }
+            downloaded, err := ioutil.ReadFile(downloadedTo)
+            if err != nil || !bytes.Equal(originals[i], downloaded) {
+                t.Errorf("%s was not saved correctly alongside the other saves", filenames[i])
+            }
+            os.Remove(downloadedTo)
+
+            err = RemoveFileWithLayout(filenames[i], username, diskLocations, layout, configs)
+            if err != nil {
+                t.Errorf("Could not remove %s: %v", filenames[i], err)
+            }
+        }(i)
+    }
+    wg.Wait()
+
+    for i := 0; i < SAVE_COUNT; i++ {
+        os.Remove(filenames[i])
+    }
+}
+
+func TestDegradedLocation(t *testing.T) {
+    testingFilename := "testingFileDegraded.txt"
+    username := "atoron"
+
+    createRandomFile(testingFilename, LARGE_FILE_SIZE + 11)
+    original, err := ioutil.ReadFile(testingFilename)
+    check(err)
+
+    layouts := []types.Layout{
+        types.DefaultLayout(len(diskLocations), configs),
+        types.Layout{Scheme: types.XOR_SCHEME, DataCount: TESTING_DISK_COUNT, ParityCount: 1,
+                     Striping: types.STRIPING_ROTATING, StripeSize: 4096},
+    }
+
+    for _, layout := range layouts {
+        check(SaveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+
+        // the component is missing, it is rebuilt on the location
+        check(os.Remove(fmt.Sprintf("%s/%s", diskLocations[0],
+                                    locationComponentName(username, testingFilename, 0, layout))))
+        downloadedTo, report, err := GetFileWithReport(testingFilename, username, diskLocations,
+                                                       layout, configs)
+        check(err)
+        downloaded, err := ioutil.ReadFile(downloadedTo)
+        check(err)
+        if !bytes.Equal(original, downloaded) {
+            t.Errorf("File with a missing component was not served correctly")
+        }
+        if len(report.Degraded) != 1 || report.Degraded[0] != diskLocations[0] ||
+           len(report.Rebuilt) != 1 || report.Rebuilt[0] != diskLocations[0] {
+            t.Errorf("Missing component was reported as %+v", report)
+        }
+
+        // the whole location is gone (not mounted), nothing is rebuilt there
+        unmounted := diskLocations[1] + "-unmounted"
+        check(os.Rename(diskLocations[1], unmounted))
+
+        downloadedTo, report, err = GetFileWithReport(testingFilename, username, diskLocations,
+                                                      layout, configs)
+        if err != nil {
+            t.Errorf("Could not get file with a missing location: %v", err)
+        } else {
+            downloaded, err = ioutil.ReadFile(downloadedTo)
+            check(err)
+            if !bytes.Equal(original, downloaded) {
+                t.Errorf("File with a missing location was not served correctly")
+            }
+            if len(report.Degraded) != 1 || report.Degraded[0] != diskLocations[1] ||
+               len(report.Rebuilt) != 0 {
+                t.Errorf("Missing location was reported as %+v", report)
+            }
+        }
+
+        var output bytes.Buffer
+        report, err = GetStreamWithReport(context.Background(), &output, testingFilename, username,
+                                          diskLocations, layout, configs)
+        if err != nil || !bytes.Equal(original, output.Bytes()) {
+            t.Errorf("File with a missing location was not streamed correctly: %v", err)
+        } else if len(report.Degraded) != 1 || report.Degraded[0] != diskLocations[1] {
+            t.Errorf("Missing location was reported as %+v when streaming", report)
+        }
+
+        if pathExists(diskLocations[1]) {
+            t.Errorf("Missing location was created again")
+            os.RemoveAll(diskLocations[1])
+        }
+        check(os.Rename(unmounted, diskLocations[1]))
+
+        check(RemoveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+    }
+}
+
+func TestUnrecoverableFile(t *testing.T) {
+    testingFilename := "testingFileUnrecoverable.txt"
+    username := "atoron"
+
+    createRandomFile(testingFilename, LARGE_FILE_SIZE)
+    original, err := ioutil.ReadFile(testingFilename)
+    check(err)
+
+    layouts := []types.Layout{
+        types.DefaultLayout(len(diskLocations), configs),
+        types.Layout{Scheme: types.XOR_SCHEME, DataCount: TESTING_DISK_COUNT, ParityCount: 1,
+                     Striping: types.STRIPING_ROTATING, StripeSize: 512},
+    }
+
+    for _, layout := range layouts {
+        check(SaveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+
+        // one more component than the parity can rebuild
+        for i := 0; i <= layout.ParityCount; i++ {
+            err := os.Remove(fmt.Sprintf("%s/%s", diskLocations[i],
+                                         locationComponentName(username, testingFilename, i, layout)))
+            check(err)
+        }
+
+        _, err := GetFileWithLayout(testingFilename, username, diskLocations, layout, configs)
+        if !errors.Is(err, types.ErrUnrecoverable) {
+            t.Errorf("Getting a file with %d missing components gave %v", layout.ParityCount + 1, err)
+        }
+        if _, err := os.Stat("downloaded-" + testingFilename); !os.IsNotExist(err) {
+            t.Errorf("Part of an unrecoverable file was left behind")
+        }
+
+        RemoveFileWithLayout(testingFilename, username, diskLocations, layout, configs)
+
+        // the same block corrupted on two components, the locations are named
+        check(SaveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+        for i := 1; i <= 2; i++ {
+            file, err := os.OpenFile(fmt.Sprintf("%s/%s", diskLocations[i],
+                                     locationComponentName(username, testingFilename, i, layout)),
+                                     os.O_RDWR, 0755)
+            check(err)
+            _, err = file.WriteAt([]byte{0xde, 0xad, 0xbe, 0xef}, 5)
+            check(err)
+            file.Close()
+        }
+
+        _, err = GetFileWithLayout(testingFilename, username, diskLocations, layout, configs)
+        shouldSay := fmt.Sprintf("2 of %d components damaged (%s, %s)",
+                                 layout.DataCount + layout.ParityCount, diskLocations[1], diskLocations[2])
+        if !errors.Is(err, types.ErrUnrecoverable) || !strings.Contains(err.Error(), shouldSay) {
+            t.Errorf("Getting a file with 2 corrupted components gave %v", err)
+        }
+        if _, err := os.Stat("downloaded-" + testingFilename); !os.IsNotExist(err) {
+            t.Errorf("Part of an unrecoverable file was left behind")
+        }
+
+        // the stream stops right before the block that can't be rebuilt
+        var output bytes.Buffer
+        err = GetStream(context.Background(), &output, testingFilename, username, diskLocations,
+                        layout, configs)
+        if !errors.Is(err, types.ErrUnrecoverable) || output.Len() >= len(original) ||
+           !bytes.Equal(original[0:output.Len()], output.Bytes()) {
+            t.Errorf("Streaming a file with 2 corrupted components gave %v, %d bytes", err, output.Len())
+        }
+
+        check(RemoveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+    }
+
+    layout := types.Layout{Scheme: types.XOR_SCHEME, DataCount: 0, ParityCount: 1}
+    err = SaveFileWithLayout(testingFilename, username, diskLocations, layout, configs)
+    if !errors.Is(err, types.ErrInvalidLayout) {
+        t.Errorf("Saving with a layout without data components gave %v", err)
+    }
+}
+
+// size of the data in a component, without the trailer at the end
+func TestRestripeFile(t *testing.T) {
+    testingFilename := "testingFileRestripe.txt"
+    username := "atoron"
+
+    createRandomFile(testingFilename, LARGE_FILE_SIZE + 5)
+    original, err := ioutil.ReadFile(testingFilename)
+    check(err)
+
+    oldLayout := types.DefaultLayout(len(diskLocations), configs)
+    check(SaveFileWithLayout(testingFilename, username, diskLocations, oldLayout, configs))
+
+    // one data disk less, in stripes this time
+    newLocations := diskLocations[1:]
+    newLayout := types.Layout{Scheme: types.XOR_SCHEME, DataCount: len(newLocations) - 1,
+                              ParityCount: 1, Striping: types.STRIPING_ROTATING,
+                              StripeSize: 4096, Generation: 1}
+
+    err = RestripeFile(testingFilename, username, diskLocations, oldLayout, diskLocations,
+                       oldLayout, configs)
+    if !errors.Is(err, types.ErrInvalidLayout) {
+        t.Errorf("Re-encoding into the same generation returned %v", err)
+    }
+
+    check(RestripeFile(testingFilename, username, diskLocations, oldLayout, newLocations,
+                       newLayout, configs))
+
+    // both generations can be read until the old one is removed
+    for _, c := range []struct {
+        locations []string
+        layout types.Layout
+    }{{diskLocations, oldLayout}, {newLocations, newLayout}} {
+        downloadedTo, err := GetFileWithLayout(testingFilename, username, c.locations, c.layout,
+                                               configs)
+        check(err)
+        downloaded, err := ioutil.ReadFile(downloadedTo)
+        check(err)
+        if !bytes.Equal(original, downloaded) {
+            t.Errorf("Generation %d did not match the original", c.layout.Generation)
+        }
+        os.Remove(downloadedTo)
+    }
+
+    check(RemoveFileWithLayout(testingFilename, username, diskLocations, oldLayout, configs))
+    for i := 0; i < len(diskLocations); i++ {
+        oldComponent := fmt.Sprintf("%s/%s", diskLocations[i],
+                                    locationComponentName(username, testingFilename, i, oldLayout))
+        if pathExists(oldComponent) {
+            t.Errorf("%s was not removed", oldComponent)
+        }
+    }
+
+    var output bytes.Buffer
+    _, err = GetStreamWithReport(context.Background(), &output, testingFilename, username,
+                                 newLocations, newLayout, configs)
+    if err != nil || !bytes.Equal(original, output.Bytes()) {
+        t.Errorf("Re-encoded file was not streamed correctly: %v", err)
+    }
+
+    check(RemoveFileWithLayout(testingFilename, username, newLocations, newLayout, configs))
+    os.Remove(testingFilename)
+}
+
+func TestScrubFile(t *testing.T) {
+    testingFilename := "testingFileScrub.txt"
+    username := "atoron"
+
+    createRandomFile(testingFilename, LARGE_FILE_SIZE + 3)
+    original, err := ioutil.ReadFile(testingFilename)
+    check(err)
+
+    layouts := []types.Layout{
+        types.DefaultLayout(len(diskLocations), configs),
+        types.Layout{Scheme: types.PQ_SCHEME, DataCount: TESTING_DISK_COUNT - 1, ParityCount: 2,
+                     Striping: types.STRIPING_ROTATING, StripeSize: 4096},
+    }
+
+    for _, layout := range layouts {
+        check(SaveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+
+        report, err := ScrubFile(testingFilename, username, diskLocations, layout, nil, configs)
+        check(err)
+        if len(report.Rebuilt) != 0 || len(report.ParityRewritten) != 0 {
+            t.Errorf("Intact file was reported as %+v", report)
+        }
+
+        // a damaged block, and parity that matches its hashes but not the data
+        component := func(location int) string {
+            return fmt.Sprintf("%s/%s", diskLocations[location],
+                               locationComponentName(username, testingFilename, location, layout))
+        }
+        file, err := os.OpenFile(component(0), os.O_RDWR, 0755)
+        check(err)
+        _, err = file.WriteAt([]byte("damaged"), 100)
+        check(err)
+        file.Close()
+
+        parityLocation := len(diskLocations) - 1
+        file, err = os.OpenFile(component(parityLocation), os.O_RDWR, 0755)
+        check(err)
+        info, err := readComponentInfo(file)
+        check(err)
+        _, err = file.WriteAt([]byte("stale parity"), info.dataSize - 20)
+        check(err)
+        check(rehashComponent(file, info, componentBlockSize(layout)))
+        file.Close()
+
+        report, err = ScrubFile(testingFilename, username, diskLocations, layout,
+                                NewRateLimiter(64 * int64(LARGE_FILE_SIZE)), configs)
+        check(err)
+        if len(report.Rebuilt) != 1 || report.Rebuilt[0] != diskLocations[0] ||
+           len(report.ParityRewritten) != 1 || report.ParityRewritten[0] != diskLocations[parityLocation] {
+            t.Errorf("Damaged file was reported as %+v", report)
+        }
+
+        // nothing is left to repair
+        report, err = ScrubFile(testingFilename, username, diskLocations, layout, nil, configs)
+        check(err)
+        if len(report.Rebuilt) != 0 || len(report.ParityRewritten) != 0 {
+            t.Errorf("Scrubbed file was reported as %+v", report)
+        }
+        downloadedTo, err := GetFileWithLayout(testingFilename, username, diskLocations, layout,
+                                               configs)
+        check(err)
+        downloaded, err := ioutil.ReadFile(downloadedTo)
+        check(err)
+        if !bytes.Equal(original, downloaded) {
+            t.Errorf("Scrubbed file did not match the original")
+        }
+        os.Remove(downloadedTo)
+
+        check(RemoveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+    }
+
+    os.Remove(testingFilename)
+}
+
+func TestRateLimiter(t *testing.T) {
+    if NewRateLimiter(0) != nil {
+        t.Errorf("Rate limiter without a limit was created")
+    }
+
+    limiter := NewRateLimiter(1000)
+    start := time.Now()
+    for i := 0; i < 4; i++ {
+        limiter.wait(100)
+    }
+    // the first 100 bytes go right away, the rest are 100ms apart
+    if elapsed := time.Since(start); elapsed < 300 * time.Millisecond {
+        t.Errorf("400 bytes at 1000 bytes per second took %v", elapsed)
+    }
+}
+
+// backend whose components can't be flushed to their disk
+type unsyncableBackend struct {
+    localBackend
+}
+
+type unsyncableComponent struct {
+    *os.File
+}
+
+func (c *unsyncableComponent) Sync() error {
+    return errors.New("disk went away")
+}
+
+func (b *unsyncableBackend) CreateComponent(name string) (Component, error) {
+    component, err := b.localBackend.CreateComponent(name)
+    if err != nil {
+        return nil, err
+    }
+    return &unsyncableComponent{component.(*os.File)}, nil
+}
+
+func TestStagedSave(t *testing.T) {
+    testingFilename := "testingFileStaged.txt"
+    username := "atoron"
+    layout := types.DefaultLayout(len(diskLocations), configs)
+
+    // no temporary or replaced components are left on any location
+    checkLeftovers := func(when string) {
+        for location := 0; location < len(diskLocations); location++ {
+            name := fmt.Sprintf("%s/%s", diskLocations[location],
+                                locationComponentName(username, testingFilename, location, layout))
+            if pathExists(name + TEMP_COMPONENT_SUFFIX) || pathExists(name + OLD_COMPONENT_SUFFIX) {
+                t.Errorf("Components of the save were left behind %s", when)
+            }
+        }
+    }
+    checkContents := func(expected []byte, when string) {
+        downloadedTo, err := GetFileWithLayout(testingFilename, username, diskLocations, layout,
+                                               configs)
+        check(err)
+        downloaded, err := ioutil.ReadFile(downloadedTo)
+        check(err)
+        if !bytes.Equal(expected, downloaded) {
+            t.Errorf("File did not have the right contents %s", when)
+        }
+        os.Remove(downloadedTo)
+    }
+
+    createRandomFile(testingFilename, int64(REGULAR_FILE_SIZE))
+    first, err := ioutil.ReadFile(testingFilename)
+    check(err)
+    check(SaveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+
+    // a new copy that is rolled back
+    check(os.Remove(testingFilename))
+    createRandomFile(testingFilename, int64(REGULAR_FILE_SIZE + 7))
+    second, err := ioutil.ReadFile(testingFilename)
+    check(err)
+    staged, err := SaveFileStaged(testingFilename, username, diskLocations, layout, configs)
+    check(err)
+    checkContents(second, "before the rollback")
+    check(staged.Rollback())
+    checkContents(first, "after the rollback")
+    checkLeftovers("after the rollback")
+
+    // and one that is committed
+    staged, err = SaveFileStaged(testingFilename, username, diskLocations, layout, configs)
+    check(err)
+    staged.Commit()
+    checkContents(second, "after the commit")
+    checkLeftovers("after the commit")
+
+    // a save that fails when it is flushed doesn't touch the copy that is there
+    RegisterBackend("unsyncable", func(location *url.URL) (Backend, error) {
+        return &unsyncableBackend{localBackend{root: location.Host + location.Path}}, nil
+    })
+    failingLocations := make([]string, len(diskLocations))
+    copy(failingLocations, diskLocations)
+    absolutePath, err := filepath.Abs(diskLocations[1])
+    check(err)
+    failingLocations[1] = "unsyncable://" + absolutePath
+
+    check(os.Remove(testingFilename))
+    createRandomFile(testingFilename, int64(REGULAR_FILE_SIZE + 11))
+    err = SaveFileWithLayout(testingFilename, username, failingLocations, layout, configs)
+    if err == nil || !strings.Contains(err.Error(), "disk went away") {
+        t.Errorf("Save that could not be flushed returned %v", err)
+    }
+    checkContents(second, "after a failed save")
+    checkLeftovers("after a failed save")
+
+    check(RemoveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+    os.Remove(testingFilename)
+}
+
+func TestWriteFileAt(t *testing.T) {
+    testingFilename := "testingFileUpdate.txt"
+    username := "atoron"
+
+    layouts := []types.Layout{
+        types.DefaultLayout(len(diskLocations), configs),
+        types.Layout{Scheme: types.RS_SCHEME, DataCount: TESTING_DISK_COUNT - 1, ParityCount: 2,
+                     Striping: types.STRIPING_ROTATING, StripeSize: 1000},
+        types.Layout{Scheme: types.PQ_SCHEME, DataCount: TESTING_DISK_COUNT - 1, ParityCount: 2,
+                     Striping: types.STRIPING_ROTATING, StripeSize: 4096},
+    }
+
+    for _, layout := range layouts {
+        createRandomFile(testingFilename, LARGE_FILE_SIZE + 5)
+        expected, err := ioutil.ReadFile(testingFilename)
+        check(err)
+        check(SaveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+
+        verify := func(step string) {
+            buf, err := GetFileRange(testingFilename, username, diskLocations, layout, configs,
+                                     0, int64(len(expected)) + 1)
+            if err != nil {
+                t.Fatalf("Could not read the file after %s: %v", step, err)
+            } else if !bytes.Equal(expected, buf) {
+                t.Errorf("File (striping %d) did not match after %s", layout.Striping, step)
+            }
+
+            report, err := ScrubFile(testingFilename, username, diskLocations, layout, nil, configs)
+            check(err)
+            if len(report.Rebuilt) != 0 || len(report.ParityRewritten) != 0 {
+                t.Errorf("File (striping %d) was reported as %+v after %s",
+                         layout.Striping, report, step)
+            }
+        }
+
+        // across the components (and stripe units), and at both ends of the file
+        size := int64(len(expected))
+        writes := [][2]int64{{0, 10}, {size / 3 - 50, 100}, {12345, 9000}, {size - 7, 7}}
+        for _, w := range writes {
+            data := make([]byte, w[1])
+            rand.Read(data)
+            check(WriteFileAt(testingFilename, username, diskLocations, layout, configs,
+                              w[0], data))
+            copy(expected[w[0]:], data)
+            verify(fmt.Sprintf("writing %d+%d", w[0], w[1]))
+        }
+
+        if layout.Striping == types.STRIPING_ROTATING {
+            // into the padding of the last stripe, up to the end of a stripe, and over many
+            unitSize := int(layout.StripeSize)
+            for _, n := range []int{1, unitSize * layout.DataCount - 1 -
+                                       int(size % int64(unitSize * layout.DataCount)),
+                                    3 * unitSize * layout.DataCount + 17} {
+                data := make([]byte, n)
+                rand.Read(data)
+                check(AppendFile(testingFilename, username, diskLocations, layout, configs, data))
+                expected = append(expected, data...)
+                size = int64(len(expected))
+                verify(fmt.Sprintf("appending %d bytes", n))
+            }
+
+            // partly over the end of the file
+            data := []byte("over the end of the file")
+            check(WriteFileAt(testingFilename, username, diskLocations, layout, configs,
+                              size - 4, data))
+            expected = append(expected[:size - 4], data...)
+            verify("writing over the end")
+        } else {
+            err = AppendFile(testingFilename, username, diskLocations, layout, configs, []byte("x"))
+            if !errors.Is(err, types.ErrInvalidLayout) {
+                t.Errorf("Appending to a file in whole strips gave %v", err)
+            }
+        }
+
+        err = WriteFileAt(testingFilename, username, diskLocations, layout, configs,
+                          int64(len(expected)) + 1, []byte("x"))
+        if err == nil {
+            t.Errorf("Writing past the end of the file was accepted")
+        }
+
+        // a damaged component has to be repaired before the file is changed
+        file, err := os.OpenFile(fmt.Sprintf("%s/%s", diskLocations[0],
+                                 locationComponentName(username, testingFilename, 0, layout)),
+                                 os.O_RDWR, 0755)
+        check(err)
+        _, err = file.WriteAt([]byte{0xde, 0xad}, 0)
+        check(err)
+        file.Close()
+        err = WriteFileAt(testingFilename, username, diskLocations, layout, configs,
+                          0, []byte("changed"))
+        if !errors.Is(err, types.ErrCorrupt) {
+            t.Errorf("Writing over a damaged block gave %v", err)
+        }
+
+        check(RemoveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+    }
+
+    os.Remove(testingFilename)
+}
+
+func TestMirroring(t *testing.T) {
+    testingFilename := "testingFileMirror.txt"
+    username := "atoron"
+
+    // a file on two locations is mirrored
+    layout := types.DefaultLayout(2, configs)
+    if layout.Scheme != types.MIRROR_SCHEME || layout.DataCount != 1 || layout.ParityCount != 1 {
+        t.Errorf("Layout on two locations is %+v, should be a mirror", layout)
+    }
+    layout = types.MirrorLayout(len(diskLocations), configs)
+
+    createRandomFile(testingFilename, LARGE_FILE_SIZE + 11)
+    original, err := ioutil.ReadFile(testingFilename)
+    check(err)
+    check(SaveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+
+    // every location holds the whole file
+    component := func(location int) string {
+        return fmt.Sprintf("%s/%s", diskLocations[location],
+                           locationComponentName(username, testingFilename, location, layout))
+    }
+    for location := 0; location < len(diskLocations); location++ {
+        stored, err := ioutil.ReadFile(component(location))
+        check(err)
+        if !bytes.Equal(original, stored[0:len(original)]) {
+            t.Errorf("Copy on %s is not the whole file", diskLocations[location])
+        }
+    }
+
+    // one copy missing, two others with different damaged blocks
+    check(os.Remove(component(0)))
+    for location, offset := range map[int]int64{1: 100, 2: LARGE_FILE_SIZE - 100} {
+        file, err := os.OpenFile(component(location), os.O_RDWR, 0755)
+        check(err)
+        _, err = file.WriteAt([]byte("damaged"), offset)
+        check(err)
+        file.Close()
+    }
+
+    downloadedTo, report, err := GetFileWithReport(testingFilename, username, diskLocations,
+                                                   layout, configs)
+    if err != nil {
+        t.Fatalf("Could not get the mirrored file: %v", err)
+    }
+    downloaded, err := ioutil.ReadFile(downloadedTo)
+    check(err)
+    if !bytes.Equal(original, downloaded) {
+        t.Errorf("Mirrored file did not match the original")
+    }
+    os.Remove(downloadedTo)
+    if len(report.Rebuilt) != 3 {
+        t.Errorf("Rebuilt %v, should be the first three copies", report.Rebuilt)
+    }
+    for location := 0; location < len(diskLocations); location++ {
+        if checkComponent(&localBackend{root: diskLocations[location]},
+                          locationComponentName(username, testingFilename, location,
+                                                layout)) != nil {
+            t.Errorf("Copy on %s was not repaired", diskLocations[location])
+        }
+    }
+
+    // mirrors grow in place
+    check(AppendFile(testingFilename, username, diskLocations, layout, configs,
+                     []byte("appended to every copy")))
+    buf, err := GetFileRange(testingFilename, username, diskLocations, layout, configs,
+                             0, int64(len(original)) + 100)
+    check(err)
+    if !bytes.Equal(append(original, []byte("appended to every copy")...), buf) {
+        t.Errorf("Appending to the mirror did not match")
+    }
+
+    // the same block damaged on every copy can't be repaired
+    for location := 0; location < len(diskLocations); location++ {
+        file, err := os.OpenFile(component(location), os.O_RDWR, 0755)
+        check(err)
+        _, err = file.WriteAt([]byte("damaged"), 0)
+        check(err)
+        file.Close()
+    }
+    _, err = GetFileWithLayout(testingFilename, username, diskLocations, layout, configs)
+    if !errors.Is(err, types.ErrUnrecoverable) {
+        t.Errorf("Mirror damaged on every copy gave %v", err)
+    }
+
+    // streams on two locations stay mirrored
+    streamed, err := SaveStream(context.Background(), bytes.NewReader(original), -1,
+                                testingFilename, username, diskLocations[0:2], configs)
+    check(err)
+    if streamed.Scheme != types.MIRROR_SCHEME || streamed.Striping != types.STRIPING_NONE {
+        t.Errorf("Stream on two locations was saved as %+v", streamed)
+    }
+    downloadedTo, err = GetFileWithLayout(testingFilename, username, diskLocations[0:2],
+                                          streamed, configs)
+    check(err)
+    downloaded, err = ioutil.ReadFile(downloadedTo)
+    check(err)
+    if !bytes.Equal(original, downloaded) {
+        t.Errorf("Mirrored stream did not match the original")
+    }
+    os.Remove(downloadedTo)
+
+    check(RemoveFileWithLayout(testingFilename, username, diskLocations, layout, configs))
+    os.Remove(testingFilename)
+}
+
+func dataSizeOf(file *os.File) int64 {
+    size, err := componentDataSize(file)
+    check(err)
+    return size
+}
+
+func createRandomFile(filename string, fileSize int64) {
+    data := make([]byte, fileSize)
+    rand.Read(data)
+
+    file, err := os.Create(filename)
+    check(err)
+
+    _, err = file.WriteAt(data, 0)
+    check(err)
+
+    file.Close()
+}
 
 // benchmarking test, modifying buffer size each time
\ No newline at end of file
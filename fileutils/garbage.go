@@ -0,0 +1,202 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: garbage.go
+* Date created: 10/16/26
+*
+* Description: finds the components that are stored on a location, so that
+* the ones that no file refers to anymore (left behind by a crash between
+* the database and the locations, or by a save that didn't finish) can be
+* removed, or moved aside into the quarantine folder of the location.
+*******************************************************************************/
+
+package fileutils
+
+import (
+    "os"
+    "path"
+    "strconv"
+    "strings"
+    "time"
+    "foxyblox/types"
+)
+
+// folder (in the root of every location) that quarantined components are moved to
+const QUARANTINE_FOLDER = ".quarantine"
+
+/*
+    A component file that was found on a location
+*/
+type StoredComponent struct {
+    Location string
+    Name string // relative to the location, <username>/[.g<N>/]<filename>_<ID>[suffix]
+    Username string
+    Filename string // file that the component is a part of (its path, see database.CheckFilename)
+    Generation int // see storedFilename
+    Suffix string // TEMP_COMPONENT_SUFFIX or OLD_COMPONENT_SUFFIX, "" for a regular component
+    Size int64
+    ModTime time.Time
+    backend Backend
+}
+
+/*
+    All of the components on the location, the files that don't look like
+    components (and the quarantine folder) are left out
+*/
+func ListStoredComponents(location string) ([]*StoredComponent, error) {
+    backend, err := OpenBackend(location)
+    if err != nil {
+        return nil, err
+    }
+
+    users, err := backend.List("")
+    if err != nil {
+        return nil, err
+    }
+
+    var components []*StoredComponent
+    for _, user := range users {
+        if !user.IsDir() || user.Name() == QUARANTINE_FOLDER {
+            continue
+        }
+        components, err = appendStoredFolder(components, location, backend, user.Name(),
+                                             user.Name(), 0, "")
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return components, nil
+}
+
+/*
+    Append the components in the folder (relative to root, the folder of the
+    user or of the generation in it) and in the folders under it, the
+    components of files saved under a path are in the folders of the path
+*/
+func appendStoredFolder(components []*StoredComponent, location string, backend Backend,
+                        username string, root string, generation int,
+                        folder string) ([]*StoredComponent, error) {
+    files, err := backend.List(path.Join(root, folder))
+    if err != nil {
+        return nil, err
+    }
+    for _, file := range files {
+        if !file.IsDir() {
+            components = appendStoredComponent(components, location, backend, username,
+                                               root, folder, generation, file)
+            continue
+        }
+
+        // the generation folders are right in the folder of the user
+        if generation == 0 && folder == "" && generationOfFolder(file.Name()) > 0 {
+            components, err = appendStoredFolder(components, location, backend, username,
+                                                 path.Join(root, file.Name()),
+                                                 generationOfFolder(file.Name()), "")
+        } else {
+            components, err = appendStoredFolder(components, location, backend, username,
+                                                 root, generation, path.Join(folder, file.Name()))
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return components, nil
+}
+
+// generation of the folder with the given name, 0 if it is not a generation folder
+func generationOfFolder(name string) int {
+    if !strings.HasPrefix(name, ".g") {
+        return 0
+    }
+    generation, err := strconv.Atoi(name[2:])
+    if err != nil || generation < 1 {
+        return 0
+    }
+    return generation
+}
+
+/*
+    append the file in folder (relative to root, the folder of the user or of
+    the generation) to the components, if it is named like a component
+*/
+func appendStoredComponent(components []*StoredComponent, location string, backend Backend,
+                           username string, root string, folder string, generation int,
+                           file os.FileInfo) []*StoredComponent {
+    base := file.Name()
+    suffix := ""
+    for _, leftover := range []string{TEMP_COMPONENT_SUFFIX, OLD_COMPONENT_SUFFIX} {
+        if strings.HasSuffix(base, leftover) {
+            suffix = leftover
+            base = strings.TrimSuffix(base, leftover)
+        }
+    }
+
+    // <filename>_<ID>, <filename>_p or <filename>_p<index>
+    separator := strings.LastIndex(base, "_")
+    if separator < 1 {
+        return components
+    }
+    ID := strings.TrimPrefix(base[separator + 1:], "p")
+    if ID != "" {
+        if _, err := strconv.Atoi(ID); err != nil {
+            return components
+        }
+    } else if base[separator + 1:] != "p" {
+        return components
+    }
+
+    return append(components, &StoredComponent{Location: location,
+                                                Name: path.Join(root, folder, file.Name()),
+                                                Username: username,
+                                                Filename: path.Join(folder, base[0:separator]),
+                                                Generation: generation, Suffix: suffix,
+                                                Size: file.Size(), ModTime: file.ModTime(),
+                                                backend: backend})
+}
+
+/*
+    True if the component is one of the components of the file (without its
+    suffix) that was saved with the layout on diskLocations (however the
+    locations are spelled, see canonicalLocation)
+*/
+func (c *StoredComponent) BelongsTo(diskLocations []string, layout types.Layout) bool {
+    if layout.Generation != c.Generation {
+        return false
+    }
+
+    name := strings.TrimSuffix(c.Name, c.Suffix)
+    storedName := storedFilename(c.Filename, layout)
+    componentLocation := canonicalLocation(c.Location)
+    for location := 0; location < len(diskLocations) &&
+                       location < layout.DataCount + layout.ParityCount; location++ {
+        if canonicalLocation(diskLocations[location]) == componentLocation &&
+           locationComponentName(c.Username, storedName, location, layout) == name {
+            return true
+        }
+    }
+    return false
+}
+
+/*
+    True if there is a regular component in the place of this one (i.e. for a
+    component that a save replaced, the component that replaced it)
+*/
+func (c *StoredComponent) Replaced() bool {
+    _, err := c.backend.StatComponent(strings.TrimSuffix(c.Name, c.Suffix))
+    return err == nil
+}
+
+// put the component back in its place (without its suffix)
+func (c *StoredComponent) Restore() error {
+    return c.backend.RenameComponent(c.Name, strings.TrimSuffix(c.Name, c.Suffix))
+}
+
+func (c *StoredComponent) Remove() error {
+    return c.backend.RemoveComponent(c.Name)
+}
+
+// move the component into the quarantine folder of its location
+func (c *StoredComponent) Quarantine() error {
+    return c.backend.RenameComponent(c.Name, path.Join(QUARANTINE_FOLDER, c.Name))
+}
@@ -0,0 +1,190 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: mirror.go
+* Date created: 10/16/26
+*
+* Description: N-way mirrors (types.MIRROR_SCHEME). Every location holds a
+* whole copy of the file, the first one named as the data component and the
+* others as its parity components (a parity component of a single data
+* component with a coefficient of 1 is a copy of it), so a 1+1 mirror is the
+* same on disk as a RAID 4 file on two locations. Rebuilds, scrubs and ranges
+* treat mirrors like any other layout, only saving and getting the file have
+* their own (simpler) paths: the file is read once and written to every copy,
+* and it is read back from any copy that is intact.
+*******************************************************************************/
+
+package fileutils
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "os"
+    "sync"
+    "foxyblox/types"
+)
+
+/*
+    Write the file to every location, a buffer at a time (sent to all of the
+    copies at once), followed by the single byte of padding of a whole strip
+    and the trailer. size < 0 means that the size is not known in advance.
+    Nothing is left on the locations if the save fails.
+*/
+func saveMirrored(ctx context.Context, originalFile io.Reader, size int64, filename string,
+                  username string, backends []Backend, layout types.Layout) error {
+    copies, err := createComponents(backends, filename, username, layout)
+    if err != nil {
+        return err
+    }
+
+    // the copies are the same, so are their hashes
+    hasher := newComponentHasher(types.COMPONENT_BLOCK_SIZE, layout.HashAlgorithm)
+    writeErrors := make([]error, len(copies))
+    writeAll := func(buf []byte, offset int64) {
+        var wg sync.WaitGroup
+        for location := 0; location < len(copies); location++ {
+            if writeErrors[location] != nil {
+                continue
+            }
+            wg.Add(1)
+            go func(location int) {
+                defer wg.Done()
+                _, writeErrors[location] = copies[location].WriteAt(buf, offset)
+            }(location)
+        }
+        wg.Wait()
+    }
+
+    var saveErr error
+    var totalRead int64 = 0
+    buf := make([]byte, types.MAX_BUFFER_SIZE)
+    for {
+        if saveErr = ctx.Err(); saveErr != nil {
+            break
+        }
+
+        toRead := int64(len(buf))
+        if size >= 0 && size - totalRead < toRead {
+            toRead = size - totalRead
+        }
+        numRead, err := io.ReadFull(originalFile, buf[0:toRead])
+        if (err == io.EOF || err == io.ErrUnexpectedEOF) && size >= 0 {
+            saveErr = fmt.Errorf("%s ended after %d of %d bytes", filename,
+                                 totalRead + int64(numRead), size)
+            break
+        } else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+            saveErr = err
+            break
+        }
+
+        if numRead > 0 {
+            writeAll(buf[0:numRead], totalRead)
+            hasher.Write(buf[0:numRead])
+            totalRead += int64(numRead)
+        }
+        if int64(numRead) < int64(len(buf)) { // the end of the file
+            break
+        }
+    }
+
+    if saveErr == nil {
+        padding := []byte{0x80}
+        hasher.Write(padding)
+        writeAll(append(padding, hasher.trailer()...), totalRead)
+    }
+
+    for location := 0; location < len(copies); location++ {
+        err = finishComponent(copies[location], writeErrors[location])
+        if err != nil && saveErr == nil {
+            saveErr = err
+        }
+    }
+
+    if saveErr != nil {
+        removeComponentsWithSuffix(backends, filename, username, layout, TEMP_COMPONENT_SUFFIX)
+    }
+
+    return saveErr
+}
+
+/*
+    Same as getStrips, for a mirror: every copy is checked, the damaged ones
+    are repaired from the intact ones (a block only has to be intact on one of
+    the copies), and the file is copied out of the first copy that is intact
+*/
+func getMirrored(filename string, outputFile *os.File, backends []Backend,
+                 layout types.Layout, username string) ([]*componentDamage, error) {
+    copyCount := layout.DataCount + layout.ParityCount
+
+    damage := make([]*componentDamage, copyCount)
+    var wg sync.WaitGroup
+    for location := 0; location < copyCount; location++ {
+        wg.Add(1)
+        go func(location int) {
+            defer wg.Done()
+            damage[location] = checkComponent(backends[location],
+                                              locationComponentName(username, filename,
+                                                                    location, layout))
+        }(location)
+    }
+    wg.Wait()
+
+    source := -1
+    damaged := false
+    for location := 0; location < copyCount; location++ {
+        if damage[location] != nil {
+            damaged = true
+        } else if source == -1 {
+            source = location
+        }
+    }
+    if damaged {
+        err := recoverFromDriveFailure(damage, filename, nil, backends, layout, username)
+        if err != nil {
+            return nil, err
+        }
+
+        // every copy on a location that can be reached is whole again
+        for location := 0; location < copyCount && source == -1; location++ {
+            if locationAvailable(backends[location]) {
+                source = location
+            }
+        }
+        if source == -1 {
+            return nil, fmt.Errorf("%w: none of the locations of %s can be reached",
+                                   types.ErrUnrecoverable, filename)
+        }
+    }
+
+    return damage, copyMirror(filename, outputFile, backends[source],
+                              locationComponentName(username, filename, source, layout))
+}
+
+// copy the file out of one of the copies of a mirror, without its padding
+func copyMirror(filename string, outputFile *os.File, backend Backend, name string) error {
+    file, err := backend.OpenComponent(name)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    size, err := componentDataSize(file)
+    if err != nil {
+        return err
+    }
+    if size == 0 {
+        return fmt.Errorf("%w: copy of %s has no padding", types.ErrCorrupt, filename)
+    }
+
+    _, err = io.Copy(outputFile, io.NewSectionReader(file, 0, size))
+    if err != nil {
+        return err
+    }
+
+    tail := make([]byte, 1)
+    _, err = file.ReadAt(tail, size - 1)
+    if err != nil {
+        return err
+    }
+    return outputFile.Truncate(size - int64(paddingLength(tail, 1)))
+}
@@ -0,0 +1,341 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: range.go
+* Date created: 10/16/26
+*
+* Description: ranged reads - a byte range of a saved file is mapped to the
+* components (and the offsets in them) that hold it, and only those regions
+* are read. When a component is missing, or the region doesn't match the
+* hashes of its blocks, only the region that is needed is rebuilt from the
+* same region of the other components.
+*******************************************************************************/
+
+package fileutils
+
+import (
+    "fmt"
+    "foxyblox/types"
+)
+
+/*
+    Reads regions of the components of a single file, opening the components
+    as they are needed. Locations whose component could not be opened or read
+    are marked as failed, and not tried again.
+*/
+type rangeReader struct {
+    filename string
+    username string
+    backends []Backend
+    layout types.Layout
+    components []Component
+    infos []*componentInfo
+    failed []bool
+    decoders map[string][][]byte
+    writable bool // open the components for writing in place as well, see update.go
+    damage []*componentDamage // damage found on every location, if it is kept track of (see stream.go)
+}
+
+func newRangeReader(filename string, username string, backends []Backend,
+                    layout types.Layout) *rangeReader {
+    componentCount := layout.DataCount + layout.ParityCount
+    return &rangeReader{filename: filename, username: username, backends: backends,
+                        layout: layout, components: make([]Component, componentCount),
+                        infos: make([]*componentInfo, componentCount),
+                        failed: make([]bool, componentCount),
+                        decoders: make(map[string][][]byte)}
+}
+
+// component on the location, nil if it is not usable
+func (r *rangeReader) component(location int) Component {
+    if r.failed[location] {
+        return nil
+    }
+    if r.components[location] == nil {
+        name := locationComponentName(r.username, r.filename, location, r.layout)
+        open := r.backends[location].OpenComponent
+        if r.writable {
+            open = r.backends[location].UpdateComponent
+        }
+        component, err := open(name)
+        if err != nil {
+            r.failed[location] = true
+            return nil
+        }
+        info, err := readComponentInfo(component)
+        if err != nil {
+            component.Close()
+            r.failed[location] = true
+            return nil
+        }
+        r.components[location] = component
+        r.infos[location] = info
+    }
+    return r.components[location]
+}
+
+func (r *rangeReader) close() {
+    for location, component := range r.components {
+        if component != nil {
+            component.Close()
+            r.components[location] = nil
+        }
+    }
+}
+
+// remember the damage found on the location, if the reader keeps track of it
+func (r *rangeReader) noteDamage(location int, damage *componentDamage) {
+    if r.damage == nil || damage == nil {
+        return
+    }
+
+    found := r.damage[location]
+    if found == nil {
+        r.damage[location] = damage
+    } else if damage.whole {
+        r.damage[location] = wholeComponentDamage
+    } else if !found.whole {
+        for _, block := range damage.blocks {
+            if !found.hasBlock(block) {
+                found.blocks = append(found.blocks, block)
+            }
+        }
+    }
+}
+
+/*
+    Fill buf with the region of the component on the location, checking the
+    blocks it is in against their hashes. False if the component can't be
+    read or the blocks don't match (the damage is noted).
+*/
+func (r *rangeReader) readIntactRegion(location int, offset int64, buf []byte) bool {
+    component := r.component(location)
+    if component == nil {
+        r.noteDamage(location, wholeComponentDamage)
+        return false
+    }
+
+    damage, err := r.infos[location].checkRegion(component, offset, buf)
+    if err != nil {
+        damage = wholeComponentDamage
+    }
+    r.noteDamage(location, damage)
+    return damage == nil
+}
+
+// size of each component without the trailer at the end of it
+func (r *rangeReader) componentSize() (int64, error) {
+    for location := 0; location < len(r.components); location++ {
+        if r.component(location) != nil {
+            return r.infos[location].dataSize, nil
+        }
+    }
+
+    return 0, fmt.Errorf("%w: none of the components of %s can be read", types.ErrUnrecoverable,
+                         r.filename)
+}
+
+/*
+    Fill buf with the region at offset of the component with the given ID
+    (locationOf gives the location holding each ID, for the part of the file
+    that the region is in). If that component can't be read, the region is
+    rebuilt from the same region of DataCount of the other components. Only
+    the blocks the region is in are checked against their hashes.
+*/
+func (r *rangeReader) readRegion(ID int, offset int64, buf []byte,
+                                 locationOf func(ID int) int) error {
+    if r.readIntactRegion(locationOf(ID), offset, buf) {
+        return nil
+    }
+
+    componentCount := r.layout.DataCount + r.layout.ParityCount
+    units := make([][]byte, componentCount)
+    read := 0
+    for other := 0; other < componentCount && read < r.layout.DataCount; other++ {
+        if other == ID {
+            continue
+        }
+
+        units[other] = make([]byte, len(buf))
+        if !r.readIntactRegion(locationOf(other), offset, units[other]) {
+            units[other] = nil
+            continue
+        }
+        read++
+    }
+
+    err := reconstructUnits(r.layout, units, []int{ID}, r.decoders)
+    if err != nil {
+        return fmt.Errorf("%w: can't rebuild region of %s at %d: %v", types.ErrUnrecoverable,
+                          r.filename, offset, err)
+    }
+    copy(buf, units[ID])
+
+    return nil
+}
+
+/*
+    Read length bytes of the file (saved with the given layout) starting at
+    offset, reading only the regions of the components that hold them (and
+    checking them against the hashes of their blocks). A range that goes past
+    the end of the file is cut short.
+
+    NOTE: components written before the block hashes existed only have a hash
+    of the whole component, so regions of those are not checked, only missing
+    and unreadable components are detected (GetStream checks everything)
+*/
+func GetFileRange(filename string, username string, diskLocations []string,
+                  layout types.Layout, configs *types.Config,
+                  offset int64, length int64) ([]byte, error) {
+    if offset < 0 || length < 0 {
+        return nil, fmt.Errorf("invalid range, offset %d, length %d", offset, length)
+    }
+
+    err := checkLayout(layout, len(diskLocations))
+    if err != nil {
+        return nil, err
+    }
+
+    backends, err := openBackends(diskLocations)
+    if err != nil {
+        return nil, err
+    }
+
+    r := newRangeReader(storedFilename(filename, layout), username, backends, layout)
+    defer r.close()
+
+    if layout.Striping == types.STRIPING_ROTATING {
+        return r.readStripedRange(offset, length)
+    }
+    return r.readStripRange(offset, length)
+}
+
+// location of every component ID, for files saved in whole strips
+func sameLocation(ID int) int {
+    return ID
+}
+
+// size of the strips (of every component), and of the file saved in them
+func (r *rangeReader) stripFileSize() (int64, int64, error) {
+    dataDiskCount := r.layout.DataCount
+
+    stripSize, err := r.componentSize()
+    if err != nil {
+        return 0, 0, err
+    }
+
+    // the padding is at most dataDiskCount bytes, at the end of the last strip
+    tailSize := int64(dataDiskCount)
+    if tailSize > stripSize {
+        tailSize = stripSize
+    }
+    tail := make([]byte, tailSize)
+    err = r.readRegion(dataDiskCount - 1, stripSize - tailSize, tail, sameLocation)
+    if err != nil {
+        return 0, 0, err
+    }
+    size := stripSize * int64(dataDiskCount) - int64(paddingLength(tail, dataDiskCount))
+
+    return stripSize, size, nil
+}
+
+// data component ID i holds [i * stripSize, (i + 1) * stripSize) of the file
+func (r *rangeReader) readStripRange(offset int64, length int64) ([]byte, error) {
+    stripSize, size, err := r.stripFileSize()
+    if err != nil {
+        return nil, err
+    }
+
+    buf := clampRange(offset, length, size)
+    for position := int64(0); position < int64(len(buf)); {
+        ID := int((offset + position) / stripSize)
+        offsetInComponent := (offset + position) % stripSize
+
+        n := stripSize - offsetInComponent
+        if n > int64(len(buf)) - position {
+            n = int64(len(buf)) - position
+        }
+
+        err = r.readRegion(ID, offsetInComponent, buf[position:position + n], sameLocation)
+        if err != nil {
+            return nil, err
+        }
+        position += n
+    }
+
+    return buf, nil
+}
+
+// amount of stripes (in every component), and size of the file saved in them
+func (r *rangeReader) stripedFileSize() (int64, int64, error) {
+    unitSize := r.layout.StripeSize
+    stripeDataSize := int64(r.layout.DataCount) * unitSize
+    layout := r.layout
+
+    componentSize, err := r.componentSize()
+    if err != nil {
+        return 0, 0, err
+    }
+    stripeCount := componentSize / unitSize
+    if stripeCount == 0 {
+        return 0, 0, fmt.Errorf("%w: components of %s are empty", types.ErrCorrupt, r.filename)
+    }
+
+    // the padding is at the end of the last stripe
+    lastStripe := stripeCount - 1
+    lastStripeBuf := make([]byte, stripeDataSize)
+    for ID := 0; ID < layout.DataCount; ID++ {
+        err = r.readRegion(ID, lastStripe * unitSize,
+                           lastStripeBuf[int64(ID) * unitSize:int64(ID + 1) * unitSize],
+                           func(ID int) int { return stripeLocation(ID, lastStripe, layout) })
+        if err != nil {
+            return 0, 0, err
+        }
+    }
+    size := stripeCount * stripeDataSize - int64(paddingLength(lastStripeBuf, len(lastStripeBuf)))
+
+    return stripeCount, size, nil
+}
+
+// stripe s holds [s * DataCount * StripeSize, (s + 1) * DataCount * StripeSize)
+func (r *rangeReader) readStripedRange(offset int64, length int64) ([]byte, error) {
+    unitSize := r.layout.StripeSize
+    stripeDataSize := int64(r.layout.DataCount) * unitSize
+    layout := r.layout
+
+    _, size, err := r.stripedFileSize()
+    if err != nil {
+        return nil, err
+    }
+
+    buf := clampRange(offset, length, size)
+    for position := int64(0); position < int64(len(buf)); {
+        stripe := (offset + position) / stripeDataSize
+        ID := int(((offset + position) % stripeDataSize) / unitSize)
+        offsetInUnit := (offset + position) % unitSize
+
+        n := unitSize - offsetInUnit
+        if n > int64(len(buf)) - position {
+            n = int64(len(buf)) - position
+        }
+
+        err = r.readRegion(ID, stripe * unitSize + offsetInUnit, buf[position:position + n],
+                           func(ID int) int { return stripeLocation(ID, stripe, layout) })
+        if err != nil {
+            return nil, err
+        }
+        position += n
+    }
+
+    return buf, nil
+}
+
+// buffer for the part of [offset, offset + length) that is in a file of the given size
+func clampRange(offset int64, length int64, size int64) []byte {
+    if offset >= size {
+        return []byte{}
+    }
+    if length > size - offset { // offset + length can overflow
+        length = size - offset
+    }
+    return make([]byte, length)
+}
@@ -0,0 +1,50 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: rebuild.go
+* Date created: 10/16/26
+*
+* Description: rebuilds the components of a file that were on a location
+* that is gone (a dead disk) onto a new location, from the components on the
+* other locations, without waiting for someone to get the file.
+*******************************************************************************/
+
+package fileutils
+
+import (
+    "fmt"
+    "foxyblox/types"
+)
+
+/*
+    Rebuild the component of the file (saved with the given layout) that was
+    on diskLocations[location] onto newLocation, which takes its place. The
+    other components are checked too, and their damaged blocks rebuilt. A
+    component that is already intact on newLocation is left as it is, so an
+    interrupted rebuild can just be run again.
+*/
+func RebuildComponent(filename string, username string, diskLocations []string,
+                      layout types.Layout, location int, newLocation string,
+                      configs *types.Config) error {
+    err := checkLayout(layout, len(diskLocations))
+    if err != nil {
+        return err
+    }
+    if location < 0 || location >= layout.DataCount + layout.ParityCount {
+        return fmt.Errorf("%s has no component on location %d", filename, location)
+    }
+
+    newLocations := make([]string, len(diskLocations))
+    copy(newLocations, diskLocations)
+    newLocations[location] = newLocation
+
+    backends, err := openBackends(newLocations)
+    if err != nil {
+        return err
+    }
+    if !locationAvailable(backends[location]) {
+        return fmt.Errorf("can't rebuild %s on %s, it can't be reached", filename, newLocation)
+    }
+
+    _, err = verifyAndRepair(storedFilename(filename, layout), username, backends, layout)
+    return err
+}
@@ -0,0 +1,92 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: restripe.go
+* Date created: 10/16/26
+*
+* Description: re-encodes a saved file from one set of locations (and
+* layout) onto another, i.e. when data disks are added or removed. The new
+* components are saved under a new generation, next to the old ones, so the
+* file stays readable from the old components until its database entry is
+* switched over.
+*******************************************************************************/
+
+package fileutils
+
+import (
+    "fmt"
+    "os"
+    "io/ioutil"
+    "foxyblox/types"
+)
+
+/*
+    Read the file saved with oldLayout on oldLocations, and save it again with
+    newLayout on newLocations. The new layout must have a different generation
+    than the old one, the old components are left where they are (remove them
+    with RemoveFileWithLayout once nothing refers to them anymore).
+*/
+func RestripeFile(filename string, username string, oldLocations []string,
+                  oldLayout types.Layout, newLocations []string, newLayout types.Layout,
+                  configs *types.Config) error {
+    err := checkLayout(oldLayout, len(oldLocations))
+    if err != nil {
+        return err
+    }
+    err = checkLayout(newLayout, len(newLocations))
+    if err != nil {
+        return err
+    }
+    if oldLayout.Generation == newLayout.Generation {
+        return fmt.Errorf("%w: %s is already saved as generation %d", types.ErrInvalidLayout,
+                          filename, newLayout.Generation)
+    }
+
+    oldBackends, err := openBackends(oldLocations)
+    if err != nil {
+        return err
+    }
+    newBackends, err := openBackends(newLocations)
+    if err != nil {
+        return err
+    }
+
+    // the file is put back together in a temporary file, then split again
+    tempFile, err := ioutil.TempFile("", "restripe-")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tempFile.Name())
+    defer tempFile.Close()
+
+    oldName := storedFilename(filename, oldLayout)
+    if oldLayout.Striping == types.STRIPING_ROTATING {
+        _, err = getStriped(oldName, tempFile, oldBackends, oldLayout, username)
+    } else {
+        _, err = getStrips(oldName, tempFile, oldBackends, oldLayout, username)
+    }
+    if err != nil {
+        return err
+    }
+
+    fileStat, err := tempFile.Stat()
+    if err != nil {
+        return err
+    }
+    _, err = tempFile.Seek(0, 0)
+    if err != nil {
+        return err
+    }
+
+    newName := storedFilename(filename, newLayout)
+    err = saveFile(tempFile, fileStat.Size(), newName, username, newBackends, newLayout)
+    if err != nil {
+        return err
+    }
+
+    staged, err := stageComponents(newBackends, newName, username, newLayout)
+    if err != nil {
+        return err
+    }
+    staged.Commit()
+    return nil
+}
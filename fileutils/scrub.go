@@ -0,0 +1,271 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: scrub.go
+* Date created: 10/16/26
+*
+* Description: scrubs saved files without anyone having to read them: every
+* component is checked against its hashes (and repaired from the others),
+* and the parity is checked against the data it was computed from. The reads
+* and writes can be limited to a number of bytes per second, so that a scrub
+* of a large volume doesn't starve the normal traffic.
+*******************************************************************************/
+
+package fileutils
+
+import (
+    "bytes"
+    "sync"
+    "time"
+    "foxyblox/types"
+)
+
+/*
+    What was wrong with the locations of a file when it was scrubbed
+*/
+type ScrubReport struct {
+    ReadReport
+    // locations whose parity did not match the data (even though it matched
+    // its hashes), it was computed again from the data
+    ParityRewritten []string
+}
+
+/*
+    Limits the bytes that are read and written to bytesPerSecond, shared by
+    everything that is scrubbed with it (nil = no limit)
+*/
+type RateLimiter struct {
+    lock sync.Mutex
+    bytesPerSecond int64
+    next time.Time // when the next read or write can start
+}
+
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+    if bytesPerSecond <= 0 {
+        return nil
+    }
+    return &RateLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// wait until n more bytes can be read or written
+func (l *RateLimiter) wait(n int) {
+    if l == nil {
+        return
+    }
+
+    l.lock.Lock()
+    now := time.Now()
+    if l.next.Before(now) {
+        l.next = now
+    }
+    delay := l.next.Sub(now)
+    l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+    l.lock.Unlock()
+
+    time.Sleep(delay)
+}
+
+// backend whose components wait for the rate limiter before every read or write
+type limitedBackend struct {
+    Backend
+    limiter *RateLimiter
+}
+
+type limitedComponent struct {
+    Component
+    limiter *RateLimiter
+}
+
+func (c *limitedComponent) ReadAt(p []byte, off int64) (int, error) {
+    c.limiter.wait(len(p))
+    return c.Component.ReadAt(p, off)
+}
+
+func (c *limitedComponent) WriteAt(p []byte, off int64) (int, error) {
+    c.limiter.wait(len(p))
+    return c.Component.WriteAt(p, off)
+}
+
+func (b *limitedBackend) limit(component Component, err error) (Component, error) {
+    if err != nil {
+        return nil, err
+    }
+    return &limitedComponent{Component: component, limiter: b.limiter}, nil
+}
+
+func (b *limitedBackend) OpenComponent(name string) (Component, error) {
+    return b.limit(b.Backend.OpenComponent(name))
+}
+
+func (b *limitedBackend) CreateComponent(name string) (Component, error) {
+    return b.limit(b.Backend.CreateComponent(name))
+}
+
+func (b *limitedBackend) UpdateComponent(name string) (Component, error) {
+    return b.limit(b.Backend.UpdateComponent(name))
+}
+
+/*
+    Check every component of the file (saved with the given layout) against
+    its hashes, and rebuild the damaged ones, the same way a read of the file
+    would. Then check that the parity matches the data, the parity that
+    doesn't is computed again from the data. Returns what was found,
+    types.ErrUnrecoverable if the file is damaged beyond repair.
+*/
+func ScrubFile(filename string, username string, diskLocations []string, layout types.Layout,
+               limiter *RateLimiter, configs *types.Config) (*ScrubReport, error) {
+    err := checkLayout(layout, len(diskLocations))
+    if err != nil {
+        return nil, err
+    }
+
+    backends, err := openBackends(diskLocations)
+    if err != nil {
+        return nil, err
+    }
+    if limiter != nil {
+        for location := 0; location < len(backends); location++ {
+            backends[location] = &limitedBackend{Backend: backends[location], limiter: limiter}
+        }
+    }
+    filename = storedFilename(filename, layout)
+
+    damage, err := verifyAndRepair(filename, username, backends, layout)
+    if err != nil {
+        return nil, err
+    }
+    report := &ScrubReport{ReadReport: *newReadReport(damage, backends, diskLocations)}
+
+    // the parity can only be compared with all of the data
+    if !allRebuilt(damage, backends) {
+        return report, nil
+    }
+
+    rewritten, err := checkParity(filename, username, backends, layout)
+    if err != nil {
+        return report, err
+    }
+    for _, location := range rewritten {
+        report.ParityRewritten = append(report.ParityRewritten, diskLocations[location])
+    }
+
+    return report, nil
+}
+
+/*
+    Compute the parity of every block (every stripe, for striped files) from
+    the data, and compare it with the parity that is stored. Parity that
+    doesn't match is overwritten, and the hashes of its component are computed
+    again. Returns the locations that were rewritten.
+*/
+func checkParity(filename string, username string, backends []Backend,
+                 layout types.Layout) ([]int, error) {
+    componentCount := layout.DataCount + layout.ParityCount
+
+    files := make([]Component, componentCount)
+    infos := make([]*componentInfo, componentCount)
+    for location := 0; location < componentCount; location++ {
+        name := locationComponentName(username, filename, location, layout)
+        file, err := backends[location].UpdateComponent(name)
+        if err != nil {
+            return nil, err
+        }
+        defer file.Close()
+        files[location] = file
+
+        infos[location], err = readComponentInfo(file)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    rawSize := infos[0].dataSize
+    blockSize := componentBlockSize(layout)
+    coefficients := parityCoefficients(layout)
+    rewritten := make([]bool, componentCount)
+
+    for block := int64(0); block * blockSize < rawSize; block++ {
+        offset := block * blockSize
+        unitSize := blockSize
+        if rawSize - offset < unitSize {
+            unitSize = rawSize - offset
+        }
+
+        // location of every component ID in this block
+        locations := make([]int, componentCount)
+        units := make([][]byte, componentCount)
+        for ID := 0; ID < componentCount; ID++ {
+            locations[ID] = ID
+            if layout.Striping == types.STRIPING_ROTATING {
+                locations[ID] = stripeLocation(ID, block, layout)
+            }
+
+            units[ID] = make([]byte, unitSize)
+            _, err := files[locations[ID]].ReadAt(units[ID], offset)
+            if err != nil {
+                return nil, err
+            }
+        }
+
+        for j := 0; j < layout.ParityCount; j++ {
+            expected := make([]byte, unitSize)
+            for i := 0; i < layout.DataCount; i++ {
+                galMulSliceXor(coefficients[j][i], units[i], expected)
+            }
+            if bytes.Equal(expected, units[layout.DataCount + j]) {
+                continue
+            }
+
+            location := locations[layout.DataCount + j]
+            _, err := files[location].WriteAt(expected, offset)
+            if err != nil {
+                return nil, err
+            }
+            rewritten[location] = true
+        }
+    }
+
+    var rewrittenLocations []int
+    for location := 0; location < componentCount; location++ {
+        if !rewritten[location] {
+            continue
+        }
+
+        err := rehashComponent(files[location], infos[location], blockSize)
+        if err != nil {
+            return nil, err
+        }
+        rewrittenLocations = append(rewrittenLocations, location)
+    }
+
+    return rewrittenLocations, nil
+}
+
+/*
+    Hash the data of the component again, and write the new trailer after it
+    (components in the old format get a trailer in the current format, with
+    blocks of blockSize)
+*/
+func rehashComponent(file Component, info *componentInfo, blockSize int64) error {
+    if info.blockSize != 0 {
+        blockSize = info.blockSize
+    }
+
+    hasher := newComponentHasher(blockSize, info.algorithm)
+    buf := make([]byte, types.MAX_BUFFER_SIZE)
+    for position := int64(0); position < info.dataSize; {
+        if info.dataSize - position < int64(len(buf)) {
+            buf = buf[0:info.dataSize - position]
+        }
+
+        _, err := file.ReadAt(buf, position)
+        if err != nil {
+            return err
+        }
+        hasher.Write(buf)
+
+        position += int64(len(buf))
+    }
+
+    _, err := file.WriteAt(hasher.trailer(), info.dataSize)
+    return err
+}
@@ -0,0 +1,107 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: staged.go
+* Date created: 10/16/26
+*
+* Description: puts the components of a save in place all at once. The
+* components are written (and flushed) under temporary names first, and only
+* renamed to their real names once every one of them was written, so a save
+* that fails halfway never touches a previous copy of the file. The previous
+* components are kept until the save is committed, so that the save can still
+* be rolled back (i.e. when the database can't be updated).
+*******************************************************************************/
+
+package fileutils
+
+import (
+    "os"
+    "foxyblox/types"
+)
+
+// suffix of the components that are being written
+const TEMP_COMPONENT_SUFFIX = ".tmp"
+// suffix of the components that a save replaced, until it is committed
+const OLD_COMPONENT_SUFFIX = ".old"
+
+/*
+    A save whose components are in place, with the components it replaced
+    still kept. Either Commit or Rollback it.
+*/
+type StagedSave struct {
+    Layout types.Layout // layout the file was saved with
+    backends []Backend
+    filename string // stored name of the file
+    username string
+    placed []bool // the component on the location was renamed into place
+    replaced []bool // the location had a component that was moved aside
+}
+
+/*
+    Move the temporary components of the save into place (the components that
+    are there already are moved aside first). If that fails, everything is
+    put back the way it was, and the temporary components are removed.
+*/
+func stageComponents(backends []Backend, filename string, username string,
+                     layout types.Layout) (*StagedSave, error) {
+    componentCount := layout.DataCount + layout.ParityCount
+    s := &StagedSave{Layout: layout, backends: backends, filename: filename,
+                     username: username, placed: make([]bool, componentCount),
+                     replaced: make([]bool, componentCount)}
+
+    for location := 0; location < componentCount; location++ {
+        name := locationComponentName(username, filename, location, layout)
+        if _, err := backends[location].StatComponent(name); err == nil {
+            err = backends[location].RenameComponent(name, name + OLD_COMPONENT_SUFFIX)
+            if err != nil {
+                s.Rollback()
+                return nil, err
+            }
+            s.replaced[location] = true
+        }
+
+        err := backends[location].RenameComponent(name + TEMP_COMPONENT_SUFFIX, name)
+        if err != nil {
+            s.Rollback()
+            return nil, err
+        }
+        s.placed[location] = true
+    }
+
+    return s, nil
+}
+
+// the save is final, remove the components it replaced
+func (s *StagedSave) Commit() {
+    for location := 0; location < len(s.replaced); location++ {
+        if s.replaced[location] {
+            name := locationComponentName(s.username, s.filename, location, s.Layout)
+            s.backends[location].RemoveComponent(name + OLD_COMPONENT_SUFFIX)
+        }
+    }
+}
+
+/*
+    Undo the save, the components it replaced are put back (the locations
+    that had none are left without one), returns the first error of putting
+    them back
+*/
+func (s *StagedSave) Rollback() error {
+    var firstErr error
+    for location := 0; location < len(s.placed); location++ {
+        name := locationComponentName(s.username, s.filename, location, s.Layout)
+
+        var err error
+        if s.replaced[location] {
+            err = s.backends[location].RenameComponent(name + OLD_COMPONENT_SUFFIX, name)
+        } else if s.placed[location] {
+            err = s.backends[location].RemoveComponent(name)
+        }
+        if err != nil && !os.IsNotExist(err) && firstErr == nil {
+            firstErr = err
+        }
+    }
+
+    removeComponentsWithSuffix(s.backends, s.filename, s.username, s.Layout,
+                               TEMP_COMPONENT_SUFFIX)
+    return firstErr
+}
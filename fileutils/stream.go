@@ -0,0 +1,285 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: stream.go
+* Date created: 10/16/26
+*
+* Description: retrieves files as streams (to any io.Writer, or as an
+* io.ReadCloser), instead of assembling them into downloaded-<filename> in the
+* working directory. Every block is checked against its hash as it is read
+* (the broken ones are rebuilt from the other components first), so only
+* verified data is ever handed out, and the file is only read once.
+*******************************************************************************/
+
+package fileutils
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "foxyblox/types"
+)
+
+/*
+    Write the file (saved with the given layout) to w, in order. Every block
+    is checked against its hash as it is read, and a damaged block (or the
+    region of a missing component) is rebuilt from the other components
+    before it is written; the damaged blocks are repaired on their locations
+    once the whole file was written. An error is returned if a block can't be
+    rebuilt (more than layout.ParityCount components are damaged in it), w
+    then only has the part of the file before that block.
+*/
+func GetStream(ctx context.Context, w io.Writer, filename string, username string,
+               diskLocations []string, layout types.Layout, configs *types.Config) error {
+    _, err := GetStreamWithReport(ctx, w, filename, username, diskLocations, layout, configs)
+    return err
+}
+
+/*
+    Same as GetStream, and also reports the locations that were degraded. When
+    a location can't be reached (so its component can't be rebuilt), the file
+    is streamed from the surviving components and the parity.
+*/
+func GetStreamWithReport(ctx context.Context, w io.Writer, filename string, username string,
+                         diskLocations []string, layout types.Layout,
+                         configs *types.Config) (*ReadReport, error) {
+    err := checkLayout(layout, len(diskLocations))
+    if err != nil {
+        return nil, err
+    }
+
+    backends, err := openBackends(diskLocations)
+    if err != nil {
+        return nil, err
+    }
+    filename = storedFilename(filename, layout)
+
+    r := newRangeReader(filename, username, backends, layout)
+    defer r.close()
+    r.damage = make([]*componentDamage, layout.DataCount + layout.ParityCount)
+
+    /*
+        Components written before the block hashes existed can only be
+        checked whole, so those are checked (and repaired) before streaming
+    */
+    if r.hasLegacyComponents() {
+        r.close()
+        damage, err := verifyAndRepair(filename, username, backends, layout)
+        if err != nil {
+            return nil, err
+        }
+
+        r = newRangeReader(filename, username, backends, layout)
+        defer r.close()
+        err = streamRegions(ctx, w, r, layout)
+        if err != nil {
+            return nil, err
+        }
+        return newReadReport(damage, backends, diskLocations), nil
+    }
+
+    err = streamRegions(ctx, w, r, layout)
+    if err != nil {
+        return nil, err
+    }
+
+    // only what was found damaged on the way is repaired
+    r.close()
+    if !intact(r.damage) {
+        if layout.Striping == types.STRIPING_ROTATING {
+            err = recoverStripedComponents(r.damage, filename, nil, backends, layout, username)
+        } else {
+            err = recoverFromDriveFailure(r.damage, filename, nil, backends, layout, username)
+        }
+        if err != nil {
+            return nil, fmt.Errorf("can't repair %s after streaming it: %w", filename, err)
+        }
+    }
+
+    return newReadReport(r.damage, backends, diskLocations), nil
+}
+
+/*
+    Same as GetStream, the file is read from the returned io.ReadCloser
+    instead (any error comes back from Read). Closing it early stops the
+    retrieval.
+*/
+func OpenStream(ctx context.Context, filename string, username string, diskLocations []string,
+                layout types.Layout, configs *types.Config) io.ReadCloser {
+    pipeReader, pipeWriter := io.Pipe()
+
+    go func() {
+        err := GetStream(ctx, pipeWriter, filename, username, diskLocations, layout, configs)
+        pipeWriter.CloseWithError(err) // nil error = EOF for the reader
+    }()
+
+    return pipeReader
+}
+
+/*
+    Check the hashes of all of the components at the same time, and rebuild
+    the damaged blocks (or the missing components) from the intact ones.
+    Returns the damage that was found (nil for the intact components).
+*/
+func verifyAndRepair(filename string, username string, backends []Backend,
+                     layout types.Layout) ([]*componentDamage, error) {
+    componentCount := layout.DataCount + layout.ParityCount
+    completionChannel := make(chan int, componentCount)
+    damage := make([]*componentDamage, componentCount)
+
+    for location := 0; location < componentCount; location++ {
+        go func(location int) {
+            name := locationComponentName(username, filename, location, layout)
+            damage[location] = checkComponent(backends[location], name)
+            if damage[location] != nil {
+                completionChannel <- location + 1
+                return
+            }
+            completionChannel <- 0 // success
+        }(location)
+    }
+
+    brokenCount := 0
+    for i := 0; i < componentCount; i++ {
+        errorCode := <- completionChannel
+        if errorCode != 0 {
+            brokenCount++
+        }
+    }
+    close(completionChannel)
+
+    if brokenCount == 0 {
+        return damage, nil
+    }
+
+    var err error
+    if layout.Striping == types.STRIPING_ROTATING {
+        err = recoverStripedComponents(damage, filename, nil, backends, layout, username)
+    } else {
+        err = recoverFromDriveFailure(damage, filename, nil, backends, layout, username)
+    }
+    return damage, err
+}
+
+// false if some missing component could not be rebuilt (its location can't be reached)
+func allRebuilt(damage []*componentDamage, backends []Backend) bool {
+    for location := 0; location < len(damage); location++ {
+        if damage[location] != nil && damage[location].whole &&
+           !locationAvailable(backends[location]) {
+            return false
+        }
+    }
+    return true
+}
+
+// true if no damage was found on any of the locations
+func intact(damage []*componentDamage) bool {
+    for _, found := range damage {
+        if found != nil {
+            return false
+        }
+    }
+    return true
+}
+
+// true if some component that can be read has no block hashes (see component.go)
+func (r *rangeReader) hasLegacyComponents() bool {
+    for location := 0; location < len(r.components); location++ {
+        if r.component(location) != nil && r.infos[location].blockSize == 0 {
+            return true
+        }
+    }
+    return false
+}
+
+// write the file to w a region at a time, see readRegion
+func streamRegions(ctx context.Context, w io.Writer, r *rangeReader, layout types.Layout) error {
+    if layout.Striping == types.STRIPING_ROTATING {
+        return r.streamStriped(ctx, w)
+    }
+    return r.streamStrips(ctx, w)
+}
+
+/*
+    Whole strips: the data components one after another, without the padding
+    at the end of the last one, read in whole blocks (see
+    types.COMPONENT_BLOCK_SIZE)
+*/
+func (r *rangeReader) streamStrips(ctx context.Context, w io.Writer) error {
+    stripSize, size, err := r.stripFileSize()
+    if err != nil {
+        return err
+    }
+
+    buf := make([]byte, types.MAX_BUFFER_SIZE)
+    for position := int64(0); position < size; {
+        if err = ctx.Err(); err != nil {
+            return err
+        }
+
+        ID := int(position / stripSize)
+        offsetInComponent := position % stripSize
+
+        chunk := buf
+        if stripSize - offsetInComponent < int64(len(chunk)) {
+            chunk = chunk[0:stripSize - offsetInComponent]
+        }
+        if size - position < int64(len(chunk)) {
+            chunk = chunk[0:size - position]
+        }
+
+        err = r.readRegion(ID, offsetInComponent, chunk, sameLocation)
+        if err != nil {
+            return err
+        }
+        _, err = w.Write(chunk)
+        if err != nil {
+            return err
+        }
+
+        position += int64(len(chunk))
+    }
+
+    return nil
+}
+
+/*
+    Stripes: the data units of every stripe, in order, without the padding at
+    the end of the last stripe (every unit is a block of its component)
+*/
+func (r *rangeReader) streamStriped(ctx context.Context, w io.Writer) error {
+    layout := r.layout
+    unitSize := layout.StripeSize
+    stripeDataSize := int64(layout.DataCount) * unitSize
+
+    stripeCount, size, err := r.stripedFileSize()
+    if err != nil {
+        return err
+    }
+
+    stripeBuf := make([]byte, stripeDataSize)
+    for stripe := int64(0); stripe < stripeCount; stripe++ {
+        if err = ctx.Err(); err != nil {
+            return err
+        }
+
+        for ID := 0; ID < layout.DataCount; ID++ {
+            unit := stripeBuf[int64(ID) * unitSize:int64(ID + 1) * unitSize]
+            err = r.readRegion(ID, stripe * unitSize, unit,
+                               func(ID int) int { return stripeLocation(ID, stripe, layout) })
+            if err != nil {
+                return err
+            }
+        }
+
+        data := stripeBuf
+        if size - stripe * stripeDataSize < stripeDataSize {
+            data = stripeBuf[0:size - stripe * stripeDataSize]
+        }
+        _, err = w.Write(data)
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
@@ -0,0 +1,418 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: stripe.go
+* Date created: 10/16/26
+*
+* Description: RAID 5 style layout - the file is cut into stripes of
+* DataCount fixed size units (layout.StripeSize bytes each), and the parity
+* units of every stripe rotate across the locations, so that no location is
+* a write hotspot. Every location holds a single component with its unit
+* of every stripe, in order, followed by the trailer with the hash of every
+* unit (each unit is a block of the component, see component.go).
+*******************************************************************************/
+
+package fileutils
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "os"
+    "foxyblox/types"
+)
+
+/*
+    Location that holds the unit of component ID (IDs >= DataCount are
+    parity) in the given stripe
+*/
+func stripeLocation(ID int, stripe int64, layout types.Layout) int {
+    componentCount := layout.DataCount + layout.ParityCount
+    return int((int64(ID) + stripe) % int64(componentCount))
+}
+
+// inverse of stripeLocation, the component ID held by the location in the stripe
+func stripeComponentID(location int, stripe int64, layout types.Layout) int {
+    componentCount := int64(layout.DataCount + layout.ParityCount)
+    return int(((int64(location) - stripe) % componentCount + componentCount) % componentCount)
+}
+
+/*
+    Split the file into stripes, reading the original file a stripe at a time
+    (never holding more than one stripe in memory), and hand the units to one
+    writer per location. The last stripe is padded with 0x80 followed by 0s,
+    there is always at least one byte of padding.
+
+    The file is read sequentially, so it can come from any reader (uploads,
+    pipes), size < 0 means that it is not known in advance and the reader is
+    read until EOF. Nothing is left on the locations if the save fails.
+*/
+func saveStriped(ctx context.Context, originalFile io.Reader, size int64, filename string,
+                 username string, backends []Backend, layout types.Layout) error {
+    componentCount := layout.DataCount + layout.ParityCount
+    unitSize := layout.StripeSize
+    stripeDataSize := int64(layout.DataCount) * unitSize
+
+    storageFiles, err := createComponents(backends, filename, username, layout)
+    if err != nil {
+        return err
+    }
+
+    completionChannel := make(chan error, componentCount)
+    unitChannels := make([]chan []byte, componentCount)
+    for i := 0; i < componentCount; i++ {
+        unitChannels[i] = make(chan []byte, 1)
+        go stripeWriter(storageFiles[i], unitSize, layout.HashAlgorithm, unitChannels[i],
+                        completionChannel)
+    }
+
+    coefficients := parityCoefficients(layout)
+    var saveErr error
+    var totalRead int64 = 0
+    for stripe := int64(0); saveErr == nil; stripe++ {
+        if saveErr = ctx.Err(); saveErr != nil {
+            break
+        }
+
+        toRead := stripeDataSize
+        if size >= 0 && size - totalRead < toRead {
+            toRead = size - totalRead
+        }
+
+        stripeBuf := make([]byte, stripeDataSize)
+        numRead, err := io.ReadFull(originalFile, stripeBuf[0:toRead])
+        totalRead += int64(numRead)
+        if (err == io.EOF || err == io.ErrUnexpectedEOF) && size >= 0 {
+            saveErr = fmt.Errorf("%s ended after %d of %d bytes", filename, totalRead, size)
+            break
+        } else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+            saveErr = err
+            break
+        }
+
+        // a stripe that is not full is the last one
+        lastStripe := int64(numRead) < stripeDataSize
+        if lastStripe {
+            stripeBuf[numRead] = 0x80 // rest of the stripe is already 0s
+        }
+
+        for ID := 0; ID < componentCount; ID++ {
+            var unit []byte
+            if ID < layout.DataCount {
+                unit = stripeBuf[int64(ID) * unitSize:int64(ID + 1) * unitSize]
+            } else {
+                unit = make([]byte, unitSize)
+                for i := 0; i < layout.DataCount; i++ {
+                    galMulSliceXor(coefficients[ID - layout.DataCount][i],
+                                   stripeBuf[int64(i) * unitSize:int64(i + 1) * unitSize], unit)
+                }
+            }
+
+            unitChannels[stripeLocation(ID, stripe, layout)] <- unit
+        }
+
+        if lastStripe {
+            break
+        }
+    }
+
+    // stop the writers, and wait until all of them are done
+    for i := 0; i < componentCount; i++ {
+        close(unitChannels[i])
+    }
+    for i := 0; i < componentCount; i++ {
+        if err = <- completionChannel; err != nil && saveErr == nil {
+            saveErr = err
+        }
+    }
+
+    if saveErr != nil {
+        removeComponentsWithSuffix(backends, filename, username, layout, TEMP_COMPONENT_SUFFIX)
+    }
+
+    return saveErr
+}
+
+/*
+    Appends all of the units it is sent to the component, followed by the
+    trailer (one block per unit, hashed with hashAlgorithm, see component.go).
+    After a failed write, the rest of the units are still taken (so the stripes
+    keep moving), but not written, and the error is sent back at the end.
+*/
+func stripeWriter(file Component, unitSize int64, hashAlgorithm int, units chan []byte,
+                  completionChannel chan error) {
+    var currentLocation int64 = 0
+    currentHash := newComponentHasher(unitSize, hashAlgorithm)
+
+    var writeErr error
+    for unit := range units {
+        if writeErr != nil {
+            continue
+        }
+        _, writeErr = file.WriteAt(unit, currentLocation)
+
+        currentHash.Write(unit)
+        currentLocation += int64(len(unit))
+    }
+
+    if writeErr == nil {
+        _, writeErr = file.WriteAt(currentHash.trailer(), currentLocation)
+    }
+
+    writeErr = finishComponent(file, writeErr)
+
+    completionChannel <- writeErr
+}
+
+/*
+    Reads the component on the given location, writing the data units in it
+    to their place in the output file (padding included, it is removed once
+    all of the data is there). Reports back the same way as basicReaderWriter,
+    the damaged blocks of the component are the damaged stripes.
+*/
+func stripedReaderWriter(filename string, outputFile *os.File, location int,
+                         completionChannel chan int, damage []*componentDamage,
+                         outputErrors []error, backends []Backend, username string,
+                         layout types.Layout) {
+    unitSize := layout.StripeSize
+
+    file, err := backends[location].OpenComponent(componentName(username, filename, location))
+    if err != nil {
+        damage[location] = wholeComponentDamage
+        completionChannel <- location + 1
+        return
+    }
+    defer file.Close()
+
+    info, err := readComponentInfo(file)
+    if err != nil || info.dataSize % unitSize != 0 {
+        damage[location] = wholeComponentDamage
+        completionChannel <- location + 1
+        return
+    }
+    size := info.dataSize
+
+    verifier := newComponentVerifier(info)
+    unit := make([]byte, unitSize)
+    for stripe := int64(0); stripe * unitSize < size; stripe++ {
+        _, err = file.ReadAt(unit, stripe * unitSize)
+        if err != nil {
+            damage[location] = wholeComponentDamage
+            completionChannel <- location + 1
+            return
+        }
+        verifier.Write(unit)
+
+        ID := stripeComponentID(location, stripe, layout)
+        if ID < layout.DataCount {
+            offsetInOutput := (stripe * int64(layout.DataCount) + int64(ID)) * unitSize
+            _, err = outputFile.WriteAt(unit, offsetInOutput)
+            if err != nil {
+                outputErrors[location] = err
+                completionChannel <- 0 // the component itself is fine
+                return
+            }
+        }
+    }
+
+    damage[location] = verifier.damage()
+    if damage[location] != nil {
+        completionChannel <- location + 1
+        return
+    }
+
+    completionChannel <- 0 // success
+}
+
+/*
+    Rebuild the damaged stripes of the components in damage (indexed by
+    location, nil for the intact ones), or the whole components if they are
+    missing, from the units on the intact locations, and write the rebuilt
+    data units into the output file (if there is one)
+*/
+func recoverStripedComponents(damage []*componentDamage, filename string, outputFile *os.File,
+                              backends []Backend, layout types.Layout, username string) error {
+    componentCount := layout.DataCount + layout.ParityCount
+    unitSize := layout.StripeSize
+
+    err := checkRecoverable(damage, filename, layout, backends)
+    if err != nil {
+        return err
+    }
+
+    var size int64 = -1
+    files := make([]Component, componentCount)
+    for location := 0; location < componentCount; location++ {
+        if damage[location] != nil && damage[location].whole {
+            continue
+        }
+
+        name := componentName(username, filename, location)
+        if damage[location] == nil {
+            files[location], err = backends[location].OpenComponent(name)
+        } else { // damaged stripes are rewritten in place
+            files[location], err = backends[location].UpdateComponent(name)
+        }
+        if err != nil {
+            return err
+        }
+        defer files[location].Close()
+
+        if size == -1 {
+            size, err = componentDataSize(files[location])
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    /*
+        Delete the offending files, and recreate them with the correct data
+        (unless the location itself is gone)
+    */
+    fixedHashes := make([]*componentHasher, componentCount)
+    for location := 0; location < componentCount; location++ {
+        if damage[location] == nil || !damage[location].whole ||
+           !locationAvailable(backends[location]) {
+            continue
+        }
+
+        name := componentName(username, filename, location)
+        backends[location].RemoveComponent(name)
+        files[location], err = backends[location].CreateComponent(name)
+        if err != nil {
+            return err
+        }
+        defer files[location].Close()
+        fixedHashes[location] = newComponentHasher(unitSize, layout.HashAlgorithm)
+    }
+
+    decoders := make(map[string][][]byte)
+    for stripe := int64(0); stripe * unitSize < size; stripe++ {
+        units := make([][]byte, componentCount)
+        var missing []int
+
+        // only need DataCount of the intact units, prefer the data units
+        read := 0
+        for ID := 0; ID < componentCount; ID++ {
+            location := stripeLocation(ID, stripe, layout)
+            if damage[location].hasBlock(stripe) {
+                missing = append(missing, ID)
+            } else if read < layout.DataCount {
+                units[ID] = make([]byte, unitSize)
+                _, err = files[location].ReadAt(units[ID], stripe * unitSize)
+                if err != nil {
+                    return err
+                }
+                read++
+            }
+        }
+        if len(missing) == 0 {
+            continue
+        }
+
+        err = reconstructUnits(layout, units, missing, decoders)
+        if err != nil {
+            return err
+        }
+
+        for _, ID := range missing {
+            location := stripeLocation(ID, stripe, layout)
+            if files[location] != nil {
+                _, err = files[location].WriteAt(units[ID], stripe * unitSize)
+                if err != nil {
+                    return err
+                }
+            }
+            if fixedHashes[location] != nil {
+                fixedHashes[location].Write(units[ID])
+            }
+
+            if ID < layout.DataCount && outputFile != nil {
+                offsetInOutput := (stripe * int64(layout.DataCount) + int64(ID)) * unitSize
+                _, err = outputFile.WriteAt(units[ID], offsetInOutput)
+                if err != nil {
+                    return err
+                }
+            }
+        }
+    }
+
+    for location := 0; location < componentCount; location++ {
+        if fixedHashes[location] != nil {
+            _, err = files[location].WriteAt(fixedHashes[location].trailer(), size)
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    return nil
+}
+
+/*
+    Remove the padding at the end of the last stripe from the output file,
+    once all of the data units have been written to it
+*/
+func trimStripePadding(outputFile *os.File, layout types.Layout) error {
+    fileStat, err := outputFile.Stat()
+    if err != nil {
+        return err
+    }
+    size := fileStat.Size()
+
+    stripeDataSize := int64(layout.DataCount) * layout.StripeSize
+    if stripeDataSize > size {
+        stripeDataSize = size
+    }
+
+    lastStripe := make([]byte, stripeDataSize)
+    _, err = outputFile.ReadAt(lastStripe, size - stripeDataSize)
+    if err != nil {
+        return err
+    }
+
+    return outputFile.Truncate(size - int64(paddingLength(lastStripe, len(lastStripe))))
+}
+
+/*
+    Same as GetFileWithLayout, for files saved with STRIPING_ROTATING, all of
+    the locations are read at the same time, and up to layout.ParityCount of
+    them can be broken in any stripe. Returns the damage that was found on the
+    locations (nil for the intact ones).
+*/
+func getStriped(filename string, outputFile *os.File, backends []Backend,
+                layout types.Layout, username string) ([]*componentDamage, error) {
+    componentCount := layout.DataCount + layout.ParityCount
+    completionChannel := make(chan int, componentCount)
+    damage := make([]*componentDamage, componentCount)
+    outputErrors := make([]error, componentCount)
+
+    for location := 0; location < componentCount; location++ {
+        go stripedReaderWriter(filename, outputFile, location, completionChannel,
+                               damage, outputErrors, backends, username, layout)
+    }
+
+    brokenCount := 0
+    for i := 0; i < componentCount; i++ {
+        errorCode := <- completionChannel
+        if errorCode != 0 {
+            brokenCount++
+        }
+    }
+    close(completionChannel)
+
+    err := firstError(outputErrors)
+    if err != nil {
+        return nil, err
+    }
+
+    if brokenCount > 0 {
+        err = recoverStripedComponents(damage, filename, outputFile, backends,
+                                       layout, username)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return damage, trimStripePadding(outputFile, layout)
+}
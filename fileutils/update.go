@@ -0,0 +1,431 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: update.go
+* Date created: 10/16/26
+*
+* Description: changes a saved file in place. Only the regions of the
+* components that hold the bytes that change are rewritten, and the parity is
+* updated with the difference between the old and the new bytes (the same
+* old-XOR-new trick that transaction.Commit uses for the parity of the
+* database, multiplied by the coefficient of the component for RS and PQ).
+* Appending to a file saved in stripes only rewrites its last stripe, and
+* adds the new stripes at the end of the components (the same goes for the
+* single strip of a mirror).
+*
+* Every component is rewritten (and its trailer updated) before the next one
+* is touched, so after a crash at most one component doesn't match its
+* hashes, and the parity that doesn't match the data is fixed by a scrub.
+*******************************************************************************/
+
+package fileutils
+
+import (
+    "fmt"
+    "foxyblox/types"
+)
+
+/*
+    Write data into the file (saved with the given layout) at offset, like
+    io.WriterAt: data that goes past the end of the file is appended to it
+    (offset can be at most the size of the file). Files saved in whole strips
+    can only be changed within their size, their strips would have to be cut
+    again to grow (types.ErrInvalidLayout, re-encode them in stripes first),
+    unless there is a single strip (mirrors). Every component must be intact in
+    the regions that change, rebuild or scrub the file first otherwise
+    (types.ErrCorrupt).
+*/
+func WriteFileAt(filename string, username string, diskLocations []string,
+                 layout types.Layout, configs *types.Config, offset int64, data []byte) error {
+    if offset < 0 {
+        return fmt.Errorf("invalid offset %d", offset)
+    }
+
+    err := checkLayout(layout, len(diskLocations))
+    if err != nil {
+        return err
+    }
+
+    backends, err := openBackends(diskLocations)
+    if err != nil {
+        return err
+    }
+
+    u := &componentUpdater{r: newRangeReader(storedFilename(filename, layout), username,
+                                             backends, layout),
+                           coefficients: parityCoefficients(layout)}
+    u.r.writable = true
+    defer u.r.close()
+
+    for location := 0; location < layout.DataCount + layout.ParityCount; location++ {
+        if u.r.component(location) == nil {
+            return fmt.Errorf("%w: component of %s on %s can't be read, rebuild it first",
+                              types.ErrCorrupt, filename, backendName(backends[location], location))
+        }
+        if u.r.infos[location].blockSize == 0 {
+            return fmt.Errorf("%w: %s was saved before components had block hashes, save it again",
+                              types.ErrInvalidLayout, filename)
+        }
+    }
+
+    if layout.Striping == types.STRIPING_ROTATING {
+        return u.writeStriped(offset, data)
+    }
+    return u.writeStrips(offset, data)
+}
+
+// append data to the end of the file, see WriteFileAt
+func AppendFile(filename string, username string, diskLocations []string,
+                layout types.Layout, configs *types.Config, data []byte) error {
+    size, err := FileSize(filename, username, diskLocations, layout, configs)
+    if err != nil {
+        return err
+    }
+
+    return WriteFileAt(filename, username, diskLocations, layout, configs, size, data)
+}
+
+// size of the file saved with the given layout (read from the end of its components)
+func FileSize(filename string, username string, diskLocations []string,
+              layout types.Layout, configs *types.Config) (int64, error) {
+    err := checkLayout(layout, len(diskLocations))
+    if err != nil {
+        return 0, err
+    }
+
+    backends, err := openBackends(diskLocations)
+    if err != nil {
+        return 0, err
+    }
+
+    r := newRangeReader(storedFilename(filename, layout), username, backends, layout)
+    defer r.close()
+
+    var size int64
+    if layout.Striping == types.STRIPING_ROTATING {
+        _, size, err = r.stripedFileSize()
+    } else {
+        _, size, err = r.stripFileSize()
+    }
+    return size, err
+}
+
+/*
+    Rewrites regions of the components of a single file (all of them open,
+    see rangeReader), keeping the parity and the trailers up to date
+*/
+type componentUpdater struct {
+    r *rangeReader
+    coefficients [][]byte
+}
+
+// data component ID i holds [i * stripSize, (i + 1) * stripSize) of the file
+func (u *componentUpdater) writeStrips(offset int64, data []byte) error {
+    stripSize, size, err := u.r.stripFileSize()
+    if err != nil {
+        return err
+    }
+    if offset > size {
+        return fmt.Errorf("offset %d is past the end of %s (%d bytes)", offset, u.r.filename, size)
+    }
+    inPlace := int64(len(data))
+    if offset + inPlace > size {
+        if u.r.layout.DataCount != 1 {
+            return fmt.Errorf("%w: %s is saved in whole strips, it can't grow in place",
+                              types.ErrInvalidLayout, u.r.filename)
+        }
+        inPlace = size - offset
+    }
+
+    for position := int64(0); position < inPlace; {
+        ID := int((offset + position) / stripSize)
+        offsetInComponent := (offset + position) % stripSize
+
+        n := stripSize - offsetInComponent
+        if n > inPlace - position {
+            n = inPlace - position
+        }
+
+        err = u.patch(ID, offsetInComponent, data[position:position + n], sameLocation)
+        if err != nil {
+            return err
+        }
+        position += n
+    }
+
+    if inPlace < int64(len(data)) {
+        return u.appendStrip(size, data[inPlace:])
+    }
+    return nil
+}
+
+/*
+    Append data to a file in a single strip (a mirror): the byte of padding
+    at the end of the strip is replaced by the start of the data, and the
+    rest (padded again) is added to the end of every component
+*/
+func (u *componentUpdater) appendStrip(size int64, data []byte) error {
+    layout := u.r.layout
+
+    padded := append(append([]byte(nil), data...), 0x80)
+    err := u.patch(0, size, padded[0:1], sameLocation)
+    if err != nil {
+        return err
+    }
+
+    err = u.grow(0, padded[1:])
+    if err != nil {
+        return err
+    }
+    for p := 0; p < layout.ParityCount; p++ {
+        parity := make([]byte, len(padded) - 1)
+        galMulSliceXor(u.coefficients[p][0], padded[1:], parity)
+        err = u.grow(layout.DataCount + p, parity)
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// stripe s holds [s * DataCount * StripeSize, (s + 1) * DataCount * StripeSize)
+func (u *componentUpdater) writeStriped(offset int64, data []byte) error {
+    layout := u.r.layout
+    unitSize := layout.StripeSize
+    stripeDataSize := int64(layout.DataCount) * unitSize
+
+    stripeCount, size, err := u.r.stripedFileSize()
+    if err != nil {
+        return err
+    }
+    if offset > size {
+        return fmt.Errorf("offset %d is past the end of %s (%d bytes)", offset, u.r.filename, size)
+    }
+
+    inPlace := int64(len(data))
+    if offset + inPlace > size {
+        inPlace = size - offset
+    }
+    for position := int64(0); position < inPlace; {
+        stripe := (offset + position) / stripeDataSize
+        ID := int(((offset + position) % stripeDataSize) / unitSize)
+        offsetInUnit := (offset + position) % unitSize
+
+        n := unitSize - offsetInUnit
+        if n > inPlace - position {
+            n = inPlace - position
+        }
+
+        err = u.patch(ID, stripe * unitSize + offsetInUnit, data[position:position + n],
+                      func(ID int) int { return stripeLocation(ID, stripe, layout) })
+        if err != nil {
+            return err
+        }
+        position += n
+    }
+
+    if inPlace < int64(len(data)) {
+        return u.appendStripes(stripeCount, size, data[inPlace:])
+    }
+    return nil
+}
+
+/*
+    Append data to a file saved in stripeCount stripes (size bytes of data):
+    the padding in the last stripe is replaced by the start of the data, and
+    the rest goes into new stripes (the last one padded again, see
+    saveStriped), added to the end of the components
+*/
+func (u *componentUpdater) appendStripes(stripeCount int64, size int64, data []byte) error {
+    layout := u.r.layout
+    componentCount := layout.DataCount + layout.ParityCount
+    unitSize := layout.StripeSize
+    stripeDataSize := int64(layout.DataCount) * unitSize
+
+    // the data of the last stripe, followed by the new data and the padding
+    lastStripe := stripeCount - 1
+    used := size - lastStripe * stripeDataSize
+    stripes := (used + int64(len(data))) / stripeDataSize + 1
+    buf := make([]byte, stripes * stripeDataSize)
+    tail, err := u.r.readStripedRange(lastStripe * stripeDataSize, used)
+    if err != nil {
+        return err
+    }
+    copy(buf, tail)
+    copy(buf[used:], data)
+    buf[used + int64(len(data))] = 0x80
+
+    // the units of the last stripe that change (the ones after the data it had)
+    for ID := int(used / unitSize); ID < layout.DataCount; ID++ {
+        err = u.patch(ID, lastStripe * unitSize, buf[int64(ID) * unitSize:int64(ID + 1) * unitSize],
+                      func(ID int) int { return stripeLocation(ID, lastStripe, layout) })
+        if err != nil {
+            return err
+        }
+    }
+
+    // the units of every location in the new stripes, in order
+    added := make([][]byte, componentCount)
+    for stripe := int64(1); stripe < stripes; stripe++ {
+        stripeBuf := buf[stripe * stripeDataSize:(stripe + 1) * stripeDataSize]
+        for ID := 0; ID < componentCount; ID++ {
+            var unit []byte
+            if ID < layout.DataCount {
+                unit = stripeBuf[int64(ID) * unitSize:int64(ID + 1) * unitSize]
+            } else {
+                unit = make([]byte, unitSize)
+                for i := 0; i < layout.DataCount; i++ {
+                    galMulSliceXor(u.coefficients[ID - layout.DataCount][i],
+                                   stripeBuf[int64(i) * unitSize:int64(i + 1) * unitSize], unit)
+                }
+            }
+
+            location := stripeLocation(ID, lastStripe + stripe, layout)
+            added[location] = append(added[location], unit...)
+        }
+    }
+
+    for location := 0; location < componentCount; location++ {
+        if len(added[location]) > 0 {
+            err = u.grow(location, added[location])
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    return nil
+}
+
+/*
+    Replace the region at offset of component ID with data (locationOf gives
+    the location holding each ID, for the part of the file the region is
+    in), and the same region of every parity component: parity ^= coefficient
+    * (old data ^ new data). Every region is read (and checked) before
+    anything is written.
+*/
+func (u *componentUpdater) patch(ID int, offset int64, data []byte,
+                                 locationOf func(ID int) int) error {
+    layout := u.r.layout
+
+    old := make([]byte, len(data))
+    err := u.readIntact(locationOf(ID), offset, old)
+    if err != nil {
+        return err
+    }
+    parity := make([][]byte, layout.ParityCount)
+    for p := 0; p < layout.ParityCount; p++ {
+        parity[p] = make([]byte, len(data))
+        err = u.readIntact(locationOf(layout.DataCount + p), offset, parity[p])
+        if err != nil {
+            return err
+        }
+    }
+
+    delta := make([]byte, len(data))
+    for i := 0; i < len(data); i++ {
+        delta[i] = old[i] ^ data[i]
+    }
+
+    err = u.rewrite(locationOf(ID), offset, data)
+    if err != nil {
+        return err
+    }
+    for p := 0; p < layout.ParityCount; p++ {
+        galMulSliceXor(u.coefficients[p][ID], delta, parity[p])
+        err = u.rewrite(locationOf(layout.DataCount + p), offset, parity[p])
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// read the region of the component on the location, error if its blocks are damaged
+func (u *componentUpdater) readIntact(location int, offset int64, buf []byte) error {
+    err := u.r.infos[location].verifyRegion(u.r.components[location], offset, buf)
+    if err != nil {
+        return fmt.Errorf("%w: %s on %s has to be repaired before it is changed: %v",
+                          types.ErrCorrupt, u.r.filename,
+                          backendName(u.r.backends[location], location), err)
+    }
+    return nil
+}
+
+/*
+    Write data at offset in the component on the location, hash the blocks it
+    is in again, and write the trailer with the new hashes
+*/
+func (u *componentUpdater) rewrite(location int, offset int64, data []byte) error {
+    component := u.r.components[location]
+    info := u.r.infos[location]
+
+    _, err := component.WriteAt(data, offset)
+    if err != nil {
+        return err
+    }
+
+    firstBlock := offset / info.blockSize
+    lastBlock := (offset + int64(len(data)) - 1) / info.blockSize
+    for block := firstBlock; block <= lastBlock; block++ {
+        end := (block + 1) * info.blockSize
+        if end > info.dataSize {
+            end = info.dataSize
+        }
+
+        blockBuf := make([]byte, end - block * info.blockSize)
+        _, err = component.ReadAt(blockBuf, block * info.blockSize)
+        if err != nil {
+            return err
+        }
+        blockHash := newHash(info.algorithm)
+        blockHash.Write(blockBuf)
+        info.blockHashes[block] = blockHash.Sum(nil)
+    }
+
+    _, err = component.WriteAt(info.trailer(), info.dataSize)
+    if err != nil {
+        return err
+    }
+    return component.Sync()
+}
+
+// add data to the end of the component on the location, followed by the new trailer
+func (u *componentUpdater) grow(location int, data []byte) error {
+    component := u.r.components[location]
+    info := u.r.infos[location]
+
+    // the last block is hashed again if the data doesn't end on a whole block
+    partial := info.dataSize % info.blockSize
+    hasher := &componentHasher{blockSize: info.blockSize, algorithm: info.algorithm,
+                               current: newHash(info.algorithm),
+                               dataSize: info.dataSize - partial,
+                               blockHashes: info.blockHashes[:(info.dataSize - partial) /
+                                                             info.blockSize]}
+    if partial > 0 {
+        lastBlock := make([]byte, partial)
+        _, err := component.ReadAt(lastBlock, info.dataSize - partial)
+        if err != nil {
+            return err
+        }
+        hasher.Write(lastBlock)
+    }
+    hasher.Write(data)
+
+    _, err := component.WriteAt(append(data, hasher.trailer()...), info.dataSize)
+    if err != nil {
+        return err
+    }
+    info.dataSize = hasher.dataSize
+    info.blockHashes = hasher.blockHashes
+    return component.Sync()
+}
+
+// trailer for the data of the component with the hashes in info (see componentHasher.trailer)
+func (info *componentInfo) trailer() []byte {
+    hasher := &componentHasher{blockSize: info.blockSize, algorithm: info.algorithm,
+                               current: newHash(info.algorithm), dataSize: info.dataSize,
+                               blockHashes: info.blockHashes}
+    return hasher.trailer()
+}
@@ -0,0 +1,255 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: blake3.go
+* Date created: 10/16/26
+*
+* Description: BLAKE3 (hash mode, 32 byte output), written out here to keep
+* the project free of outside dependencies. Follows the reference
+* implementation - the input is cut into 1024 byte chunks, and the chaining
+* values of the chunks are merged into a binary tree as they are completed.
+*******************************************************************************/
+
+package hashes
+
+import (
+    "encoding/binary"
+    "math/bits"
+)
+
+const BLAKE3_SIZE = 32
+const BLAKE3_BLOCK_SIZE = 64
+const BLAKE3_CHUNK_SIZE = 1024
+
+// flags of the compression function
+const (
+    blake3ChunkStart uint32 = 1 << 0
+    blake3ChunkEnd uint32 = 1 << 1
+    blake3Parent uint32 = 1 << 2
+    blake3Root uint32 = 1 << 3
+)
+
+var blake3IV = [8]uint32{
+    0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A,
+    0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+var blake3MessagePermutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func blake3G(state *[16]uint32, a int, b int, c int, d int, mx uint32, my uint32) {
+    state[a] = state[a] + state[b] + mx
+    state[d] = bits.RotateLeft32(state[d] ^ state[a], -16)
+    state[c] = state[c] + state[d]
+    state[b] = bits.RotateLeft32(state[b] ^ state[c], -12)
+    state[a] = state[a] + state[b] + my
+    state[d] = bits.RotateLeft32(state[d] ^ state[a], -8)
+    state[c] = state[c] + state[d]
+    state[b] = bits.RotateLeft32(state[b] ^ state[c], -7)
+}
+
+func blake3Round(state *[16]uint32, m *[16]uint32) {
+    // columns
+    blake3G(state, 0, 4, 8, 12, m[0], m[1])
+    blake3G(state, 1, 5, 9, 13, m[2], m[3])
+    blake3G(state, 2, 6, 10, 14, m[4], m[5])
+    blake3G(state, 3, 7, 11, 15, m[6], m[7])
+    // diagonals
+    blake3G(state, 0, 5, 10, 15, m[8], m[9])
+    blake3G(state, 1, 6, 11, 12, m[10], m[11])
+    blake3G(state, 2, 7, 8, 13, m[12], m[13])
+    blake3G(state, 3, 4, 9, 14, m[14], m[15])
+}
+
+func blake3Compress(chainingValue [8]uint32, blockWords [16]uint32, counter uint64,
+                    blockLen uint32, flags uint32) [16]uint32 {
+    state := [16]uint32{
+        chainingValue[0], chainingValue[1], chainingValue[2], chainingValue[3],
+        chainingValue[4], chainingValue[5], chainingValue[6], chainingValue[7],
+        blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3],
+        uint32(counter), uint32(counter >> 32), blockLen, flags,
+    }
+
+    m := blockWords
+    for round := 0; round < 7; round++ {
+        blake3Round(&state, &m)
+        if round < 6 {
+            var permuted [16]uint32
+            for i := 0; i < 16; i++ {
+                permuted[i] = m[blake3MessagePermutation[i]]
+            }
+            m = permuted
+        }
+    }
+
+    for i := 0; i < 8; i++ {
+        state[i] ^= state[i + 8]
+        state[i + 8] ^= chainingValue[i]
+    }
+    return state
+}
+
+func blake3Words(block []byte) [16]uint32 {
+    var words [16]uint32
+    for i := 0; i < 16; i++ {
+        words[i] = binary.LittleEndian.Uint32(block[4 * i:])
+    }
+    return words
+}
+
+func blake3First8(words [16]uint32) [8]uint32 {
+    var first [8]uint32
+    copy(first[:], words[0:8])
+    return first
+}
+
+/*
+    Everything that is needed to compute either the chaining value of a node
+    (chunk or parent), or the output of the root
+*/
+type blake3Output struct {
+    inputChainingValue [8]uint32
+    blockWords [16]uint32
+    counter uint64
+    blockLen uint32
+    flags uint32
+}
+
+func (o *blake3Output) chainingValue() [8]uint32 {
+    return blake3First8(blake3Compress(o.inputChainingValue, o.blockWords, o.counter,
+                                       o.blockLen, o.flags))
+}
+
+func (o *blake3Output) rootBytes() []byte {
+    words := blake3Compress(o.inputChainingValue, o.blockWords, 0, o.blockLen, o.flags | blake3Root)
+    out := make([]byte, BLAKE3_SIZE)
+    for i := 0; i < BLAKE3_SIZE / 4; i++ {
+        binary.LittleEndian.PutUint32(out[4 * i:], words[i])
+    }
+    return out
+}
+
+func blake3ParentOutput(left [8]uint32, right [8]uint32) blake3Output {
+    var blockWords [16]uint32
+    copy(blockWords[0:8], left[:])
+    copy(blockWords[8:16], right[:])
+    return blake3Output{inputChainingValue: blake3IV, blockWords: blockWords,
+                        blockLen: BLAKE3_BLOCK_SIZE, flags: blake3Parent}
+}
+
+// the chunk that is being hashed
+type blake3ChunkState struct {
+    chainingValue [8]uint32
+    chunkCounter uint64
+    block [BLAKE3_BLOCK_SIZE]byte
+    blockLen int
+    blocksCompressed int
+}
+
+func newBlake3ChunkState(chunkCounter uint64) blake3ChunkState {
+    return blake3ChunkState{chainingValue: blake3IV, chunkCounter: chunkCounter}
+}
+
+func (c *blake3ChunkState) len() int {
+    return BLAKE3_BLOCK_SIZE * c.blocksCompressed + c.blockLen
+}
+
+func (c *blake3ChunkState) startFlag() uint32 {
+    if c.blocksCompressed == 0 {
+        return blake3ChunkStart
+    }
+    return 0
+}
+
+func (c *blake3ChunkState) update(input []byte) {
+    for len(input) > 0 {
+        // only compress a full block once there is more input, the last block
+        // of the chunk has to be compressed with the end flag
+        if c.blockLen == BLAKE3_BLOCK_SIZE {
+            c.chainingValue = blake3First8(blake3Compress(c.chainingValue, blake3Words(c.block[:]),
+                                                          c.chunkCounter, BLAKE3_BLOCK_SIZE,
+                                                          c.startFlag()))
+            c.blocksCompressed++
+            c.block = [BLAKE3_BLOCK_SIZE]byte{}
+            c.blockLen = 0
+        }
+
+        n := copy(c.block[c.blockLen:], input)
+        c.blockLen += n
+        input = input[n:]
+    }
+}
+
+func (c *blake3ChunkState) output() blake3Output {
+    return blake3Output{inputChainingValue: c.chainingValue, blockWords: blake3Words(c.block[:]),
+                        counter: c.chunkCounter, blockLen: uint32(c.blockLen),
+                        flags: c.startFlag() | blake3ChunkEnd}
+}
+
+/*
+    hash.Hash for BLAKE3, the chaining values of the completed subtrees are
+    kept on a stack (at most one per level of the tree)
+*/
+type blake3 struct {
+    chunk blake3ChunkState
+    stack [54][8]uint32
+    stackLen int
+}
+
+func newBlake3() *blake3 {
+    return &blake3{chunk: newBlake3ChunkState(0)}
+}
+
+func (h *blake3) addChunkChainingValue(chainingValue [8]uint32, totalChunks uint64) {
+    // merge with the completed subtrees of the same size, one per trailing 0 bit
+    for totalChunks & 1 == 0 {
+        h.stackLen--
+        parent := blake3ParentOutput(h.stack[h.stackLen], chainingValue)
+        chainingValue = parent.chainingValue()
+        totalChunks >>= 1
+    }
+    h.stack[h.stackLen] = chainingValue
+    h.stackLen++
+}
+
+func (h *blake3) Write(p []byte) (int, error) {
+    written := len(p)
+    for len(p) > 0 {
+        // only finish a full chunk once there is more input, the last chunk
+        // is part of the root
+        if h.chunk.len() == BLAKE3_CHUNK_SIZE {
+            output := h.chunk.output()
+            totalChunks := h.chunk.chunkCounter + 1
+            h.addChunkChainingValue(output.chainingValue(), totalChunks)
+            h.chunk = newBlake3ChunkState(totalChunks)
+        }
+
+        n := BLAKE3_CHUNK_SIZE - h.chunk.len()
+        if n > len(p) {
+            n = len(p)
+        }
+        h.chunk.update(p[0:n])
+        p = p[n:]
+    }
+
+    return written, nil
+}
+
+func (h *blake3) Sum(b []byte) []byte {
+    output := h.chunk.output()
+    for i := h.stackLen - 1; i >= 0; i-- {
+        output = blake3ParentOutput(h.stack[i], output.chainingValue())
+    }
+    return append(b, output.rootBytes()...)
+}
+
+func (h *blake3) Reset() {
+    h.chunk = newBlake3ChunkState(0)
+    h.stackLen = 0
+}
+
+func (h *blake3) Size() int {
+    return BLAKE3_SIZE
+}
+
+func (h *blake3) BlockSize() int {
+    return BLAKE3_BLOCK_SIZE
+}
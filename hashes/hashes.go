@@ -0,0 +1,65 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: hashes.go
+* Date created: 10/16/26
+*
+* Description: the hash algorithms that can be used to check user data and
+* the database (selected with types.Config.HashAlgorithm). The identifier of
+* the algorithm is stored next to every hash that is written, so data written
+* with any of them (including MD5, which was the only option before) can
+* always be read back.
+*******************************************************************************/
+
+package hashes
+
+import (
+    "crypto/md5"
+    "crypto/sha256"
+    "fmt"
+    "hash"
+    "foxyblox/types"
+)
+
+// largest hash any of the algorithms produce
+const MAX_HASH_SIZE = sha256.Size
+
+/*
+    New hash.Hash for the given algorithm (types.HASH_MD5, types.HASH_SHA256
+    or types.HASH_BLAKE3), error if the algorithm is not known
+*/
+func New(algorithm int) (hash.Hash, error) {
+    switch algorithm {
+    case types.HASH_MD5:
+        return md5.New(), nil
+    case types.HASH_SHA256:
+        return sha256.New(), nil
+    case types.HASH_BLAKE3:
+        return newBlake3(), nil
+    }
+
+    return nil, fmt.Errorf("unknown hash algorithm %d", algorithm)
+}
+
+// size of the hashes of the algorithm (in bytes), 0 if the algorithm is not known
+func Size(algorithm int) int {
+    switch algorithm {
+    case types.HASH_MD5:
+        return md5.Size
+    case types.HASH_SHA256:
+        return sha256.Size
+    case types.HASH_BLAKE3:
+        return BLAKE3_SIZE
+    }
+
+    return 0
+}
+
+// hash of data with the given algorithm
+func Sum(algorithm int, data []byte) ([]byte, error) {
+    h, err := New(algorithm)
+    if err != nil {
+        return nil, err
+    }
+    h.Write(data)
+    return h.Sum(nil), nil
+}
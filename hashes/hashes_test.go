@@ -0,0 +1,76 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: hashes_test.go
+* Date created: 10/16/26
+*
+* Description: checks the hash algorithms against known hashes
+*******************************************************************************/
+
+package hashes
+
+import (
+    "testing"
+    "encoding/hex"
+    "foxyblox/types"
+)
+
+// input of the official BLAKE3 test vectors, byte i = i % 251
+func testInput(length int) []byte {
+    input := make([]byte, length)
+    for i := 0; i < length; i++ {
+        input[i] = byte(i % 251)
+    }
+    return input
+}
+
+func TestKnownHashes(t *testing.T) {
+    cases := []struct {
+        algorithm int
+        input []byte
+        expected string
+    }{
+        {types.HASH_MD5, []byte("abc"), "900150983cd24fb0d6963f7d28e17f72"},
+        {types.HASH_SHA256, []byte("abc"), "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+        {types.HASH_BLAKE3, []byte{}, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+        {types.HASH_BLAKE3, []byte("abc"), "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+        // more than one chunk, and a tree of chunks
+        {types.HASH_BLAKE3, testInput(1025), "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+        {types.HASH_BLAKE3, testInput(8192), "aae792484c8efe4f19e2ca7d371d8c467ffb10748d8a5a1ae579948f718a2a63"},
+    }
+
+    for _, c := range cases {
+        sum, err := Sum(c.algorithm, c.input)
+        if err != nil {
+            t.Fatalf("Algorithm %d: %v", c.algorithm, err)
+        }
+        if hex.EncodeToString(sum) != c.expected {
+            t.Errorf("Algorithm %d of %d bytes = %x, expected %s", c.algorithm, len(c.input),
+                     sum, c.expected)
+        }
+        if len(sum) != Size(c.algorithm) {
+            t.Errorf("Algorithm %d gave %d bytes, size is %d", c.algorithm, len(sum), Size(c.algorithm))
+        }
+    }
+
+    // written in pieces that don't line up with the blocks or the chunks
+    h, err := New(types.HASH_BLAKE3)
+    if err != nil {
+        t.Fatalf("%v", err)
+    }
+    input := testInput(8192)
+    for len(input) > 0 {
+        n := 777
+        if n > len(input) {
+            n = len(input)
+        }
+        h.Write(input[0:n])
+        input = input[n:]
+    }
+    if hex.EncodeToString(h.Sum(nil)) != cases[len(cases) - 1].expected {
+        t.Errorf("BLAKE3 written in pieces did not match")
+    }
+
+    if _, err = New(255); err == nil {
+        t.Errorf("Unknown algorithm did not return an error")
+    }
+}
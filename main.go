@@ -9,7 +9,7 @@
 package main
 
 import (
-    //"fmt"
+    "fmt"
     //"foxyblox/server"
     "os"
     "foxyblox/bash"
@@ -21,5 +21,10 @@ func main() {
     //server.Run() // note: to use function in another package, need capital R
     // bash.Run()
     args := os.Args
-    bash.Run(args)
+    err := bash.Run(args)
+    if err != nil {
+        // a failed command exits with a non-zero status, for scripts and cron jobs
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        os.Exit(1)
+    }
 }
\ No newline at end of file
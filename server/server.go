@@ -10,6 +10,7 @@ package server
 
 import (
     "html/template" // part of Go standard library, keep HTML in separate file
+    "errors"
     "fmt"
     "net/http"
     "log"
@@ -17,7 +18,11 @@ import (
     "crypto/md5"
     "io"
     "strconv"
-    "os"
+    "io/ioutil"
+    "path/filepath"
+    "foxyblox/database"
+    "foxyblox/system"
+    "foxyblox/types"
 )
 
 func check(err error) {
@@ -42,25 +47,76 @@ func upload(w http.ResponseWriter, r *http.Request) {
     } else {
         fmt.Println("Got into the POST method")
 
-        // argument = max memory, parses the form and can get the components
-        r.ParseMultipartForm(32 << 20)
-
-        // get file "handle from" so that the file can be saved, has Filename + MIME header
-        file, handler, err := r.FormFile("uploadfile")
-        if err != nil {
-            fmt.Println(err)
-            return
-        }
-        defer file.Close()
-        fmt.Fprintf(w, "%v", handler.Header)
-        f, err := os.OpenFile("./server/uploaded/" + handler.Filename, os.O_WRONLY | os.O_CREATE, 0755)
+        /*
+            Go through the parts of the form as they come in, instead of
+            parsing the whole form (which spools the file to disk), so the
+            uploaded file is split and saved while it is still being received
+        */
+        reader, err := r.MultipartReader()
         if err != nil {
             fmt.Println(err)
             return
         }
-        defer f.Close()
 
-        io.Copy(f, file) // saves the file to the local file f
+        username := ""
+        policy := "" // the default layout in the configs
+        for {
+            part, err := reader.NextPart()
+            if err == io.EOF {
+                break
+            } else if err != nil {
+                fmt.Println(err)
+                return
+            }
+
+            switch part.FormName() {
+                case "username": // has to come before the file in the form
+                    value, err := ioutil.ReadAll(io.LimitReader(part, int64(types.MAX_FILE_NAME_SIZE)))
+                    if err != nil {
+                        fmt.Println(err)
+                        return
+                    }
+                    username = string(value)
+
+                    // a folder on every data and database disk, see database.CheckUsername
+                    err = database.CheckUsername(username)
+                    if err != nil {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                    }
+
+                case "policy": // optional, has to come before the file in the form too
+                    value, err := ioutil.ReadAll(io.LimitReader(part, int64(types.MAX_POLICY_SIZE)))
+                    if err != nil {
+                        fmt.Println(err)
+                        return
+                    }
+                    policy = string(value)
+
+                case "uploadfile":
+                    if username == "" {
+                        http.Error(w, "username has to be sent before the file", http.StatusBadRequest)
+                        return
+                    }
+
+                    // saved to the data disks in the configs (the ones the policy needs)
+                    filename := filepath.Base(part.FileName())
+                    err := system.AddStreamWithPolicy(r.Context(), part, -1, filename, username,
+                                                      nil, policy)
+                    if errors.Is(err, types.ErrInvalidName) || errors.Is(err, types.ErrNameTooLong) ||
+                       errors.Is(err, types.ErrInvalidLayout) {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                    } else if err != nil {
+                        fmt.Println(err)
+                        http.Error(w, err.Error(), http.StatusInternalServerError)
+                        return
+                    }
+                    fmt.Fprintf(w, "Saved %s\n", filename)
+            }
+
+            part.Close()
+        }
     }
 }
 
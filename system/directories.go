@@ -0,0 +1,163 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: directories.go
+* Date created: 10/16/26
+*
+* Description: folders of files. Files are kept under their relative paths
+* ("photos/2020/beach.jpg"), so a folder is every file whose path starts with
+* it: whole directory trees can be saved, listed and gotten back at once.
+*******************************************************************************/
+
+package system
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "foxyblox/database"
+    "foxyblox/fileutils"
+    "foxyblox/types"
+)
+
+/*
+    Save every file in the directory and the directories under it, each one
+    under its path from the directory, in a folder named after the directory
+    ("photos/2020/beach.jpg" for the directory "photos" or "/home/me/photos"),
+    with the policy (see AddFileWithPolicy). Files that are not regular files
+    (links, devices) are skipped. Returns the amount of files that were
+    saved, the files after the one that couldn't be saved are not.
+*/
+func AddDirectory(dir string, username string, diskLocations []string,
+                  policy string) (int, error) {
+    absDir, err := filepath.Abs(dir)
+    if err != nil {
+        return 0, err
+    }
+    folder := filepath.Base(absDir)
+
+    saved := 0
+    err = filepath.Walk(absDir, func(filePath string, info os.FileInfo, err error) error {
+        if err != nil || !info.Mode().IsRegular() {
+            return err
+        }
+
+        relative, err := filepath.Rel(absDir, filePath)
+        if err != nil {
+            return err
+        }
+        filename := path.Join(folder, filepath.ToSlash(relative))
+        err = addFile(filePath, filename, username, diskLocations, policy)
+        if err != nil {
+            return fmt.Errorf("can't add %s: %w", filename, err)
+        }
+        saved++
+        return nil
+    })
+
+    return saved, err
+}
+
+/*
+    The files in the folder and the folders under it (directory "" for every
+    file of the user), in order of their paths, without their past versions
+*/
+func ListDirectory(directory string, username string) ([]*types.TreeEntry, error) {
+    configs, err := GetConfigs()
+    if err != nil {
+        return nil, err
+    }
+
+    entries, err := database.ListFileEntries(username, configs)
+    if err != nil {
+        return nil, err
+    }
+
+    prefix := directoryPrefix(directory)
+    inDirectory := entries[:0]
+    for _, entry := range entries {
+        if strings.HasPrefix(entry.Filename, prefix) {
+            trimDisks(entry)
+            inDirectory = append(inDirectory, entry)
+        }
+    }
+    return inDirectory, nil
+}
+
+// what the paths of the files in the directory start with
+func directoryPrefix(directory string) string {
+    directory = strings.Trim(path.Clean(filepath.ToSlash(directory)), "/")
+    if directory == "." || directory == "" {
+        return ""
+    }
+    return directory + "/"
+}
+
+/*
+    Get every file in the folder (see ListDirectory) into outputDir, in the
+    same tree under the name of the folder (the files in "archive/photos" are
+    gotten into <outputDir>/photos), with their sizes, modes and times (see
+    stat.go). Returns the amount of files that were gotten, the files after
+    the one that couldn't be gotten are not, types.ErrNotFound if there are
+    no files in the folder.
+*/
+func GetDirectory(directory string, username string, outputDir string) (int, error) {
+    configs, err := GetConfigs()
+    if err != nil {
+        return 0, err
+    }
+
+    entries, err := ListDirectory(directory, username)
+    if err != nil {
+        return 0, err
+    }
+    if len(entries) == 0 {
+        return 0, fmt.Errorf("%w: no files in %s of user %s", types.ErrNotFound, directory,
+                             username)
+    }
+
+    // the paths are kept from the folder itself on
+    parent := path.Dir(strings.TrimSuffix(directoryPrefix(directory), "/"))
+    for gotten, entry := range entries {
+        relative := entry.Filename
+        if parent != "." {
+            relative = strings.TrimPrefix(relative, parent + "/")
+        }
+        outputPath := filepath.Join(outputDir, filepath.FromSlash(relative))
+
+        err = getInto(entry, outputPath, username, configs)
+        if err != nil {
+            return gotten, fmt.Errorf("can't get %s into %s: %w", entry.Filename, outputPath, err)
+        }
+    }
+
+    return len(entries), nil
+}
+
+// get the file of the entry into outputPath, along with its stat
+func getInto(entry *types.TreeEntry, outputPath string, username string,
+             configs *types.Config) error {
+    err := os.MkdirAll(filepath.Dir(outputPath), 0755)
+    if err != nil {
+        return err
+    }
+
+    // a copy that is there already may be read-only
+    os.Remove(outputPath)
+    outputFile, err := os.Create(outputPath)
+    if err != nil {
+        return err
+    }
+    _, err = fileutils.GetStreamWithReport(context.Background(), outputFile, entry.Filename,
+                                           username, entry.Disks, entry.Layout, configs)
+    outputFile.Close()
+    if err == nil {
+        err = restoreStat(outputPath, entry.Stat)
+    }
+    if err != nil {
+        os.Remove(outputPath)
+    }
+    return err
+}
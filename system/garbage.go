@@ -0,0 +1,131 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: garbage.go
+* Date created: 10/16/26
+*
+* Description: collects the components on the data disks that the database
+* doesn't refer to anymore (see fileutils.ListStoredComponents), i.e. the
+* ones left behind by a crash between removing a file from the database and
+* removing its components.
+*******************************************************************************/
+
+package system
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+    "foxyblox/fileutils"
+    "foxyblox/types"
+)
+
+/*
+    What a garbage collection found (and did, unless it was a dry run)
+*/
+type GarbageReport struct {
+    DryRun bool
+    Quarantined bool // the orphans were moved into the quarantine folders instead of removed
+    Orphans []string // components that nothing refers to, <location>/<name>
+    Restored []string // components that an interrupted save replaced, put back in place
+    ReclaimedBytes int64 // size of the orphans
+}
+
+/*
+    Go through every component on the data disks in the configs, and remove
+    the ones that the database doesn't refer to (or move them into the
+    quarantine folder of their location, when quarantine is set). Components
+    that were changed less than minAge ago are left alone, they may belong to
+    a save that is still going on. Components that were replaced by a save
+    that never finished are put back when nothing took their place. Nothing
+    is changed in a dry run, the report says what would be.
+*/
+func CollectGarbage(dryRun bool, quarantine bool, minAge time.Duration) (*GarbageReport, error) {
+    configs, err := GetConfigs()
+    if err != nil {
+        return nil, err
+    }
+
+    report := &GarbageReport{DryRun: dryRun, Quarantined: quarantine}
+    references := make(map[string][]*types.TreeEntry) // by <username>/<filename>, see fileReferences
+    for _, location := range configs.Datadisks {
+        components, err := fileutils.ListStoredComponents(location)
+        if err != nil {
+            return report, err
+        }
+
+        for _, component := range components {
+            if time.Since(component.ModTime) < minAge {
+                continue
+            }
+
+            key := component.Username + "/" + component.Filename
+            fileReferenced, found := references[key]
+            if !found {
+                fileReferenced, err = fileReferences(component.Filename, component.Username,
+                                                     configs)
+                if errors.Is(err, types.ErrInvalidName) || errors.Is(err, types.ErrNameTooLong) {
+                    fileReferenced, err = nil, nil
+                } else if err != nil {
+                    return report, fmt.Errorf("can't tell if %s is referenced: %w", key, err)
+                }
+                references[key] = fileReferenced
+            }
+            referenced := false
+            for _, entry := range fileReferenced {
+                referenced = referenced || component.BelongsTo(entry.Disks, entry.Layout)
+            }
+
+            name := fmt.Sprintf("%s/%s", location, component.Name)
+            switch {
+                case component.Suffix == "" && referenced:
+                    continue
+                case component.Suffix == fileutils.OLD_COMPONENT_SUFFIX && referenced &&
+                     !component.Replaced():
+                    report.Restored = append(report.Restored, name)
+                    if !dryRun {
+                        err = component.Restore()
+                    }
+                default:
+                    report.Orphans = append(report.Orphans, name)
+                    report.ReclaimedBytes += component.Size
+                    if dryRun {
+                        break
+                    }
+                    if quarantine {
+                        err = component.Quarantine()
+                    } else {
+                        err = component.Remove()
+                    }
+            }
+            if err != nil {
+                return report, err
+            }
+        }
+    }
+
+    return report, nil
+}
+
+// the report as text
+func (r *GarbageReport) Report() string {
+    var report strings.Builder
+    action := "removed"
+    if r.Quarantined {
+        action = "quarantined"
+    }
+    if r.DryRun {
+        fmt.Fprintf(&report, "Dry run, nothing was changed\n")
+        action = "would be " + action
+    }
+
+    fmt.Fprintf(&report, "%d orphaned components (%d bytes) %s\n", len(r.Orphans),
+                r.ReclaimedBytes, action)
+    for _, orphan := range r.Orphans {
+        fmt.Fprintf(&report, "orphan %s\n", orphan)
+    }
+    for _, restored := range r.Restored {
+        fmt.Fprintf(&report, "restored %s\n", restored)
+    }
+    return report.String()
+}
@@ -0,0 +1,225 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: scrub.go
+* Date created: 10/16/26
+*
+* Description: scrubs every file of every user and snapshot (see
+* fileutils.ScrubFile), and the past versions of the files, in order, saving
+* the progress after every file so that a scrub that was stopped (or that ran
+* out of time) continues where it left off.
+*******************************************************************************/
+
+package system
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "io/ioutil"
+    "strings"
+    "foxyblox/database"
+    "foxyblox/fileutils"
+    "foxyblox/types"
+    "encoding/json"
+)
+
+/*
+    What a scrub found, and how far it got (the last file it finished, files
+    are scrubbed in order of their users and then their names)
+*/
+type ScrubSummary struct {
+    Checked int // files that were checked
+    // files that had something wrong with them, and what was done (not in
+    // the saved progress, see appendScrubFinding)
+    Repaired []string `json:"-"`
+    Failed []string `json:"-"` // files that could not be checked or repaired, and why
+    LastUsername string // database of the last file, of a user or of a snapshot
+    LastFilename string
+}
+
+// start of the lines of the findings, and of the report
+const SCRUB_REPAIRED_PREFIX = "repaired "
+const SCRUB_FAILED_PREFIX = "failed "
+
+/*
+    Scrub all of the files, reading and writing at most bytesPerSecond (0 = no
+    limit). The progress (the counters and the last file) is saved to
+    statePath after every file, and what was found is added to the end of
+    <statePath>.found, so a scrub that finds a saved progress there continues
+    after the last file it finished. Once every file is scrubbed, both are
+    removed and the summary of the whole scrub is returned. When ctx is done
+    before that, the summary so far is returned with the error of ctx, the
+    next scrub resumes it.
+*/
+func Scrub(ctx context.Context, statePath string, bytesPerSecond int64) (*ScrubSummary, error) {
+    configs, err := GetConfigs()
+    if err != nil {
+        return nil, err
+    }
+
+    summary := &ScrubSummary{}
+    foundPath := statePath + ".found"
+    if !pathExists(statePath) {
+        os.Remove(foundPath) // left behind by a scrub that didn't save its progress
+    } else {
+        state, err := ioutil.ReadFile(statePath)
+        if err != nil {
+            return nil, err
+        }
+        err = json.Unmarshal(state, summary)
+        if err != nil {
+            return nil, fmt.Errorf("can't resume the scrub in %s: %v", statePath, err)
+        }
+    }
+    resumeUsername, resumeFilename := summary.LastUsername, summary.LastFilename
+
+    err = scrubFiles(ctx, summary, statePath, foundPath, resumeUsername, resumeFilename,
+                     bytesPerSecond, configs)
+    readErr := readScrubFindings(foundPath, summary)
+    if err != nil {
+        return summary, err
+    } else if readErr != nil {
+        return summary, readErr
+    }
+
+    os.Remove(statePath)
+    os.Remove(foundPath)
+    return summary, nil
+}
+
+// scrub the files after the one the scrub is resumed from, see Scrub
+func scrubFiles(ctx context.Context, summary *ScrubSummary, statePath string, foundPath string,
+                resumeUsername string, resumeFilename string, bytesPerSecond int64,
+                configs *types.Config) error {
+    databases, err := allDatabases(configs)
+    if err != nil {
+        return err
+    }
+
+    limiter := fileutils.NewRateLimiter(bytesPerSecond)
+    for _, name := range databases {
+        if name < resumeUsername {
+            continue
+        }
+
+        entries, err := database.ListFileEntriesWithVersions(name, configs)
+        if err != nil {
+            return err
+        }
+
+        for _, entry := range entries {
+            if name == resumeUsername && entry.Filename <= resumeFilename {
+                continue
+            }
+            if err = ctx.Err(); err != nil {
+                return err
+            }
+
+            trimDisks(entry)
+            report, err := fileutils.ScrubFile(entryFilename(entry), databaseOwner(name),
+                                               entry.Disks, entry.Layout, limiter, configs)
+            scrubbed := fmt.Sprintf("%s/%s", name, describeEntry(entry))
+            if err != nil {
+                err = appendScrubFinding(foundPath,
+                                         fmt.Sprintf("%s%s: %v", SCRUB_FAILED_PREFIX, scrubbed, err))
+            } else if found := describeScrubReport(report); found != "" {
+                err = appendScrubFinding(foundPath,
+                                         fmt.Sprintf("%s%s: %s", SCRUB_REPAIRED_PREFIX, scrubbed, found))
+            }
+            if err != nil {
+                return err
+            }
+            summary.Checked++
+            summary.LastUsername, summary.LastFilename = name, entry.Filename
+
+            err = saveScrubState(statePath, summary)
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    return nil
+}
+
+// save the progress of the scrub (without the findings), replacing the file at once
+func saveScrubState(statePath string, summary *ScrubSummary) error {
+    state, err := json.Marshal(summary)
+    if err != nil {
+        return err
+    }
+
+    err = ioutil.WriteFile(statePath + ".tmp", state, 0644)
+    if err != nil {
+        return err
+    }
+    return os.Rename(statePath + ".tmp", statePath)
+}
+
+/*
+    Add a line for a file that something was found on to the end of the
+    findings of the scrub, so the saved progress stays the same size however
+    much is found
+*/
+func appendScrubFinding(foundPath string, line string) error {
+    file, err := os.OpenFile(foundPath, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+
+    _, err = file.WriteString(line + "\n")
+    closeErr := file.Close()
+    if err == nil {
+        err = closeErr
+    }
+    return err
+}
+
+// the findings of the scrub so far (see appendScrubFinding) in the summary
+func readScrubFindings(foundPath string, summary *ScrubSummary) error {
+    if !pathExists(foundPath) {
+        return nil
+    }
+    found, err := ioutil.ReadFile(foundPath)
+    if err != nil {
+        return err
+    }
+
+    for _, line := range strings.Split(string(found), "\n") {
+        if strings.HasPrefix(line, SCRUB_REPAIRED_PREFIX) {
+            summary.Repaired = append(summary.Repaired, strings.TrimPrefix(line, SCRUB_REPAIRED_PREFIX))
+        } else if strings.HasPrefix(line, SCRUB_FAILED_PREFIX) {
+            summary.Failed = append(summary.Failed, strings.TrimPrefix(line, SCRUB_FAILED_PREFIX))
+        }
+    }
+    return nil
+}
+
+// what was found on the locations of a file, "" if nothing was
+func describeScrubReport(report *fileutils.ScrubReport) string {
+    var found []string
+    if len(report.Degraded) > 0 {
+        found = append(found, "missing on " + strings.Join(report.Degraded, ", "))
+    }
+    if len(report.Rebuilt) > 0 {
+        found = append(found, "repaired on " + strings.Join(report.Rebuilt, ", "))
+    }
+    if len(report.ParityRewritten) > 0 {
+        found = append(found, "parity rewritten on " + strings.Join(report.ParityRewritten, ", "))
+    }
+    return strings.Join(found, ", ")
+}
+
+// the summary as text, for the report of the scrub
+func (s *ScrubSummary) Report() string {
+    var report strings.Builder
+    fmt.Fprintf(&report, "Checked %d files, %d repaired, %d failed\n", s.Checked,
+                len(s.Repaired), len(s.Failed))
+    for _, line := range s.Repaired {
+        fmt.Fprintf(&report, "%s%s\n", SCRUB_REPAIRED_PREFIX, line)
+    }
+    for _, line := range s.Failed {
+        fmt.Fprintf(&report, "%s%s\n", SCRUB_FAILED_PREFIX, line)
+    }
+    return report.String()
+}
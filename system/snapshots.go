@@ -0,0 +1,238 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: snapshots.go
+* Date created: 10/16/26
+*
+* Description: named, read-only snapshots of all of the files of a user (see
+* database/snapshot.go). A snapshot shares the components of the files with
+* the user, the components are only removed once neither the user nor any
+* of their snapshots refers to them anymore (see fileReferences).
+*******************************************************************************/
+
+package system
+
+import (
+    "sort"
+    "foxyblox/database"
+    "foxyblox/fileutils"
+    "foxyblox/types"
+)
+
+/*
+    Freeze the files of the user (and their past versions) as they are now,
+    under the given name, types.ErrExists if the user has a snapshot with
+    that name already
+*/
+func CreateSnapshot(username string, snapshot string) error {
+    configs, err := GetConfigs()
+    if err != nil {
+        return err
+    }
+
+    return database.CreateSnapshot(username, snapshot, configs)
+}
+
+// names of the snapshots of the user, in order
+func ListSnapshots(username string) ([]string, error) {
+    configs, err := GetConfigs()
+    if err != nil {
+        return nil, err
+    }
+
+    return database.ListSnapshots(username, configs)
+}
+
+// the files in the snapshot, in order of their names, as they were when it was made
+func ListSnapshotFiles(username string, snapshot string) ([]*types.TreeEntry, error) {
+    configs, err := GetConfigs()
+    if err != nil {
+        return nil, err
+    }
+
+    entries, err := database.ListFileEntries(database.SnapshotDatabase(username, snapshot), configs)
+    if err != nil {
+        return nil, err
+    }
+    for _, entry := range entries {
+        trimDisks(entry)
+    }
+    return entries, nil
+}
+
+/*
+    Same as GetFile, for the file as it was in the snapshot, types.ErrNotFound
+    if it was not in it
+*/
+func GetSnapshotFile(username string, snapshot string, filename string) (string, error) {
+    configs, err := GetConfigs()
+    if err != nil {
+        return "", err
+    }
+
+    entry, err := database.GetFileEntry(filename, database.SnapshotDatabase(username, snapshot),
+                                        configs)
+    if err != nil {
+        return "", err
+    }
+    trimDisks(entry)
+
+    downloadedTo, err := fileutils.GetFileWithLayout(filename, username, entry.Disks,
+                                                     entry.Layout, configs)
+    if err != nil {
+        return "", err
+    }
+    return downloadedTo, restoreStat(downloadedTo, entry.Stat)
+}
+
+/*
+    Make the file the way it was in the snapshot the current version of the
+    file (a new version, the version it replaces is kept, see versions.go),
+    the file is added back if it was deleted since
+*/
+func RestoreSnapshotFile(username string, snapshot string, filename string) error {
+    configs, err := GetConfigs()
+    if err != nil {
+        return err
+    }
+
+    _, err = restoreFromSnapshot(username, database.SnapshotDatabase(username, snapshot),
+                                 filename, configs)
+    return err
+}
+
+/*
+    Restore every file in the snapshot (see RestoreSnapshotFile), the files
+    that are the same as in the snapshot are left alone, and so are the files
+    that were added since. Returns the amount of files that were restored.
+*/
+func RestoreSnapshot(username string, snapshot string) (int, error) {
+    configs, err := GetConfigs()
+    if err != nil {
+        return 0, err
+    }
+
+    snapshotDatabase := database.SnapshotDatabase(username, snapshot)
+    entries, err := database.ListFileEntries(snapshotDatabase, configs)
+    if err != nil {
+        return 0, err
+    }
+
+    restoredCount := 0
+    for _, entry := range entries {
+        // restored even if its past versions couldn't be pruned afterwards
+        restored, err := restoreFromSnapshot(username, snapshotDatabase, entry.Filename, configs)
+        if restored {
+            restoredCount++
+        }
+        if err != nil {
+            return restoredCount, err
+        }
+    }
+    return restoredCount, nil
+}
+
+// restore the file from the database of the snapshot, false if it is the same already
+func restoreFromSnapshot(username string, snapshotDatabase string, filename string,
+                         configs *types.Config) (bool, error) {
+    frozen, err := database.GetFileEntry(filename, snapshotDatabase, configs)
+    if err != nil {
+        return false, err
+    }
+    trimDisks(frozen)
+
+    current, err := currentEntry(filename, username, configs)
+    if err != nil {
+        return false, err
+    }
+    if current != nil && current.Layout.Generation == frozen.Layout.Generation {
+        return false, nil
+    }
+
+    // the database of the user has to fit the disks of the snapshot
+    err = database.ResizeDatabaseForUser(username, configs)
+    if err != nil {
+        return false, err
+    }
+    entry := &types.TreeEntry{Filename: filename, Disks: frozen.Disks, Layout: frozen.Layout,
+                              Policy: frozen.Policy, Stat: frozen.Stat}
+    err = addVersion(entry, current, username, configs)
+    if err != nil {
+        return false, err
+    }
+
+    return true, pruneVersions(filename, username, configs)
+}
+
+/*
+    Delete the snapshot, along with the components that only the snapshot
+    still referred to (files that were deleted or overwritten since)
+*/
+func DeleteSnapshot(username string, snapshot string) error {
+    configs, err := GetConfigs()
+    if err != nil {
+        return err
+    }
+
+    snapshotDatabase := database.SnapshotDatabase(username, snapshot)
+    entries, err := database.ListFileEntriesWithVersions(snapshotDatabase, configs)
+    if err != nil {
+        return err
+    }
+    err = database.DeleteSnapshot(username, snapshot, configs)
+    if err != nil {
+        return err
+    }
+
+    // if crash during this, the components that are left are removed by
+    // CollectGarbage, see garbage.go
+    for _, entry := range entries {
+        trimDisks(entry)
+        err = removeUnreferenced(entry, entryFilename(entry), username, configs)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// the database of the user, followed by the databases of their snapshots
+func userDatabases(username string, configs *types.Config) ([]string, error) {
+    snapshots, err := database.ListSnapshots(username, configs)
+    if err != nil {
+        return nil, err
+    }
+
+    databases := []string{username}
+    for _, snapshot := range snapshots {
+        databases = append(databases, database.SnapshotDatabase(username, snapshot))
+    }
+    return databases, nil
+}
+
+// the databases of every user and of their snapshots, in order of their names
+func allDatabases(configs *types.Config) ([]string, error) {
+    usernames, err := database.ListUsers(configs)
+    if err != nil {
+        return nil, err
+    }
+
+    var databases []string
+    for _, username := range usernames {
+        userDbs, err := userDatabases(username, configs)
+        if err != nil {
+            return nil, err
+        }
+        databases = append(databases, userDbs...)
+    }
+    sort.Strings(databases)
+
+    return databases, nil
+}
+
+// the user that the database (of the user, or of one of their snapshots) belongs to
+func databaseOwner(name string) string {
+    if username, _, isSnapshot := database.ParseSnapshotDatabase(name); isSnapshot {
+        return username
+    }
+    return name
+}
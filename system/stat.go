@@ -0,0 +1,113 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: stat.go
+* Date created: 10/16/26
+*
+* Description: the size, permission bits and times of the original files
+* (types.FileStat), kept in their entries and restored onto the files when
+* they are gotten. Files saved before these were kept (or kept in a database
+* of an older format) have no stat, and are gotten the way they were before.
+*******************************************************************************/
+
+package system
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "time"
+    "foxyblox/database"
+    "foxyblox/types"
+)
+
+// mode of files that were saved from a stream (nothing to take it from)
+const STREAM_FILE_MODE uint32 = 0644
+
+/*
+    Stat of the file at path, the time it was created is only known once it
+    is saved (see addVersion)
+*/
+func fileStat(path string) (*types.FileStat, error) {
+    info, err := os.Stat(path)
+    if err != nil {
+        return nil, err
+    }
+    return &types.FileStat{Size: info.Size(), Mode: uint32(info.Mode().Perm()),
+                           ModTime: info.ModTime().UnixNano()}, nil
+}
+
+// counts the bytes read through it, for streams of unknown size
+type countingReader struct {
+    r io.Reader
+    count int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+    n, err := c.r.Read(p)
+    c.count += int64(n)
+    return n, err
+}
+
+/*
+    Give the file that was gotten to path the size, permission bits and
+    modification time of the original file (nothing to do without a stat).
+    types.ErrCorrupt if the file doesn't have the size that was saved.
+*/
+func restoreStat(path string, stat *types.FileStat) error {
+    if stat == nil {
+        return nil
+    }
+
+    info, err := os.Stat(path)
+    if err != nil {
+        return err
+    }
+    if info.Size() != stat.Size {
+        return fmt.Errorf("%w: %s has %d bytes, %d were saved", types.ErrCorrupt, path,
+                          info.Size(), stat.Size)
+    }
+
+    err = os.Chmod(path, os.FileMode(stat.Mode))
+    if err != nil {
+        return err
+    }
+    modTime := time.Unix(0, stat.ModTime)
+    return os.Chtimes(path, modTime, modTime)
+}
+
+/*
+    Record the size of the file after it was changed in place (see update.go),
+    and that it was modified now. Entries without a stat are left alone.
+*/
+func touchEntry(entry *types.TreeEntry, size int64, username string,
+                configs *types.Config) error {
+    if entry.Stat == nil {
+        return nil
+    }
+
+    stat := *entry.Stat
+    stat.Size = size
+    stat.ModTime = time.Now().UnixNano()
+    entry.Stat = &stat
+    return database.AddFileEntryToDatabase(entry, username, configs)
+}
+
+/*
+    Entry of the current version of the file, with its stat (nil if it was
+    saved before stats were kept), types.ErrNotFound if the user has no such
+    file
+*/
+func StatFile(filename string, username string) (*types.TreeEntry, error) {
+    configs, err := GetConfigs()
+    if err != nil {
+        return nil, err
+    }
+
+    entry, err := database.GetFileEntry(filename, username, configs)
+    if err != nil {
+        return nil, err
+    }
+    trimDisks(entry)
+
+    return entry, nil
+}
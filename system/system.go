@@ -10,9 +10,13 @@
 package system
 
 import (
+    "context"
+    "errors"
     "fmt"
+    "io"
     "os"
-    "log"
+    "path/filepath"
+    "strings"
     // "math"
     // "os/exec"
     // "bytes"
@@ -21,16 +25,9 @@ import (
     "foxyblox/fileutils"
     "foxyblox/types"
     "encoding/json"
-    // "time"
+    "time"
 )
 
-// check error, exit if non-nil
-func check(err error) {
-    if err != nil {
-        log.Fatal("Exiting: ", err);
-    }
-}
-
 // return true if either file or directory exists with given path
 func pathExists(path string) (bool) {
     _, err := os.Stat(path)
@@ -49,12 +46,9 @@ func pathExists(path string) (bool) {
     TODO: another option here would be to just set environment variables instead
     of having to pass it through, not clear which is better
 */
-func GetConfigs() *types.Config {
+func GetConfigs() (*types.Config, error) {
     if !pathExists(types.CONFIG_FILE) {
         // add default values, and return config object
-        configFile, err := os.OpenFile(types.CONFIG_FILE, os.O_RDWR | os.O_CREATE, 0755)
-        check(err)
-
         dbDisks := make([]string, types.DBDISK_COUNT + types.DBDISK_PARITY_COUNT)
         for i := 0; i < len(dbDisks); i++ { // parity disk in this already
             dbDisks[i] = fmt.Sprintf(types.LOCALHOST_DBDISK, i)
@@ -68,72 +62,137 @@ func GetConfigs() *types.Config {
         configs := &types.Config{Sys: types.LOCALHOST, Dbdisks: dbDisks, 
                            Datadisks: diskLocations,
                            DataDiskCount: types.DBDISK_COUNT, 
-                           ParityDiskCount: types.DBDISK_PARITY_COUNT}
-        obj, err := json.Marshal(configs)
-        check(err)
-
-        jsonString := string(obj)
-        jsonBytes := []byte(jsonString)
-
-        _, err = configFile.WriteAt(jsonBytes, 0)
-        check(err)
-
-        configFile.Close()
+                           ParityDiskCount: types.DBDISK_PARITY_COUNT,
+                           Scheme: types.XOR_SCHEME}
+        err := SetConfigs(configs)
+        if err != nil {
+            return nil, err
+        }
     }
 
     configFile, err := os.OpenFile(types.CONFIG_FILE, os.O_RDWR, 0755)
-    check(err)
+    if err != nil {
+        return nil, err
+    }
+    defer configFile.Close()
 
-    fileStat, err := configFile.Stat(); check(err)
+    fileStat, err := configFile.Stat()
+    if err != nil {
+        return nil, err
+    }
     sizeOfFile := fileStat.Size()
 
     buf := make([]byte, sizeOfFile)
     _, err = configFile.ReadAt(buf, 0)
-    check(err)
+    if err != nil {
+        return nil, err
+    }
     // fmt.Printf()
 
     var configs types.Config
     err = json.Unmarshal(buf, &configs)
-    check(err)
-
-    configFile.Close()
+    if err != nil {
+        return nil, fmt.Errorf("%w: can't parse %s: %v", types.ErrInvalidConfig,
+                               types.CONFIG_FILE, err)
+    }
+    if len(configs.Dbdisks) < 2 {
+        return nil, fmt.Errorf("%w: %s needs at least one database disk and a parity disk",
+                               types.ErrInvalidConfig, types.CONFIG_FILE)
+    }
 
-    return &configs
+    return &configs, nil
 }
 
 /*
     Manually sets the configs for the configuration file, overwrites the
     configurations that exist now, if there are any
 */
-func SetConfigs(newConfigs *types.Config) {
+func SetConfigs(newConfigs *types.Config) error {
     // should re-create file and write into it if going to change the configs
     // add default values, and return config object
-    configFile, err := os.OpenFile(types.CONFIG_FILE, os.O_RDWR | os.O_CREATE, 0755)
-    check(err)
+    configFile, err := os.OpenFile(types.CONFIG_FILE, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0755)
+    if err != nil {
+        return err
+    }
+    defer configFile.Close()
 
     configs, err := json.Marshal(newConfigs)
-    check(err)
-
-    jsonString := string(configs)
-    jsonBytes := []byte(jsonString)
-
-    _, err = configFile.WriteAt(jsonBytes, 0)
-    check(err)
+    if err != nil {
+        return err
+    }
 
-    configFile.Close()
+    _, err = configFile.WriteAt(configs, 0)
+    return err
 }
 
+// drop the empty disk slots at the end of entry.Disks (not saved on max)
+func trimDisks(entry *types.TreeEntry) {
+    newLength := len(entry.Disks)
+    for i := len(entry.Disks) - 1; i > 0; i-- {
+        if entry.Disks[i] == "" {
+            newLength--
+        }
+    }
+    entry.Disks = entry.Disks[0:newLength]
+}
 
-// get better error checking for this: maybe pass back errors to this
-// ex: if file name size is too large, should not do anything on server side
-// just return an error - so maybe just treat those as special cases and return
-// error then, don't do log.Fatal for user malfeason
+/*
+    Save the file (at path filename, it is kept under its path, see fileKey) on
+    diskLocations, and add it to the database of the user. A filename that
+    can't be stored is rejected before anything is saved, and the saved
+    components are removed again if the file can't be added to the database.
+    Saving a file that the user has already keeps the version it replaces (see
+    versions.go).
+*/
 // disklocations = where to store file (including parity disk, doesn't matter
 // to user which disk is treated as the parity disk, preferrably pass in a
 // nice format to this function, and parse in another file)
-func AddFile(filename string, username string, diskLocations []string) {
+func AddFile(filename string, username string, diskLocations []string) error {
+    return AddFileWithPolicy(filename, username, diskLocations, "")
+}
+
+/*
+    Same as AddFile, the file is saved with the given redundancy policy
+    ("mirror:3", "xor:3+1", "rs:6+3", see types.ParsePolicy) instead of the
+    default layout in the configs ("" for the default). The policy is kept in
+    the entry of the file, and the file keeps it when it is re-encoded. With
+    no disk locations, the file is saved to the data disks in the configs
+    (the first ones that the policy needs).
+*/
+func AddFileWithPolicy(filename string, username string, diskLocations []string,
+                       policy string) error {
+    return addFile(filename, fileKey(filename), username, diskLocations, policy)
+}
+
+/*
+    The file at path is saved under its path, relative to the working
+    directory ("./photos/../photos/beach.jpg" is saved as "photos/beach.jpg"),
+    files outside of it ("/tmp/beach.jpg", "../beach.jpg") under their name
+*/
+func fileKey(path string) string {
+    key := filepath.ToSlash(filepath.Clean(path))
+    if filepath.IsAbs(path) || key == ".." || strings.HasPrefix(key, "../") {
+        return filepath.Base(path)
+    }
+    return key
+}
+
+// save the file at path under filename, see AddFileWithPolicy
+func addFile(path string, filename string, username string, diskLocations []string,
+             policy string) error {
     // read configs from a file
-    configs := GetConfigs() // TODO: can cache these while running
+    configs, err := GetConfigs() // TODO: can cache these while running
+    if err != nil {
+        return err
+    }
+
+    err = database.CheckFilename(filename)
+    if err == nil {
+        err = database.CheckUsername(username)
+    }
+    if err != nil {
+        return err
+    }
 
     // save file to system first
     // should pass in username here, and save into a directory titled <username>
@@ -142,66 +201,579 @@ func AddFile(filename string, username string, diskLocations []string) {
     // maybe better to add to database first, and then later groom the system
     // to make sure that the database doesn't have unecessary entries? either
     // is ok
-    fileutils.SaveFile(filename, username, diskLocations, configs)
+    // layout (scheme, data and parity component counts) comes from the configs,
+    // and is kept in the database so the file can be rebuilt the same way later
+    current, err := currentEntry(filename, username, configs)
+    if err != nil {
+        return err
+    }
+    layout, diskLocations, err := policyLayout(policy, diskLocations, configs)
+    if err != nil {
+        return err
+    }
+    stat, err := fileStat(path)
+    if err != nil {
+        return err
+    }
+    layout.Generation, err = nextGeneration(filename, username, configs)
+    if err != nil {
+        return err
+    }
+    staged, err := fileutils.SaveFileStagedAs(path, filename, username, diskLocations, layout,
+                                              configs)
+    if err != nil {
+        return err
+    }
 
-    // add file to database (diskLocations = location that the file was stored at)
-    database.AddFileSpecsToDatabase(filename, username, diskLocations, configs)
+    // add file to database (diskLocations = location that the file was stored at),
+    // only once all of the components are in place, the new components are
+    // removed again if the database can't be updated
+    entry := &types.TreeEntry{Filename: filename, Disks: diskLocations, Layout: layout,
+                              Stat: stat}
+    if policy != "" {
+        entry.Policy = layout.Policy()
+    }
+    err = addVersion(entry, current, username, configs)
+    if err != nil {
+        staged.Rollback()
+        return err
+    }
+    staged.Commit()
 
     // fmt.Printf("Added file %s to system, for user %s\n", filename, username)
+    return pruneVersions(filename, username, configs)
 }
 
-// returns the location at which the downloaded and assembled file is temporarily stored now
-func GetFile(filename string, username string) string {
+/*
+    Layout for a file saved with the policy ("" = default layout for the disk
+    locations), and the disk locations to save it to (if none are given, the
+    data disks in the configs, or the first ones that the policy needs)
+*/
+func policyLayout(policy string, diskLocations []string,
+                  configs *types.Config) (types.Layout, []string, error) {
+    if policy == "" {
+        if len(diskLocations) == 0 {
+            diskLocations = append([]string(nil), configs.Datadisks...)
+        }
+        return types.DefaultLayout(len(diskLocations), configs), diskLocations, nil
+    }
+
+    layout, err := types.ParsePolicy(policy, configs)
+    if err != nil {
+        return layout, nil, err
+    }
+    if len(diskLocations) == 0 {
+        locationCount := layout.DataCount + layout.ParityCount
+        if locationCount > len(configs.Datadisks) {
+            return layout, nil, fmt.Errorf("%w: policy %s needs %d locations, there are %d data disks",
+                                           types.ErrInvalidLayout, policy, locationCount,
+                                           len(configs.Datadisks))
+        }
+        diskLocations = append([]string(nil), configs.Datadisks[0:locationCount]...)
+    }
+    return layout, diskLocations, nil
+}
+
+/*
+    Same as AddFile, for a file that is read from r as it comes in (size < 0 if
+    it is not known up front), e.g. the body of an upload, so that it never has
+    to be spooled to disk on this server first. With no disk locations, the
+    file is saved to the data disks in the configs.
+*/
+func AddStream(ctx context.Context, r io.Reader, size int64, filename string,
+               username string, diskLocations []string) error {
+    return AddStreamWithPolicy(ctx, r, size, filename, username, diskLocations, "")
+}
+
+// same as AddStream, with a redundancy policy (see AddFileWithPolicy)
+func AddStreamWithPolicy(ctx context.Context, r io.Reader, size int64, filename string,
+                         username string, diskLocations []string, policy string) error {
+    configs, err := GetConfigs()
+    if err != nil {
+        return err
+    }
+
+    err = database.CheckFilename(filename)
+    if err == nil {
+        err = database.CheckUsername(username)
+    }
+    if err != nil {
+        return err
+    }
+
+    current, err := currentEntry(filename, username, configs)
+    if err != nil {
+        return err
+    }
+    layout, diskLocations, err := policyLayout(policy, diskLocations, configs)
+    if err != nil {
+        return err
+    }
+    layout.Generation, err = nextGeneration(filename, username, configs)
+    if err != nil {
+        return err
+    }
+    counter := &countingReader{r: r}
+    staged, err := fileutils.SaveStreamStagedWithLayout(ctx, counter, size, filename, username,
+                                                        diskLocations, layout, configs)
+    if err != nil {
+        return err
+    }
+
+    // a stream has no mode or times of its own, it was modified when it came in
+    stat := &types.FileStat{Size: counter.count, Mode: STREAM_FILE_MODE,
+                            ModTime: time.Now().UnixNano()}
+    entry := &types.TreeEntry{Filename: filename, Disks: diskLocations, Layout: staged.Layout,
+                              Stat: stat}
+    if policy != "" {
+        entry.Policy = layout.Policy()
+    }
+    err = addVersion(entry, current, username, configs)
+    if err != nil {
+        staged.Rollback()
+        return err
+    }
+    staged.Commit()
+
+    return pruneVersions(filename, username, configs)
+}
+
+/*
+    returns the location at which the downloaded and assembled file is
+    temporarily stored now, types.ErrNotFound if the user has no such file
+*/
+func GetFile(filename string, username string) (string, error) {
+    downloadedTo, _, err := GetFileWithReport(filename, username)
+    return downloadedTo, err
+}
+
+/*
+    Same as GetFile, and also reports the locations that were degraded
+    (missing or unreadable, the file was served from the other locations)
+*/
+func GetFileWithReport(filename string, username string) (string, *fileutils.ReadReport, error) {
     // read configs from file
-    configs := GetConfigs()
+    configs, err := GetConfigs()
+    if err != nil {
+        return "", nil, err
+    }
 
     // first fetch where it is stored in database
-    entry := database.GetFileEntry(filename, username, configs)
-    if entry == nil {
-        // fmt.Printf("Did not find the file %s\n", filename)
-        return ""
+    entry, err := database.GetFileEntry(filename, username, configs)
+    if err != nil {
+        return "", nil, err
     }
+    trimDisks(entry)
 
-    // trim entry.Disks if not saved on max
-    newLength := len(entry.Disks)
-    for i := len(entry.Disks) - 1; i > 0; i-- {
-        if entry.Disks[i] == "" {
-            newLength--
+    // get the actual file from those locations
+    downloadedTo, report, err := fileutils.GetFileWithReport(filename, username, entry.Disks,
+                                                             entry.Layout, configs)
+    if err != nil {
+        return "", nil, err
+    }
+    return downloadedTo, report, restoreStat(downloadedTo, entry.Stat)
+}
+
+/*
+    Same as GetFile, but the file is written to w (a response, stdout, a file
+    of the caller's choosing) instead of to downloaded-<filename> in the
+    working directory
+*/
+func GetStream(ctx context.Context, w io.Writer, filename string, username string) error {
+    _, err := GetStreamWithReport(ctx, w, filename, username)
+    return err
+}
+
+// same as GetStream, and also reports the locations that were degraded
+func GetStreamWithReport(ctx context.Context, w io.Writer, filename string,
+                         username string) (*fileutils.ReadReport, error) {
+    configs, err := GetConfigs()
+    if err != nil {
+        return nil, err
+    }
+
+    entry, err := database.GetFileEntry(filename, username, configs)
+    if err != nil {
+        return nil, err
+    }
+
+    return fileutils.GetStreamWithReport(ctx, w, filename, username, entry.Disks,
+                                         entry.Layout, configs)
+}
+
+/*
+    Rebuild everything that was saved on oldLocation (a disk that died) onto
+    newLocation: the components of the files of every user that reference
+    oldLocation are rebuilt from their other components, then their database
+    entries point to newLocation instead, and newLocation replaces oldLocation
+    in the configs (only once every file was rebuilt). Files that are already
+    moved are skipped, so an interrupted rebuild is resumed by running it
+    again. Returns the amount of files (and past versions of files) that were
+    rebuilt, the files that can't be rebuilt are skipped (and the error says
+    how many there were).
+*/
+func RebuildLocation(oldLocation string, newLocation string) (int, error) {
+    configs, err := GetConfigs()
+    if err != nil {
+        return 0, err
+    }
+
+    databases, err := allDatabases(configs)
+    if err != nil {
+        return 0, err
+    }
+
+    rebuiltCount := 0
+    failedCount := 0
+    var firstErr error
+    for _, name := range databases {
+        entries, err := database.ListFileEntriesWithVersions(name, configs)
+        if err != nil {
+            return rebuiltCount, err
+        }
+
+        for _, entry := range entries {
+            trimDisks(entry)
+            err = rebuildEntry(entry, databaseOwner(name), name, oldLocation, newLocation, configs)
+            if err == errNothingToRebuild {
+                continue
+            } else if err != nil {
+                if firstErr == nil {
+                    firstErr = fmt.Errorf("can't rebuild %s of %s: %w",
+                                          describeEntry(entry), name, err)
+                }
+                failedCount++
+                continue
+            }
+            rebuiltCount++
         }
     }
-    entry.Disks = entry.Disks[0:newLength]
 
-    // get the actual file from those locations
-    downloadedTo := fileutils.GetFile(filename, username, entry.Disks, configs)
+    // the configs keep the old location until every file is moved off of it
+    if failedCount > 0 {
+        return rebuiltCount, fmt.Errorf("%d files could not be rebuilt, first one: %w",
+                                        failedCount, firstErr)
+    }
 
-    return downloadedTo
+    // new files go to the new location from now on
+    for i := 0; i < len(configs.Datadisks); i++ {
+        if configs.Datadisks[i] == oldLocation {
+            configs.Datadisks[i] = newLocation
+        }
+    }
+    return rebuiltCount, SetConfigs(configs)
 }
 
-func DeleteFile(filename string, username string) *types.TreeEntry {
-    // read configs from file
-    configs := GetConfigs()   
+// the entry has no components on the location that is rebuilt
+var errNothingToRebuild = errors.New("nothing to rebuild")
+
+/*
+    Rebuild the components of the entry (the current or a past version of a
+    file) that are on oldLocation onto newLocation, and then update the entry
+    in the database it is from (only once all of them are there)
+*/
+func rebuildEntry(entry *types.TreeEntry, username string, dbName string, oldLocation string,
+                  newLocation string, configs *types.Config) error {
+    found := false
+    for location := 0; location < len(entry.Disks); location++ {
+        if entry.Disks[location] != oldLocation {
+            continue
+        }
+        found = true
+
+        err := fileutils.RebuildComponent(entryFilename(entry), username, entry.Disks,
+                                          entry.Layout, location, newLocation, configs)
+        if err != nil {
+            return err
+        }
+        entry.Disks[location] = newLocation
+    }
+    if !found {
+        return errNothingToRebuild
+    }
+
+    return database.AddFileEntryToDatabase(entry, dbName, configs)
+}
+
+// the file that the entry is a version of (past versions are named after their keys)
+func entryFilename(entry *types.TreeEntry) string {
+    if filename, _, isVersion := database.ParseVersionKey(entry.Filename); isVersion {
+        return filename
+    }
+    return entry.Filename
+}
 
-    // delete from database first
-    entry := database.DeleteFileEntry(filename, username, configs)
-    if entry == nil {
+// the file of the entry, and its version for a past version, for messages
+func describeEntry(entry *types.TreeEntry) string {
+    if filename, version, isVersion := database.ParseVersionKey(entry.Filename); isVersion {
+        return fmt.Sprintf("%s (version %d)", filename, version)
+    }
+    return entry.Filename
+}
+
+/*
+    Re-encode the file across the data disks in the configs, with the layout in
+    the configs (i.e. after data disks were added or removed), or with its own
+    policy across the first data disks it needs. The new components are saved
+    first, then the database entry is switched over to them, and only then are
+    the old components removed, so the file can be read the whole time.
+*/
+func RestripeFile(filename string, username string) error {
+    configs, err := GetConfigs()
+    if err != nil {
+        return err
+    }
+
+    entry, err := database.GetFileEntry(filename, username, configs)
+    if err != nil {
+        return err
+    }
+    trimDisks(entry)
+
+    err = restripeEntry(entry, username, username, configs)
+    if err == errNothingToRestripe {
         return nil
     }
+    return err
+}
 
-    // trim entry.Disks if not saved on max
-    newLength := len(entry.Disks)
-    for i := len(entry.Disks) - 1; i > 0; i-- {
-        if entry.Disks[i] == "" {
-            newLength--
+/*
+    Re-encode every file (and past version of a file) of every user that is
+    not spread across the data disks in the configs (see RestripeFile). The
+    snapshots are not re-encoded themselves, their entries that share the
+    components of a file are pointed to its new components (files that only
+    snapshots still have stay where they are).
+    Returns the amount of files that were re-encoded, the files that can't be
+    are skipped (and the error says how many there were), running it again
+    picks up where it stopped.
+*/
+func Rebalance() (int, error) {
+    configs, err := GetConfigs()
+    if err != nil {
+        return 0, err
+    }
+
+    usernames, err := database.ListUsers(configs)
+    if err != nil {
+        return 0, err
+    }
+
+    restripedCount := 0
+    failedCount := 0
+    var firstErr error
+    for _, name := range usernames {
+        entries, err := database.ListFileEntriesWithVersions(name, configs)
+        if err != nil {
+            return restripedCount, err
+        }
+
+        for _, entry := range entries {
+            trimDisks(entry)
+            err = restripeEntry(entry, name, name, configs)
+            if err == errNothingToRestripe {
+                continue
+            } else if err != nil {
+                if firstErr == nil {
+                    firstErr = fmt.Errorf("can't re-encode %s of %s: %w",
+                                          describeEntry(entry), name, err)
+                }
+                failedCount++
+                continue
+            }
+            restripedCount++
         }
     }
-    entry.Disks = entry.Disks[0:newLength]
 
-    // now actually remove the saved file (if crash during this, can just
-    // occasionally skim the database and remove files that don't exist
-    // in the database from the system)
-    fileutils.RemoveFile(filename, username, entry.Disks, configs)
+    if failedCount > 0 {
+        return restripedCount, fmt.Errorf("%d files could not be re-encoded, first one: %w",
+                                          failedCount, firstErr)
+    }
+    return restripedCount, nil
+}
+
+// the entry is already spread across the data disks in the configs
+var errNothingToRestripe = errors.New("nothing to re-encode")
+
+/*
+    Save the file of the entry (the current or a past version of a file)
+    again across the data disks in the configs, switch the entry (in the
+    database it is from) and the entries of the snapshots that share its
+    components over to the new components, and remove the old ones unless
+    another version shares them
+*/
+func restripeEntry(entry *types.TreeEntry, username string, dbName string,
+                   configs *types.Config) error {
+    // files saved with a policy of their own keep it, on the first data disks it needs
+    newLayout, newLocations, err := policyLayout(entry.Policy, nil, configs)
+    if err != nil {
+        return err
+    }
+
+    if entry.Layout.Striping == types.STRIPING_ROTATING &&
+       newLayout.Striping == types.STRIPING_NONE && newLayout.Scheme != types.MIRROR_SCHEME {
+        // streams are always saved in stripes, keep them that way
+        newLayout.Striping = types.STRIPING_ROTATING
+        newLayout.StripeSize = entry.Layout.StripeSize
+    }
+    newLayout.Generation = entry.Layout.Generation
+
+    if newLayout == entry.Layout && sameLocations(entry.Disks, newLocations) {
+        return errNothingToRestripe
+    }
+    filename := entryFilename(entry)
+    generation, err := nextGeneration(filename, username, configs)
+    if err != nil {
+        return err
+    }
+    newLayout.Generation = generation
+
+    err = fileutils.RestripeFile(filename, username, entry.Disks, entry.Layout,
+                                 newLocations, newLayout, configs)
+    if err != nil {
+        return err
+    }
+
+    // the entry has to fit the new disks before it can point to them
+    newEntry := *entry
+    newEntry.Disks = newLocations
+    newEntry.Layout = newLayout
+    err = database.ResizeDatabaseForUser(dbName, configs)
+    if err == nil {
+        err = database.AddFileEntryToDatabase(&newEntry, dbName, configs)
+    }
+    if err != nil {
+        fileutils.RemoveFileWithLayout(filename, username, newLocations, newLayout, configs)
+        return err
+    }
+
+    // the old components are kept as long as a snapshot still points to them
+    err = repointSnapshots(entry, &newEntry, username, configs)
+    if err != nil {
+        return err
+    }
+
+    return removeUnreferenced(entry, filename, username, configs)
+}
+
+/*
+    Point the entries in the snapshots of the user that share the components
+    of entry to the components of newEntry (the same file, re-encoded), so
+    the snapshots stay as they were and keep sharing the components
+*/
+func repointSnapshots(entry *types.TreeEntry, newEntry *types.TreeEntry, username string,
+                      configs *types.Config) error {
+    databases, err := userDatabases(username, configs)
+    if err != nil {
+        return err
+    }
+
+    filename := entryFilename(entry)
+    for _, name := range databases[1:] {
+        current, err := currentEntry(filename, name, configs)
+        if err != nil {
+            return err
+        } else if current == nil {
+            continue
+        }
+        versions, err := database.ListFileVersions(filename, name, configs)
+        if err != nil {
+            return err
+        }
+
+        for _, shared := range append(versions, current) {
+            if shared.Layout.Generation != entry.Layout.Generation {
+                continue
+            }
+            repointed := *shared
+            repointed.Disks = newEntry.Disks
+            repointed.Layout = newEntry.Layout
+            err = database.ResizeDatabaseForUser(name, configs)
+            if err == nil {
+                err = database.AddFileEntryToDatabase(&repointed, name, configs)
+            }
+            if err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// true if both lists have the same locations, in the same order
+func sameLocations(a []string, b []string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := 0; i < len(a); i++ {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+// read length bytes of the file starting at offset, see fileutils.GetFileRange
+func GetFileRange(filename string, username string, offset int64, length int64) ([]byte, error) {
+    configs, err := GetConfigs()
+    if err != nil {
+        return nil, err
+    }
+
+    entry, err := database.GetFileEntry(filename, username, configs)
+    if err != nil {
+        return nil, err
+    }
+
+    return fileutils.GetFileRange(filename, username, entry.Disks, entry.Layout, configs,
+                                  offset, length)
+}
+
+/*
+    Delete the file, along with all of its past versions, returns the entry
+    of the file that was deleted, types.ErrNotFound if there is none
+*/
+func DeleteFile(filename string, username string) (*types.TreeEntry, error) {
+    // read configs from file
+    configs, err := GetConfigs()
+    if err != nil {
+        return nil, err
+    }
+
+    // delete from database first (the past versions before the current one,
+    // they are found from it)
+    versions, err := database.ListFileVersions(filename, username, configs)
+    if err != nil {
+        return nil, err
+    }
+    for _, version := range versions {
+        _, err = database.DeleteFileEntry(version.Filename, username, configs)
+        if err != nil {
+            return nil, err
+        }
+    }
+    entry, err := database.DeleteFileEntry(filename, username, configs)
+    if err != nil {
+        return nil, err
+    }
+
+    // now actually remove the saved file, unless a snapshot still refers to it
+    // (if crash during this, the components that are left are removed by
+    // CollectGarbage, see garbage.go)
+    removed := make(map[int]bool) // generations, versions can share components
+    for _, deleted := range append(versions, entry) {
+        if removed[deleted.Layout.Generation] {
+            continue
+        }
+        removed[deleted.Layout.Generation] = true
+
+        trimDisks(deleted)
+        err = removeUnreferenced(deleted, filename, username, configs)
+        if err != nil {
+            return entry, err
+        }
+    }
 
-    return entry
+    return entry, nil
 }
 
 func InitLocal() {
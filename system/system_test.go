@@ -10,13 +10,21 @@ package system
 
 import (
     "testing"
+    "context"
+    "io/ioutil"
     "math/rand"
     "math"
     "os"
     "fmt"
     "bytes"
+    "errors"
+    "strings"
     "os/exec"
+    "path/filepath"
     "time"
+    "log"
+    "foxyblox/database"
+    "foxyblox/fileutils"
     "foxyblox/types"
 )
 
@@ -40,6 +48,13 @@ var diskLocations []string
 // var letterRunes = []rune("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ!@#$^&()_+[]{}")
 var letterRunes = []rune("VWXYZ[]^_abcdefghijklmnop") // all on drive 1
 
+// the packages return their errors, tests still stop at the unexpected ones
+func check(err error) {
+    if err != nil {
+        log.Fatal("Exiting: ", err)
+    }
+}
+
 func TestMain(m *testing.M) {
     fmt.Println("Setting up for tests")
 
@@ -155,7 +170,7 @@ func TestBasicCorrectness(t *testing.T) {
     // create sample file with random binary data
     testingFile, err := os.Create(testingFilename) // overwrite existing file if there
     if err != nil {
-        t.Errorf("Could not create %d\n", testingFilename)
+        t.Errorf("Could not create %s\n", testingFilename)
     }
 
     fileData := make([]byte, SMALL_FILE_SIZE)
@@ -165,9 +180,10 @@ func TestBasicCorrectness(t *testing.T) {
     check(err)
     testingFile.Close()
 
-    AddFile(testingFilename, username, configs.Datadisks)
+    check(AddFile(testingFilename, username, configs.Datadisks))
 
-    downloadedTo := GetFile(testingFilename, username)
+    downloadedTo, err := GetFile(testingFilename, username)
+    check(err)
 
     // test differences
     cmd := exec.Command("diff", testingFilename, downloadedTo)
@@ -189,7 +205,7 @@ func TestBasicCorrectness(t *testing.T) {
     }
 
     // delete the file, and make sure all parts are deleted
-    entry := DeleteFile(testingFilename, username)
+    entry, _ := DeleteFile(testingFilename, username)
     for i := 0; i < len(entry.Disks); i++ {
         if entry.Disks[i] != configs.Datadisks[i] {
             t.Errorf("Error, tree entry did not have correct disk locations")
@@ -199,6 +215,1175 @@ func TestBasicCorrectness(t *testing.T) {
     removeDatabaseStructureLocal()
 }
 
+func TestAddingStream(t *testing.T) {
+    initializeDatabaseStructureLocal()
+
+    testingFilename := "testingStream.txt"
+    username := "atoron"
+
+    fileData := make([]byte, REGULAR_FILE_SIZE + 17)
+    rand.Read(fileData)
+
+    err := AddStream(context.Background(), bytes.NewReader(fileData), -1, testingFilename,
+                     username, configs.Datadisks)
+    if err != nil {
+        t.Errorf("Could not add stream: %v", err)
+    }
+
+    downloadedTo, err := GetFile(testingFilename, username)
+    check(err)
+    downloaded, err := ioutil.ReadFile(downloadedTo)
+    check(err)
+    if !bytes.Equal(fileData, downloaded) {
+        t.Errorf("Streamed file %s was not saved correctly", testingFilename)
+    }
+
+    // also straight into a buffer, without going through the working directory
+    var output bytes.Buffer
+    err = GetStream(context.Background(), &output, testingFilename, username)
+    if err != nil || !bytes.Equal(fileData, output.Bytes()) {
+        t.Errorf("Streamed file %s did not match", testingFilename)
+    }
+
+    part, err := GetFileRange(testingFilename, username, 10, 100)
+    if err != nil || !bytes.Equal(fileData[10:110], part) {
+        t.Errorf("Range of %s did not match", testingFilename)
+    }
+
+    DeleteFile(testingFilename, username)
+    os.Remove(downloadedTo)
+
+    if GetStream(context.Background(), &output, testingFilename, username) == nil {
+        t.Errorf("Streaming a deleted file did not fail")
+    }
+
+    // without locations, the stream goes to the data disks in the configs
+    check(AddStream(context.Background(), bytes.NewReader(fileData), -1, testingFilename,
+                    username, nil))
+    entry, err := database.GetFileEntry(testingFilename, username, configs)
+    check(err)
+    trimDisks(entry)
+    if !sameLocations(entry.Disks, configs.Datadisks) {
+        t.Errorf("Stream without locations was saved to %v", entry.Disks)
+    }
+    output.Reset()
+    err = GetStream(context.Background(), &output, testingFilename, username)
+    if err != nil || !bytes.Equal(fileData, output.Bytes()) {
+        t.Errorf("Stream without locations did not match")
+    }
+    DeleteFile(testingFilename, username)
+
+    removeDatabaseStructureLocal()
+}
+
+func TestAddingInvalidNames(t *testing.T) {
+    initializeDatabaseStructureLocal()
+
+    username := "atoron"
+    longName := strings.Repeat("a", int(types.MAX_FILE_NAME_SIZE) + 1)
+
+    err := AddFile(longName, username, configs.Datadisks)
+    if !errors.Is(err, types.ErrNameTooLong) {
+        t.Errorf("Adding a name that is too long gave %v", err)
+    }
+    err = AddStream(context.Background(), bytes.NewReader([]byte("data")), -1, "",
+                    username, configs.Datadisks)
+    if !errors.Is(err, types.ErrInvalidName) {
+        t.Errorf("Adding an empty name gave %v", err)
+    }
+
+    // usernames are folders on every disk, they can't lead out of them
+    for _, badUsername := range []string{"", ".", "..", "../../x", "a\\b"} {
+        err = AddStream(context.Background(), bytes.NewReader([]byte("data")), -1,
+                        "testingBadUser.txt", badUsername, nil)
+        if !errors.Is(err, types.ErrInvalidName) {
+            t.Errorf("Adding a stream for user %q gave %v", badUsername, err)
+        }
+    }
+    if pathExists("x") || pathExists("../x") {
+        t.Errorf("A stream of an invalid user was saved outside of the disks")
+    }
+
+    _, err = GetFile("missingFile.txt", username)
+    if !errors.Is(err, types.ErrNotFound) {
+        t.Errorf("Getting a missing file gave %v", err)
+    }
+
+    removeDatabaseStructureLocal()
+}
+
+func TestRebuildingALocation(t *testing.T) {
+    initializeDatabaseStructureLocal()
+
+    filenames := []string{"testingRebuild1.txt", "testingRebuild2.txt", "testingRebuild3.txt"}
+    usernames := []string{"atoron", "atoron", "atoron2"}
+    originals := make([][]byte, len(filenames))
+    for i := 0; i < len(filenames); i++ {
+        createRandomFile(filenames[i], int64(REGULAR_FILE_SIZE * (i + 1)))
+        original, err := ioutil.ReadFile(filenames[i])
+        check(err)
+        originals[i] = original
+        check(AddFile(filenames[i], usernames[i], configs.Datadisks))
+    }
+
+    // the disk dies, and a new one takes its place
+    oldLocation := configs.Datadisks[1]
+    newLocation := "./storage/drive-replacement"
+    check(os.RemoveAll(oldLocation))
+    check(os.Mkdir(newLocation, types.REGULAR_FILE_MODE))
+
+    // a rebuild that was interrupted after the component of the first file
+    entry, err := database.GetFileEntry(filenames[0], usernames[0], configs)
+    check(err)
+    check(fileutils.RebuildComponent(filenames[0], usernames[0], configs.Datadisks, entry.Layout,
+                                     1, newLocation, configs))
+
+    rebuiltCount, err := RebuildLocation(oldLocation, newLocation)
+    if err != nil || rebuiltCount != len(filenames) {
+        t.Errorf("Rebuilt %d of %d files: %v", rebuiltCount, len(filenames), err)
+    }
+
+    for i := 0; i < len(filenames); i++ {
+        downloadedTo, report, err := GetFileWithReport(filenames[i], usernames[i])
+        check(err)
+        downloaded, err := ioutil.ReadFile(downloadedTo)
+        check(err)
+        if !bytes.Equal(originals[i], downloaded) {
+            t.Errorf("%s did not match after the rebuild", filenames[i])
+        }
+        if len(report.Degraded) != 0 || len(report.Rebuilt) != 0 {
+            t.Errorf("%s was still degraded after the rebuild: %+v", filenames[i], report)
+        }
+
+        entry, err := database.GetFileEntry(filenames[i], usernames[i], configs)
+        check(err)
+        if entry.Disks[1] != newLocation {
+            t.Errorf("Entry of %s still points to %s", filenames[i], entry.Disks[1])
+        }
+        os.Remove(downloadedTo)
+    }
+
+    newConfigs, err := GetConfigs()
+    check(err)
+    if newConfigs.Datadisks[1] != newLocation {
+        t.Errorf("Configs still have %s", newConfigs.Datadisks[1])
+    }
+
+    // nothing is left to do the second time
+    rebuiltCount, err = RebuildLocation(oldLocation, newLocation)
+    if err != nil || rebuiltCount != 0 {
+        t.Errorf("Rebuilt %d files again: %v", rebuiltCount, err)
+    }
+
+    for i := 0; i < len(filenames); i++ {
+        os.Remove(filenames[i])
+    }
+    os.Remove(types.CONFIG_FILE) // back to the default configs
+    removeDatabaseStructureLocal()
+}
+
+func TestFailedRebuildKeepsConfigs(t *testing.T) {
+    initializeDatabaseStructureLocal()
+
+    username := "atoron"
+    filenames := []string{"testingFailedRebuild1.txt", "testingFailedRebuild2.txt"}
+    for _, filename := range filenames {
+        createRandomFile(filename, int64(REGULAR_FILE_SIZE))
+        check(AddFile(filename, username, configs.Datadisks))
+        os.Remove(filename)
+    }
+
+    // the second file loses another component, it can't be rebuilt
+    oldLocation := configs.Datadisks[1]
+    newLocation := "./storage/drive-replacement"
+    check(os.RemoveAll(oldLocation))
+    check(os.Mkdir(newLocation, types.REGULAR_FILE_MODE))
+    check(os.Remove(fmt.Sprintf("%s/%s/%s_0", configs.Datadisks[0], username, filenames[1])))
+
+    rebuiltCount, err := RebuildLocation(oldLocation, newLocation)
+    if err == nil || rebuiltCount != 1 {
+        t.Errorf("Rebuilt %d files with one that can't be: %v", rebuiltCount, err)
+    }
+
+    // new files don't go to the new location until everything is moved
+    newConfigs, err := GetConfigs()
+    check(err)
+    if newConfigs.Datadisks[1] != oldLocation {
+        t.Errorf("Configs were switched to %s after a failed rebuild", newConfigs.Datadisks[1])
+    }
+
+    os.Remove(types.CONFIG_FILE) // back to the default configs
+    removeDatabaseStructureLocal()
+}
+
+func TestRebalancing(t *testing.T) {
+    initializeDatabaseStructureLocal()
+
+    filenames := []string{"testingRebalance1.txt", "testingRebalance2.txt", "testingRebalance3.txt"}
+    usernames := []string{"atoron", "atoron", "atoron2"}
+    originals := make([][]byte, len(filenames))
+    for i := 0; i < len(filenames); i++ {
+        createRandomFile(filenames[i], int64(REGULAR_FILE_SIZE * (i + 1) + i))
+        original, err := ioutil.ReadFile(filenames[i])
+        check(err)
+        originals[i] = original
+    }
+    check(AddFile(filenames[0], usernames[0], configs.Datadisks))
+    check(AddFile(filenames[1], usernames[1], configs.Datadisks[0:3]))
+    check(AddFile(filenames[2], usernames[2], configs.Datadisks))
+
+    // a data disk is added
+    newConfigs, err := GetConfigs()
+    check(err)
+    addedLocation := fmt.Sprintf(types.LOCALHOST_DATADISK, len(newConfigs.Datadisks))
+    check(os.Mkdir(addedLocation, types.REGULAR_FILE_MODE))
+    newConfigs.Datadisks = append(newConfigs.Datadisks, addedLocation)
+    newConfigs.DataDiskCount++
+    check(SetConfigs(newConfigs))
+
+    restripedCount, err := Rebalance()
+    if err != nil || restripedCount != len(filenames) {
+        t.Errorf("Re-encoded %d of %d files: %v", restripedCount, len(filenames), err)
+    }
+
+    for i := 0; i < len(filenames); i++ {
+        downloadedTo, err := GetFile(filenames[i], usernames[i])
+        check(err)
+        downloaded, err := ioutil.ReadFile(downloadedTo)
+        check(err)
+        if !bytes.Equal(originals[i], downloaded) {
+            t.Errorf("%s did not match after rebalancing", filenames[i])
+        }
+        os.Remove(downloadedTo)
+
+        entry, err := database.GetFileEntry(filenames[i], usernames[i], newConfigs)
+        check(err)
+        if len(entry.Disks) != len(newConfigs.Datadisks) ||
+           entry.Layout.DataCount != newConfigs.DataDiskCount || entry.Layout.Generation != 1 {
+            t.Errorf("Entry of %s was not switched over: %+v", filenames[i], entry)
+        }
+
+        // the old components are gone
+        oldComponent := fmt.Sprintf("%s/%s/%s_0", configs.Datadisks[0], usernames[i], filenames[i])
+        if pathExists(oldComponent) {
+            t.Errorf("%s was not removed", oldComponent)
+        }
+    }
+
+    // nothing is left to do the second time, a single file is skipped too
+    restripedCount, err = Rebalance()
+    if err != nil || restripedCount != 0 {
+        t.Errorf("Re-encoded %d files again: %v", restripedCount, err)
+    }
+    check(RestripeFile(filenames[0], usernames[0]))
+
+    // and back to the old disks
+    os.Remove(types.CONFIG_FILE)
+    check(SetConfigs(configs))
+    check(RestripeFile(filenames[0], usernames[0]))
+    entry, err := database.GetFileEntry(filenames[0], usernames[0], configs)
+    check(err)
+    if len(entry.Disks) != len(configs.Datadisks) || entry.Layout.Generation != 2 {
+        t.Errorf("Entry of %s was not switched back: %+v", filenames[0], entry)
+    }
+    downloadedTo, err := GetFile(filenames[0], usernames[0])
+    check(err)
+    downloaded, err := ioutil.ReadFile(downloadedTo)
+    check(err)
+    if !bytes.Equal(originals[0], downloaded) {
+        t.Errorf("%s did not match after moving back", filenames[0])
+    }
+    os.Remove(downloadedTo)
+
+    for i := 0; i < len(filenames); i++ {
+        os.Remove(filenames[i])
+    }
+    os.Remove(types.CONFIG_FILE) // back to the default configs
+    removeDatabaseStructureLocal()
+}
+
+func TestScrubbing(t *testing.T) {
+    initializeDatabaseStructureLocal()
+
+    username := "atoron"
+    filenames := []string{"testingScrub1.txt", "testingScrub2.txt", "testingScrub3.txt"}
+    for i := 0; i < len(filenames); i++ {
+        createRandomFile(filenames[i], int64(REGULAR_FILE_SIZE * (i + 1)))
+        check(AddFile(filenames[i], username, configs.Datadisks))
+    }
+
+    corrupt := func(filename string) {
+        file, err := os.OpenFile(fmt.Sprintf("%s/%s/%s_1", configs.Datadisks[1], username,
+                                             filename), os.O_RDWR, 0755)
+        check(err)
+        _, err = file.WriteAt([]byte("damaged"), 10)
+        check(err)
+        file.Close()
+    }
+    corrupt(filenames[0])
+    corrupt(filenames[2])
+
+    // a scrub that stopped after the first file
+    statePath := "testingScrubState.json"
+    check(saveScrubState(statePath, &ScrubSummary{Checked: 1, LastUsername: username,
+                                                  LastFilename: filenames[0]}))
+
+    summary, err := Scrub(context.Background(), statePath, 0)
+    check(err)
+    if summary.Checked != len(filenames) || len(summary.Failed) != 0 ||
+       len(summary.Repaired) != 1 || !strings.HasPrefix(summary.Repaired[0], username + "/" + filenames[2]) {
+        t.Errorf("Resumed scrub returned %+v", summary)
+    }
+    if pathExists(statePath) {
+        t.Errorf("Progress of a finished scrub was kept")
+    }
+
+    // a new scrub goes through all of them, the first one is still damaged
+    summary, err = Scrub(context.Background(), statePath, 0)
+    check(err)
+    if summary.Checked != len(filenames) || len(summary.Repaired) != 1 ||
+       !strings.HasPrefix(summary.Repaired[0], username + "/" + filenames[0]) {
+        t.Errorf("Scrub returned %+v", summary)
+    }
+
+    // a scrub that is stopped before it checks anything
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    summary, err = Scrub(ctx, statePath, 0)
+    if err != context.Canceled || summary.Checked != 0 {
+        t.Errorf("Stopped scrub returned %+v, %v", summary, err)
+    }
+    if !strings.Contains(summary.Report(), "Checked 0 files") {
+        t.Errorf("Report was %q", summary.Report())
+    }
+
+    // the progress is saved without the findings, which are kept separately
+    corrupt(filenames[2])
+    check(saveScrubState(statePath, &ScrubSummary{Checked: 2, Repaired: []string{"earlier"},
+                                                  LastUsername: username,
+                                                  LastFilename: filenames[1]}))
+    check(appendScrubFinding(statePath + ".found", SCRUB_REPAIRED_PREFIX + "earlier: found"))
+    state, err := ioutil.ReadFile(statePath)
+    check(err)
+    if strings.Contains(string(state), "earlier") {
+        t.Errorf("Progress of the scrub has the findings in it: %s", state)
+    }
+
+    summary, err = Scrub(context.Background(), statePath, 0)
+    check(err)
+    if summary.Checked != len(filenames) || len(summary.Repaired) != 2 ||
+       summary.Repaired[0] != "earlier: found" ||
+       !strings.HasPrefix(summary.Repaired[1], username + "/" + filenames[2]) {
+        t.Errorf("Scrub resumed with findings returned %+v", summary)
+    }
+    if pathExists(statePath) || pathExists(statePath + ".found") {
+        t.Errorf("Progress of a finished scrub was kept")
+    }
+
+    for i := 0; i < len(filenames); i++ {
+        os.Remove(filenames[i])
+    }
+    os.Remove(statePath)
+    removeDatabaseStructureLocal()
+}
+
+func TestAddingRollsBack(t *testing.T) {
+    initializeDatabaseStructureLocal()
+
+    testingFilename := "testingRollback.txt"
+    username := "atoron"
+
+    createRandomFile(testingFilename, int64(REGULAR_FILE_SIZE))
+    first, err := ioutil.ReadFile(testingFilename)
+    check(err)
+    check(AddFile(testingFilename, username, configs.Datadisks))
+
+    // the database can't be written, the new copy must not replace the first one
+    var dbFiles []string
+    for i := 0; i < len(configs.Dbdisks) - 1; i++ {
+        dbFiles = append(dbFiles, fmt.Sprintf("%s/%s_%d", configs.Dbdisks[i], username, i))
+    }
+    for _, dbFile := range dbFiles {
+        check(os.Rename(dbFile, dbFile + ".moved"))
+        check(os.Mkdir(dbFile, types.REGULAR_FILE_MODE))
+    }
+
+    check(os.Remove(testingFilename))
+    createRandomFile(testingFilename, int64(REGULAR_FILE_SIZE + 5))
+    if err = AddFile(testingFilename, username, configs.Datadisks); err == nil {
+        t.Errorf("Adding a file without a database did not fail")
+    }
+
+    for _, dbFile := range dbFiles {
+        check(os.Remove(dbFile))
+        check(os.Rename(dbFile + ".moved", dbFile))
+    }
+
+    downloadedTo, err := GetFile(testingFilename, username)
+    check(err)
+    downloaded, err := ioutil.ReadFile(downloadedTo)
+    check(err)
+    if !bytes.Equal(first, downloaded) {
+        t.Errorf("First copy of the file was not put back")
+    }
+    os.Remove(downloadedTo)
+
+    for i := 0; i < len(configs.Datadisks); i++ {
+        files, err := ioutil.ReadDir(fmt.Sprintf("%s/%s", configs.Datadisks[i], username))
+        check(err)
+        if len(files) != 1 {
+            t.Errorf("%s has %d components of the file", configs.Datadisks[i], len(files))
+        }
+    }
+
+    os.Remove(testingFilename)
+    removeDatabaseStructureLocal()
+}
+
+func TestCollectingGarbage(t *testing.T) {
+    initializeDatabaseStructureLocal()
+
+    username := "atoron"
+    kept := "testingGarbageKept.txt"
+    orphaned := "testingGarbageOrphaned.txt"
+    createRandomFile(kept, int64(REGULAR_FILE_SIZE))
+    original, err := ioutil.ReadFile(kept)
+    check(err)
+    createRandomFile(orphaned, int64(REGULAR_FILE_SIZE))
+    check(AddFile(kept, username, configs.Datadisks))
+    check(AddFile(orphaned, username, configs.Datadisks))
+
+    // crashed after the database entry was removed
+    _, err = database.DeleteFileEntry(orphaned, username, configs)
+    check(err)
+    // a save of the kept file that crashed halfway, and a file that is not a component
+    userFolder := fmt.Sprintf("%s/%s", configs.Datadisks[1], username)
+    check(os.Rename(fmt.Sprintf("%s/%s_1", userFolder, kept),
+                    fmt.Sprintf("%s/%s_1%s", userFolder, kept, fileutils.OLD_COMPONENT_SUFFIX)))
+    check(ioutil.WriteFile(fmt.Sprintf("%s/%s_0%s", userFolder, kept,
+                                       fileutils.TEMP_COMPONENT_SUFFIX), []byte("partial"), 0644))
+    check(ioutil.WriteFile(userFolder + "/notes", []byte("not a component"), 0644))
+
+    var orphanedBytes int64 = int64(len("partial"))
+    for i := 0; i < len(configs.Datadisks); i++ {
+        name := fmt.Sprintf("%s/%s/%s_%d", configs.Datadisks[i], username, orphaned, i)
+        if i == len(configs.Datadisks) - 1 {
+            name = fmt.Sprintf("%s/%s/%s_p", configs.Datadisks[i], username, orphaned)
+        }
+        info, err := os.Stat(name)
+        check(err)
+        orphanedBytes += info.Size()
+    }
+
+    // too recent, might still be in use
+    report, err := CollectGarbage(false, false, time.Hour)
+    check(err)
+    if len(report.Orphans) != 0 || len(report.Restored) != 0 {
+        t.Errorf("Recent components were collected: %+v", report)
+    }
+
+    report, err = CollectGarbage(true, false, 0)
+    check(err)
+    if len(report.Orphans) != len(configs.Datadisks) + 1 || len(report.Restored) != 1 ||
+       report.ReclaimedBytes != orphanedBytes {
+        t.Errorf("Dry run reported %+v, expected %d bytes", report, orphanedBytes)
+    }
+    if !pathExists(fmt.Sprintf("%s/%s/%s_0", configs.Datadisks[0], username, orphaned)) {
+        t.Errorf("Dry run removed a component")
+    }
+
+    report, err = CollectGarbage(false, true, 0)
+    check(err)
+    if len(report.Orphans) != len(configs.Datadisks) + 1 || len(report.Restored) != 1 {
+        t.Errorf("Collection reported %+v", report)
+    }
+    for i := 0; i < len(configs.Datadisks) - 1; i++ {
+        name := fmt.Sprintf("%s/%s_%d", username, orphaned, i)
+        if pathExists(configs.Datadisks[i] + "/" + name) ||
+           !pathExists(configs.Datadisks[i] + "/" + fileutils.QUARANTINE_FOLDER + "/" + name) {
+            t.Errorf("%s was not quarantined", name)
+        }
+    }
+    if !pathExists(userFolder + "/notes") {
+        t.Errorf("A file that is not a component was collected")
+    }
+
+    downloadedTo, err := GetFile(kept, username)
+    check(err)
+    downloaded, err := ioutil.ReadFile(downloadedTo)
+    check(err)
+    if !bytes.Equal(original, downloaded) {
+        t.Errorf("%s did not match after the collection", kept)
+    }
+    os.Remove(downloadedTo)
+
+    // nothing is left, the quarantine is not collected again
+    report, err = CollectGarbage(false, false, 0)
+    check(err)
+    if len(report.Orphans) != 0 || len(report.Restored) != 0 || report.ReclaimedBytes != 0 {
+        t.Errorf("Second collection reported %+v", report)
+    }
+    if !strings.Contains(report.Report(), "0 orphaned components") {
+        t.Errorf("Report was %q", report.Report())
+    }
+
+    os.Remove(kept)
+    os.Remove(orphaned)
+    removeDatabaseStructureLocal()
+}
+
+func TestCollectingGarbageOfOtherSpellings(t *testing.T) {
+    initializeDatabaseStructureLocal()
+
+    username := "atoron"
+    filename := "testingGarbageSpelling.txt"
+    createRandomFile(filename, int64(REGULAR_FILE_SIZE))
+    original, err := ioutil.ReadFile(filename)
+    check(err)
+
+    // the same folders as the configs, spelled differently
+    locations := make([]string, len(configs.Datadisks))
+    for i, location := range configs.Datadisks {
+        if i % 2 == 0 {
+            locations[i] = "./" + location + "/"
+        } else {
+            locations[i] = "file://" + location
+        }
+    }
+    check(AddFile(filename, username, locations))
+    os.Remove(filename)
+
+    report, err := CollectGarbage(false, false, 0)
+    check(err)
+    if len(report.Orphans) != 0 || len(report.Restored) != 0 {
+        t.Errorf("Components on differently spelled locations were collected: %+v", report)
+    }
+
+    downloadedTo, err := GetFile(filename, username)
+    check(err)
+    downloaded, err := ioutil.ReadFile(downloadedTo)
+    check(err)
+    if !bytes.Equal(original, downloaded) {
+        t.Errorf("%s did not match after the collection", filename)
+    }
+    os.Remove(downloadedTo)
+
+    removeDatabaseStructureLocal()
+}
+
+func TestVersioning(t *testing.T) {
+    initializeDatabaseStructureLocal()
+
+    testingFilename := "testingVersions.txt"
+    username := "atoron"
+
+    // three saves of the file, each one different
+    var contents [][]byte
+    for i := 0; i < 3; i++ {
+        createRandomFile(testingFilename, int64(REGULAR_FILE_SIZE + i))
+        content, err := ioutil.ReadFile(testingFilename)
+        check(err)
+        contents = append(contents, content)
+        check(AddFile(testingFilename, username, configs.Datadisks))
+        os.Remove(testingFilename)
+    }
+
+    versions, err := ListVersions(testingFilename, username)
+    check(err)
+    if len(versions) != 3 {
+        t.Fatalf("Listed %d versions, should be 3", len(versions))
+    }
+    for i, version := range versions {
+        if version.Filename != testingFilename || version.Version != i + 1 || version.Saved == 0 {
+            t.Errorf("Version %d is %s version %d", i, version.Filename, version.Version)
+        }
+
+        downloadedTo, err := GetFileVersion(testingFilename, username, version.Version)
+        check(err)
+        downloaded, err := ioutil.ReadFile(downloadedTo)
+        check(err)
+        if !bytes.Equal(contents[i], downloaded) {
+            t.Errorf("Version %d did not match what was saved", version.Version)
+        }
+        os.Remove(downloadedTo)
+    }
+    if _, err = GetFileVersion(testingFilename, username, 7); !errors.Is(err, types.ErrNotFound) {
+        t.Errorf("Getting a version that doesn't exist gave %v", err)
+    }
+    entries, err := database.ListFileEntries(username, configs)
+    check(err)
+    if len(entries) != 1 {
+        t.Errorf("Past versions were listed as files: %d entries", len(entries))
+    }
+
+    // the first version comes back as a new one, the others are kept
+    check(RestoreVersion(testingFilename, username, 1))
+    downloadedTo, err := GetFile(testingFilename, username)
+    check(err)
+    downloaded, err := ioutil.ReadFile(downloadedTo)
+    check(err)
+    if !bytes.Equal(contents[0], downloaded) {
+        t.Errorf("Restored version did not match the first version")
+    }
+    os.Remove(downloadedTo)
+    versions, err = ListVersions(testingFilename, username)
+    check(err)
+    if len(versions) != 4 || versions[3].Version != 4 {
+        t.Errorf("Restoring left %d versions", len(versions))
+    }
+
+    // keeping two versions prunes the two oldest ones at the next save, the
+    // components of the first are shared with the restored one, and stay
+    check(SetRetention(username, types.Retention{KeepVersions: 2}))
+    createRandomFile(testingFilename, int64(REGULAR_FILE_SIZE + 3))
+    check(AddFile(testingFilename, username, configs.Datadisks))
+    os.Remove(testingFilename)
+
+    versions, err = ListVersions(testingFilename, username)
+    check(err)
+    if len(versions) != 2 || versions[0].Version != 4 || versions[1].Version != 5 {
+        t.Fatalf("Kept %d versions after pruning", len(versions))
+    }
+    downloadedTo, err = GetFileVersion(testingFilename, username, 4)
+    check(err)
+    downloaded, err = ioutil.ReadFile(downloadedTo)
+    check(err)
+    if !bytes.Equal(contents[0], downloaded) {
+        t.Errorf("Pruning removed the components of the restored version")
+    }
+    os.Remove(downloadedTo)
+    if pathExists(fmt.Sprintf("%s/%s/.g1/%s_0", configs.Datadisks[0], username, testingFilename)) {
+        t.Errorf("Components of a pruned version were not removed")
+    }
+
+    // versions saved longer ago than the user keeps them are pruned
+    check(SetRetention(username, types.Retention{KeepDays: 1}))
+    old, err := database.GetFileEntry(database.VersionKey(testingFilename, 4), username, configs)
+    check(err)
+    old.Saved = time.Now().AddDate(0, 0, -2).Unix()
+    check(database.AddFileEntryToDatabase(old, username, configs))
+    check(RestoreVersion(testingFilename, username, 5)) // nothing to restore, already current
+    createRandomFile(testingFilename, int64(REGULAR_FILE_SIZE + 4))
+    check(AddFile(testingFilename, username, configs.Datadisks))
+    os.Remove(testingFilename)
+
+    versions, err = ListVersions(testingFilename, username)
+    check(err)
+    if len(versions) != 2 || versions[0].Version != 5 {
+        t.Errorf("Kept %d versions after pruning by age", len(versions))
+    }
+
+    // deleting the file deletes every version, and every component
+    _, err = DeleteFile(testingFilename, username)
+    check(err)
+    if _, err = ListVersions(testingFilename, username); !errors.Is(err, types.ErrNotFound) {
+        t.Errorf("Listing the versions of a deleted file gave %v", err)
+    }
+    report, err := CollectGarbage(true, false, 0)
+    check(err)
+    if len(report.Orphans) != 0 {
+        t.Errorf("Deleting the file left %d components", len(report.Orphans))
+    }
+
+    check(SetConfigs(configs))
+    removeDatabaseStructureLocal()
+}
+
+func TestSnapshotting(t *testing.T) {
+    initializeDatabaseStructureLocal()
+
+    username := "atoron"
+    overwritten := "testingSnapshotOverwritten.txt"
+    deleted := "testingSnapshotDeleted.txt"
+    originals := make(map[string][]byte)
+    for _, filename := range []string{overwritten, deleted} {
+        createRandomFile(filename, int64(REGULAR_FILE_SIZE))
+        original, err := ioutil.ReadFile(filename)
+        check(err)
+        originals[filename] = original
+        check(AddFile(filename, username, configs.Datadisks))
+        os.Remove(filename)
+    }
+
+    check(CreateSnapshot(username, "end of quarter"))
+
+    // the snapshot keeps the files as they were
+    createRandomFile(overwritten, int64(REGULAR_FILE_SIZE + 7))
+    check(AddFile(overwritten, username, configs.Datadisks))
+    os.Remove(overwritten)
+    _, err := DeleteFile(deleted, username)
+    check(err)
+    check(SetRetention(username, types.Retention{KeepVersions: 1}))
+
+    report, err := CollectGarbage(true, false, 0)
+    check(err)
+    if len(report.Orphans) != 0 {
+        t.Errorf("Components in the snapshot were collected: %v", report.Orphans)
+    }
+
+    entries, err := ListSnapshotFiles(username, "end of quarter")
+    check(err)
+    if len(entries) != 2 {
+        t.Errorf("Snapshot has %d files, should be 2", len(entries))
+    }
+    for filename, original := range originals {
+        downloadedTo, err := GetSnapshotFile(username, "end of quarter", filename)
+        check(err)
+        downloaded, err := ioutil.ReadFile(downloadedTo)
+        check(err)
+        if !bytes.Equal(original, downloaded) {
+            t.Errorf("%s in the snapshot did not match the original", filename)
+        }
+        os.Remove(downloadedTo)
+    }
+
+    // both come back (the deleted one too), only once
+    restoredCount, err := RestoreSnapshot(username, "end of quarter")
+    check(err)
+    if restoredCount != 2 {
+        t.Errorf("Restored %d files, should be 2", restoredCount)
+    }
+    restoredCount, err = RestoreSnapshot(username, "end of quarter")
+    if err != nil || restoredCount != 0 {
+        t.Errorf("Restoring again restored %d files: %v", restoredCount, err)
+    }
+    for filename, original := range originals {
+        downloadedTo, err := GetFile(filename, username)
+        check(err)
+        downloaded, err := ioutil.ReadFile(downloadedTo)
+        check(err)
+        if !bytes.Equal(original, downloaded) {
+            t.Errorf("Restored %s did not match the original", filename)
+        }
+        os.Remove(downloadedTo)
+    }
+
+    // once the snapshot and the files are gone, so are their components
+    check(DeleteSnapshot(username, "end of quarter"))
+    for filename := range originals {
+        _, err = DeleteFile(filename, username)
+        check(err)
+    }
+    report, err = CollectGarbage(true, false, 0)
+    check(err)
+    if len(report.Orphans) != 0 {
+        t.Errorf("Deleting the snapshot left %d components", len(report.Orphans))
+    }
+    for i := 0; i < len(configs.Datadisks); i++ {
+        components, err := fileutils.ListStoredComponents(configs.Datadisks[i])
+        check(err)
+        if len(components) != 0 {
+            t.Errorf("%s has %d components left", configs.Datadisks[i], len(components))
+        }
+    }
+
+    check(SetConfigs(configs))
+    removeDatabaseStructureLocal()
+}
+
+func TestUpdatingInPlace(t *testing.T) {
+    initializeDatabaseStructureLocal()
+
+    username := "atoron"
+    filename := "testingUpdatingInPlace.txt"
+    createRandomFile(filename, int64(REGULAR_FILE_SIZE))
+    expected, err := ioutil.ReadFile(filename)
+    check(err)
+    check(AddFile(filename, username, configs.Datadisks))
+    os.Remove(filename)
+
+    check(CreateSnapshot(username, "before"))
+
+    // the snapshot shares the components, so they are copied first
+    check(WriteAt(filename, username, 10, []byte("changed in place")))
+    copy(expected[10:], []byte("changed in place"))
+    // saved in whole strips, so it is re-encoded in stripes to grow
+    check(AppendFile(filename, username, []byte("appended")))
+    expected = append(expected, []byte("appended")...)
+    check(AppendFile(filename, username, []byte(" and again")))
+    expected = append(expected, []byte(" and again")...)
+
+    downloadedTo, err := GetFile(filename, username)
+    check(err)
+    downloaded, err := ioutil.ReadFile(downloadedTo)
+    check(err)
+    if !bytes.Equal(expected, downloaded) {
+        t.Errorf("Updated file did not match")
+    }
+    os.Remove(downloadedTo)
+
+    downloadedTo, err = GetSnapshotFile(username, "before", filename)
+    check(err)
+    downloaded, err = ioutil.ReadFile(downloadedTo)
+    check(err)
+    if bytes.Equal(expected, downloaded) || len(downloaded) != REGULAR_FILE_SIZE {
+        t.Errorf("Updating the file changed the snapshot")
+    }
+    os.Remove(downloadedTo)
+
+    entries, err := ListVersions(filename, username)
+    check(err)
+    if len(entries) != 1 || entries[0].Layout.Striping != types.STRIPING_ROTATING {
+        t.Errorf("Updated file has %d versions, striping %d", len(entries),
+                 entries[len(entries) - 1].Layout.Striping)
+    }
+
+    // the components that were replaced are gone, but not the ones of the snapshot
+    check(DeleteSnapshot(username, "before"))
+    _, err = DeleteFile(filename, username)
+    check(err)
+    for i := 0; i < len(configs.Datadisks); i++ {
+        components, err := fileutils.ListStoredComponents(configs.Datadisks[i])
+        check(err)
+        if len(components) != 0 {
+            t.Errorf("%s has %d components left", configs.Datadisks[i], len(components))
+        }
+    }
+
+    removeDatabaseStructureLocal()
+}
+
+func TestSavingWithPolicies(t *testing.T) {
+    initializeDatabaseStructureLocal()
+
+    username := "atoron"
+    policies := map[string]string{"testingPolicyMirror.txt": "mirror:3",
+                                  "testingPolicyRS.txt": "rs:2+2",
+                                  "testingPolicyDefault.txt": ""}
+    originals := make(map[string][]byte)
+    for filename, policy := range policies {
+        createRandomFile(filename, int64(REGULAR_FILE_SIZE))
+        original, err := ioutil.ReadFile(filename)
+        check(err)
+        originals[filename] = original
+        check(AddFileWithPolicy(filename, username, nil, policy))
+        os.Remove(filename)
+    }
+
+    createRandomFile("testingPolicyBad.txt", int64(REGULAR_FILE_SIZE))
+    err := AddFileWithPolicy("testingPolicyBad.txt", username, nil, "raid:3+1")
+    if !errors.Is(err, types.ErrInvalidLayout) {
+        t.Errorf("Unknown policy gave %v", err)
+    }
+    err = AddFileWithPolicy("testingPolicyBad.txt", username, nil, "rs:6+3")
+    if !errors.Is(err, types.ErrInvalidLayout) {
+        t.Errorf("Policy needing more disks than there are gave %v", err)
+    }
+    os.Remove("testingPolicyBad.txt")
+
+    // streams can be saved with a policy too
+    originals["testingPolicyStream.txt"] = originals["testingPolicyRS.txt"]
+    policies["testingPolicyStream.txt"] = "mirror:2"
+    check(AddStreamWithPolicy(context.Background(), bytes.NewReader(originals["testingPolicyStream.txt"]),
+                              -1, "testingPolicyStream.txt", username, nil, "mirror:2"))
+
+    // the files keep their policies when the data disks are rebalanced
+    _, err = Rebalance()
+    check(err)
+    for filename, policy := range policies {
+        versions, err := ListVersions(filename, username)
+        check(err)
+        entry := versions[len(versions) - 1]
+        if entry.Policy != policy || (policy != "" && entry.Layout.Policy() != policy) {
+            t.Errorf("%s has policy %q (%s), should be %q", filename, entry.Policy,
+                     entry.Layout.Policy(), policy)
+        }
+        if policy == "mirror:3" && len(entry.Disks) != 3 {
+            t.Errorf("%s is on %d disks, should be 3", filename, len(entry.Disks))
+        }
+
+        downloadedTo, err := GetFile(filename, username)
+        check(err)
+        downloaded, err := ioutil.ReadFile(downloadedTo)
+        check(err)
+        if !bytes.Equal(originals[filename], downloaded) {
+            t.Errorf("%s did not match the original", filename)
+        }
+        os.Remove(downloadedTo)
+    }
+
+    // a missing component is rebuilt with the policy of the file
+    check(os.Remove(fmt.Sprintf("%s/%s/%s_p", configs.Datadisks[1], username,
+                                "testingPolicyMirror.txt")))
+    summary, err := Scrub(context.Background(), "testingPolicyScrub.json", 0)
+    check(err)
+    if len(summary.Repaired) != 1 ||
+       !strings.HasPrefix(summary.Repaired[0], username + "/testingPolicyMirror.txt") {
+        t.Errorf("Scrub returned %+v", summary)
+    }
+
+    for filename := range policies {
+        _, err = DeleteFile(filename, username)
+        check(err)
+    }
+    for i := 0; i < len(configs.Datadisks); i++ {
+        components, err := fileutils.ListStoredComponents(configs.Datadisks[i])
+        check(err)
+        if len(components) != 0 {
+            t.Errorf("%s has %d components left", configs.Datadisks[i], len(components))
+        }
+    }
+
+    removeDatabaseStructureLocal()
+}
+
+func TestKeepingFileStats(t *testing.T) {
+    initializeDatabaseStructureLocal()
+
+    username := "atoron"
+    filename := "testingFileStats.txt"
+    modTime := time.Date(2020, 5, 17, 12, 30, 0, 123456789, time.UTC)
+    createRandomFile(filename, int64(REGULAR_FILE_SIZE))
+    check(os.Chmod(filename, 0600))
+    check(os.Chtimes(filename, modTime, modTime))
+    check(AddFile(filename, username, configs.Datadisks))
+
+    entry, err := StatFile(filename, username)
+    check(err)
+    if entry.Stat == nil || entry.Stat.Size != int64(REGULAR_FILE_SIZE) ||
+       entry.Stat.Mode != 0600 || entry.Stat.ModTime != modTime.UnixNano() ||
+       entry.Stat.Created == 0 {
+        t.Fatalf("File was saved with stat %+v", entry.Stat)
+    }
+    created := entry.Stat.Created
+
+    // the copy gets the mode and modification time of the original
+    downloadedTo, err := GetFile(filename, username)
+    check(err)
+    info, err := os.Stat(downloadedTo)
+    check(err)
+    if info.Mode().Perm() != 0600 || !info.ModTime().Equal(modTime) {
+        t.Errorf("Copy has mode %v, modified %v", info.Mode(), info.ModTime())
+    }
+
+    // a new version keeps the time the file was created, writes change the size
+    check(AddFile(filename, username, configs.Datadisks))
+    os.Remove(filename)
+    check(AppendFile(filename, username, []byte("appended")))
+    entry, err = StatFile(filename, username)
+    check(err)
+    if entry.Stat.Created != created || entry.Stat.Size != int64(REGULAR_FILE_SIZE + 8) ||
+       entry.Stat.ModTime == modTime.UnixNano() {
+        t.Errorf("File has stat %+v after a new version and an append", entry.Stat)
+    }
+    downloadedTo, err = GetFile(filename, username)
+    check(err)
+    info, err = os.Stat(downloadedTo)
+    check(err)
+    if info.Size() != int64(REGULAR_FILE_SIZE + 8) {
+        t.Errorf("Copy has %d bytes after an append", info.Size())
+    }
+    os.Remove(downloadedTo)
+
+    // a stream has no mode of its own
+    check(AddStream(context.Background(), strings.NewReader("streamed"), -1,
+                    "testingFileStatsStream.txt", username, configs.Datadisks))
+    entry, err = StatFile("testingFileStatsStream.txt", username)
+    check(err)
+    if entry.Stat == nil || entry.Stat.Size != 8 || entry.Stat.Mode != STREAM_FILE_MODE {
+        t.Errorf("Stream was saved with stat %+v", entry.Stat)
+    }
+
+    _, err = DeleteFile(filename, username)
+    check(err)
+    _, err = DeleteFile("testingFileStatsStream.txt", username)
+    check(err)
+
+    removeDatabaseStructureLocal()
+}
+
+func TestSavingDirectories(t *testing.T) {
+    initializeDatabaseStructureLocal()
+
+    username := "atoron"
+    filenames := []string{"testingDirectory/top.txt", "testingDirectory/a/same.txt",
+                          "testingDirectory/b/c/same.txt"}
+    originals := make(map[string][]byte)
+    for _, filename := range filenames {
+        check(os.MkdirAll(filepath.Dir(filename), 0755))
+        createRandomFile(filename, int64(REGULAR_FILE_SIZE))
+        original, err := ioutil.ReadFile(filename)
+        check(err)
+        originals[filename] = original
+    }
+
+    // saved under the name of the directory, files with the same name don't collide
+    absDir, err := filepath.Abs("testingDirectory")
+    check(err)
+    saved, err := AddDirectory(absDir, username, configs.Datadisks, "")
+    check(err)
+    if saved != len(filenames) {
+        t.Errorf("Saved %d files of the directory", saved)
+    }
+    os.RemoveAll("testingDirectory")
+
+    entries, err := ListDirectory("testingDirectory/", username)
+    check(err)
+    if len(entries) != len(filenames) || entries[0].Filename != "testingDirectory/a/same.txt" {
+        t.Errorf("Listed %d files in the directory", len(entries))
+    }
+    entries, err = ListDirectory("testingDirectory/b", username)
+    check(err)
+    if len(entries) != 1 || entries[0].Filename != "testingDirectory/b/c/same.txt" {
+        t.Errorf("Listed %d files in a folder of the directory", len(entries))
+    }
+
+    // the copies are in the folders of their paths, files with the same
+    // name don't overwrite each other
+    var downloaded []byte
+    for _, filename := range filenames[1:] {
+        downloadedTo, err := GetFile(filename, username)
+        check(err)
+        shouldBe := filepath.Join(filepath.Dir(filename), "downloaded-same.txt")
+        if downloadedTo != shouldBe {
+            t.Errorf("File in a folder was gotten to %s", downloadedTo)
+        }
+    }
+    for _, filename := range filenames[1:] {
+        downloaded, err = ioutil.ReadFile(filepath.Join(filepath.Dir(filename), "downloaded-same.txt"))
+        if err != nil || !bytes.Equal(originals[filename], downloaded) {
+            t.Errorf("Copy of %s did not match the original (%v)", filename, err)
+        }
+    }
+    os.RemoveAll("testingDirectory")
+
+    // a folder is gotten back into the same tree
+    gotten, err := GetDirectory("testingDirectory/b", username, "testingDirectoryOut")
+    check(err)
+    downloaded, err = ioutil.ReadFile(filepath.Join("testingDirectoryOut", "b", "c", "same.txt"))
+    if gotten != 1 || err != nil || !bytes.Equal(originals["testingDirectory/b/c/same.txt"], downloaded) {
+        t.Errorf("Got %d files of a folder (%v)", gotten, err)
+    }
+    gotten, err = GetDirectory("testingDirectory", username, "testingDirectoryOut")
+    check(err)
+    for _, filename := range filenames {
+        downloaded, err = ioutil.ReadFile(filepath.Join("testingDirectoryOut", filename))
+        if err != nil || !bytes.Equal(originals[filename], downloaded) {
+            t.Errorf("%s did not match the original (%v)", filename, err)
+        }
+    }
+    os.RemoveAll("testingDirectoryOut")
+    if _, err = GetDirectory("testingDirectory/none", username, "testingDirectoryOut");
+       !errors.Is(err, types.ErrNotFound) {
+        t.Errorf("Getting an empty folder gave %v", err)
+    }
+
+    // the components in folders are found, and belong to their files
+    report, err := CollectGarbage(true, false, 0)
+    check(err)
+    if len(report.Orphans) != 0 {
+        t.Errorf("Components of files in folders were taken for orphans: %v", report.Orphans)
+    }
+
+    check(os.MkdirAll(".g3", 0755))
+    createRandomFile(".g3/file.txt", int64(SMALL_FILE_SIZE))
+    if err = AddFile(".g3/file.txt", username, configs.Datadisks); !errors.Is(err, types.ErrInvalidName) {
+        t.Errorf("Saving under a generation folder gave %v", err)
+    }
+    os.RemoveAll(".g3")
+
+    for _, filename := range filenames {
+        _, err = DeleteFile(filename, username)
+        check(err)
+    }
+    for i := 0; i < len(configs.Datadisks); i++ {
+        components, err := fileutils.ListStoredComponents(configs.Datadisks[i])
+        check(err)
+        if len(components) != 0 {
+            t.Errorf("%s has %d components left", configs.Datadisks[i], len(components))
+        }
+    }
+
+    removeDatabaseStructureLocal()
+}
+
+func TestSavingByAbsolutePath(t *testing.T) {
+    initializeDatabaseStructureLocal()
+
+    username := "atoron"
+    filename := "testingAbsolutePath.txt"
+    createRandomFile(filename, int64(REGULAR_FILE_SIZE))
+    original, err := ioutil.ReadFile(filename)
+    check(err)
+
+    // files outside of the working directory are kept under their name
+    absPath, err := filepath.Abs(filename)
+    check(err)
+    check(AddFile(absPath, username, configs.Datadisks))
+    check(AddFile("../system/" + filename, username, configs.Datadisks))
+    os.Remove(filename)
+
+    versions, err := ListVersions(filename, username)
+    check(err)
+    if len(versions) != 2 {
+        t.Errorf("Saved %d versions under %s", len(versions), filename)
+    }
+    downloadedTo, err := GetFile(filename, username)
+    check(err)
+    downloaded, err := ioutil.ReadFile(downloadedTo)
+    check(err)
+    if !bytes.Equal(original, downloaded) {
+        t.Errorf("File saved by its absolute path did not match the original")
+    }
+    os.Remove(downloadedTo)
+
+    _, err = DeleteFile(filename, username)
+    check(err)
+
+    removeDatabaseStructureLocal()
+}
+
+func TestRebalancingSnapshots(t *testing.T) {
+    initializeDatabaseStructureLocal()
+
+    username := "atoron"
+    filename := "testingRebalanceSnapshot.txt"
+    createRandomFile(filename, int64(REGULAR_FILE_SIZE))
+    original, err := ioutil.ReadFile(filename)
+    check(err)
+    check(AddFile(filename, username, configs.Datadisks))
+    os.Remove(filename)
+    check(CreateSnapshot(username, "before"))
+
+    newConfigs, err := GetConfigs()
+    check(err)
+    addedLocation := fmt.Sprintf(types.LOCALHOST_DATADISK, len(newConfigs.Datadisks))
+    check(os.Mkdir(addedLocation, types.REGULAR_FILE_MODE))
+    newConfigs.Datadisks = append(newConfigs.Datadisks, addedLocation)
+    newConfigs.DataDiskCount++
+    check(SetConfigs(newConfigs))
+
+    // the snapshot is not re-encoded itself, it keeps sharing the components of the file
+    restripedCount, err := Rebalance()
+    if err != nil || restripedCount != 1 {
+        t.Errorf("Re-encoded %d files: %v", restripedCount, err)
+    }
+    entry, err := database.GetFileEntry(filename, username, newConfigs)
+    check(err)
+    frozen, err := ListSnapshotFiles(username, "before")
+    check(err)
+    if len(frozen) != 1 || frozen[0].Layout != entry.Layout ||
+       len(frozen[0].Disks) != len(newConfigs.Datadisks) {
+        t.Errorf("Snapshot entry %+v does not share the components of %+v", frozen, entry)
+    }
+    oldComponent := fmt.Sprintf("%s/%s/%s_0", configs.Datadisks[0], username, filename)
+    if pathExists(oldComponent) {
+        t.Errorf("%s was not removed", oldComponent)
+    }
+
+    downloadedTo, err := GetSnapshotFile(username, "before", filename)
+    check(err)
+    downloaded, err := ioutil.ReadFile(downloadedTo)
+    check(err)
+    if !bytes.Equal(original, downloaded) {
+        t.Errorf("Snapshot of %s did not match after rebalancing", filename)
+    }
+    os.Remove(downloadedTo)
+
+    os.Remove(types.CONFIG_FILE) // back to the default configs
+    removeDatabaseStructureLocal()
+}
+
 func TestOverallAddingGettingDeleting(t *testing.T) {
     initializeDatabaseStructureLocal()
 
@@ -224,7 +1409,7 @@ func TestOverallAddingGettingDeleting(t *testing.T) {
             // create sample file with random binary data
             testingFile, err := os.Create(filenames[num]) // overwrite existing file if there
             if err != nil {
-                t.Errorf("Could not create %d\n", filenames[num])
+                t.Errorf("Could not create %s\n", filenames[num])
             }
 
             fileData := make([]byte, SMALL_FILE_SIZE)
@@ -234,7 +1419,7 @@ func TestOverallAddingGettingDeleting(t *testing.T) {
             check(err)
             testingFile.Close()
 
-            AddFile(filenames[num], username, configs.Datadisks)
+            check(AddFile(filenames[num], username, configs.Datadisks))
             inDatabase[num] = true
             added++
         }
@@ -251,7 +1436,7 @@ func TestOverallAddingGettingDeleting(t *testing.T) {
         // create sample file with random binary data
         testingFile, err := os.Create(filenames[num]) // overwrite existing file if there
         if err != nil {
-            t.Errorf("Could not create %d\n", filenames[num])
+            t.Errorf("Could not create %s\n", filenames[num])
         }
 
         fileData := make([]byte, SMALL_FILE_SIZE) // running with a non-small file size will make this test run for a while
@@ -261,7 +1446,7 @@ func TestOverallAddingGettingDeleting(t *testing.T) {
         check(err)
         testingFile.Close()
 
-        AddFile(filenames[num], username, configs.Datadisks)
+        check(AddFile(filenames[num], username, configs.Datadisks))
         inDatabase[num] = true
 
         // get one
@@ -269,7 +1454,8 @@ func TestOverallAddingGettingDeleting(t *testing.T) {
         for !inDatabase[num] {
             num = rand.Intn(amountOfFiles - 1) + 1
         }
-        downloadedTo := GetFile(filenames[num], username)
+        downloadedTo, err := GetFile(filenames[num], username)
+        check(err)
         if downloadedTo == "" {
             t.Errorf("Did not get entry %d at all", num)
             break
@@ -299,7 +1485,7 @@ func TestOverallAddingGettingDeleting(t *testing.T) {
         for !inDatabase[num] {
             num = rand.Intn(amountOfFiles - 1) + 1
         }
-        entry := DeleteFile(filenames[num], username)
+        entry, _ := DeleteFile(filenames[num], username)
         if entry == nil {
             t.Errorf("There was an error in deletion")
             break
@@ -323,7 +1509,7 @@ func TestAddingToLessThanFourDrives(t *testing.T) {
     // create sample file with random binary data
     testingFile, err := os.Create(testingFilename) // overwrite existing file if there
     if err != nil {
-        t.Errorf("Could not create %d\n", testingFilename)
+        t.Errorf("Could not create %s\n", testingFilename)
     }
 
     fileData := make([]byte, SMALL_FILE_SIZE)
@@ -333,9 +1519,10 @@ func TestAddingToLessThanFourDrives(t *testing.T) {
     check(err)
     testingFile.Close()
 
-    AddFile(testingFilename, username, configs.Datadisks[0:2])
+    check(AddFile(testingFilename, username, configs.Datadisks[0:2]))
 
-    downloadedTo := GetFile(testingFilename, username)
+    downloadedTo, err := GetFile(testingFilename, username)
+    check(err)
 
     // test differences
     cmd := exec.Command("diff", testingFilename, downloadedTo)
@@ -357,7 +1544,7 @@ func TestAddingToLessThanFourDrives(t *testing.T) {
     }
 
     // delete the file, and make sure all parts are deleted
-    entry := DeleteFile(testingFilename, username)
+    entry, _ := DeleteFile(testingFilename, username)
     for i := 0; i < len(entry.Disks); i++ {
         if entry.Disks[i] != configs.Datadisks[i] {
             t.Errorf("Error, tree entry did not have correct disk locations")
@@ -378,7 +1565,7 @@ func TestCorruptingADataDisk(t *testing.T) {
     // create sample file with random binary data
     testingFile, err := os.Create(testingFilename) // overwrite existing file if there
     if err != nil {
-        t.Errorf("Could not create %d\n", testingFilename)
+        t.Errorf("Could not create %s\n", testingFilename)
     }
 
     fileData := make([]byte, SMALL_FILE_SIZE)
@@ -388,7 +1575,7 @@ func TestCorruptingADataDisk(t *testing.T) {
     check(err)
     testingFile.Close()
 
-    AddFile(testingFilename, username, configs.Datadisks)
+    check(AddFile(testingFilename, username, configs.Datadisks))
 
     // corrupt one of the files
     fileToCorrupt := fmt.Sprintf("storage/drive0/%s/%s_0", username, testingFilename)
@@ -410,7 +1597,8 @@ func TestCorruptingADataDisk(t *testing.T) {
     // fmt.Printf("Wrote some faulty bits\n")
     file.Close()
 
-    downloadedTo := GetFile(testingFilename, username)
+    downloadedTo, err := GetFile(testingFilename, username)
+    check(err)
 
     // test differences
     cmd := exec.Command("diff", testingFilename, downloadedTo)
@@ -432,7 +1620,7 @@ func TestCorruptingADataDisk(t *testing.T) {
     }
 
     // delete the file, and make sure all parts are deleted
-    entry := DeleteFile(testingFilename, username)
+    entry, _ := DeleteFile(testingFilename, username)
     for i := 0; i < len(entry.Disks); i++ {
         if entry.Disks[i] != configs.Datadisks[i] {
             t.Errorf("Error, tree entry did not have correct disk locations")
@@ -528,7 +1716,7 @@ func BenchmarkSaving4(b *testing.B) {
         // create the file, with random data
         createRandomFile(testingFilename, fileSize)
 
-        AddFile(testingFilename, username, diskLocations)
+        check(AddFile(testingFilename, username, diskLocations))
     }
     
     // run the tests
@@ -552,7 +1740,7 @@ func BenchmarkSaving4(b *testing.B) {
                 // actually it's faster to just add when you already have
                 // entry in the database, so this won't be an accurate reading
 
-                AddFile(testingFilename, username, diskLocations)
+                check(AddFile(testingFilename, username, diskLocations))
 
                 // just going to delete the file after, so that the runtimes
                 // make sense, at least it'll just be a multiple of 2 basically
@@ -560,7 +1748,7 @@ func BenchmarkSaving4(b *testing.B) {
                 // sizes (note that the file size doesn't matter for the
                 // database itself)
 
-                r := DeleteFile(testingFilename, username)
+                r, _ := DeleteFile(testingFilename, username)
                 if r == nil {
                     return
                 }
@@ -616,7 +1804,7 @@ func BenchmarkSaveDb(b *testing.B) {
             // create the file, with random data
             createRandomFile(testingFilename, fileSize)
 
-            AddFile(testingFilename, username, diskLocations)
+            check(AddFile(testingFilename, username, diskLocations))
         }
 
         b.Run(fmt.Sprintf("SaveOnDb-Dbsize=%d", n), func(b *testing.B) {
@@ -630,7 +1818,7 @@ func BenchmarkSaveDb(b *testing.B) {
                 // actually it's faster to just add when you already have
                 // entry in the database, so this won't be an accurate reading
 
-                AddFile(testingFilename, username, diskLocations)
+                check(AddFile(testingFilename, username, diskLocations))
 
                 // just going to delete the file after, so that the runtimes
                 // make sense, at least it'll just be a multiple of 2 basically
@@ -638,7 +1826,7 @@ func BenchmarkSaveDb(b *testing.B) {
                 // sizes (note that the file size doesn't matter for the
                 // database itself)
 
-                r := DeleteFile(testingFilename, username)
+                r, _ := DeleteFile(testingFilename, username)
                 if r == nil {
                     return
                 }
@@ -0,0 +1,135 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: update.go
+* Date created: 10/16/26
+*
+* Description: changes the current version of a file in place (see
+* fileutils/update.go), without saving the whole file again. Components that
+* a past version or a snapshot shares are never changed, the file is copied
+* to components of a new generation first.
+*******************************************************************************/
+
+package system
+
+import (
+    "foxyblox/database"
+    "foxyblox/fileutils"
+    "foxyblox/types"
+)
+
+/*
+    Write data into the file at offset (at most the size of the file, data
+    past the end of the file is appended to it), only the components (and
+    the parity) that hold the bytes that change are rewritten. Files saved in
+    whole strips are re-encoded in stripes first if they grow.
+*/
+func WriteAt(filename string, username string, offset int64, data []byte) error {
+    configs, err := GetConfigs()
+    if err != nil {
+        return err
+    }
+
+    entry, err := database.GetFileEntry(filename, username, configs)
+    if err != nil {
+        return err
+    }
+    trimDisks(entry)
+
+    size, err := fileutils.FileSize(filename, username, entry.Disks, entry.Layout, configs)
+    if err != nil {
+        return err
+    }
+    end := offset + int64(len(data))
+    entry, err = writableEntry(entry, username, end > size, configs)
+    if err != nil {
+        return err
+    }
+
+    err = fileutils.WriteFileAt(filename, username, entry.Disks, entry.Layout, configs,
+                                offset, data)
+    if err != nil {
+        return err
+    }
+    if end > size {
+        size = end
+    }
+    return touchEntry(entry, size, username, configs)
+}
+
+// add data to the end of the file, see WriteAt
+func AppendFile(filename string, username string, data []byte) error {
+    configs, err := GetConfigs()
+    if err != nil {
+        return err
+    }
+
+    entry, err := database.GetFileEntry(filename, username, configs)
+    if err != nil {
+        return err
+    }
+    trimDisks(entry)
+
+    entry, err = writableEntry(entry, username, true, configs)
+    if err != nil {
+        return err
+    }
+
+    err = fileutils.AppendFile(filename, username, entry.Disks, entry.Layout, configs, data)
+    if err != nil || entry.Stat == nil {
+        return err
+    }
+    return touchEntry(entry, entry.Stat.Size + int64(len(data)), username, configs)
+}
+
+/*
+    The entry of the current version of the file, with components that can
+    be changed in place: if another version (or a snapshot) shares its
+    components, or if the file has to grow and is saved in whole strips (and
+    is not a mirror), the file is copied to components of a new generation
+    (in stripes, if it has to grow) on the same disks, and the entry points
+    to them from now on
+*/
+func writableEntry(entry *types.TreeEntry, username string, grow bool,
+                   configs *types.Config) (*types.TreeEntry, error) {
+    references, err := fileReferences(entry.Filename, username, configs)
+    if err != nil {
+        return nil, err
+    }
+    shared := 0
+    for _, reference := range references {
+        if reference.Layout.Generation == entry.Layout.Generation {
+            shared++
+        }
+    }
+
+    newLayout := entry.Layout
+    if grow && newLayout.Striping != types.STRIPING_ROTATING && newLayout.DataCount > 1 {
+        newLayout.Striping = types.STRIPING_ROTATING
+        newLayout.StripeSize = configs.StripeSize
+        if newLayout.StripeSize <= 0 {
+            newLayout.StripeSize = types.DEFAULT_STRIPE_SIZE
+        }
+    } else if shared <= 1 {
+        return entry, nil
+    }
+
+    newLayout.Generation, err = nextGeneration(entry.Filename, username, configs)
+    if err != nil {
+        return nil, err
+    }
+    err = fileutils.RestripeFile(entry.Filename, username, entry.Disks, entry.Layout,
+                                 entry.Disks, newLayout, configs)
+    if err != nil {
+        return nil, err
+    }
+
+    newEntry := *entry
+    newEntry.Layout = newLayout
+    err = database.AddFileEntryToDatabase(&newEntry, username, configs)
+    if err != nil {
+        fileutils.RemoveFileWithLayout(entry.Filename, username, entry.Disks, newLayout, configs)
+        return nil, err
+    }
+
+    return &newEntry, removeUnreferenced(entry, entry.Filename, username, configs)
+}
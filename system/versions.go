@@ -0,0 +1,325 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: versions.go
+* Date created: 10/16/26
+*
+* Description: keeps the past versions of the files. Every save of a file
+* gets components of a new generation, and the entry of the version it
+* replaces is kept in the database under its version key (see
+* database.VersionKey), until the retention policy of the user prunes it.
+*******************************************************************************/
+
+package system
+
+import (
+    "errors"
+    "fmt"
+    "time"
+    "foxyblox/database"
+    "foxyblox/fileutils"
+    "foxyblox/types"
+)
+
+/*
+    Every version of the file that is kept, oldest first, the last one is the
+    current one (all of them named after the file)
+*/
+func ListVersions(filename string, username string) ([]*types.TreeEntry, error) {
+    configs, err := GetConfigs()
+    if err != nil {
+        return nil, err
+    }
+
+    current, err := database.GetFileEntry(filename, username, configs)
+    if err != nil {
+        return nil, err
+    }
+    versions, err := database.ListFileVersions(filename, username, configs)
+    if err != nil {
+        return nil, err
+    }
+
+    versions = append(versions, current)
+    for _, version := range versions {
+        version.Filename = filename
+        trimDisks(version)
+    }
+    return versions, nil
+}
+
+/*
+    Same as GetFile, for the given version of the file (see ListVersions),
+    types.ErrNotFound if that version is not kept
+*/
+func GetFileVersion(filename string, username string, version int) (string, error) {
+    configs, err := GetConfigs()
+    if err != nil {
+        return "", err
+    }
+
+    entry, err := versionEntry(filename, username, version, configs)
+    if err != nil {
+        return "", err
+    }
+
+    downloadedTo, err := fileutils.GetFileWithLayout(filename, username, entry.Disks,
+                                                     entry.Layout, configs)
+    if err != nil {
+        return "", err
+    }
+    return downloadedTo, restoreStat(downloadedTo, entry.Stat)
+}
+
+/*
+    Make the given version of the file the current one again. It becomes a
+    new version (with the same components as the one it is restored from),
+    so the version that was current until now is kept as well.
+*/
+func RestoreVersion(filename string, username string, version int) error {
+    configs, err := GetConfigs()
+    if err != nil {
+        return err
+    }
+
+    current, err := database.GetFileEntry(filename, username, configs)
+    if err != nil {
+        return err
+    }
+    if current.Version == version {
+        return nil
+    }
+    restored, err := versionEntry(filename, username, version, configs)
+    if err != nil {
+        return err
+    }
+
+    entry := &types.TreeEntry{Filename: filename, Disks: restored.Disks, Layout: restored.Layout,
+                              Policy: restored.Policy, Stat: restored.Stat}
+    err = addVersion(entry, current, username, configs)
+    if err != nil {
+        return err
+    }
+
+    return pruneVersions(filename, username, configs)
+}
+
+/*
+    Set the versions that the user keeps from now on (username "" for every
+    user without a policy of their own), the versions that the policy doesn't
+    keep are pruned the next time each file is saved
+*/
+func SetRetention(username string, retention types.Retention) error {
+    configs, err := GetConfigs()
+    if err != nil {
+        return err
+    }
+
+    if configs.Retention == nil {
+        configs.Retention = make(map[string]types.Retention)
+    }
+    configs.Retention[username] = retention
+    return SetConfigs(configs)
+}
+
+// the retention policy of the user, see types.Retention
+func retentionOf(username string, configs *types.Config) types.Retention {
+    if retention, found := configs.Retention[username]; found {
+        return retention
+    }
+    return configs.Retention[""]
+}
+
+// entry of the given version of the file (the current one included), with trimmed disks
+func versionEntry(filename string, username string, version int,
+                  configs *types.Config) (*types.TreeEntry, error) {
+    entry, err := database.GetFileEntry(filename, username, configs)
+    if err == nil && entry.Version != version {
+        entry, err = database.GetFileEntry(database.VersionKey(filename, version), username,
+                                           configs)
+    }
+    if errors.Is(err, types.ErrNameTooLong) {
+        err = fmt.Errorf("%w: %s has no past versions", types.ErrNotFound, filename)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    trimDisks(entry)
+    return entry, nil
+}
+
+// the entry of the file, nil if the user has no such file
+func currentEntry(filename string, username string,
+                  configs *types.Config) (*types.TreeEntry, error) {
+    entry, err := database.GetFileEntry(filename, username, configs)
+    if errors.Is(err, types.ErrNotFound) {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+
+    trimDisks(entry)
+    return entry, nil
+}
+
+/*
+    The entries that refer to components of the file (the current one and
+    the past versions, in the database of the user and in the databases of
+    their snapshots), with trimmed disks, none if there is no such file
+*/
+func fileReferences(filename string, username string,
+                    configs *types.Config) ([]*types.TreeEntry, error) {
+    databases, err := userDatabases(username, configs)
+    if err != nil {
+        return nil, err
+    }
+
+    var references []*types.TreeEntry
+    for _, name := range databases {
+        current, err := currentEntry(filename, name, configs)
+        if err != nil {
+            return nil, err
+        } else if current == nil {
+            continue
+        }
+
+        versions, err := database.ListFileVersions(filename, name, configs)
+        if err != nil {
+            return nil, err
+        }
+        for _, version := range versions {
+            trimDisks(version)
+        }
+        references = append(references, versions...)
+        references = append(references, current)
+    }
+    return references, nil
+}
+
+/*
+    Generation for the next components of the file, newer than the
+    generation of every version of the file that is kept (0 for a file that
+    nothing refers to)
+*/
+func nextGeneration(filename string, username string, configs *types.Config) (int, error) {
+    references, err := fileReferences(filename, username, configs)
+    if err != nil || len(references) == 0 {
+        return 0, err
+    }
+
+    generation := 0
+    for _, reference := range references {
+        if reference.Layout.Generation > generation {
+            generation = reference.Layout.Generation
+        }
+    }
+    return generation + 1, nil
+}
+
+/*
+    Remove the components of the entry (a version of the file that is gone
+    from the database), unless a version that is still kept (or a snapshot)
+    shares them
+*/
+func removeUnreferenced(entry *types.TreeEntry, filename string, username string,
+                        configs *types.Config) error {
+    references, err := fileReferences(filename, username, configs)
+    if err != nil {
+        return err
+    }
+    for _, reference := range references {
+        if reference.Layout.Generation == entry.Layout.Generation {
+            return nil
+        }
+    }
+
+    return fileutils.RemoveFileWithLayout(filename, username, entry.Disks, entry.Layout, configs)
+}
+
+/*
+    Make entry the current version of its file. The version that is current
+    now (nil for a new file) is kept as a past version, unless the filename
+    is too long for a version key, then its components are removed once the
+    entry is replaced.
+*/
+func addVersion(entry *types.TreeEntry, current *types.TreeEntry, username string,
+                configs *types.Config) error {
+    now := time.Now()
+    entry.Version = 1
+    entry.Saved = now.Unix()
+    // the file keeps the time it was first saved at across its versions
+    if entry.Stat != nil && entry.Stat.Created == 0 {
+        entry.Stat.Created = now.UnixNano()
+        if current != nil && current.Stat != nil {
+            entry.Stat.Created = current.Stat.Created
+        }
+    }
+    if current == nil {
+        return database.AddFileEntryToDatabase(entry, username, configs)
+    }
+    entry.Version = current.Version + 1
+
+    past := *current
+    past.Filename = database.VersionKey(current.Filename, current.Version)
+    if len(past.Filename) > int(types.MAX_FILE_NAME_SIZE) {
+        err := database.AddFileEntryToDatabase(entry, username, configs)
+        if err != nil {
+            return err
+        }
+        return removeUnreferenced(current, current.Filename, username, configs)
+    }
+
+    err := database.AddFileEntryToDatabase(&past, username, configs)
+    if err != nil {
+        return err
+    }
+    err = database.AddFileEntryToDatabase(entry, username, configs)
+    if err != nil {
+        database.DeleteFileEntry(past.Filename, username, configs)
+        return err
+    }
+    return nil
+}
+
+/*
+    Remove the past versions of the file that the retention policy of the
+    user doesn't keep (oldest first), along with their components. Versions
+    that can't be pruned now are pruned after the next save (the error says
+    why, the file itself is in place either way).
+*/
+func pruneVersions(filename string, username string, configs *types.Config) error {
+    retention := retentionOf(username, configs)
+    if retention.KeepVersions <= 0 && retention.KeepDays <= 0 {
+        return nil
+    }
+
+    versions, err := database.ListFileVersions(filename, username, configs)
+    if err != nil {
+        return fmt.Errorf("can't prune the past versions of %s: %w", filename, err)
+    }
+
+    // the current version counts towards the versions that are kept
+    excess := 0
+    if retention.KeepVersions > 0 && len(versions) >= retention.KeepVersions {
+        excess = len(versions) - retention.KeepVersions + 1
+    }
+    oldest := time.Now().AddDate(0, 0, -retention.KeepDays).Unix()
+
+    for i, version := range versions {
+        if i >= excess && (retention.KeepDays <= 0 || version.Saved >= oldest) {
+            break
+        }
+
+        _, err = database.DeleteFileEntry(version.Filename, username, configs)
+        if err != nil {
+            return fmt.Errorf("can't prune the past versions of %s: %w", filename, err)
+        }
+        trimDisks(version)
+        err = removeUnreferenced(version, filename, username, configs)
+        if err != nil {
+            return fmt.Errorf("can't prune the past versions of %s: %w", filename, err)
+        }
+    }
+
+    return nil
+}
@@ -0,0 +1,39 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: errors.go
+* Date created: 10/16/26
+*
+* Description: errors returned across packages. Errors carry more details
+* about what went wrong, and wrap one of these, so callers can check what
+* kind of error it is with errors.Is.
+*******************************************************************************/
+
+package types
+
+import (
+    "errors"
+)
+
+// the file (or the database of the user) does not exist
+var ErrNotFound = errors.New("not found")
+
+// stored data (a component, a database entry or header) doesn't match its hash
+var ErrCorrupt = errors.New("corrupted")
+
+// more components are damaged than the layout of the file can rebuild
+var ErrUnrecoverable = errors.New("unrecoverable")
+
+// the filename doesn't fit in a database entry (MAX_FILE_NAME_SIZE bytes)
+var ErrNameTooLong = errors.New("name is too long")
+
+// the filename can't be stored (empty)
+var ErrInvalidName = errors.New("invalid name")
+
+// there is something with that name already (i.e. a snapshot)
+var ErrExists = errors.New("already exists")
+
+// the layout can't be used with the locations given
+var ErrInvalidLayout = errors.New("invalid layout")
+
+// the configs (or the config file) can't be used
+var ErrInvalidConfig = errors.New("invalid configs")
@@ -0,0 +1,86 @@
+/*******************************************************************************
+* Author: Antony Toron
+* File name: policy.go
+* Date created: 10/16/26
+*
+* Description: redundancy policies that a file can be saved with, in place of
+* the default layout in the configs: "mirror:<copies>", "xor:<k>+1",
+* "pq:<k>+2" or "rs:<k>+<m>" (k data components and m parity components).
+*******************************************************************************/
+
+package types
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// longest policy that fits in a database entry
+const MAX_POLICY_SIZE = 32
+
+var policySchemes = map[string]int{
+    "xor": XOR_SCHEME,
+    "rs": RS_SCHEME,
+    "pq": PQ_SCHEME,
+    "mirror": MIRROR_SCHEME,
+}
+
+/*
+    Layout for a file saved with the policy (see the top of this file), the
+    stripe size and the hash algorithm come from the configs. Whether the
+    locations can hold the layout is only checked when the file is saved.
+*/
+func ParsePolicy(policy string, configs *Config) (Layout, error) {
+    parts := strings.SplitN(policy, ":", 2)
+    scheme, found := policySchemes[strings.ToLower(parts[0])]
+    if !found || len(parts) != 2 {
+        return Layout{}, fmt.Errorf("%w: unknown policy %q, should be mirror:<copies>, " +
+                                    "xor:<k>+1, pq:<k>+2 or rs:<k>+<m>", ErrInvalidLayout, policy)
+    }
+
+    if scheme == MIRROR_SCHEME {
+        copyCount, err := strconv.Atoi(parts[1])
+        if err != nil || copyCount < 2 {
+            return Layout{}, fmt.Errorf("%w: policy %q needs at least 2 copies",
+                                        ErrInvalidLayout, policy)
+        }
+        return MirrorLayout(copyCount, configs), nil
+    }
+
+    counts := strings.SplitN(parts[1], "+", 2)
+    if len(counts) != 2 {
+        return Layout{}, fmt.Errorf("%w: policy %q should have <data>+<parity> components",
+                                    ErrInvalidLayout, policy)
+    }
+    dataCount, err := strconv.Atoi(counts[0])
+    if err == nil {
+        var parityCount int
+        parityCount, err = strconv.Atoi(counts[1])
+        if err == nil && dataCount >= 1 && parityCount >= 1 {
+            layout := Layout{Scheme: scheme, DataCount: dataCount, ParityCount: parityCount,
+                             HashAlgorithm: configs.HashAlgorithm}
+            if configs.StripeSize > 0 {
+                layout.Striping = STRIPING_ROTATING
+                layout.StripeSize = configs.StripeSize
+            }
+            return layout, nil
+        }
+    }
+    return Layout{}, fmt.Errorf("%w: policy %q needs at least 1 data and 1 parity component",
+                                ErrInvalidLayout, policy)
+}
+
+// the policy that the layout was made with (see ParsePolicy)
+func (l Layout) Policy() string {
+    for name, scheme := range policySchemes {
+        if scheme != l.Scheme {
+            continue
+        }
+        if scheme == MIRROR_SCHEME {
+            return fmt.Sprintf("%s:%d", name, l.DataCount + l.ParityCount)
+        }
+        return fmt.Sprintf("%s:%d+%d", name, l.DataCount, l.ParityCount)
+    }
+    return fmt.Sprintf("scheme%d:%d+%d", l.Scheme, l.DataCount, l.ParityCount)
+}
@@ -12,7 +12,7 @@ import (
     // "fmt"
     "os"
     "crypto/md5"
-    // "time"
+    "time"
 )
 
 // storageType
@@ -34,9 +34,37 @@ const NUM_PARITY_DISKS  = 1
 const POINTER_SIZE = 8
 
 // have to add 1 because parity disk also needs to be stored!
-const SIZE_OF_ENTRY = MAX_FILE_NAME_SIZE + 2*(POINTER_SIZE) + int16(MAX_DISK_COUNT + 1) * int16(MAX_DISK_NAME_SIZE) + MD5_SIZE
+const SIZE_OF_ENTRY = MAX_FILE_NAME_SIZE + 2*(POINTER_SIZE) + int16(MAX_DISK_COUNT + 1) * int16(MAX_DISK_NAME_SIZE) + ENTRY_METADATA_SIZE + MD5_SIZE
 const ASCII = 255
 
+// database format versions, stored in the header of every database file
+// (0 = original format, before the header had a version in it)
+const DB_FORMAT_LEGACY uint8 = 0
+const DB_FORMAT_LAYOUT uint8 = 1 // per-file layouts in the entries, everything hashed with MD5
+const DB_FORMAT_HASH uint8 = 2 // hash algorithm of the database in the header
+const DB_FORMAT_STAT uint8 = 3 // size, mode and times of the files in the entries
+const DB_FORMAT_VERSION uint8 = DB_FORMAT_STAT // format of new databases
+// bytes reserved in every entry (from DB_FORMAT_LAYOUT on) for per-file
+// metadata such as the layout the file was saved with, unused bytes are 0
+const ENTRY_METADATA_SIZE = 128
+
+// redundancy schemes for user data (how the parity components are computed)
+const XOR_SCHEME int = 0 // RAID 4, single parity component = XOR of the strips
+const RS_SCHEME int = 1 // Reed-Solomon, k data + m parity components
+const PQ_SCHEME int = 2 // RAID 6, P (XOR) + Q (Galois field) parity components
+const MIRROR_SCHEME int = 3 // N-way mirror, one data component and N - 1 copies of it
+
+// how the components of a file are laid out across its locations
+const STRIPING_NONE int = 0 // one large strip per location, parity on the last locations
+const STRIPING_ROTATING int = 1 // fixed size stripe units, parity rotates across locations (RAID 5)
+const COMPONENT_BLOCK_SIZE int64 = int64(MAX_BUFFER_SIZE) // blocks of whole strips that are hashed separately
+const DEFAULT_STRIPE_SIZE int64 = int64(MAX_BUFFER_SIZE) // used for streams when the configs don't set one
+
+// hash algorithms used to check user data and database entries (see package hashes)
+const HASH_MD5 int = 0 // the only one before the algorithm was stored with the data
+const HASH_SHA256 int = 1
+const HASH_BLAKE3 int = 2
+
 // entries in header
 const HEADER_FILE_SIZE int = 2
 const HEADER_DISK_SIZE int = 2
@@ -52,6 +80,26 @@ const DBDISK_COUNT = 3 // not including parity db disk
 const DBDISK_PARITY_COUNT = 1
 const RETRY_COUNT = 3
 
+// scrub-related constants (progress of an interrupted scrub, and the summary
+// of the last one)
+const SCRUB_STATE_FILE = "scrub-state.json"
+const SCRUB_REPORT_FILE = "scrub-report.txt"
+
+// garbage collection constants (components changed more recently than
+// GC_MIN_AGE may belong to a save that is still going on)
+const GC_MIN_AGE = time.Hour
+const GC_REPORT_FILE = "gc-report.txt"
+
+// versioning constants (past versions of a file are kept in the database
+// under <filename><VERSION_SEPARATOR><version>, so it can't be in filenames)
+const VERSION_SEPARATOR = "\x1f"
+
+// snapshot constants (the database of a snapshot is a copy of the database of
+// the user, in SNAPSHOT_FOLDER/<username>/<username>@<snapshot>_N on every
+// database disk)
+const SNAPSHOT_FOLDER = ".snapshots"
+const SNAPSHOT_SEPARATOR = "@"
+
 // transaction-related constants
 const INIT_ACTION_SIZE = 5
 const MAX_PATH_TO_DB = 256
@@ -67,7 +115,38 @@ type TreeEntry struct {
     Left int64
     Right int64
     Disks []string
-    Hash []byte // md5 hash of the contents before this in the entry
+    Layout Layout // how the file was distributed across the disks
+    Version int // 1 for the first save of the file, 0 if saved before versions were kept
+    Saved int64 // when this version was saved (unix time, in seconds)
+    Policy string // policy the file was saved with (see policy.go), "" = default layout in the configs
+    Stat *FileStat // size, mode and times of the original file, nil if not known
+    Hash []byte // hash of the contents before this in the entry (algorithm in the db header)
+}
+
+/*
+    What is kept about the original file, restored onto it when it is gotten
+    (only stored in databases from DB_FORMAT_STAT on)
+*/
+type FileStat struct {
+    Size int64 // exact size of the file, in bytes
+    Mode uint32 // permission bits
+    ModTime int64 // last modification (unix time, in nanoseconds)
+    Created int64 // when the file was first saved (unix time, in nanoseconds)
+}
+
+/*
+    How a file is split into components: DataCount data components, followed
+    by ParityCount parity components (in the same order as the disks the file
+    is stored on)
+*/
+type Layout struct {
+    Scheme int // XOR_SCHEME, RS_SCHEME, PQ_SCHEME or MIRROR_SCHEME
+    DataCount int
+    ParityCount int
+    Striping int // STRIPING_NONE or STRIPING_ROTATING
+    StripeSize int64 // size of a stripe unit (in bytes), only for STRIPING_ROTATING
+    HashAlgorithm int // algorithm the components are hashed with, HASH_MD5 by default
+    Generation int // new for every save and re-encoding of the file, the components are named after it
 }
 
 type Config struct {
@@ -76,10 +155,58 @@ type Config struct {
     Datadisks []string // slice containing all of the data disks available locally, including those for parity
     DataDiskCount int // default = 3, size of datadisks[] = datadiskcount + paritydiskcount
     ParityDiskCount int // default = 1 (RAID 4)
+    Scheme int // redundancy scheme for user data, default = XOR_SCHEME (RAID 4)
+    StripeSize int64 // default = 0 (one strip per location), > 0 = rotating stripes of this size
+    HashAlgorithm int // default = HASH_MD5, algorithm for new components and databases
+    Retention map[string]Retention // past versions that each user keeps, "" = users not in it
 } 
 // note: DataDiskCount defines the maximum amount of data drives you can distribute across (not including parity), can store on less
 // should be careful to add + 1 in a lot of places to include that parity disk name in the entries in database, etc.
 
+/*
+    Layout used for a file saved across locationCount locations with the
+    settings in the configs (the last ParityDiskCount locations hold parity).
+    When that leaves a single data component (i.e. a file on two locations),
+    the file is mirrored on every location instead.
+*/
+func DefaultLayout(locationCount int, configs *Config) Layout {
+    parityCount := configs.ParityDiskCount
+    if parityCount < 1 {
+        parityCount = 1
+    }
+    if locationCount - parityCount == 1 {
+        return MirrorLayout(locationCount, configs)
+    }
+
+    layout := Layout{Scheme: configs.Scheme, DataCount: locationCount - parityCount,
+                     ParityCount: parityCount, HashAlgorithm: configs.HashAlgorithm}
+    if configs.StripeSize > 0 {
+        layout.Striping = STRIPING_ROTATING
+        layout.StripeSize = configs.StripeSize
+    }
+
+    return layout
+}
+
+/*
+    Layout of a file mirrored on copyCount locations: every location holds
+    the whole file (the first one as the data component, the others as its
+    copies), always in whole strips
+*/
+func MirrorLayout(copyCount int, configs *Config) Layout {
+    return Layout{Scheme: MIRROR_SCHEME, DataCount: 1, ParityCount: copyCount - 1,
+                  HashAlgorithm: configs.HashAlgorithm}
+}
+
+/*
+    Which past versions of their files a user keeps, the rest are pruned
+    whenever a file is saved (no limit = every version is kept)
+*/
+type Retention struct {
+    KeepVersions int // versions kept, the current one included (0 = no limit)
+    KeepDays int // past versions saved longer ago than this are pruned (0 = no limit)
+}
+
 // ALL TODOs:
 /*
     New TODO: make this compatible with adding in a username - add this to
@@ -152,6 +279,8 @@ type Config struct {
 
             *** this might work actually, just have to standardize this across the system
             (can do this later, but BIG TODO)**
+            -> done for 2 places: a single data component is mirrored (MIRROR_SCHEME,
+            see DefaultLayout)
 
     also need to fix that max_disk_count thing in database (it uses that sometimes 
     for creating entries)